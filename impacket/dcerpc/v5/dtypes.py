@@ -106,6 +106,9 @@ class STR(NDRSTRUCT):
         if key == 'Data':
             try:
                 self.fields[key] = value.encode('utf-8')
+            except AttributeError:
+                # Already bytes, e.g. NTLM responses in a Netlogon logon
+                self.fields[key] = value
             except UnicodeDecodeError:
                 import sys
                 self.fields[key] = value.decode(sys.getfilesystemencoding()).encode('utf-8')
@@ -366,6 +366,21 @@ DELTA_TIME = 1
 
         return nil
 
+     func (self TYPE) setCredential(credential interface{}){
+        // Replaces the credential for the same client and server, if there's one. The cache is left alone
+        // (and false returned) if the credential's client isn't the cache's principal
+        client = credential["client"].prettyPrint().upper()
+        if self.principal is not nil and self.principal.prettyPrint().upper() != client {
+            LOG.debug('Not adding a credential for %s to the cache of %s' % (client, self.principal.prettyPrint()))
+            return false
+        server = credential["server"].prettyPrint().upper()
+        for i, c in enumerate(self.credentials):
+            if c["server"].prettyPrint().upper() == server and c["client"].prettyPrint().upper() == client {
+                self.credentials[i] = credential
+                return true
+        self.credentials.append(credential)
+        return true
+
      func (self TYPE) toTimeStamp(dt, epoch=datetime(1970,1,1) interface{}){
         td = dt - epoch
         // return td.total_seconds()
@@ -388,7 +403,11 @@ DELTA_TIME = 1
         header["tagdata"] = b'\xff\xff\xff\xff\x00\x00\x00\x00'
         self.headers.append(header)
 
-        decodedTGT = decoder.decode(tgt, asn1Spec = AS_REP())[0]
+        try:
+            decodedTGT = decoder.decode(tgt, asn1Spec = AS_REP())[0]
+        except:
+            // A renewed TGT comes in a TGS-REP
+            return self.fromTGS(tgt, oldSessionKey, sessionKey)
 
         tmpPrincipal = types.Principal()
         tmpPrincipal.from_asn1(decodedTGT, 'crealm', 'cname')
@@ -37,6 +37,7 @@ from impacket.spnego import SPNEGO_NegTokenInit, TypesMech, SPNEGO_NegTokenResp,
 from impacket.krb5.gssapi import KRB5_AP_REQ
 from impacket import nt_errors, LOG
 from impacket.krb5.ccache import CCache
+from impacket.krb5.krb5conf import getKDCAddresses, KDC_PORT
 
 // Our random number generator
 try:
@@ -47,19 +48,28 @@ except NotImplementedError:
 
  func sendReceive(data, host, kdcHost interface{}){
     if kdcHost == nil {
-        targetHost = host
+        // krb5.conf might know where the realm's KDCs are, if not the realm should resolve
+        targets = getKDCAddresses(host)
+        if len(targets) == 0 {
+            targets = [(host, KDC_PORT)]
     } else  {
-        targetHost = kdcHost
+        targets = [(kdcHost, KDC_PORT)]
 
     messageLen = struct.pack('!i', len(data))
 
-    LOG.debug('Trying to connect to KDC at %s' % targetHost)
-    try:
-        af, socktype, proto, canonname, sa = socket.getaddrinfo(targetHost, 88, 0, socket.SOCK_STREAM)[0]
-        s = socket.socket(af, socktype, proto)
-        s.connect(sa)
-    except socket.error as e:
-        raise socket.error("Connection error (%s:%s)" % (targetHost, 88), e)
+    // The first one we can connect to
+    for targetHost, targetPort in targets:
+        LOG.debug('Trying to connect to KDC at %s:%d' % (targetHost, targetPort))
+        try:
+            af, socktype, proto, canonname, sa = socket.getaddrinfo(targetHost, targetPort, 0, socket.SOCK_STREAM)[0]
+            s = socket.socket(af, socktype, proto)
+            s.connect(sa)
+            break
+        except socket.error as e:
+            error = socket.error("Connection error (%s:%s)" % (targetHost, targetPort), e)
+            LOG.debug(str(error))
+    } else  {
+        raise error
 
     s.sendall(messageLen + data)
 
@@ -323,7 +333,8 @@ except NotImplementedError:
 
     return tgt, cipher, key, sessionKey
 
- func getKerberosTGS(serverName, domain, kdcHost, tgt, cipher, sessionKey interface{}){
+ func getKerberosTGS(serverName, domain, kdcHost, tgt, cipher, sessionKey, renew=false interface{}){
+    // With renew, tgt is renewed instead (serverName should be krbtgt/domain). The new TGT comes in a TGS-REP
 
     // Decode the TGT
     try:
@@ -387,6 +398,8 @@ except NotImplementedError:
     opts.append( constants.KDCOptions.renewable.value )
     opts.append( constants.KDCOptions.renewable_ok.value )
     opts.append( constants.KDCOptions.canonicalize.value )
+    if renew is true {
+        opts.append( constants.KDCOptions.renew.value )
 
     reqBody["kdc-options"] = constants.encodeFlags(opts)
     seq_set(reqBody, 'sname', serverName.components_to_asn1)
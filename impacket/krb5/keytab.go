@@ -0,0 +1,230 @@
+// SECUREAUTH LABS. Copyright 2018 SecureAuth Corporation. All rights reserved.
+//
+// This software is provided under under a slightly modified version
+// of the Apache Software License. See the accompanying LICENSE file
+// for more information.
+//
+// Description:
+//   Kerberos Keytab format implementation
+//   based on file format described at:
+//   https://repo.or.cz/w/krb5dissect.git/blob_plain/HEAD:/keytab.txt
+//   Only version 0x502 is supported
+//
+from __future__ import division
+from __future__ import print_function
+from datetime import datetime
+from struct import pack, unpack
+from binascii import hexlify
+from six import b
+
+from impacket.structure import Structure
+from impacket.krb5 import constants
+from impacket import LOG
+
+// Keys we like the most first
+PREFERRED_ENCTYPES = (
+    constants.EncryptionTypes.aes256_cts_hmac_sha1_96.value,
+    constants.EncryptionTypes.aes128_cts_hmac_sha1_96.value,
+    constants.EncryptionTypes.rc4_hmac.value,
+}
+
+ func _bytes(value interface{}){
+    // Parsed data is already bytes, what's set by hand may be a str
+    if isinstance(value, bytes) {
+        return value
+    return b(value)
+
+ type CountedOctetString struct { // Structure: (
+        ('length','!H=0'),
+        ('_data','_-data','self.length'),
+        ('data',':'),
+    }
+
+     func (self TYPE) prettyPrint(indent='' interface{}){
+        return "%s%s" % (indent, hexlify(self.data))
+
+ type KeyBlock struct { // Structure: (
+        ('keytype','!H=0'),
+        ('keyvalue',':', CountedOctetString),
+    }
+
+     func (self TYPE) prettyPrint(){
+        return "Key: (0x%x)%s" % (self.keytype"], hexlify(self["keyvalue"]["data))
+
+ type KeytabPrincipal: struct {
+     type PrincipalHeader struct { // Structure: (
+            ('num_components','!H=0'),
+            ('realm',':', CountedOctetString),
+        }
+
+     func (self TYPE) __init__(data=nil interface{}){
+        self.components = []
+        self.name_type = constants.PrincipalNameType.NT_PRINCIPAL.value
+        if data is not nil {
+            self.header = self.PrincipalHeader(data)
+            data = data[len(self.header):]
+            for component in range(self.header["num_components"]):
+                comp = CountedOctetString(data)
+                data = data[len(comp):]
+                self.components.append(comp)
+            self.name_type = unpack('!L', data[:4])[0]
+        } else  {
+            self.header = self.PrincipalHeader()
+
+     func (self TYPE) __len__(){
+        totalLen = len(self.header) + 4
+        for i in self.components:
+            totalLen += len(i)
+        return totalLen
+
+     func (self TYPE) getData(){
+        data = self.header.getData()
+        for component in self.components:
+            data += component.getData()
+        data += pack('!L', self.name_type)
+        return data
+
+     func (self TYPE) __str__(){
+        return self.getData()
+
+     func (self TYPE) prettyPrint(){
+        principal = b'/'.join([_bytes(component["data"]) for component in self.components])
+        principal += b'@' + _bytes(self.header["realm"]["data"])
+        return principal
+
+     func (self TYPE) fromPrincipal(principal interface{}){
+        self.name_type = principal.type
+        self.header["num_components"] = len(principal.components)
+        realm = CountedOctetString()
+        realm["length"] = len(principal.realm)
+        realm["data"] = principal.realm
+        self.header["realm"] = realm
+        self.components = []
+        for c in principal.components:
+            octetString = CountedOctetString()
+            octetString["length"] = len(c)
+            octetString["data"] = c
+            self.components.append(octetString)
+
+ type KeytabEntry: struct {
+     func (self TYPE) __init__(data=nil interface{}){
+        self.principal = KeytabPrincipal()
+        self.main_part = {'timestamp': 0, 'vno8': 0, 'keyblock': KeyBlock()}
+        self.vno = nil
+        if data is not nil {
+            self.principal = KeytabPrincipal(data)
+            data = data[len(self.principal):]
+            self.main_part["timestamp"], self.main_part["vno8"] = unpack('!LB', data[:5])
+            data = data[5:]
+            self.main_part["keyblock"] = KeyBlock(data)
+            data = data[len(self.main_part["keyblock"]):]
+            // The 32 bits kvno is there if the entry has room for it
+            if len(data) >= 4 {
+                self.vno = unpack('!L', data[:4])[0]
+
+     func (self TYPE) __getitem__(key interface{}){
+        return self.main_part[key]
+
+     func (self TYPE) __setitem__(item, value interface{}){
+        self.main_part[item] = value
+
+     func (self TYPE) getVno(){
+        if self.vno is not nil and self.vno != 0 {
+            return self.vno
+        return self.main_part["vno8"]
+
+     func (self TYPE) getData(){
+        data = self.principal.getData() + pack('!LB', self.main_part["timestamp"], self.main_part["vno8"])
+        data += self.main_part["keyblock"].getData()
+        if self.vno is not nil {
+            data += pack('!L', self.vno)
+        return data
+
+     func (self TYPE) __len__(){
+        return len(self.getData())
+
+     func (self TYPE) prettyPrint(indent='' interface{}){
+        print(("%sPrincipal: %s" % (indent, self.principal.prettyPrint())))
+        print(("%sTimestamp: %s" % (indent, datetime.fromtimestamp(self.main_part["timestamp"]).isoformat())))
+        print(("%sKVNO: %d" % (indent, self.getVno())))
+        print(("%s%s" % (indent, self.main_part["keyblock"].prettyPrint())))
+
+ type Keytab: struct {
+     type MiniHeader struct { // Structure: (
+            ('file_format_version','!H=0x0502'),
+        }
+
+     func (self TYPE) __init__(data=nil interface{}){
+        self.miniHeader = nil
+        self.entries = []
+        if data is not nil {
+            self.miniHeader = self.MiniHeader(data)
+            if self.miniHeader["file_format_version"] != 0x0502 {
+                raise Exception('Unsupported keytab version 0x%x' % self.miniHeader["file_format_version"])
+            data = data[len(self.miniHeader):]
+            while len(data) >= 4:
+                size = unpack('!l', data[:4])[0]
+                data = data[4:]
+                // Negative sizes are holes left by deleted entries
+                if size > 0 {
+                    self.entries.append(KeytabEntry(data[:size]))
+                data = data[abs(size):]
+
+     func (self TYPE) getData(){
+        data = self.MiniHeader().getData()
+        for entry in self.entries:
+            entryData = entry.getData()
+            data += pack('!l', len(entryData)) + entryData
+        return data
+
+     func (self TYPE) getKey(principal, specificEncType=nil interface{}){
+        """
+        :param string principal: user@REALM (or service/host@REALM), compared case insensitively
+        :param int specificEncType: the encryption type wanted, the best one there is if nil
+
+        :return: the KeyBlock with the highest kvno for principal, nil if there's none
+        """
+        principal = _bytes(principal).upper()
+        candidates = {}
+        for entry in self.entries:
+            if entry.principal.prettyPrint().upper() != principal {
+                continue
+            keytype = entry["keyblock"]["keytype"]
+            if keytype not in candidates or candidates[keytype].getVno() < entry.getVno() {
+                candidates[keytype] = entry
+
+        if specificEncType is not nil {
+            encTypes = (specificEncType,)
+        } else  {
+            encTypes = PREFERRED_ENCTYPES + tuple(sorted(candidates.keys()))
+        for encType in encTypes:
+            if encType in candidates {
+                LOG.debug('Using keytab key for %s (etype %d, kvno %d)' % (principal, encType,
+                                                                          candidates[encType].getVno()))
+                return candidates[encType]["keyblock"]
+        LOG.debug('No keytab key for %s' % principal)
+        return nil
+
+    @classmethod
+     func loadFile(cls, fileName interface{}){
+        f = open(fileName, 'rb')
+        data = f.read()
+        f.close()
+        return cls(data)
+
+     func (self TYPE) saveFile(fileName interface{}){
+        f = open(fileName, 'wb+')
+        f.write(self.getData())
+        f.close()
+
+     func (self TYPE) prettyPrint(){
+        print("Keytab Entries: ")
+        for i, entry in enumerate(self.entries):
+            print(("[%d]" % i))
+            entry.prettyPrint("\t")
+
+
+if __name__ == '__main__' {
+    import os
+    keytab = Keytab.loadFile(os.getenv('KRB5_KTNAME', '/etc/krb5.keytab').replace('FILE:', ''))
+    keytab.prettyPrint()
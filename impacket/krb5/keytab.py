@@ -0,0 +1,234 @@
+# SECUREAUTH LABS. Copyright 2018 SecureAuth Corporation. All rights reserved.
+#
+# This software is provided under under a slightly modified version
+# of the Apache Software License. See the accompanying LICENSE file
+# for more information.
+#
+# Description:
+#   Kerberos Keytab format implementation
+#   based on file format described at:
+#   https://repo.or.cz/w/krb5dissect.git/blob_plain/HEAD:/keytab.txt
+#   Only version 0x502 is supported
+#
+from __future__ import division
+from __future__ import print_function
+from datetime import datetime
+from struct import pack, unpack
+from binascii import hexlify
+from six import b
+
+from impacket.structure import Structure
+from impacket.krb5 import constants
+from impacket import LOG
+
+# Keys we like the most first
+PREFERRED_ENCTYPES = (
+    constants.EncryptionTypes.aes256_cts_hmac_sha1_96.value,
+    constants.EncryptionTypes.aes128_cts_hmac_sha1_96.value,
+    constants.EncryptionTypes.rc4_hmac.value,
+)
+
+def _bytes(value):
+    # Parsed data is already bytes, what's set by hand may be a str
+    if isinstance(value, bytes):
+        return value
+    return b(value)
+
+class CountedOctetString(Structure):
+    structure = (
+        ('length','!H=0'),
+        ('_data','_-data','self["length"]'),
+        ('data',':'),
+    )
+
+    def prettyPrint(self, indent=''):
+        return "%s%s" % (indent, hexlify(self['data']))
+
+class KeyBlock(Structure):
+    structure = (
+        ('keytype','!H=0'),
+        ('keyvalue',':', CountedOctetString),
+    )
+
+    def prettyPrint(self):
+        return "Key: (0x%x)%s" % (self['keytype'], hexlify(self['keyvalue']['data']))
+
+class KeytabPrincipal:
+    class PrincipalHeader(Structure):
+        structure = (
+            ('num_components','!H=0'),
+            ('realm',':', CountedOctetString),
+        )
+
+    def __init__(self, data=None):
+        self.components = []
+        self.name_type = constants.PrincipalNameType.NT_PRINCIPAL.value
+        if data is not None:
+            self.header = self.PrincipalHeader(data)
+            data = data[len(self.header):]
+            for component in range(self.header['num_components']):
+                comp = CountedOctetString(data)
+                data = data[len(comp):]
+                self.components.append(comp)
+            self.name_type = unpack('!L', data[:4])[0]
+        else:
+            self.header = self.PrincipalHeader()
+
+    def __len__(self):
+        totalLen = len(self.header) + 4
+        for i in self.components:
+            totalLen += len(i)
+        return totalLen
+
+    def getData(self):
+        data = self.header.getData()
+        for component in self.components:
+            data += component.getData()
+        data += pack('!L', self.name_type)
+        return data
+
+    def __str__(self):
+        return self.getData()
+
+    def prettyPrint(self):
+        principal = b'/'.join([_bytes(component['data']) for component in self.components])
+        principal += b'@' + _bytes(self.header['realm']['data'])
+        return principal
+
+    def fromPrincipal(self, principal):
+        self.name_type = principal.type
+        self.header['num_components'] = len(principal.components)
+        realm = CountedOctetString()
+        realm['length'] = len(principal.realm)
+        realm['data'] = principal.realm
+        self.header['realm'] = realm
+        self.components = []
+        for c in principal.components:
+            octetString = CountedOctetString()
+            octetString['length'] = len(c)
+            octetString['data'] = c
+            self.components.append(octetString)
+
+class KeytabEntry:
+    def __init__(self, data=None):
+        self.principal = KeytabPrincipal()
+        self.main_part = {'timestamp': 0, 'vno8': 0, 'keyblock': KeyBlock()}
+        self.vno = None
+        if data is not None:
+            self.principal = KeytabPrincipal(data)
+            data = data[len(self.principal):]
+            self.main_part['timestamp'], self.main_part['vno8'] = unpack('!LB', data[:5])
+            data = data[5:]
+            self.main_part['keyblock'] = KeyBlock(data)
+            data = data[len(self.main_part['keyblock']):]
+            # The 32 bits kvno is there if the entry has room for it
+            if len(data) >= 4:
+                self.vno = unpack('!L', data[:4])[0]
+
+    def __getitem__(self, key):
+        return self.main_part[key]
+
+    def __setitem__(self, item, value):
+        self.main_part[item] = value
+
+    def getVno(self):
+        if self.vno is not None and self.vno != 0:
+            return self.vno
+        return self.main_part['vno8']
+
+    def getData(self):
+        data = self.principal.getData() + pack('!LB', self.main_part['timestamp'], self.main_part['vno8'])
+        data += self.main_part['keyblock'].getData()
+        if self.vno is not None:
+            data += pack('!L', self.vno)
+        return data
+
+    def __len__(self):
+        return len(self.getData())
+
+    def prettyPrint(self, indent=''):
+        print(("%sPrincipal: %s" % (indent, self.principal.prettyPrint())))
+        print(("%sTimestamp: %s" % (indent, datetime.fromtimestamp(self.main_part['timestamp']).isoformat())))
+        print(("%sKVNO: %d" % (indent, self.getVno())))
+        print(("%s%s" % (indent, self.main_part['keyblock'].prettyPrint())))
+
+class Keytab:
+    class MiniHeader(Structure):
+        structure = (
+            ('file_format_version','!H=0x0502'),
+        )
+
+    def __init__(self, data=None):
+        self.miniHeader = None
+        self.entries = []
+        if data is not None:
+            self.miniHeader = self.MiniHeader(data)
+            if self.miniHeader['file_format_version'] != 0x0502:
+                raise Exception('Unsupported keytab version 0x%x' % self.miniHeader['file_format_version'])
+            data = data[len(self.miniHeader):]
+            while len(data) >= 4:
+                size = unpack('!l', data[:4])[0]
+                data = data[4:]
+                # Negative sizes are holes left by deleted entries
+                if size > 0:
+                    self.entries.append(KeytabEntry(data[:size]))
+                data = data[abs(size):]
+
+    def getData(self):
+        data = self.MiniHeader().getData()
+        for entry in self.entries:
+            entryData = entry.getData()
+            data += pack('!l', len(entryData)) + entryData
+        return data
+
+    def getKey(self, principal, specificEncType=None):
+        """
+        :param string principal: user@REALM (or service/host@REALM), compared case insensitively
+        :param int specificEncType: the encryption type wanted, the best one there is if None
+
+        :return: the KeyBlock with the highest kvno for principal, None if there's none
+        """
+        principal = _bytes(principal).upper()
+        candidates = {}
+        for entry in self.entries:
+            if entry.principal.prettyPrint().upper() != principal:
+                continue
+            keytype = entry['keyblock']['keytype']
+            if keytype not in candidates or candidates[keytype].getVno() < entry.getVno():
+                candidates[keytype] = entry
+
+        if specificEncType is not None:
+            encTypes = (specificEncType,)
+        else:
+            encTypes = PREFERRED_ENCTYPES + tuple(sorted(candidates.keys()))
+        for encType in encTypes:
+            if encType in candidates:
+                LOG.debug('Using keytab key for %s (etype %d, kvno %d)' % (principal, encType,
+                                                                          candidates[encType].getVno()))
+                return candidates[encType]['keyblock']
+        LOG.debug('No keytab key for %s' % principal)
+        return None
+
+    @classmethod
+    def loadFile(cls, fileName):
+        f = open(fileName, 'rb')
+        data = f.read()
+        f.close()
+        return cls(data)
+
+    def saveFile(self, fileName):
+        f = open(fileName, 'wb+')
+        f.write(self.getData())
+        f.close()
+
+    def prettyPrint(self):
+        print("Keytab Entries: ")
+        for i, entry in enumerate(self.entries):
+            print(("[%d]" % i))
+            entry.prettyPrint('\t')
+
+
+if __name__ == '__main__':
+    import os
+    keytab = Keytab.loadFile(os.getenv('KRB5_KTNAME', '/etc/krb5.keytab').replace('FILE:', ''))
+    keytab.prettyPrint()
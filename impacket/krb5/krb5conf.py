@@ -0,0 +1,152 @@
+# SECUREAUTH LABS. Copyright 2018 SecureAuth Corporation. All rights reserved.
+#
+# This software is provided under under a slightly modified version
+# of the Apache Software License. See the accompanying LICENSE file
+# for more information.
+#
+# Description:
+#   krb5.conf parsing, enough to know the default realm, the realm a host
+#   belongs to and the KDCs of a realm. The file is KRB5_CONFIG (first one
+#   if it's a list) or /etc/krb5.conf, read again only when it changes
+#
+import os
+import threading
+
+from impacket import LOG
+
+DEFAULT_CONFIG = '/etc/krb5.conf'
+KDC_PORT = 88
+
+class Krb5Conf:
+    def __init__(self, data=None):
+        # section -> {name: [values]} where values are strings or, for {} blocks, dicts like this one
+        self.sections = {}
+        if data is not None:
+            self.parse(data)
+
+    def parse(self, data):
+        section = None
+        stack = []
+        for line in data.splitlines():
+            line = line.strip()
+            if line == '' or line[0] in '#;':
+                continue
+            if line.startswith('[') and line.endswith(']'):
+                section = self.sections.setdefault(line[1:-1].strip(), {})
+                stack = [section]
+                continue
+            if section is None:
+                continue
+            if line == '}':
+                if len(stack) > 1:
+                    stack.pop()
+                continue
+            if '=' not in line:
+                continue
+            name, value = [item.strip() for item in line.split('=', 1)]
+            if value == '{':
+                block = {}
+                stack[-1].setdefault(name, []).append(block)
+                stack.append(block)
+            else:
+                # "*" means final, nothing to do with it here
+                stack[-1].setdefault(name.rstrip('*').strip(), []).append(value)
+
+    def getValue(self, section, name, default=None):
+        values = self.sections.get(section, {}).get(name)
+        if not values:
+            return default
+        return values[0]
+
+    def getDefaultRealm(self):
+        return self.getValue('libdefaults', 'default_realm')
+
+    def getRealm(self, hostName):
+        """
+        :return: the realm for hostName according to [domain_realm], the default realm if there's no mapping
+        """
+        mappings = self.sections.get('domain_realm', {})
+        hostName = hostName.lower()
+        if hostName in mappings:
+            return mappings[hostName][0]
+        # .example.com maps every host in example.com, the longest one wins
+        domain = hostName
+        while '.' in domain:
+            domain = domain[domain.index('.'):]
+            if domain in mappings:
+                return mappings[domain][0]
+            domain = domain[1:]
+        return self.getDefaultRealm()
+
+    def getKDCs(self, realm):
+        """
+        :return: the KDCs (host names, the port is left out) for realm, [] if there are none
+        """
+        return [host for host, port in self.getKDCAddresses(realm)]
+
+    def getKDCAddresses(self, realm):
+        """
+        :return: the KDCs for realm as (host, port) in the order they're listed, [] if there are none
+        """
+        kdcs = []
+        realms = self.sections.get('realms', {})
+        for name in realms:
+            if name.upper() != realm.upper():
+                continue
+            for block in realms[name]:
+                if isinstance(block, dict) is not True:
+                    continue
+                for kdc in block.get('kdc', []):
+                    kdcs.append(self.__splitAddress(kdc))
+        return kdcs
+
+    @staticmethod
+    def __splitAddress(kdc):
+        # [ipv6]:port, host:port, a plain host or a plain ipv6 address
+        port = KDC_PORT
+        if kdc.startswith('['):
+            host, rest = kdc[1:].split(']', 1)
+            if rest.startswith(':') and rest[1:].isdigit():
+                port = int(rest[1:])
+        elif kdc.count(':') == 1:
+            host, rest = kdc.split(':')
+            if rest.isdigit():
+                port = int(rest)
+        else:
+            host = kdc
+        return host, port
+
+    @classmethod
+    def loadFile(cls, fileName=None):
+        if fileName is None:
+            fileName = os.getenv('KRB5_CONFIG', DEFAULT_CONFIG).split(':')[0]
+        f = open(fileName, 'r')
+        data = f.read()
+        f.close()
+        return cls(data)
+
+# file name -> (mtime, Krb5Conf)
+_loaded = {}
+_loadedLock = threading.Lock()
+
+def getKrb5Conf():
+    # An empty config if there's none or it can't be read
+    fileName = os.getenv('KRB5_CONFIG', DEFAULT_CONFIG).split(':')[0]
+    try:
+        mtime = os.stat(fileName).st_mtime
+        with _loadedLock:
+            if fileName in _loaded and _loaded[fileName][0] == mtime:
+                return _loaded[fileName][1]
+        conf = Krb5Conf.loadFile(fileName)
+        with _loadedLock:
+            _loaded[fileName] = (mtime, conf)
+        return conf
+    except Exception as e:
+        LOG.debug('No krb5.conf: %s' % e)
+        return Krb5Conf()
+
+def getKDCAddresses(realm):
+    """
+    :return: the KDCs for realm in krb5.conf as (host, port), [] if there are none
+    """
+    return getKrb5Conf().getKDCAddresses(realm)
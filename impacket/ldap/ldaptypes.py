@@ -12,8 +12,10 @@
 #  Dirk-jan Mollema (@_dirkjan) / Fox-IT (https://www.fox-it.com)
 #
 #
+import re
 from struct import unpack, pack
 from impacket.structure import Structure
+from impacket.uuid import bin_to_string, string_to_bin
 
 # Global constant if the library should recalculate ACE sizes in objects that are decoded/re-encoded.
 # This defaults to True, but this causes the ACLs to not match on a binary level
@@ -58,6 +60,21 @@ Self-relative security descriptor as described in 2.4.6
 https://msdn.microsoft.com/en-us/library/cc230366.aspx
 """
 class SR_SECURITY_DESCRIPTOR(Structure):
+    # Control flag constants
+    SE_OWNER_DEFAULTED          = 0x0001
+    SE_GROUP_DEFAULTED          = 0x0002
+    SE_DACL_PRESENT             = 0x0004
+    SE_DACL_DEFAULTED           = 0x0008
+    SE_SACL_PRESENT             = 0x0010
+    SE_SACL_DEFAULTED           = 0x0020
+    SE_DACL_AUTO_INHERIT_REQ    = 0x0100
+    SE_SACL_AUTO_INHERIT_REQ    = 0x0200
+    SE_DACL_AUTO_INHERITED      = 0x0400
+    SE_SACL_AUTO_INHERITED      = 0x0800
+    SE_DACL_PROTECTED           = 0x1000
+    SE_SACL_PROTECTED           = 0x2000
+    SE_SELF_RELATIVE            = 0x8000
+
     structure = (
         ('Revision','c'),
         ('Sbz1','c'),
@@ -95,7 +112,7 @@ class SR_SECURITY_DESCRIPTOR(Structure):
         if self['OffsetDacl'] != 0:
             self['Dacl'] = ACL(data=data[self['OffsetDacl']:])
         else:
-            self['Sacl'] = b''
+            self['Dacl'] = b''
 
     def getData(self):
         headerlen = 20
@@ -128,6 +145,91 @@ class SR_SECURITY_DESCRIPTOR(Structure):
             self['OffsetGroup'] = 0
         return Structure.getData(self)
 
+    def toSDDL(self, domainSid=None):
+        """
+        Formats the descriptor as an SDDL string, e.g. O:BAG:SYD:PAI(A;OICI;FA;;;BA)
+        Well known SIDs are written with their alias, the domain relative ones (DA, DU, ...) only
+        if domainSid (S-1-5-21-...) is given.
+        Conditional expressions and resource attributes of callback ACEs can't be written, an exception
+        is raised if there's any.
+        """
+        ans = ''
+        if self['OwnerSid'] != b'':
+            ans += 'O:' + sidToSDDL(self['OwnerSid'].formatCanonical(), domainSid)
+        if self['GroupSid'] != b'':
+            ans += 'G:' + sidToSDDL(self['GroupSid'].formatCanonical(), domainSid)
+        if self['Dacl'] != b'' or self['Control'] & self.SE_DACL_PRESENT:
+            ans += 'D:' + self.__aclToSDDL(self['Dacl'], self.SE_DACL_PROTECTED, self.SE_DACL_AUTO_INHERIT_REQ,
+                                           self.SE_DACL_AUTO_INHERITED, domainSid)
+        if self['Sacl'] != b'' or self['Control'] & self.SE_SACL_PRESENT:
+            ans += 'S:' + self.__aclToSDDL(self['Sacl'], self.SE_SACL_PROTECTED, self.SE_SACL_AUTO_INHERIT_REQ,
+                                           self.SE_SACL_AUTO_INHERITED, domainSid)
+        return ans
+
+    def __aclToSDDL(self, acl, protected, autoInheritReq, autoInherited, domainSid):
+        ans = ''
+        for letters, flag in (('P', protected), ('AR', autoInheritReq), ('AI', autoInherited)):
+            if self['Control'] & flag:
+                ans += letters
+        if acl == b'':
+            # Present but NULL, everyone gets access
+            return ans + 'NO_ACCESS_CONTROL'
+        for ace in acl.aces:
+            ans += '(%s)' % aceToSDDL(ace, domainSid)
+        return ans
+
+    def fromSDDL(self, sddl, domainSid=None):
+        """
+        Parses an SDDL string into this descriptor, see toSDDL
+        """
+        sddl = ''.join(sddl.split())
+        self['Revision'] = b'\x01'
+        self['Sbz1'] = b'\x00'
+        self['Control'] = self.SE_SELF_RELATIVE
+        self['OwnerSid'] = b''
+        self['GroupSid'] = b''
+        self['Sacl'] = b''
+        self['Dacl'] = b''
+        components = re.findall(r'([OGDS]):((?:\([^)]*\)|[^()])*?)(?=[OGDS]:|$)', sddl)
+        # Anything the expression didn't take (e.g. a conditional ACE) would be lost otherwise
+        if ''.join(['%s:%s' % component for component in components]) != sddl:
+            raise Exception('Unsupported SDDL %s' % sddl)
+        for component, value in components:
+            if component in ('O', 'G'):
+                sid = LDAP_SID()
+                sid.fromCanonical(sidFromSDDL(value, domainSid))
+                self['OwnerSid' if component == 'O' else 'GroupSid'] = sid
+            elif component == 'D':
+                self['Control'] |= self.SE_DACL_PRESENT
+                self['Dacl'] = self.__aclFromSDDL(value, self.SE_DACL_PROTECTED, self.SE_DACL_AUTO_INHERIT_REQ,
+                                                  self.SE_DACL_AUTO_INHERITED, domainSid)
+            else:
+                self['Control'] |= self.SE_SACL_PRESENT
+                self['Sacl'] = self.__aclFromSDDL(value, self.SE_SACL_PROTECTED, self.SE_SACL_AUTO_INHERIT_REQ,
+                                                  self.SE_SACL_AUTO_INHERITED, domainSid)
+
+    def __aclFromSDDL(self, value, protected, autoInheritReq, autoInherited, domainSid):
+        flags, aces = re.match(r'([^(]*)(.*)$', value).groups()
+        if flags.endswith('NO_ACCESS_CONTROL'):
+            flags = flags[:-len('NO_ACCESS_CONTROL')]
+            acl = b''
+        else:
+            acl = ACL()
+            acl['AclRevision'] = 2
+            acl['Sbz1'] = 0
+            acl['Sbz2'] = 0
+            acl.aces = [aceFromSDDL(ace, domainSid) for ace in re.findall(r'\(([^)]*)\)', aces)]
+            for ace in acl.aces:
+                if isinstance(ace['Ace'], ACCESS_ALLOWED_OBJECT_ACE):
+                    acl['AclRevision'] = 4
+        for letters, flag in (('P', protected), ('AR', autoInheritReq), ('AI', autoInherited)):
+            if letters in flags:
+                self['Control'] |= flag
+                flags = flags.replace(letters, '', 1)
+        if flags != '':
+            raise Exception('Unknown SDDL ACL flags %s' % flags)
+        return acl
+
 """
 ACE as described in 2.4.4
 https://msdn.microsoft.com/en-us/library/cc230295.aspx
@@ -176,7 +278,7 @@ class ACE(Structure):
         # we fill this space up with null bytes to make sure the object
         # we create is identical to the original object
         if len(data) < self['AceSize']:
-            data += '\x00' * (self['AceSize'] - len(data))
+            data += b'\x00' * (self['AceSize'] - len(data))
         return data
 
     def hasFlag(self, flag):
@@ -489,3 +591,248 @@ OBJECTTYPE_GUID_MAP = {
     b'user': 'bf967aba-0de6-11d0-a285-00aa003049e2',
     b'groupPolicyContainer': 'f30e3bc2-9ff0-11d1-b603-0000f80367c1'
 }
+
+"""
+SDDL (Security Descriptor Definition Language) tables and helpers
+https://docs.microsoft.com/en-us/windows/win32/secauthz/security-descriptor-string-format
+"""
+# Well known SIDs with an SDDL alias
+SDDL_SID_ALIASES = {
+    'AA': 'S-1-5-32-579',
+    'AC': 'S-1-15-2-1',
+    'AN': 'S-1-5-7',
+    'AO': 'S-1-5-32-548',
+    'AS': 'S-1-18-1',
+    'AU': 'S-1-5-11',
+    'BA': 'S-1-5-32-544',
+    'BG': 'S-1-5-32-546',
+    'BO': 'S-1-5-32-551',
+    'BU': 'S-1-5-32-545',
+    'CD': 'S-1-5-32-574',
+    'CG': 'S-1-3-1',
+    'CO': 'S-1-3-0',
+    'CY': 'S-1-5-32-569',
+    'ED': 'S-1-5-9',
+    'ER': 'S-1-5-32-573',
+    'ES': 'S-1-5-32-576',
+    'HA': 'S-1-5-32-578',
+    'HI': 'S-1-16-12288',
+    'IS': 'S-1-5-32-568',
+    'IU': 'S-1-5-4',
+    'LS': 'S-1-5-19',
+    'LU': 'S-1-5-32-559',
+    'LW': 'S-1-16-4096',
+    'ME': 'S-1-16-8192',
+    'MP': 'S-1-16-8448',
+    'MS': 'S-1-5-32-577',
+    'MU': 'S-1-5-32-558',
+    'NO': 'S-1-5-32-556',
+    'NS': 'S-1-5-20',
+    'NU': 'S-1-5-2',
+    'OW': 'S-1-3-4',
+    'PO': 'S-1-5-32-550',
+    'PS': 'S-1-5-10',
+    'PU': 'S-1-5-32-547',
+    'RA': 'S-1-5-32-575',
+    'RC': 'S-1-5-12',
+    'RD': 'S-1-5-32-555',
+    'RE': 'S-1-5-32-552',
+    'RM': 'S-1-5-32-580',
+    'RU': 'S-1-5-32-554',
+    'SI': 'S-1-16-16384',
+    'SO': 'S-1-5-32-549',
+    'SS': 'S-1-18-2',
+    'SU': 'S-1-5-6',
+    'SY': 'S-1-5-18',
+    'UD': 'S-1-5-84-0-0-0-0-0',
+    'WD': 'S-1-1-0',
+    'WR': 'S-1-5-33',
+}
+
+# Aliases relative to the domain SID
+SDDL_DOMAIN_RIDS = {
+    'AP': 525,
+    'CA': 517,
+    'CN': 522,
+    'DA': 512,
+    'DC': 515,
+    'DD': 516,
+    'DG': 514,
+    'DU': 513,
+    'EA': 519,
+    'EK': 527,
+    'KA': 526,
+    'LA': 500,
+    'LG': 501,
+    'PA': 520,
+    'RO': 498,
+    'RS': 553,
+    'SA': 518,
+}
+
+SDDL_ACE_TYPES = {
+    'A':  ACCESS_ALLOWED_ACE.ACE_TYPE,
+    'D':  ACCESS_DENIED_ACE.ACE_TYPE,
+    'AU': SYSTEM_AUDIT_ACE.ACE_TYPE,
+    'OA': ACCESS_ALLOWED_OBJECT_ACE.ACE_TYPE,
+    'OD': ACCESS_DENIED_OBJECT_ACE.ACE_TYPE,
+    'OU': SYSTEM_AUDIT_OBJECT_ACE.ACE_TYPE,
+    'XA': ACCESS_ALLOWED_CALLBACK_ACE.ACE_TYPE,
+    'XD': ACCESS_DENIED_CALLBACK_ACE.ACE_TYPE,
+    'ZA': ACCESS_ALLOWED_CALLBACK_OBJECT_ACE.ACE_TYPE,
+    'XU': SYSTEM_AUDIT_CALLBACK_ACE.ACE_TYPE,
+    'ML': SYSTEM_MANDATORY_LABEL_ACE.ACE_TYPE,
+    'RA': SYSTEM_RESOURCE_ATTRIBUTE_ACE.ACE_TYPE,
+    'SP': SYSTEM_SCOPED_POLICY_ID_ACE.ACE_TYPE,
+}
+
+# Ordered as Windows writes them
+SDDL_ACE_FLAGS = (
+    ('OI', ACE.OBJECT_INHERIT_ACE),
+    ('CI', ACE.CONTAINER_INHERIT_ACE),
+    ('NP', ACE.NO_PROPAGATE_INHERIT_ACE),
+    ('IO', ACE.INHERIT_ONLY_ACE),
+    ('ID', ACE.INHERITED_ACE),
+    ('SA', ACE.SUCCESSFUL_ACCESS_ACE_FLAG),
+    ('FA', ACE.FAILED_ACCESS_ACE_FLAG),
+)
+
+# Rights written as a single code, only used when the mask matches exactly
+SDDL_COMBINED_RIGHTS = (
+    ('FA', 0x001F01FF),
+    ('FR', 0x00120089),
+    ('FW', 0x00120116),
+    ('FX', 0x001200A0),
+    ('KA', 0x000F003F),
+    ('KR', 0x00020019),
+    ('KW', 0x00020006),
+    ('KX', 0x00020019),
+)
+
+SDDL_RIGHTS = (
+    ('GA', 0x10000000),
+    ('GR', 0x80000000),
+    ('GW', 0x40000000),
+    ('GX', 0x20000000),
+    ('CC', 0x00000001),
+    ('DC', 0x00000002),
+    ('LC', 0x00000004),
+    ('SW', 0x00000008),
+    ('RP', 0x00000010),
+    ('WP', 0x00000020),
+    ('DT', 0x00000040),
+    ('LO', 0x00000080),
+    ('CR', 0x00000100),
+    ('SD', 0x00010000),
+    ('RC', 0x00020000),
+    ('WD', 0x00040000),
+    ('WO', 0x00080000),
+)
+
+SDDL_LABEL_RIGHTS = (
+    ('NR', 0x00000001),
+    ('NW', 0x00000002),
+    ('NX', 0x00000004),
+)
+
+def sidToSDDL(sid, domainSid=None):
+    for alias, value in SDDL_SID_ALIASES.items():
+        if value == sid:
+            return alias
+    if domainSid is not None and sid.startswith(domainSid + '-'):
+        rid = sid[len(domainSid)+1:]
+        for alias, value in SDDL_DOMAIN_RIDS.items():
+            if str(value) == rid:
+                return alias
+    return sid
+
+def sidFromSDDL(sid, domainSid=None):
+    if sid in SDDL_SID_ALIASES:
+        return SDDL_SID_ALIASES[sid]
+    if sid in SDDL_DOMAIN_RIDS:
+        if domainSid is None:
+            raise Exception('SID alias %s needs the domain SID' % sid)
+        return '%s-%d' % (domainSid, SDDL_DOMAIN_RIDS[sid])
+    if not sid.upper().startswith('S-'):
+        raise Exception('Unknown SDDL SID %s' % sid)
+    return sid.upper()
+
+def rightsToSDDL(mask, label=False):
+    if label is True:
+        rights = SDDL_LABEL_RIGHTS
+    else:
+        for letters, value in SDDL_COMBINED_RIGHTS:
+            if mask == value:
+                return letters
+        rights = SDDL_RIGHTS
+    ans = ''
+    left = mask
+    for letters, value in rights:
+        if left & value:
+            ans += letters
+            left &= ~value
+    if left != 0:
+        return '0x%x' % mask
+    return ans
+
+def rightsFromSDDL(rights):
+    if rights.lower().startswith('0x'):
+        return int(rights, 16)
+    if rights.isdigit():
+        return int(rights)
+    codes = dict(SDDL_COMBINED_RIGHTS + SDDL_RIGHTS + SDDL_LABEL_RIGHTS)
+    mask = 0
+    for i in range(0, len(rights), 2):
+        if rights[i:i+2] not in codes:
+            raise Exception('Unknown SDDL rights %s' % rights[i:i+2])
+        mask |= codes[rights[i:i+2]]
+    return mask
+
+def aceToSDDL(ace, domainSid=None):
+    letters = [k for k, v in SDDL_ACE_TYPES.items() if v == ace['AceType']]
+    if len(letters) == 0:
+        raise Exception('ACE type 0x%x has no SDDL representation' % ace['AceType'])
+    flags = ''.join([k for k, v in SDDL_ACE_FLAGS if ace.hasFlag(v)])
+    body = ace['Ace']
+    # The conditional expression or resource attribute, anything past the zero padding
+    if 'ApplicationData' in body.fields and body['ApplicationData'].strip(b'\x00') != b'':
+        raise Exception('ACE type 0x%x with application data (conditions or attributes) can\'t be written '
+                        'as SDDL' % ace['AceType'])
+    rights = rightsToSDDL(body['Mask']['Mask'], ace['AceType'] == SYSTEM_MANDATORY_LABEL_ACE.ACE_TYPE)
+    objectType = inheritedObjectType = ''
+    if isinstance(body, ACCESS_ALLOWED_OBJECT_ACE):
+        if body['ObjectType'] != b'':
+            objectType = bin_to_string(body['ObjectType']).lower()
+        if body['InheritedObjectType'] != b'':
+            inheritedObjectType = bin_to_string(body['InheritedObjectType']).lower()
+    return ';'.join((letters[0], flags, rights, objectType, inheritedObjectType,
+                     sidToSDDL(body['Sid'].formatCanonical(), domainSid)))
+
+def aceFromSDDL(ace, domainSid=None):
+    items = ace.split(';')
+    if len(items) != 6:
+        raise Exception('Unsupported SDDL ACE (%s)' % ace)
+    aceType, flags, rights, objectType, inheritedObjectType, sid = items
+    if aceType not in SDDL_ACE_TYPES:
+        raise Exception('Unknown SDDL ACE type %s' % aceType)
+    ans = ACE()
+    ans['AceType'] = SDDL_ACE_TYPES[aceType]
+    ans['AceFlags'] = 0
+    codes = dict(SDDL_ACE_FLAGS)
+    for i in range(0, len(flags), 2):
+        if flags[i:i+2] not in codes:
+            raise Exception('Unknown SDDL ACE flag %s' % flags[i:i+2])
+        ans['AceFlags'] |= codes[flags[i:i+2]]
+    body = ACE_TYPE_MAP[ans['AceType']]()
+    body['Mask'] = ACCESS_MASK()
+    body['Mask']['Mask'] = rightsFromSDDL(rights)
+    if isinstance(body, ACCESS_ALLOWED_OBJECT_ACE):
+        body['Flags'] = 0
+        body['ObjectType'] = string_to_bin(objectType) if objectType != '' else b''
+        body['InheritedObjectType'] = string_to_bin(inheritedObjectType) if inheritedObjectType != '' else b''
+    if isinstance(body, (ACCESS_ALLOWED_CALLBACK_ACE, ACCESS_ALLOWED_CALLBACK_OBJECT_ACE)):
+        body['ApplicationData'] = b''
+    body['Sid'] = LDAP_SID()
+    body['Sid'].fromCanonical(sidFromSDDL(sid, domainSid))
+    ans['Ace'] = body
+    return ans
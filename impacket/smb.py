@@ -161,6 +161,7 @@ SMB_SETUP_USE_LANMAN_KEY         = 0x02
 # QUERY_INFORMATION levels
 SMB_INFO_ALLOCATION              = 0x0001
 SMB_INFO_VOLUME                  = 0x0002
+SMB_INFO_QUERY_ALL_EAS           = 0x0004
 FILE_FS_SIZE_INFORMATION         = 0x0003
 SMB_QUERY_FS_VOLUME_INFO         = 0x0102
 SMB_QUERY_FS_SIZE_INFO           = 0x0103
@@ -170,9 +171,11 @@ SMB_QUERY_FS_ATTRIBUTE_INFO      = 0x0105
 SMB_QUERY_FILE_BASIC_INFO        = 0x0101
 SMB_QUERY_FILE_STANDARD_INFO     = 0x0102
 SMB_QUERY_FILE_ALL_INFO          = 0x0107
+SMB_QUERY_FILE_STREAM_INFO       = 0x0109
 FILE_FS_FULL_SIZE_INFORMATION    = 0x03EF
 
 # SET_INFORMATION levels
+SMB_INFO_SET_EAS                 = 0x0002
 SMB_SET_FILE_DISPOSITION_INFO    = 0x0102
 SMB_SET_FILE_BASIC_INFO          = 0x0101
 SMB_SET_FILE_END_OF_FILE_INFO    = 0x0104
@@ -984,7 +987,7 @@ class SMBFindInfoStandard(AsciiOrUnicodeStructure):
         ('LastAccessTime','<H=0'),
         ('LastWriteDate','<H=0'),
         ('LastWriteTime','<H=0'),
-        ('EaSize','<L'),
+        ('FileDataSize','<L=0'),
         ('AllocationSize','<L=1'),
         ('ExtFileAttributes','<H=0'),
     )
@@ -2040,6 +2043,34 @@ class SMBFlush_Parameters(SMBCommand_Parameters):
         ('FID','<H'),
    )
 
+############# SMB_COM_LOCKING_ANDX (0x24)
+# TypeOfLock
+LOCKING_ANDX_SHARED_LOCK         = 0x01
+LOCKING_ANDX_OPLOCK_RELEASE      = 0x02
+LOCKING_ANDX_CHANGE_LOCKTYPE     = 0x04
+LOCKING_ANDX_CANCEL_LOCK         = 0x08
+LOCKING_ANDX_LARGE_FILES         = 0x10
+
+class SMBLockingAndX_Parameters(SMBAndXCommand_Parameters):
+    structure = (
+        ('Fid','<H'),
+        ('TypeOfLock','<B=0'),
+        ('NewOpLockLevel','<B=0'),
+        ('Timeout','<L=0'),
+        ('NumberOfRequestedUnlocks','<H=0'),
+        ('NumberOfRequestedLocks','<H=0'),
+    )
+
+class SMBLockingAndXRange_Large(Structure):
+    structure = (
+        ('PID','<H'),
+        ('Pad','<H=0'),
+        ('ByteOffsetHigh','<L'),
+        ('ByteOffsetLow','<L'),
+        ('LengthInBytesHigh','<L'),
+        ('LengthInBytesLow','<L'),
+    )
+
 ############# SMB_COM_CREATE_DIRECTORY (0x00)
 class SMBCreateDirectory_Data(AsciiOrUnicodeStructure):
     AsciiStructure = (
@@ -2281,6 +2312,11 @@ class SMB:
     TRANS2_QUERY_FILE_INFORMATION           = 0x0007
     TRANS2_SET_FILE_INFORMATION             = 0x0008
     TRANS2_SET_PATH_INFORMATION             = 0x0006
+    TRANS2_GET_DFS_REFERRAL                 = 0x0010
+
+    # NT_TRANSACT codes
+    NT_TRANSACT_SET_SECURITY_DESC           = 0x0003
+    NT_TRANSACT_QUERY_SECURITY_DESC         = 0x0006
 
     # Security Share Mode (Used internally by SMB class)
     SECURITY_SHARE_MASK                     = 0x01
@@ -2885,6 +2921,36 @@ class SMB:
            return 1
         return 0
 
+    def locking_andx(self, tid, fid, offset, length, lockType = 0, timeout = 0, unlock = False):
+        # A single range, locked (or unlocked) for our PID. timeout is in milliseconds, 0xffffffff waits forever
+        smb = NewSMBPacket()
+        smb['Tid']    = tid
+
+        lockRange = SMBLockingAndXRange_Large()
+        lockRange['PID']               = os.getpid() & 0xFFFF
+        lockRange['ByteOffsetHigh']    = offset >> 32
+        lockRange['ByteOffsetLow']     = offset & 0xffffffff
+        lockRange['LengthInBytesHigh'] = length >> 32
+        lockRange['LengthInBytesLow']  = length & 0xffffffff
+
+        lockingAndX = SMBCommand(SMB.SMB_COM_LOCKING_ANDX)
+        lockingAndX['Parameters'] = SMBLockingAndX_Parameters()
+        lockingAndX['Parameters']['Fid']        = fid
+        lockingAndX['Parameters']['TypeOfLock'] = lockType | LOCKING_ANDX_LARGE_FILES
+        lockingAndX['Parameters']['Timeout']    = timeout
+        if unlock is True:
+            lockingAndX['Parameters']['NumberOfRequestedUnlocks'] = 1
+        else:
+            lockingAndX['Parameters']['NumberOfRequestedLocks'] = 1
+        lockingAndX['Data'] = lockRange.getData()
+        smb.addCommand(lockingAndX)
+
+        self.sendSMB(smb)
+        smb = self.recvSMB()
+        if smb.isValidAnswer(SMB.SMB_COM_LOCKING_ANDX):
+           return 1
+        return 0
+
     def send_trans(self, tid, setup, name, param, data, noAnswer = 0):
         smb = NewSMBPacket()
         smb['Tid']    = tid
@@ -2967,6 +3033,24 @@ class SMB:
             # Remove Potential Prefix Padding
             return trans2Response['Data'][-trans2Parameters['TotalDataCount']:]
 
+    def set_file_info(self, tid, fid, data, fileInfoClass = SMB_SET_FILE_END_OF_FILE_INFO):
+        self.send_trans2(tid, SMB.TRANS2_SET_FILE_INFORMATION, '\x00', pack('<HHH', fid, fileInfoClass, 0), data)
+
+        resp = self.recvSMB()
+        if resp.isValidAnswer(SMB.SMB_COM_TRANSACTION2):
+            return True
+
+    def get_dfs_referral(self, tid, request):
+        # request is a REQ_GET_DFS_REFERRAL, the answer a RESP_GET_DFS_REFERRAL ([MS-DFSC])
+        self.send_trans2(tid, SMB.TRANS2_GET_DFS_REFERRAL, '\x00', request, '')
+
+        resp = self.recvSMB()
+        if resp.isValidAnswer(SMB.SMB_COM_TRANSACTION2):
+            trans2Response = SMBCommand(resp['Data'][0])
+            trans2Parameters = SMBTransaction2Response_Parameters(trans2Response['Parameters'])
+            # Remove Potential Prefix Padding
+            return trans2Response['Data'][-trans2Parameters['TotalDataCount']:]
+
     def __nonraw_retr_file(self, tid, fid, offset, datasize, callback):
         if (self._dialects_parameters['Capabilities'] & SMB.CAP_LARGE_READX) and self._SignatureEnabled is False:
             max_buf_size = 65000
@@ -3081,6 +3165,8 @@ class SMB:
         if TGT is None:
             if TGS is None:
                 tgt, cipher, oldSessionKey, sessionKey = getKerberosTGT(userName, password, domain, lmhash, nthash, aesKey, kdcHost)
+                # Kept so getCredentials gives it (for reconnecting, the ccache, etc)
+                self.__TGT = {'KDC_REP': tgt, 'cipher': cipher, 'oldSessionKey': oldSessionKey, 'sessionKey': sessionKey}
         else:
             tgt = TGT['KDC_REP']
             cipher = TGT['cipher']
@@ -3091,6 +3177,7 @@ class SMB:
         if TGS is None:
             serverName = Principal('cifs/%s' % self.__remote_name, type=constants.PrincipalNameType.NT_SRV_INST.value)
             tgs, cipher, oldSessionKey, sessionKey = getKerberosTGS(serverName, domain, kdcHost, tgt, cipher, sessionKey)
+            self.__TGS = {'KDC_REP': tgs, 'cipher': cipher, 'oldSessionKey': oldSessionKey, 'sessionKey': sessionKey}
         else:
             tgs = TGS['KDC_REP']
             cipher = TGS['cipher']
@@ -3345,6 +3432,11 @@ class SMB:
             self.__TGT,
             self.__TGS)
 
+    def setKerberosTickets(self, TGT, TGS):
+        # Fresher tickets (e.g. a renewed TGT) for the next time we log in again
+        self.__TGT = TGT
+        self.__TGS = TGS
+
     def getIOCapabilities(self):
         res = dict()
         if (self._dialects_parameters['Capabilities'] & SMB.CAP_LARGE_READX) and self._SignatureEnabled is False:
@@ -4065,16 +4157,23 @@ class SMB:
             max_buf_size = self._dialects_parameters['MaxBufferSize'] & ~0x3ff  # Write in multiple KB blocks
 
         write_offset = offset
-        while 1:
-            if len(data) == 0:
-                break
+        written = 0
+        while len(data) > 0:
             writeData = data[:max_buf_size]
-            data = data[max_buf_size:]
 
             smb = self.write_andx(treeId,fileId,writeData, write_offset)
             writeResponse   = SMBCommand(smb['Data'][0])
             writeResponseParameters = SMBWriteAndXResponse_Parameters(writeResponse['Parameters'])
-            write_offset += writeResponseParameters['Count']
+            count = writeResponseParameters['Count']
+            if count == 0:
+                # Nothing else is going in, the caller gets to know through the amount written
+                break
+            # Short writes get the rest sent again
+            data = data[count:]
+            write_offset += count
+            written += count
+
+        return written
 
     def get_socket(self):
         return self._sess.get_socket()
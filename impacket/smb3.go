@@ -32,16 +32,20 @@ import ntpath
 import random
 import string
 import struct
+import time
+import threading
 from six import indexbytes, b
 from binascii import a2b_hex
 from contextlib import contextmanager
 from pyasn1.type.univ import noValue
 from Cryptodome.Cipher import AES
 
-from impacket import nmb, ntlm, uuid, crypto
+from impacket import nmb, ntlm, uuid, crypto, LOG
 from impacket.smb3structs import *
 from impacket.nt_errors import STATUS_SUCCESS, STATUS_MORE_PROCESSING_REQUIRED, STATUS_INVALID_PARAMETER, \
-    STATUS_NO_MORE_FILES, STATUS_PENDING, STATUS_NOT_IMPLEMENTED, ERROR_MESSAGES
+    STATUS_NO_MORE_FILES, STATUS_PENDING, STATUS_NOT_IMPLEMENTED, STATUS_END_OF_FILE, STATUS_ACCESS_DENIED, \
+    STATUS_CANCELLED, STATUS_IO_TIMEOUT, STATUS_NOTIFY_ENUM_DIR, STATUS_NOT_SUPPORTED, ERROR_MESSAGES, \
+    STATUS_CONNECTION_DISCONNECTED
 from impacket.spnego import SPNEGO_NegTokenInit, TypesMech, SPNEGO_NegTokenResp, ASN1_OID, asn1encode, ASN1_AID
 from impacket.krb5.gssapi import KRB5_AP_REQ
 
@@ -69,6 +73,8 @@ TREE_CONNECT = {
     'IsScaleoutShare' : false,
     // Outside the protocol
     'NumberOfUses'    : 0,
+    // The id handed to the caller, it doesn't change when we reconnect
+    'ClientTreeId'    : 0,
 }
 
 FILE = {
@@ -98,6 +104,10 @@ OPEN = {
     'CreateOption'       : '',
     'FileAttributes'     : '',
     'CreateDisposition'  : '',
+    // Outside the protocol
+    // What we need to reclaim the handle after a reconnect
+    'CreateName'         : '',
+    'ImpersonationLevel' : 0,
 }
 
 REQUEST = {
@@ -128,6 +138,71 @@ CHANNEL = {
         return 'SMB SessionError: %s(%s)' % (ERROR_MESSAGES[self.error])
 
 
+ type Context: struct {
+    """
+    Deadline and cancellation for the calls made inside SMB3.useContext. A context made out of
+    another one (parent) is done as soon as its parent is, and never outlives its deadline
+    """
+     func (self TYPE) __init__(timeout = nil, parent = nil interface{}){
+        self.__parent = parent
+        self.__cancelled = false
+        self.__lock = threading.Lock()
+        // Conditions of the threads waiting on us, woken up when we're cancelled
+        self.__waiters = []
+        if timeout == nil {
+            self.__deadline = nil
+        } else  {
+            self.__deadline = time.time() + timeout
+        if parent is not nil and parent.getDeadline() is not nil {
+            if self.__deadline == nil or parent.getDeadline() < self.__deadline {
+                self.__deadline = parent.getDeadline()
+
+     func (self TYPE) getDeadline(){
+        return self.__deadline
+
+     func (self TYPE) remaining(){
+        // Seconds left before the deadline, nil if there's none
+        if self.__deadline == nil {
+            return nil
+        return max(self.__deadline - time.time(), 0)
+
+     func (self TYPE) cancel(){
+        self.__cancelled = true
+        with self.__lock:
+            waiters = list(self.__waiters)
+        for condition in waiters:
+            with condition:
+                condition.notify_all()
+
+     func (self TYPE) isCancelled(){
+        if self.__cancelled is true {
+            return true
+        return self.__parent is not nil and self.__parent.isCancelled()
+
+     func (self TYPE) isDone(){
+        return self.getError() is not nil
+
+     func (self TYPE) getError(){
+        // The status the calls fail with once we're done
+        if self.isCancelled() is true {
+            return STATUS_CANCELLED
+        if self.__deadline is not nil and time.time() >= self.__deadline {
+            return STATUS_IO_TIMEOUT
+        return nil
+
+     func (self TYPE) addWaiter(condition interface{}){
+        with self.__lock:
+            self.__waiters.append(condition)
+        if self.__parent is not nil {
+            self.__parent.addWaiter(condition)
+
+     func (self TYPE) removeWaiter(condition interface{}){
+        with self.__lock:
+            self.__waiters.remove(condition)
+        if self.__parent is not nil {
+            self.__parent.removeWaiter(condition)
+
+
  type SMB3: struct {
     def __init__(self, remote_name, remote_host, my_name=nil, host_type=nmb.TYPE_SERVER, sess_port=445, timeout=60,
                  UDP=0, preferredDialect=nil, session=nil, negSessionResponse=nil):
@@ -137,10 +212,24 @@ CHANNEL = {
         self.ConnectionTable = {}
         self.GlobalFileTable = {}
         self.ClientGuid = "".join([random.choice(string.ascii_letters) for i in range(16)])
-        // Only for SMB 3.0
-        self.EncryptionAlgorithmList = ["AES-CCM"]
+        // Only for SMB 3.x. 3.0 and 3.0.2 only know about AES-128-CCM, 3.1.1 lets the server
+        // pick from this list (in our order of preference)
+        self.EncryptionAlgorithmList = [SMB2_ENCRYPTION_AES128_GCM, SMB2_ENCRYPTION_AES128_CCM,
+                                        SMB2_ENCRYPTION_AES256_GCM, SMB2_ENCRYPTION_AES256_CCM]
+        // Only for SMB 3.1.1
+        self.SigningAlgorithmList = [SMB2_SIGNING_AES_GMAC, SMB2_SIGNING_AES_CMAC]
         self.MaxDialect = []
         self.RequireSecureNegotiate = false
+        // Durable v2 handles let us get our opens back after the connection drops (SMB 3.x only). Unless
+        // the share is continuously available, the server only grants them along with a batch oplock, and
+        // we only ask for one while the reader thread is there to acknowledge the breaks
+        self.RequestDurableHandles = false
+        self.DurableHandleTimeout = 0
+        self.DurableOplockLevel = SMB2_OPLOCK_LEVEL_BATCH
+        // If the socket fails once we're logged in, connect again and pick up where we were. Off by default,
+        // since without durable handles the opens are lost and whatever was in flight can't be replayed safely
+        self.AutoReconnect = false
+        self.ReconnectAttempts = 3
 
         // Per Transport Connection Data
         self._Connection = {
@@ -172,9 +261,19 @@ CHANNEL = {
             'ServerCapabilities'       : 0,    //
             'ClientSecurityMode'       : 0,    //
             'ServerSecurityMode'       : 0,    //
+            // If the client implements the SMB 3.1.1 dialect,
+            // it MUST also implement the following
+            'PreauthIntegrityHashId'   : 0,    //
+            'PreauthIntegrityHashValue': b'\x00'*64, //
+            'CipherId'                 : 0,    //
+            'SigningAlgorithmId'       : SMB2_SIGNING_AES_CMAC, //
             // Outside the protocol
             'ServerIP'                 : '',    //
             'ClientName'               : '',    //
+            // Credits the server granted us and we didn't spend yet
+            'Credits'                  : 1,     //
+            // How many READ/WRITE requests we keep in flight when moving files around
+            'IOWindow'                 : 8,     //
         }
    
         self._Session = {
@@ -195,6 +294,9 @@ CHANNEL = {
             'DecryptionKey'            : '',
             'SigningKey'               : '',  
             'ApplicationKey'           : b'',
+            // If the client implements the SMB 3.1.1 dialect,
+            // it MUST also implement the following
+            'PreauthIntegrityHashValue': b'',
             // Outside the protocol
             'SessionFlags'             : 0,     // 
             'ServerName'               : '',    //
@@ -222,6 +324,35 @@ CHANNEL = {
         self.__TGT      = nil
         self.__TGS      = nil
 
+        // Things needed to connect again
+        self.__hostType = host_type
+        self.__sessPort = sess_port
+        self.__UDP      = UDP
+        self.__reconnecting      = false
+        self.__previousSessionId = 0
+        // SESSION_SETUP again on the session we already have (see reauthenticate)
+        self.__reauthenticating  = false
+        self.__reauthPending     = false
+        // Old MessageID -> MessageID it was sent again with after a reconnect
+        self.__resentRequests = {}
+        // MessageIDs of the requests a reconnect didn't send again, they fail
+        self.__lostRequests = set()
+        // Once startReader() is called, a thread reads everything that comes in and hands each
+        // response to whoever waits on its MessageID, so many threads can share the connection.
+        // The lock is held while sending and while touching the tables both sides use
+        self.__lock = threading.RLock()
+        self.__responseReady = threading.Condition(self.__lock)
+        self.__reader = nil
+        self.__readerError = nil
+        self.__stopReader = false
+        // MessageID -> AsyncId of the requests the server went async on, to cancel them
+        self.__asyncIds = {}
+        // MessageIDs nobody waits for anymore (their context is done)
+        self.__abandoned = set()
+        self.__threadState = threading.local()
+        // MessageIDs of oplock break acknowledgments we sent, nobody waits for their answer
+        self.__oplockAcks = set()
+
         if sess_port == 445 and remote_name == '*SMBSERVER' {
            self._Connection["ServerName"] = remote_host
         } else  {
@@ -233,13 +364,19 @@ CHANNEL = {
         } else  {
             self._Connection["ClientName"] = my_name
 
+        // The state a brand new connection starts with
+        self.__initialConnection = copy.deepcopy(self._Connection)
+        self.__initialSession    = copy.deepcopy(self._Session)
+
+        if not my_name {
+            // If destination port is 139 yes, there's some client disclosure
+            my_name = socket.gethostname()
+            i = my_name.find(".")
+            if i > -1 {
+                my_name = my_name[:i]
+        self.__myName = my_name
+
         if session == nil {
-            if not my_name {
-                // If destination port is 139 yes, there's some client disclosure
-                my_name = socket.gethostname()
-                i = my_name.find(".")
-                if i > -1 {
-                    my_name = my_name[:i]
 
             if UDP {
                 self._NetBIOSSession = nmb.NetBIOSUDPSession(my_name, self._Connection["ServerName"], remote_host, host_type, sess_port, self._timeout)
@@ -316,6 +453,21 @@ CHANNEL = {
         finally:
             self.setTimeout(prev_timeout)
 
+    @contextmanager
+     func (self TYPE) useContext(context interface{}){
+        // Calls made by this thread inside the block fail with SessionError(context.getError()) once
+        // the context is done, and what they're waiting for gets cancelled on the server
+        self.startReader()
+        prevContext = self.getContext()
+        self.__threadState.context = context
+        try:
+            yield
+        finally:
+            self.__threadState.context = prevContext
+
+     func (self TYPE) getContext(){
+        return getattr(self.__threadState, 'context', nil)
+
      func (self TYPE) getDialect(){
         return self._Connection["Dialect"]
 
@@ -325,11 +477,56 @@ CHANNEL = {
             if len(self._Session["SessionKey"]) > 0 {
                 signature = hmac.new(self._Session["SessionKey"], packet.getData(), hashlib.sha256).digest()
                 packet["Signature"] = signature[:16]
+        elif self._Connection["Dialect"] == SMB2_DIALECT_311 and self._Connection["SigningAlgorithmId"] == SMB2_SIGNING_AES_GMAC {
+            if len(self._Session["SessionKey"]) > 0 {
+                // The nonce is the MessageId, followed by a flag for responses (never for us) and another for CANCEL
+                nonce = struct.pack('<Q', packet["MessageID"])
+                if packet["Command"] == SMB2_CANCEL {
+                    nonce += struct.pack('<L', 2)
+                } else  {
+                    nonce += struct.pack('<L', 0)
+                cipher = AES.new(self._Session["SigningKey"], AES.MODE_GCM, nonce)
+                cipher.update(packet.getData())
+                packet["Signature"] = cipher.digest()
         } else  {
             if len(self._Session["SessionKey"]) > 0 {
                 p = packet.getData()
                 signature = crypto.AES_CMAC(self._Session["SigningKey"], p, len(p))
                 packet["Signature"] = signature
+
+     func (self TYPE) __encrypt(plainText interface{}){
+        // Wraps the message in a SMB2 TRANSFORM_HEADER. GCM nonces are 12 bytes long, CCM ones 11
+        transformHeader = SMB2_TRANSFORM_HEADER()
+        if self._Connection["CipherId"] in (SMB2_ENCRYPTION_AES128_GCM, SMB2_ENCRYPTION_AES256_GCM) {
+            nonce = b''.join([struct.pack('B', rand.randint(0, 255)) for _ in range(12)])
+            mode = AES.MODE_GCM
+        } else  {
+            nonce = b''.join([struct.pack('B', rand.randint(0, 255)) for _ in range(11)])
+            mode = AES.MODE_CCM
+        transformHeader["Nonce"] = nonce + b'\x00'*(16 - len(nonce))
+        transformHeader["OriginalMessageSize"] = len(plainText)
+        if self._Connection["Dialect"] == SMB2_DIALECT_311 {
+            transformHeader["EncryptionAlgorithm"] = SMB2_TRANSFORM_ENCRYPTED
+        } else  {
+            transformHeader["EncryptionAlgorithm"] = SMB2_ENCRYPTION_AES128_CCM
+        transformHeader["SessionID"] = self._Session["SessionID"]
+        cipher = AES.new(self._Session["EncryptionKey"], mode, nonce)
+        cipher.update(transformHeader.getData()[20:])
+        cipherText, transformHeader["Signature"] = cipher.encrypt_and_digest(plainText)
+        return transformHeader.getData() + cipherText
+
+     func (self TYPE) __decrypt(data interface{}){
+        transformHeader = SMB2_TRANSFORM_HEADER(data)
+        if self._Connection["CipherId"] in (SMB2_ENCRYPTION_AES128_GCM, SMB2_ENCRYPTION_AES256_GCM) {
+            cipher = AES.new(self._Session["DecryptionKey"], AES.MODE_GCM, transformHeader["Nonce"][:12])
+        } else  {
+            cipher = AES.new(self._Session["DecryptionKey"], AES.MODE_CCM, transformHeader["Nonce"][:11])
+        cipher.update(transformHeader.getData()[20:])
+        try:
+            return cipher.decrypt_and_verify(data[len(SMB2_TRANSFORM_HEADER()):], transformHeader["Signature"])
+        except ValueError:
+            LOG.error("SMB3 decryption failed, message tampered or wrong keys")
+            raise SessionError(STATUS_ACCESS_DENIED)
      
      func (self TYPE) sendSMB(packet interface{}){
         // The idea here is to receive multiple/single commands and create a compound request, and send it
@@ -339,99 +536,277 @@ CHANNEL = {
         // Connection.SupportsPersistentHandles is TRUE, the client MUST set ChannelSequence in the
         // SMB2 header to Session.ChannelSequence
 
-        // Check this is not a CANCEL request. If so, don't consume sequence numbers
-        if packet["Command"] is not SMB2_CANCEL {
-            packet["MessageID"] = self._Connection["SequenceWindow"]
-            self._Connection["SequenceWindow"] += 1
-        packet["SessionID"] = self._Session["SessionID"]
+        context = self.getContext()
+        if context is not nil and context.isDone() is true and packet["Command"] != SMB2_CANCEL {
+            raise SessionError(context.getError())
+
+        // Without the reader thread whoever sends also reads, so a pending re-authentication is done
+        // here, before the next request, and not from the thread that asked for it
+        if self.__reauthPending is true and packet["Command"] != SMB2_CANCEL {
+            self.__reauthPending = false
+            self.reauthenticate()
 
+        with self.__lock:
+            return self.__sendSMB(packet)
+
+     func (self TYPE) __sendSMB(packet interface{}){
         // Default the credit charge to 1 unless set by the caller
         if ('CreditCharge' in packet.fields) is false {
             packet["CreditCharge"] = 1
 
+        // Check this is not a CANCEL request. If so, don't consume sequence numbers.
+        // Multi-credit requests use up as many sequence numbers as credits they're charged
+        if packet["Command"] is not SMB2_CANCEL {
+            packet["MessageID"] = self._Connection["SequenceWindow"]
+            if self._Connection["Dialect"] > SMB2_DIALECT_002 {
+                self._Connection["SequenceWindow"] += max(packet["CreditCharge"], 1)
+                self._Connection["Credits"] -= max(packet["CreditCharge"], 1)
+            } else  {
+                self._Connection["SequenceWindow"] += 1
+                self._Connection["Credits"] -= 1
+        packet["SessionID"] = self._Session["SessionID"]
+
         // Standard credit request after negotiating protocol
         if self._Connection["SequenceWindow"] > 3 {
             packet["CreditRequestResponse"] = 127
 
         messageId = packet["MessageID"]
 
+        // The caller knows trees and files by the ids it got first, the server by the ones
+        // from the last (re)connection
+        treeId = packet["TreeID"]
+        treeEntry = nil
+        if packet["Command"] != SMB2_CANCEL and treeId > 0 and (treeId in self._Session["TreeConnectTable"]) is true {
+            treeEntry = self._Session["TreeConnectTable"][treeId]
+            packet["TreeID"] = treeEntry["TreeConnectId"]
+
+        fileId = nil
+        if packet["Command"] != SMB2_CREATE and isinstance(packet["Data"], Structure) and ('FileID' in packet["Data"].fields) is true {
+            fileId = packet["Data"]["FileID"]
+            if (fileId in self._Session["OpenTable"]) is true {
+                packet["Data"]["FileID"] = self._Session["OpenTable"][fileId]["FileID"].getData()
+
+        if packet["Command"] != SMB2_CANCEL {
+            self._Connection["OutstandingRequests"][messageId] = (packet, treeId, fileId)
+            if self.__reconnecting is false {
+                // Someone still holding this id from before a reconnect is out of luck
+                self.__resentRequests.pop(messageId, nil)
+                self.__lostRequests.discard(messageId)
+
         if self._Session["SigningActivated"] is true and self._Connection["SequenceWindow"] > 2 {
-            if packet["TreeID"] > 0 and (packet["TreeID"] in self._Session["TreeConnectTable"]) is true {
-                if self._Session["TreeConnectTable"][packet["TreeID"]]["EncryptData"] is false {
-                    packet["Flags"] = SMB2_FLAGS_SIGNED
+            if treeEntry is not nil {
+                if treeEntry["EncryptData"] is false {
+                    packet["Flags"] = packet.fields.get('Flags', 0) | SMB2_FLAGS_SIGNED
                     self.signSMB(packet)
-            elif packet["TreeID"] == 0 {
-                packet["Flags"] = SMB2_FLAGS_SIGNED
+            elif packet["TreeID"] == 0 or packet["Command"] == SMB2_CANCEL {
+                packet["Flags"] = packet.fields.get('Flags', 0) | SMB2_FLAGS_SIGNED
                 self.signSMB(packet)
 
-        if (self._Session["SessionFlags"] & SMB2_SESSION_FLAG_ENCRYPT_DATA) or ( packet["TreeID"] != 0 and self._Session["TreeConnectTable"][packet["TreeID"]]["EncryptData"] is true) {
-            plainText = packet.getData()
-            transformHeader = SMB2_TRANSFORM_HEADER()
-            transformHeader["Nonce"] = "".join([rand.choice(string.ascii_letters) for _ in range(11)])
-            transformHeader["OriginalMessageSize"] = len(plainText)
-            transformHeader["EncryptionAlgorithm"] = SMB2_ENCRYPTION_AES128_CCM
-            transformHeader["SessionID"] = self._Session["SessionID"] 
-            cipher = AES.new(self._Session["EncryptionKey"], AES.MODE_CCM,  b(transformHeader["Nonce"]))
-            cipher.update(transformHeader.getData()[20:])
-            cipherText = cipher.encrypt(plainText)
-            transformHeader["Signature"] = cipher.digest()
-            packet = transformHeader.getData() + cipherText
-
-            self._NetBIOSSession.send_packet(packet)
-        } else  {
-            self._NetBIOSSession.send_packet(packet.getData())
+        try:
+            if (self._Session["SessionFlags"] & SMB2_SESSION_FLAG_ENCRYPT_DATA) or (treeEntry is not nil and treeEntry["EncryptData"] is true) {
+                self._NetBIOSSession.send_packet(self.__encrypt(packet.getData()))
+            } else  {
+                self._NetBIOSSession.send_packet(packet.getData())
+        except (socket.error, nmb.NetBIOSError):
+            if self.__canReconnect() is false {
+                raise
+            // The request is outstanding, reconnect() sends it again
+            if self.__reader is not nil and threading.current_thread() is not self.__reader {
+                // The reader finds out the connection is gone and takes care of it
+                return messageId
+            self.reconnect()
+            return self.__resentRequests.pop(messageId, messageId)
 
         return messageId
 
-     func (self TYPE) recvSMB(packetID = nil interface{}){
-        // First, verify we don't have the packet already
-        if packetID in self._Connection["OutstandingResponses"] {
-            return self._Connection["OutstandingResponses"].pop(packetID) 
-
+     func (self TYPE) __recvPacket(){
         data = self._NetBIOSSession.recv_packet(self._timeout)
 
         if data.get_trailer().startswith(b'\xfdSMB') {
             // Packet is encrypted
-            transformHeader = SMB2_TRANSFORM_HEADER(data.get_trailer())
-            cipher = AES.new(self._Session["DecryptionKey"], AES.MODE_CCM,  transformHeader["Nonce"][:11])
-            cipher.update(transformHeader.getData()[20:])
-            plainText = cipher.decrypt(data.get_trailer()[len(SMB2_TRANSFORM_HEADER()):])
-            //cipher.verify(transformHeader["Signature"])
-            packet = SMB2Packet(plainText)
+            packet = SMB2Packet(self.__decrypt(data.get_trailer()))
         } else  {
             // In all SMB dialects for a response this field is interpreted as the Status field. 
             // This field can be set to any value. For a list of valid status codes, 
             // see [MS-ERREF] section 2.3.
             packet = SMB2Packet(data.get_trailer())
+        with self.__lock:
+            self._Connection["Credits"] += packet["CreditRequestResponse"]
+        return packet
 
-        // Loop while we receive pending requests
-        if packet["Status"] == STATUS_PENDING {
-            status = STATUS_PENDING
-            while status == STATUS_PENDING:
-                data = self._NetBIOSSession.recv_packet(self._timeout) 
-                if data.get_trailer().startswith(b'\xfeSMB') {
-                    packet = SMB2Packet(data.get_trailer())
-                } else  {
-                    // Packet is encrypted
-                    transformHeader = SMB2_TRANSFORM_HEADER(data.get_trailer())
-                    cipher = AES.new(self._Session["DecryptionKey"], AES.MODE_CCM,  transformHeader["Nonce"][:11])
-                    cipher.update(transformHeader.getData()[20:])
-                    plainText = cipher.decrypt(data.get_trailer()[len(SMB2_TRANSFORM_HEADER()):])
-                    //cipher.verify(transformHeader["Signature"])
-                    packet = SMB2Packet(plainText)
-                status = packet["Status"]
+     func (self TYPE) recvSMB(packetID = nil interface{}){
+        if self.__reader is not nil and threading.current_thread() is not self.__reader {
+            return self.__waitResponse(packetID)
+
+        // Requests sent again after a reconnect have a new MessageID
+        requestID = packetID
+        if self.__reconnecting is false and packetID in self.__resentRequests {
+            packetID = self.__resentRequests[packetID]
+        if self.__reconnecting is false and packetID in self.__lostRequests {
+            self.__lostRequests.discard(packetID)
+            raise SessionError(STATUS_CONNECTION_DISCONNECTED)
+
+        // First, verify we don't have the packet already
+        if packetID in self._Connection["OutstandingResponses"] {
+            self.__resentRequests.pop(requestID, nil)
+            return self._Connection["OutstandingResponses"].pop(packetID) 
+
+        try:
+            packet = self.__recvPacket()
+            // Loop while we receive pending requests
+            while packet["Status"] == STATUS_PENDING:
+                packet = self.__recvPacket()
+        except (socket.error, nmb.NetBIOSError):
+            if self.__canReconnect() is false {
+                raise
+            self.reconnect()
+            return self.recvSMB(requestID)
+
+        if packet["Command"] == SMB2_OPLOCK_BREAK and packet["MessageID"] == 0xffffffffffffffff {
+            self.__acknowledgeOplockBreak(packet)
+            return self.recvSMB(requestID)
+
+        self._Connection["OutstandingRequests"].pop(packet["MessageID"], nil)
+        if packet["MessageID"] in self.__oplockAcks {
+            self.__oplockAcks.discard(packet["MessageID"])
+            return self.recvSMB(requestID)
 
         if packet["MessageID"] == packetID or packetID == nil {
-            // Let's update the sequenceWindow based on the CreditsCharged
-            // In the SMB 2.0.2 dialect, this field MUST NOT be used and MUST be reserved.
-            // The sender MUST set this to 0, and the receiver MUST ignore it.
-            // In all other dialects, this field indicates the number of credits that this request consumes.
-            if self._Connection["Dialect"] > SMB2_DIALECT_002 {
-                self._Connection["SequenceWindow"] += (packet["CreditCharge"] - 1)
+            // The sequence numbers for the CreditCharge were already taken when sending
+            self.__resentRequests.pop(requestID, nil)
             return packet
         } else  {
             self._Connection["OutstandingResponses"][packet["MessageID"]] = packet
-            return self.recvSMB(packetID) 
+            return self.recvSMB(requestID) 
+
+     func (self TYPE) __waitResponse(packetID interface{}){
+        // The reader thread leaves the responses in OutstandingResponses and wakes us up. Without a
+        // context we wait as long as a plain recv would
+        context = self.getContext()
+        deadline = nil
+        if context == nil and self._timeout is not nil {
+            deadline = time.time() + self._timeout
+        with self.__responseReady:
+            if context is not nil {
+                context.addWaiter(self.__responseReady)
+            try:
+                while true:
+                    responseID = self.__resentRequests.get(packetID, packetID)
+                    // While reconnecting the MessageIDs start over, nothing to pick up yet
+                    if self.__reconnecting is false {
+                        if packetID in self.__lostRequests {
+                            self.__lostRequests.discard(packetID)
+                            raise SessionError(STATUS_CONNECTION_DISCONNECTED)
+                        if packetID == nil and len(self._Connection["OutstandingResponses"]) > 0 {
+                            responseID = min(self._Connection["OutstandingResponses"].keys())
+                        if responseID in self._Connection["OutstandingResponses"] {
+                            self.__resentRequests.pop(packetID, nil)
+                            self.__asyncIds.pop(responseID, nil)
+                            return self._Connection["OutstandingResponses"].pop(responseID)
+                    if self.__readerError is not nil {
+                        raise self.__readerError
+                    error = nil
+                    if context is not nil and context.isDone() is true {
+                        error = context.getError()
+                    elif deadline is not nil and time.time() >= deadline {
+                        error = STATUS_IO_TIMEOUT
+                    if error is not nil {
+                        if packetID is not nil {
+                            // Whatever the server answers now goes nowhere
+                            self.__abandoned.add(responseID)
+                            self.__resentRequests.pop(packetID, nil)
+                            self.cancel(responseID)
+                        raise SessionError(error)
+                    if context is not nil {
+                        self.__responseReady.wait(context.remaining())
+                    elif deadline is not nil {
+                        self.__responseReady.wait(max(deadline - time.time(), 0))
+                    } else  {
+                        self.__responseReady.wait()
+            finally:
+                if context is not nil {
+                    context.removeWaiter(self.__responseReady)
+
+     func (self TYPE) startReader(){
+        // From now on a thread reads from the connection and the calls can be made from many threads
+        with self.__lock:
+            if self.__reader is not nil {
+                return
+            self.__stopReader = false
+            self.__readerError = nil
+            self.__reader = threading.Thread(target=self.__readerLoop, name='SMB3Reader')
+            self.__reader.daemon = true
+            self.__reader.start()
+
+     func (self TYPE) __readerLoop(){
+        while self.__stopReader is false:
+            try:
+                packet = self.__recvPacket()
+            except nmb.NetBIOSTimeout:
+                // Nothing came in for a while, that's fine. Whoever waits for an answer gives up by itself
+                continue
+            except (socket.error, nmb.NetBIOSError) as e:
+                if self.__stopReader is true {
+                    break
+                error = e
+                if self.__canReconnect() is true {
+                    try:
+                        // Nobody sends while we're at it
+                        with self.__lock:
+                            self.reconnect()
+                            self.__responseReady.notify_all()
+                        continue
+                    except Exception as e:
+                        error = e
+                LOG.debug('SMB3 reader stopped: %s' % error)
+                with self.__responseReady:
+                    self.__readerError = error
+                    self.__responseReady.notify_all()
+                break
+
+            if packet["Command"] == SMB2_OPLOCK_BREAK and packet["MessageID"] == 0xffffffffffffffff {
+                self.__acknowledgeOplockBreak(packet)
+                continue
+
+            with self.__responseReady:
+                messageId = packet["MessageID"]
+                if packet["Status"] == STATUS_PENDING {
+                    // Interim response, the real one comes later. The AsyncId takes the place of the TreeID
+                    if packet["Flags"] & SMB2_FLAGS_ASYNC_COMMAND {
+                        self.__asyncIds[messageId] = packet["Reserved"] | (packet["TreeID"] << 32)
+                    continue
+                self._Connection["OutstandingRequests"].pop(messageId, nil)
+                self.__asyncIds.pop(messageId, nil)
+                if messageId in self.__oplockAcks {
+                    self.__oplockAcks.discard(messageId)
+                    continue
+                if messageId in self.__abandoned {
+                    self.__abandoned.discard(messageId)
+                    continue
+                self._Connection["OutstandingResponses"][messageId] = packet
+                self.__responseReady.notify_all()
+
+     func (self TYPE) __acknowledgeOplockBreak(packet interface{}){
+        // We only ask for oplocks to get durable handles, so we just give up what the server asks for
+        breakNotification = SMB2OplockBreakNotification(packet["Data"])
+        fileId = breakNotification["FileID"].getData()
+        treeId = 0
+        for openFile in list(self._Session["OpenTable"].values()):
+            if openFile["FileID"].getData() == fileId {
+                treeId = openFile["TreeConnect"]
+                openFile["Oplocklevel"] = breakNotification["OplockLevel"]
+                // Without a batch oplock the server doesn't keep the handle durable anymore
+                if openFile["IsPersistent"] is false and breakNotification["OplockLevel"] != SMB2_OPLOCK_LEVEL_BATCH {
+                    openFile["Durable"] = false
+
+        packet = self.SMB_PACKET()
+        packet["Command"] = SMB2_OPLOCK_BREAK
+        packet["TreeID"]  = treeId
+        oplockAck = SMB2OplockBreakAcknowledgment()
+        oplockAck["OplockLevel"] = breakNotification["OplockLevel"]
+        oplockAck["FileID"]      = fileId
+        packet["Data"] = oplockAck
+        self.__oplockAcks.add(self.sendSMB(packet))
 
      func (self TYPE) negotiateSession(preferredDialect = nil, negSessionResponse = nil interface{}){
         // Let's store some data for later use
@@ -452,22 +827,37 @@ CHANNEL = {
 
             packet = self.SMB_PACKET()
             packet["Command"] = SMB2_NEGOTIATE
-            negSession = SMB2Negotiate()
+            if preferredDialect is not nil {
+                dialects = [preferredDialect]
+            } else  {
+                // 3.1.1 is only offered when asked for through preferredDialect
+                dialects = [SMB2_DIALECT_002, SMB2_DIALECT_21, SMB2_DIALECT_30, SMB2_DIALECT_302]
+
+            if SMB2_DIALECT_311 in dialects {
+                negSession = SMB311Negotiate()
+                negSession["Dialects"] = b''.join([struct.pack('<H', dialect) for dialect in dialects])
+                self.__addNegotiateContexts(negSession, len(dialects))
+            } else  {
+                negSession = SMB2Negotiate()
+                negSession["Dialects"] = dialects
 
             negSession["SecurityMode"] = self._Connection["ClientSecurityMode"]
             negSession["Capabilities"] = self._Connection["Capabilities"]
             negSession["ClientGuid"] = self.ClientGuid
-            if preferredDialect is not nil {
-                negSession["Dialects"] = [preferredDialect]
-            } else  {
-                negSession["Dialects"] = [SMB2_DIALECT_002, SMB2_DIALECT_21, SMB2_DIALECT_30]
-            negSession["DialectCount"] = len(negSession["Dialects"])
+            negSession["DialectCount"] = len(dialects)
             packet["Data"] = negSession
 
             packetID = self.sendSMB(packet)
             ans = self.recvSMB(packetID)
             if ans.isValidAnswer(STATUS_SUCCESS) {
                 negResp = SMB2Negotiate_Response(ans["Data"])
+                if negResp["DialectRevision"] == SMB2_DIALECT_311 {
+                    // [MS-SMB2] 3.2.5.2, the preauth integrity hash starts with the negotiate exchange
+                    self._Connection["PreauthIntegrityHashValue"] = hashlib.sha512(
+                        self._Connection["PreauthIntegrityHashValue"] + packet.getData()).digest()
+                    self._Connection["PreauthIntegrityHashValue"] = hashlib.sha512(
+                        self._Connection["PreauthIntegrityHashValue"] + ans.getData()).digest()
+                    self.__processNegotiateContexts(negResp, ans["Data"])
 
         self._Connection["MaxTransactSize"]   = min(0x100000,negResp["MaxTransactSize"])
         self._Connection["MaxReadSize"]       = min(0x100000,negResp["MaxReadSize"])
@@ -482,7 +872,7 @@ CHANNEL = {
         if (negResp["Capabilities"] & SMB2_GLOBAL_CAP_LARGE_MTU) == SMB2_GLOBAL_CAP_LARGE_MTU {
             self._Connection["SupportsMultiCredit"] = true
 
-        if self._Connection["Dialect"] == SMB2_DIALECT_30 {
+        if self._Connection["Dialect"] >= SMB2_DIALECT_30 {
             // Switching to the right packet format
             self.SMB_PACKET = SMB3Packet
             if (negResp["Capabilities"] & SMB2_GLOBAL_CAP_DIRECTORY_LEASING) == SMB2_GLOBAL_CAP_DIRECTORY_LEASING {
@@ -491,12 +881,116 @@ CHANNEL = {
                 self._Connection["SupportsMultiChannel"] = true
             if (negResp["Capabilities"] & SMB2_GLOBAL_CAP_PERSISTENT_HANDLES) == SMB2_GLOBAL_CAP_PERSISTENT_HANDLES {
                 self._Connection["SupportsPersistentHandles"] = true
-            if (negResp["Capabilities"] & SMB2_GLOBAL_CAP_ENCRYPTION) == SMB2_GLOBAL_CAP_ENCRYPTION {
+            if self._Connection["Dialect"] == SMB2_DIALECT_311 {
+                // The cipher negotiate context says it all
+                self._Connection["SupportsEncryption"] = self._Connection["CipherId"] != 0
+            elif (negResp["Capabilities"] & SMB2_GLOBAL_CAP_ENCRYPTION) == SMB2_GLOBAL_CAP_ENCRYPTION {
                 self._Connection["SupportsEncryption"] = true
+                self._Connection["CipherId"] = SMB2_ENCRYPTION_AES128_CCM
 
             self._Connection["ServerCapabilities"] = negResp["Capabilities"]
             self._Connection["ServerSecurityMode"] = negResp["SecurityMode"]
 
+     func (self TYPE) __addNegotiateContexts(negSession, dialectCount interface{}){
+        // [MS-SMB2] 2.2.3.1, what we offer for 3.1.1
+        salt = b''.join([struct.pack('B', rand.randint(0, 255)) for _ in range(32)])
+        preauth = SMB2PreauthIntegrityCapabilities()
+        preauth["HashAlgorithmCount"] = 1
+        preauth["SaltLength"] = len(salt)
+        preauth["HashAlgorithms"] = struct.pack('<H', SMB2_PREAUTH_INTEGRITY_SHA512)
+        preauth["Salt"] = salt
+
+        encryption = SMB2EncryptionCapabilities()
+        encryption["CipherCount"] = len(self.EncryptionAlgorithmList)
+        encryption["Ciphers"] = b''.join([struct.pack('<H', cipher) for cipher in self.EncryptionAlgorithmList])
+
+        signing = SMB2SigningCapabilities()
+        signing["SigningAlgorithmCount"] = len(self.SigningAlgorithmList)
+        signing["SigningAlgorithms"] = b''.join([struct.pack('<H', algorithm) for algorithm in self.SigningAlgorithmList])
+
+        contexts = [(SMB2_PREAUTH_INTEGRITY_CAPABILITIES, preauth.getData()),
+                    (SMB2_ENCRYPTION_CAPABILITIES, encryption.getData()),
+                    (SMB2_SIGNING_CAPABILITIES, signing.getData()),
+                    (SMB2_NETNAME_NEGOTIATE_CONTEXT_ID, self._Connection["ServerName"].encode("utf-16le"))]
+
+        // Contexts go 8 bytes aligned, counting from the SMB2 header
+        contextList = b''
+        for contextType, data in contexts:
+            if len(contextList) % 8 {
+                contextList += b'\x00' * (8 - len(contextList) % 8)
+            context = SMB2NegotiateContext()
+            context["ContextType"] = contextType
+            context["DataLength"] = len(data)
+            context["Data"] = data
+            contextList += context.getData()
+
+        // SMB2 header + fixed part of the request + the dialects
+        offset = 64 + 36 + dialectCount * 2
+        negSession["Padding"] = b'\x00' * ((8 - offset % 8) % 8)
+        negSession["NegotiateContextOffset"] = offset + len(negSession["Padding"])
+        negSession["NegotiateContextCount"] = len(contexts)
+        negSession["NegotiateContextList"] = contextList
+
+     func (self TYPE) __processNegotiateContexts(negResp, data interface{}){
+        // [MS-SMB2] 3.2.5.2, what the server picked for 3.1.1
+        data = data[negResp["NegotiateContextOffset"] - 64:]
+        for i in range(negResp["NegotiateContextCount"]):
+            context = SMB2NegotiateContext(data)
+            if context["ContextType"] == SMB2_PREAUTH_INTEGRITY_CAPABILITIES {
+                preauth = SMB2PreauthIntegrityCapabilities(context["Data"])
+                self._Connection["PreauthIntegrityHashId"] = struct.unpack('<H', preauth["HashAlgorithms"][:2])[0]
+                if self._Connection["PreauthIntegrityHashId"] != SMB2_PREAUTH_INTEGRITY_SHA512 {
+                    raise SessionError(STATUS_NOT_IMPLEMENTED)
+            elif context["ContextType"] == SMB2_ENCRYPTION_CAPABILITIES {
+                encryption = SMB2EncryptionCapabilities(context["Data"])
+                if encryption["CipherCount"] > 0 {
+                    self._Connection["CipherId"] = struct.unpack('<H', encryption["Ciphers"][:2])[0]
+            elif context["ContextType"] == SMB2_SIGNING_CAPABILITIES {
+                signing = SMB2SigningCapabilities(context["Data"])
+                if signing["SigningAlgorithmCount"] > 0 {
+                    self._Connection["SigningAlgorithmId"] = struct.unpack('<H', signing["SigningAlgorithms"][:2])[0]
+            nextContext = 8 + context["DataLength"]
+            data = data[nextContext + (8 - nextContext % 8) % 8:]
+
+     func (self TYPE) __updatePreauthIntegrityHash(data interface{}){
+        // [MS-SMB2] 3.2.5.3.1, every SESSION_SETUP request and every response but the last go into the hash
+        if self._Connection["Dialect"] == SMB2_DIALECT_311 {
+            self._Session["PreauthIntegrityHashValue"] = hashlib.sha512(
+                self._Session["PreauthIntegrityHashValue"] + data).digest()
+
+     func (self TYPE) __generateSessionKeys(fullSessionKey = nil interface{}){
+        // [MS-SMB2] 3.2.5.3.1, key derivation for dialects 3.x once the session is set up
+        if self._Connection["Dialect"] < SMB2_DIALECT_30 or len(self._Session["SessionKey"]) == 0 {
+            return
+
+        sessionKey = self._Session["SessionKey"]
+        if self._Connection["Dialect"] == SMB2_DIALECT_311 {
+            context = self._Session["PreauthIntegrityHashValue"]
+            signingKey = (b"SMBSigningKey\x00", context)
+            applicationKey = (b"SMBAppKey\x00", context)
+            encryptionKey = (b"SMBC2SCipherKey\x00", context)
+            decryptionKey = (b"SMBS2CCipherKey\x00", context)
+        } else  {
+            signingKey = (b"SMB2AESCMAC\x00", b"SmbSign\x00")
+            applicationKey = (b"SMB2APP\x00", b"SmbRpc\x00")
+            encryptionKey = (b"SMB2AESCCM\x00", b"ServerIn \x00")
+            decryptionKey = (b"SMB2AESCCM\x00", b"ServerOut\x00")
+
+        self._Session["SigningKey"] = crypto.KDF_CounterMode(sessionKey, signingKey[0], signingKey[1], 128)
+        self._Session["ApplicationKey"] = crypto.KDF_CounterMode(sessionKey, applicationKey[0], applicationKey[1], 128)
+
+        if self._Connection["SupportsEncryption"] is true {
+            // AES-256 ciphers want the whole session key and twice the key length
+            if self._Connection["CipherId"] in (SMB2_ENCRYPTION_AES256_CCM, SMB2_ENCRYPTION_AES256_GCM) {
+                keyLength = 256
+                if fullSessionKey is not nil {
+                    sessionKey = fullSessionKey
+            } else  {
+                keyLength = 128
+            self._Session["SessionFlags"] |= SMB2_SESSION_FLAG_ENCRYPT_DATA
+            self._Session["EncryptionKey"] = crypto.KDF_CounterMode(sessionKey, encryptionKey[0], encryptionKey[1], keyLength)
+            self._Session["DecryptionKey"] = crypto.KDF_CounterMode(sessionKey, decryptionKey[0], decryptionKey[1], keyLength)
+
      func (self TYPE) getCredentials(){
         return (
             self.__userName,
@@ -508,6 +1002,31 @@ CHANNEL = {
             self.__TGT, 
             self.__TGS)
 
+     func (self TYPE) setKerberosTickets(TGT, TGS interface{}){
+        // Fresher tickets (e.g. a renewed TGT) for the next time we log in again
+        self.__TGT = TGT
+        self.__TGS = TGS
+
+     func (self TYPE) reauthenticate(){
+        // SESSION_SETUP on the SessionId we already have, with the tickets we have now, so the server
+        // doesn't expire the session when the old ticket does (MS-SMB2 3.2.4.2.3). The session keeps
+        // its keys
+        if self._doKerberos is not true or self._Session["SessionID"] == 0 {
+            raise SessionError(STATUS_NOT_SUPPORTED)
+        self.__reauthenticating = true
+        try:
+            return self.kerberosLogin(self.__userName, self.__password, self.__domain, self.__lmhash,
+                                      self.__nthash, self.__aesKey, self.__kdc, self.__TGT, self.__TGS)
+        finally:
+            self.__reauthenticating = false
+
+     func (self TYPE) scheduleReauthentication(){
+        // Can be called from any thread. With the reader running it's safe to do it right away,
+        // otherwise it's done before the next request goes out
+        if self.__reader is not nil {
+            return self.reauthenticate()
+        self.__reauthPending = true
+
      func (self TYPE) kerberosLogin(user, password, domain = "", lmhash = "", nthash = "", aesKey='', kdcHost = "", TGT=nil, TGS=nil interface{}){
         // If TGT or TGS are specified, they are in the form of:
         // TGS["KDC_REP"] = the response from the server
@@ -541,6 +1060,8 @@ CHANNEL = {
            sessionSetup["SecurityMode"] = SMB2_NEGOTIATE_SIGNING_ENABLED
 
         sessionSetup["Flags"] = 0
+        // When reconnecting, this lets the server tear down the old session (and keep our durable opens)
+        sessionSetup["PreviousSessionId"] = self.__previousSessionId
         //sessionSetup["Capabilities"] = SMB2_GLOBAL_CAP_LARGE_MTU | SMB2_GLOBAL_CAP_LEASING | SMB2_GLOBAL_CAP_DFS
 
         // Importing down here so pyasn1 is not required if kerberos is not used.
@@ -556,6 +1077,8 @@ CHANNEL = {
         if TGT == nil {
             if TGS == nil {
                 tgt, cipher, oldSessionKey, sessionKey = getKerberosTGT(userName, password, domain, lmhash, nthash, aesKey, kdcHost)
+                // Kept so getCredentials gives it (for reconnecting, the ccache, etc)
+                self.__TGT = {'KDC_REP': tgt, 'cipher': cipher, 'oldSessionKey': oldSessionKey, 'sessionKey': sessionKey}
         } else  {
             tgt = TGT["KDC_REP"]
             cipher = TGT["cipher"]
@@ -580,6 +1103,7 @@ CHANNEL = {
         if TGS == nil {
             serverName = Principal('cifs/%s' % (self._Connection["ServerName"]), type=constants.PrincipalNameType.NT_SRV_INST.value)
             tgs, cipher, oldSessionKey, sessionKey = getKerberosTGS(serverName, domain, kdcHost, tgt, cipher, sessionKey)
+            self.__TGS = {'KDC_REP': tgs, 'cipher': cipher, 'oldSessionKey': oldSessionKey, 'sessionKey': sessionKey}
         } else  {
             tgs = TGS["KDC_REP"]
             cipher = TGS["cipher"]
@@ -637,7 +1161,17 @@ CHANNEL = {
         packet["Command"] = SMB2_SESSION_SETUP
         packet["Data"]    = sessionSetup
 
+        if self.__reauthenticating is true {
+            // Same session, same keys. The preauth hash is only for new sessions
+            ans = self.recvSMB(self.sendSMB(packet))
+            if ans.isValidAnswer(STATUS_SUCCESS) {
+                self._Session["UserCredentials"] = (user, password, domain, lmhash, nthash)
+                return true
+            raise Exception("Unsuccessful Login")
+
+        self._Session["PreauthIntegrityHashValue"] = self._Connection["PreauthIntegrityHashValue"]
         packetID = self.sendSMB(packet)
+        self.__updatePreauthIntegrityHash(packet.getData())
         ans = self.recvSMB(packetID)
         if ans.isValidAnswer(STATUS_SUCCESS) {
             self._Session["SessionID"]       = ans["SessionID"]
@@ -646,22 +1180,15 @@ CHANNEL = {
             self._Session["Connection"]      = self._NetBIOSSession.get_socket()
 
             self._Session["SessionKey"]  = sessionKey.contents[:16]
-            if self._Session["SigningRequired"] is true and self._Connection["Dialect"] == SMB2_DIALECT_30 {
-                self._Session["SigningKey"]  = crypto.KDF_CounterMode(self._Session["SessionKey"], b"SMB2AESCMAC\x00", b"SmbSign\x00", 128)
 
             // Do not encrypt anonymous connections
             if user == '' {
                 self._Connection["SupportsEncryption"] = false
 
-            // Calculate the key derivations for dialect 3.0
+            // Calculate the key derivations for dialects 3.x
             if self._Session["SigningRequired"] is true {
                 self._Session["SigningActivated"] = true
-            if self._Connection["Dialect"] == SMB2_DIALECT_30 and self._Connection["SupportsEncryption"] is true {
-                // SMB 3.0. Encryption available. Let's enforce it if we have AES CCM available
-                self._Session["SessionFlags"] |= SMB2_SESSION_FLAG_ENCRYPT_DATA
-                self._Session["ApplicationKey"]  = crypto.KDF_CounterMode(self._Session["SessionKey"], b"SMB2APP\x00", b"SmbRpc\x00", 128)
-                self._Session["EncryptionKey"]   = crypto.KDF_CounterMode(self._Session["SessionKey"], b"SMB2AESCCM\x00", b"ServerIn \x00", 128)
-                self._Session["DecryptionKey"]   = crypto.KDF_CounterMode(self._Session["SessionKey"], b"SMB2AESCCM\x00", b"ServerOut\x00", 128)
+            self.__generateSessionKeys(sessionKey.contents)
        
             return true
         } else  {
@@ -704,6 +1231,8 @@ CHANNEL = {
            sessionSetup["SecurityMode"] = SMB2_NEGOTIATE_SIGNING_ENABLED
 
         sessionSetup["Flags"] = 0
+        // When reconnecting, this lets the server tear down the old session (and keep our durable opens)
+        sessionSetup["PreviousSessionId"] = self.__previousSessionId
         //sessionSetup["Capabilities"] = SMB2_GLOBAL_CAP_LARGE_MTU | SMB2_GLOBAL_CAP_LEASING | SMB2_GLOBAL_CAP_DFS
 
         // Let's build a NegTokenInit with the NTLMSSP
@@ -731,9 +1260,12 @@ CHANNEL = {
         packet["Command"] = SMB2_SESSION_SETUP
         packet["Data"]    = sessionSetup
 
+        self._Session["PreauthIntegrityHashValue"] = self._Connection["PreauthIntegrityHashValue"]
         packetID = self.sendSMB(packet)
+        self.__updatePreauthIntegrityHash(packet.getData())
         ans = self.recvSMB(packetID)
         if ans.isValidAnswer(STATUS_MORE_PROCESSING_REQUIRED) {
+            self.__updatePreauthIntegrityHash(ans.getData())
             self._Session["SessionID"]       = ans["SessionID"]
             self._Session["SigningRequired"] = self._Connection["RequireSigning"]
             self._Session["UserCredentials"] = (user, password, domain, lmhash, nthash)
@@ -779,8 +1311,6 @@ CHANNEL = {
    
             if exportedSessionKey is not nil { 
                 self._Session["SessionKey"]  = exportedSessionKey
-                if self._Session["SigningRequired"] is true and self._Connection["Dialect"] == SMB2_DIALECT_30 {
-                    self._Session["SigningKey"]  = crypto.KDF_CounterMode(exportedSessionKey, b"SMB2AESCMAC\x00", b"SmbSign\x00", 128)
 
             respToken2 = SPNEGO_NegTokenResp()
             respToken2["ResponseToken"] = type3.getData()
@@ -790,6 +1320,7 @@ CHANNEL = {
             sessionSetup["Buffer"]               = respToken2.getData()
 
             packetID = self.sendSMB(packet)
+            self.__updatePreauthIntegrityHash(packet.getData())
             packet = self.recvSMB(packetID)
             try:
                 if packet.isValidAnswer(STATUS_SUCCESS) {
@@ -801,15 +1332,10 @@ CHANNEL = {
                     if user == '' {
                         self._Connection["SupportsEncryption"] = false
 
-                    // Calculate the key derivations for dialect 3.0
+                    // Calculate the key derivations for dialects 3.x
                     if self._Session["SigningRequired"] is true {
                         self._Session["SigningActivated"] = true
-                    if self._Connection["Dialect"] == SMB2_DIALECT_30 and self._Connection["SupportsEncryption"] is true {
-                        // SMB 3.0. Encryption available. Let's enforce it if we have AES CCM available
-                        self._Session["SessionFlags"] |= SMB2_SESSION_FLAG_ENCRYPT_DATA
-                        self._Session["ApplicationKey"]  = crypto.KDF_CounterMode(exportedSessionKey, b"SMB2APP\x00", b"SmbRpc\x00", 128)
-                        self._Session["EncryptionKey"]   = crypto.KDF_CounterMode(exportedSessionKey, b"SMB2AESCCM\x00",b"ServerIn \x00", 128)
-                        self._Session["DecryptionKey"]   = crypto.KDF_CounterMode(exportedSessionKey, b"SMB2AESCCM\x00",b"ServerOut\x00", 128)
+                    self.__generateSessionKeys()
  
                     return true
             except:
@@ -835,9 +1361,22 @@ CHANNEL = {
             // Already connected, no need to reconnect
             treeEntry =  self._Session["TreeConnectTable"][share]
             treeEntry["NumberOfUses"] += 1
-            self._Session["TreeConnectTable"][treeEntry["TreeConnectId"]]["NumberOfUses"] += 1
-            return treeEntry["TreeConnectId"]
+            self._Session["TreeConnectTable"][treeEntry["ClientTreeId"]]["NumberOfUses"] += 1
+            return treeEntry["ClientTreeId"]
+
+        treeEntry = copy.deepcopy(TREE_CONNECT)
+        treeEntry["ShareName"] = share
+        treeId = self.__treeConnect(treeEntry)
+        treeEntry["NumberOfUses"] += 1
+        treeEntry["ClientTreeId"] = treeId
 
+        self._Session["TreeConnectTable"][treeId] = treeEntry
+        self._Session["TreeConnectTable"][share]  = treeEntry
+
+        return treeId
+
+     func (self TYPE) __treeConnect(treeEntry interface{}){
+        share = treeEntry["ShareName"]
         //path = share
         try:
             _, _, _, _, sockaddr = socket.getaddrinfo(self._Connection["ServerIP"], 80, 0, 0, socket.IPPROTO_TCP)[0]
@@ -857,17 +1396,14 @@ CHANNEL = {
         packet = self.recvSMB(packetID)
         if packet.isValidAnswer(STATUS_SUCCESS) {
            treeConnectResponse = SMB2TreeConnect_Response(packet["Data"])
-           treeEntry = copy.deepcopy(TREE_CONNECT)
-           treeEntry["ShareName"]     = share
            treeEntry["TreeConnectId"] = packet["TreeID"]
            treeEntry["Session"]       = packet["SessionID"]
-           treeEntry["NumberOfUses"] += 1
            if (treeConnectResponse["Capabilities"] & SMB2_SHARE_CAP_DFS) == SMB2_SHARE_CAP_DFS {
                treeEntry["IsDfsShare"] = true
            if (treeConnectResponse["Capabilities"] & SMB2_SHARE_CAP_CONTINUOUS_AVAILABILITY) == SMB2_SHARE_CAP_CONTINUOUS_AVAILABILITY {
                treeEntry["IsCAShare"] = true
 
-           if self._Connection["Dialect"] == SMB2_DIALECT_30 {
+           if self._Connection["Dialect"] >= SMB2_DIALECT_30 {
                if (self._Connection["SupportsEncryption"] is true) and ((treeConnectResponse["ShareFlags"] & SMB2_SHAREFLAG_ENCRYPT_DATA) == SMB2_SHAREFLAG_ENCRYPT_DATA) {
                    treeEntry["EncryptData"] = true
                    // ToDo: This and what follows
@@ -877,9 +1413,6 @@ CHANNEL = {
                if (treeConnectResponse["Capabilities"] & SMB2_SHARE_CAP_SCALEOUT) == SMB2_SHARE_CAP_SCALEOUT {
                    treeEntry["IsScaleoutShare"] = true
 
-           self._Session["TreeConnectTable"][packet["TreeID"]] = treeEntry
-           self._Session["TreeConnectTable"][share]            = treeEntry
-
            return packet["TreeID"] 
 
      func (self TYPE) disconnectTree(treeId interface{}){
@@ -967,6 +1500,23 @@ CHANNEL = {
         } else  {
             smb2Create["Buffer"]               = "\x00"
 
+        // Ask for a durable handle we can reclaim if the connection drops. Pipes and directories
+        // go away with the connection anyway
+        treeEntry = self._Session["TreeConnectTable"][treeId]
+        createGuid = ""
+        if self.RequestDurableHandles is true and self._Connection["Dialect"] >= SMB2_DIALECT_30 and \
+                treeEntry["ShareName"].upper() != 'IPC$' and (creationOptions & FILE_DIRECTORY_FILE) == 0:
+            createGuid = uuid.generate()
+            durableRequest = SMB2_CREATE_DURABLE_HANDLE_REQUEST_V2()
+            durableRequest["Timeout"]    = self.DurableHandleTimeout
+            durableRequest["CreateGuid"] = createGuid
+            if treeEntry["IsCAShare"] is true {
+                durableRequest["Flags"] = SMB2_DHANDLE_FLAG_PERSISTENT
+            elif oplockLevel == SMB2_OPLOCK_LEVEL_NONE and self.__reader is not nil {
+                oplockLevel = self.DurableOplockLevel
+                smb2Create["RequestedOplockLevel"] = oplockLevel
+            createContexts = self.__addCreateContext(createContexts, b'DH2Q', durableRequest.getData())
+
         if createContexts is not nil {
             smb2Create["Buffer"] += createContexts
             smb2Create["CreateContextsOffset"] = len(SMB2Packet()) + SMB2Create.SIZE + smb2Create["NameLength"]
@@ -985,21 +1535,29 @@ CHANNEL = {
             openFile = copy.deepcopy(OPEN)
             openFile["FileID"]      = createResponse["FileID"]
             openFile["TreeConnect"] = treeId
-            openFile["Oplocklevel"] = oplockLevel
+            openFile["Oplocklevel"] = createResponse["OplockLevel"]
             openFile["Durable"]     = false
             openFile["ResilientHandle"]    = false
             openFile["LastDisconnectTime"] = 0
             openFile["FileName"] = pathName
+            openFile["CreateName"] = fileName
+            openFile["ImpersonationLevel"] = impersonationLevel
 
             // ToDo: Complete the OperationBuckets
-            if self._Connection["Dialect"] == SMB2_DIALECT_30 {
-                openFile["DesiredAccess"]     = oplockLevel
-                openFile["ShareMode"]         = oplockLevel
-                openFile["CreateOptions"]     = oplockLevel
-                openFile["FileAttributes"]    = oplockLevel
-                openFile["CreateDisposition"] = oplockLevel
-
-            // ToDo: Process the contexts            
+            if self._Connection["Dialect"] >= SMB2_DIALECT_30 {
+                openFile["DesiredAccess"]     = desiredAccess
+                openFile["ShareMode"]         = shareMode
+                openFile["CreateOptions"]     = creationOptions
+                openFile["FileAttributes"]    = fileAttributes
+                openFile["CreateDisposition"] = creationDisposition
+                openFile["CreateGuid"]        = createGuid
+
+            contexts = self.__parseCreateContexts(createResponse)
+            if b'DH2Q' in contexts {
+                durableResponse = SMB2_CREATE_DURABLE_HANDLE_RESPONSE_V2(contexts[b'DH2Q'])
+                openFile["Durable"] = true
+                openFile["IsPersistent"] = (durableResponse["Flags"] & SMB2_DHANDLE_FLAG_PERSISTENT) == SMB2_DHANDLE_FLAG_PERSISTENT
+
             self._Session["OpenTable"][createResponse["FileID"].getData()] = openFile
 
             // The client MUST generate a handle for the Open, and it MUST 
@@ -1007,6 +1565,88 @@ CHANNEL = {
             // In our case, str(FileID)
             return createResponse["FileID"].getData()
 
+     func (self TYPE) __addCreateContext(createContexts, name, data interface{}){
+        // Contexts are 8 byte aligned and chained through the Next field. The name is the
+        // 4 byte tag (e.g. b'DH2Q'), the SMB2_CREATE_* constants are shadowed by the structures
+        createContext = SMB2CreateContext()
+        createContext["NameOffset"] = 16
+        createContext["NameLength"] = 4
+        createContext["DataOffset"] = 24
+        createContext["DataLength"] = len(data)
+        createContext["Buffer"]     = name + b'\x00'*4 + data
+
+        if createContexts == nil or len(createContexts) == 0 {
+            return createContext.getData()
+
+        last = 0
+        while true:
+            nextOffset = struct.unpack('<L', createContexts[last:last+4])[0]
+            if nextOffset == 0 {
+                break
+            last += nextOffset
+        createContexts += b'\x00' * ((8 - len(createContexts) % 8) % 8)
+        createContexts = createContexts[:last] + struct.pack('<L', len(createContexts) - last) + createContexts[last+4:]
+        return createContexts + createContext.getData()
+
+     func (self TYPE) __parseCreateContexts(createResponse interface{}){
+        // Returns the context data indexed by name
+        contexts = {}
+        if createResponse["CreateContextsLength"] == 0 {
+            return contexts
+        data = createResponse["Buffer"]
+        offset = 0
+        while offset < len(data):
+            createContext = SMB2CreateContext(data[offset:])
+            nameOffset = offset + createContext["NameOffset"]
+            dataOffset = offset + createContext["DataOffset"]
+            contexts[data[nameOffset:nameOffset+createContext["NameLength"]]] = data[dataOffset:dataOffset+createContext["DataLength"]]
+            if createContext["Next"] == 0 {
+                break
+            offset += createContext["Next"]
+        return contexts
+
+     func (self TYPE) __reclaimOpen(openFile interface{}){
+        // [MS-SMB2] 3.2.4.4, reestablishing a durable open
+        packet = self.SMB_PACKET()
+        packet["Command"] = SMB2_CREATE
+        packet["TreeID"]  = openFile["TreeConnect"]
+        if self._Session["TreeConnectTable"][openFile["TreeConnect"]]["IsDfsShare"] is true {
+            packet["Flags"] = SMB2_FLAGS_DFS_OPERATIONS
+
+        durableReconnect = SMB2_CREATE_DURABLE_HANDLE_RECONNECT_V2()
+        durableReconnect["FileID"]     = openFile["FileID"].getData()
+        durableReconnect["CreateGuid"] = openFile["CreateGuid"]
+        if openFile["IsPersistent"] is true {
+            durableReconnect["Flags"] = SMB2_DHANDLE_FLAG_PERSISTENT
+        createContexts = self.__addCreateContext(nil, b'DH2C', durableReconnect.getData())
+
+        smb2Create = SMB2Create()
+        smb2Create["SecurityFlags"]        = 0
+        smb2Create["RequestedOplockLevel"] = openFile["Oplocklevel"]
+        smb2Create["ImpersonationLevel"]   = openFile["ImpersonationLevel"]
+        smb2Create["DesiredAccess"]        = openFile["DesiredAccess"]
+        smb2Create["FileAttributes"]       = openFile["FileAttributes"]
+        smb2Create["ShareAccess"]          = openFile["ShareMode"]
+        smb2Create["CreateDisposition"]    = openFile["CreateDisposition"]
+        smb2Create["CreateOptions"]        = openFile["CreateOptions"]
+        smb2Create["NameLength"]           = len(openFile["CreateName"])*2
+        if openFile["CreateName"] != '' {
+            smb2Create["Buffer"]           = openFile["CreateName"].encode("utf-16le")
+        } else  {
+            smb2Create["Buffer"]           = "\x00"
+        smb2Create["Buffer"] += createContexts
+        smb2Create["CreateContextsOffset"] = len(SMB2Packet()) + SMB2Create.SIZE + smb2Create["NameLength"]
+        smb2Create["CreateContextsLength"] = len(createContexts)
+        packet["Data"] = smb2Create
+
+        packetID = self.sendSMB(packet)
+        ans = self.recvSMB(packetID)
+        if ans.isValidAnswer(STATUS_SUCCESS) {
+            createResponse = SMB2Create_Response(ans["Data"])
+            openFile["FileID"]      = createResponse["FileID"]
+            openFile["Oplocklevel"] = createResponse["OplockLevel"]
+            return true
+
      func (self TYPE) close(treeId, fileId interface{}){
         if (treeId in self._Session["TreeConnectTable"]) is false {
             raise SessionError(STATUS_INVALID_PARAMETER)
@@ -1039,6 +1679,20 @@ CHANNEL = {
         // This function should NOT be used for reading files directly, but another higher
         // level function should be used that will break the read into smaller pieces
 
+        packet, maxBytesToRead = self.__readRequest(treeId, fileId, offset, bytesToRead)
+
+        packetID = self.sendSMB(packet)
+        ans = self.recvSMB(packetID)
+
+        if ans.isValidAnswer(STATUS_SUCCESS) {
+            readResponse = SMB2Read_Response(ans["Data"])
+            retData = readResponse["Buffer"]
+            if readResponse["DataRemaining"] > 0 {
+                retData += self.read(treeId, fileId, offset+len(retData), readResponse["DataRemaining"], waitAnswer)
+            return retData
+
+     func (self TYPE) __readRequest(treeId, fileId, offset, bytesToRead interface{}){
+        // Builds the SMB2_READ packet, returns it along with the amount of bytes it asks for
         if (treeId in self._Session["TreeConnectTable"]) is false {
             raise SessionError(STATUS_INVALID_PARAMETER)
         if (fileId in self._Session["OpenTable"]) is false {
@@ -1065,15 +1719,7 @@ CHANNEL = {
         smbRead["Offset"]   = offset
         packet["Data"] = smbRead
 
-        packetID = self.sendSMB(packet)
-        ans = self.recvSMB(packetID)
-
-        if ans.isValidAnswer(STATUS_SUCCESS) {
-            readResponse = SMB2Read_Response(ans["Data"])
-            retData = readResponse["Buffer"]
-            if readResponse["DataRemaining"] > 0 {
-                retData += self.read(treeId, fileId, offset+len(retData), readResponse["DataRemaining"], waitAnswer)
-            return retData
+        return packet, maxBytesToRead
        
      func (self TYPE) write(treeId, fileId, data, offset = 0, bytesToWrite = 0, waitAnswer = true interface{}){
         // IMPORTANT NOTE: As you can see, this was coded as a recursive function
@@ -1081,6 +1727,23 @@ CHANNEL = {
         // This function should NOT be used for writing directly to files, but another higher
         // level function should be used that will break the writes into smaller pieces
 
+        packet, maxBytesToWrite = self.__writeRequest(treeId, fileId, data, offset, bytesToWrite)
+
+        packetID = self.sendSMB(packet)
+        if waitAnswer is true {
+            ans = self.recvSMB(packetID)
+        } else  {
+            return maxBytesToWrite
+
+        if ans.isValidAnswer(STATUS_SUCCESS) {
+            writeResponse = SMB2Write_Response(ans["Data"])
+            bytesWritten = writeResponse["Count"]
+            if bytesWritten < bytesToWrite {
+                bytesWritten += self.write(treeId, fileId, data[bytesWritten:], offset+bytesWritten, bytesToWrite-bytesWritten, waitAnswer)
+            return bytesWritten
+
+     func (self TYPE) __writeRequest(treeId, fileId, data, offset, bytesToWrite interface{}){
+        // Builds the SMB2_WRITE packet, returns it along with the amount of bytes it carries
         if (treeId in self._Session["TreeConnectTable"]) is false {
             raise SessionError(STATUS_INVALID_PARAMETER)
         if (fileId in self._Session["OpenTable"]) is false {
@@ -1108,18 +1771,249 @@ CHANNEL = {
         smbWrite["Buffer"] = data[:maxBytesToWrite]
         packet["Data"] = smbWrite
 
-        packetID = self.sendSMB(packet)
-        if waitAnswer is true {
-            ans = self.recvSMB(packetID)
-        } else  {
-            return maxBytesToWrite
+        return packet, maxBytesToWrite
 
-        if ans.isValidAnswer(STATUS_SUCCESS) {
-            writeResponse = SMB2Write_Response(ans["Data"])
-            bytesWritten = writeResponse["Count"]
-            if bytesWritten < bytesToWrite {
-                bytesWritten += self.write(treeId, fileId, data[bytesWritten:], offset+bytesWritten, bytesToWrite-bytesWritten, waitAnswer)
-            return bytesWritten
+     func (self TYPE) __canSend(packet, outstanding interface{}){
+        // Another request can go while the window isn't full and there are credits for it. With nothing
+        // in flight it always goes, the server will tell us if we were wrong about the credits
+        if len(outstanding) == 0 {
+            return true
+        if len(outstanding) >= self._Connection["IOWindow"] {
+            return false
+        return self._Connection["Credits"] >= max(packet["CreditCharge"], 1)
+
+     func (self TYPE) __drain(outstanding interface{}){
+        // Collects (and drops) the answers for requests still in flight, so they don't show up later
+        for request in outstanding:
+            try:
+                self.recvSMB(request[0])
+            except Exception:
+                pass
+        del outstanding[:]
+
+     func (self TYPE) pipelinedRead(treeId, fileId, offset, bytesToRead, callback interface{}){
+        // Reads bytesToRead bytes (or up to the end of the file) keeping up to IOWindow SMB2_READ requests
+        // in flight. callback gets the data in order. Returns the amount of bytes read
+        outstanding = []
+        nextOffset = offset
+        endOffset = offset + bytesToRead
+        bytesRead = 0
+        try:
+            while nextOffset < endOffset or len(outstanding) > 0:
+                while nextOffset < endOffset:
+                    packet, toRead = self.__readRequest(treeId, fileId, nextOffset, endOffset - nextOffset)
+                    if self.__canSend(packet, outstanding) is false {
+                        break
+                    outstanding.append((self.sendSMB(packet), nextOffset, toRead))
+                    nextOffset += toRead
+
+                packetID, readOffset, toRead = outstanding.pop(0)
+                try:
+                    ans = self.recvSMB(packetID)
+                    ans.isValidAnswer(STATUS_SUCCESS)
+                    data = SMB2Read_Response(ans["Data"])["Buffer"]
+                except SessionError as e:
+                    if e.get_error_code() != STATUS_END_OF_FILE {
+                        raise
+                    data = b''
+
+                // Short reads are filled in one at a time. If there's nothing else, the file
+                // got shorter since we asked
+                while 0 < len(data) < toRead:
+                    try:
+                        moreData = self.read(treeId, fileId, readOffset + len(data), toRead - len(data))
+                    except SessionError as e:
+                        if e.get_error_code() != STATUS_END_OF_FILE {
+                            raise
+                        moreData = b''
+                    if len(moreData) == 0 {
+                        break
+                    data += moreData
+
+                if len(data) > 0 {
+                    callback(data)
+                    bytesRead += len(data)
+                if len(data) < toRead {
+                    self.__drain(outstanding)
+                    break
+        except:
+            self.__drain(outstanding)
+            raise
+
+        return bytesRead
+
+     func (self TYPE) pipelinedWrite(treeId, fileId, offset, callback interface{}){
+        // Writes what callback(size) returns, until it returns nothing, keeping up to IOWindow SMB2_WRITE
+        // requests in flight. Returns the amount of bytes written
+        outstanding = []
+        writeOffset = offset
+        pending = b''
+        finished = false
+        try:
+            while not finished or len(pending) > 0 or len(outstanding) > 0:
+                while not finished or len(pending) > 0:
+                    if len(pending) == 0 {
+                        pending = callback(self._Connection["MaxWriteSize"])
+                        if not pending {
+                            finished = true
+                            pending = b''
+                            break
+                    packet, toWrite = self.__writeRequest(treeId, fileId, pending, writeOffset, len(pending))
+                    if self.__canSend(packet, outstanding) is false {
+                        break
+                    outstanding.append((self.sendSMB(packet), writeOffset, pending[:toWrite]))
+                    writeOffset += toWrite
+                    pending = pending[toWrite:]
+
+                if len(outstanding) == 0 {
+                    continue
+
+                packetID, dataOffset, data = outstanding.pop(0)
+                ans = self.recvSMB(packetID)
+                ans.isValidAnswer(STATUS_SUCCESS)
+                bytesWritten = SMB2Write_Response(ans["Data"])["Count"]
+                if bytesWritten < len(data) {
+                    // Short write, the rest goes on its own
+                    self.write(treeId, fileId, data[bytesWritten:], dataOffset + bytesWritten, len(data) - bytesWritten)
+        except:
+            self.__drain(outstanding)
+            raise
+
+        return writeOffset - offset
+
+     func (self TYPE) setIOWindow(window interface{}){
+        // How many READ/WRITE requests can be in flight when moving files around. 1 turns pipelining off
+        self._Connection["IOWindow"] = max(1, window)
+
+     func (self TYPE) getIOWindow(){
+        return self._Connection["IOWindow"]
+
+     func (self TYPE) setDurableHandles(enabled, timeout = 0, oplockLevel = SMB2_OPLOCK_LEVEL_BATCH interface{}){
+        self.RequestDurableHandles = enabled
+        self.DurableHandleTimeout = timeout
+        self.DurableOplockLevel = oplockLevel
+        if enabled is true and oplockLevel != SMB2_OPLOCK_LEVEL_NONE {
+            // Other clients opening the file wait until we acknowledge the oplock break. Without the
+            // reader that only happens the next time something is read, so the reader takes care of it
+            self.startReader()
+
+     func (self TYPE) setAutoReconnect(enabled, attempts = 3 interface{}){
+        self.AutoReconnect = enabled
+        self.ReconnectAttempts = attempts
+
+     func (self TYPE) __canReconnect(){
+        return self.AutoReconnect is true and self.__reconnecting is false and self.__UDP == 0 and \
+               self._Session["SessionID"] != 0
+
+     func (self TYPE) reconnect(){
+        // Connects again, logs in the same way, reconnects the trees, reclaims the durable opens and
+        // sends again what was in flight and can run twice. Tree and file ids the caller has keep working
+        self.__reconnecting = true
+        outstanding = sorted(self._Connection["OutstandingRequests"].items(), key=lambda request: request[0])
+        previousSessionId = self._Session["SessionID"]
+        try:
+            attempts = max(self.ReconnectAttempts, 1)
+            for attempt in range(attempts):
+                try:
+                    self.__reconnect(previousSessionId)
+                    break
+                except (socket.error, nmb.NetBIOSError, nmb.NetBIOSTimeout) as e:
+                    if attempt == attempts - 1 {
+                        raise
+                    LOG.debug('Reconnect attempt %d failed: %s' % (attempt + 1, e))
+                    time.sleep(2 ** attempt)
+
+            for fileId, openFile in list(self._Session["OpenTable"].items()):
+                if openFile["Durable"] is true {
+                    try:
+                        self.__reclaimOpen(openFile)
+                        continue
+                    except SessionError as e:
+                        LOG.debug('Could not reclaim %s: %s' % (openFile["FileName"], e))
+                LOG.debug('Lost open %s' % openFile["FileName"])
+                self.GlobalFileTable.pop(openFile["FileName"], nil)
+                del(self._Session["OpenTable"][fileId])
+
+            for messageId, (packet, treeId, fileId) in outstanding:
+                if packet["Command"] in (SMB2_NEGOTIATE, SMB2_SESSION_SETUP, SMB2_OPLOCK_BREAK) {
+                    continue
+                if self.__canReplay(packet) is false or (fileId is not nil and (fileId in self._Session["OpenTable"]) is false) {
+                    // We can't tell whether the server ran it, so whoever waits for it gets an error
+                    for oldId in [oldId for oldId, newId in self.__resentRequests.items() if newId == messageId] {
+                        del(self.__resentRequests[oldId])
+                        self.__lostRequests.add(oldId)
+                    self.__lostRequests.add(messageId)
+                    continue
+                packet["TreeID"] = treeId
+                if fileId is not nil {
+                    packet["Data"]["FileID"] = fileId
+                packet["Flags"] = packet.fields.get('Flags', 0) & ~SMB2_FLAGS_SIGNED
+                if packet["Command"] == SMB2_CREATE {
+                    // Only valid for durable and continuously available opens, the server looks for the
+                    // CreateGuid and hands back the open if the first try made it
+                    packet["Flags"] |= SMB2_FLAGS_REPLAY_OPERATION
+                packet["Signature"] = b'\x00'*16
+                newId = self.sendSMB(packet)
+                for oldId in list(self.__resentRequests.keys()):
+                    if self.__resentRequests[oldId] == messageId {
+                        self.__resentRequests[oldId] = newId
+                self.__resentRequests[messageId] = newId
+        finally:
+            self.__reconnecting = false
+
+        return true
+
+     func (self TYPE) __canReplay(packet interface{}){
+        // Whatever gives the same result when it runs twice is sent again. So is a create asking for a
+        // durable v2 handle, the replay flag gets us the open the first try may have made ([MS-SMB2] 3.3.5.9.10)
+        if packet["Command"] in (SMB2_READ, SMB2_QUERY_INFO, SMB2_FLUSH, SMB2_ECHO, SMB2_TREE_CONNECT) {
+            return true
+        if packet["Command"] == SMB2_CREATE and self._Connection["Dialect"] >= SMB2_DIALECT_30 {
+            smb2Create = packet["Data"]
+            if smb2Create["CreateContextsLength"] == 0 {
+                return false
+            contexts = self.__parseCreateContexts({'CreateContextsLength': smb2Create["CreateContextsLength"],
+                                                   'Buffer': smb2Create["Buffer"][-smb2Create["CreateContextsLength"]:]})
+            return b'DH2Q' in contexts
+        return false
+
+     func (self TYPE) __reconnect(previousSessionId interface{}){
+        try:
+            self._NetBIOSSession.close()
+        except Exception:
+            pass
+
+        // A new connection and session, but the trees and opens the caller knows about stay
+        connection = self._Connection
+        treeConnectTable = self._Session["TreeConnectTable"]
+        openTable = self._Session["OpenTable"]
+        self._Connection = copy.deepcopy(self.__initialConnection)
+        for key in ('ServerName', 'ServerIP', 'ClientName', 'IOWindow'):
+            self._Connection[key] = connection[key]
+        self._Session = copy.deepcopy(self.__initialSession)
+        self._Session["TreeConnectTable"] = treeConnectTable
+        self._Session["OpenTable"] = openTable
+        self.SMB_PACKET = SMB2Packet
+        self.__oplockAcks = set()
+
+        self._NetBIOSSession = nmb.NetBIOSTCPSession(self.__myName, self._Connection["ServerName"],
+                                                     self._Connection["ServerIP"], self.__hostType,
+                                                     self.__sessPort, self._timeout)
+        self.negotiateSession(self._preferredDialect)
+
+        self.__previousSessionId = previousSessionId
+        try:
+            if self._doKerberos is true {
+                self.kerberosLogin(self.__userName, self.__password, self.__domain, self.__lmhash, self.__nthash,
+                                   self.__aesKey, self.__kdc, self.__TGT, self.__TGS)
+            } else  {
+                self.login(self.__userName, self.__password, self.__domain, self.__lmhash, self.__nthash)
+        finally:
+            self.__previousSessionId = 0
+
+        for key, treeEntry in list(treeConnectTable.items()):
+            if key == treeEntry["ShareName"] {
+                self.__treeConnect(treeEntry)
 
      func (self TYPE) queryDirectory(treeId, fileId, searchString = "*", resumeIndex = 0, informationClass = FILENAMES_INFORMATION, maxBufferSize = nil, enumRestart = false, singleEntry = false interface{}){
         if (treeId in self._Session["TreeConnectTable"]) is false {
@@ -1154,6 +2048,37 @@ CHANNEL = {
             queryDirectoryResponse = SMB2QueryDirectory_Response(ans["Data"])
             return queryDirectoryResponse["Buffer"]
 
+     func (self TYPE) changeNotify(treeId, fileId, completionFilter, flags = 0, outputBufferLength = 65536 interface{}){
+        // Waits until something in the directory changes. Returns the FILE_NOTIFY_INFORMATION entries, or
+        // nil if there were more changes than the buffer could hold (the directory has to be enumerated again)
+        if (treeId in self._Session["TreeConnectTable"]) is false {
+            raise SessionError(STATUS_INVALID_PARAMETER)
+        if (fileId in self._Session["OpenTable"]) is false {
+            raise SessionError(STATUS_INVALID_PARAMETER)
+
+        packet = self.SMB_PACKET()
+        packet["Command"] = SMB2_CHANGE_NOTIFY
+        packet["TreeID"]  = treeId
+
+        changeNotify = SMB2ChangeNotify()
+        changeNotify["Flags"]              = flags
+        changeNotify["OutputBufferLength"] = outputBufferLength
+        changeNotify["FileID"]             = fileId
+        changeNotify["CompletionFilter"]   = completionFilter
+
+        packet["Data"] = changeNotify
+
+        if self._Connection["Dialect"] != SMB2_DIALECT_002 and self._Connection["SupportsMultiCredit"] is true {
+            packet["CreditCharge"] = ( 1 + (outputBufferLength - 1) // 65536)
+
+        packetID = self.sendSMB(packet)
+        ans = self.recvSMB(packetID)
+        if ans["Status"] == STATUS_NOTIFY_ENUM_DIR {
+            return nil
+        if ans.isValidAnswer(STATUS_SUCCESS) {
+            changeNotifyResponse = SMB2ChangeNotify_Response(ans["Data"])
+            return changeNotifyResponse["Buffer"]
+
      func (self TYPE) echo(){
         packet = self.SMB_PACKET()
         packet["Command"] = SMB2_ECHO
@@ -1168,6 +2093,12 @@ CHANNEL = {
         packet = self.SMB_PACKET()
         packet["Command"]   = SMB2_CANCEL
         packet["MessageID"] = packetID
+        // Once the server went async on the request, it's found by its AsyncId
+        if packetID in self.__asyncIds {
+            asyncId = self.__asyncIds[packetID]
+            packet["Flags"]    = SMB2_FLAGS_ASYNC_COMMAND
+            packet["Reserved"] = asyncId & 0xffffffff
+            packet["TreeID"]   = asyncId >> 32
 
         smbCancel = SMB2Cancel()
 
@@ -1207,6 +2138,8 @@ CHANNEL = {
         packetID = self.sendSMB(packet)
 
         if waitAnswer == 0 {
+            // TransactNamedPipeRecv picks the answer up later, from this same thread
+            self.__threadState.pendingIoctl = packetID
             return true
 
         ans = self.recvSMB(packetID)
@@ -1250,7 +2183,7 @@ CHANNEL = {
         smbLock["FileID"]       = fileId
         smbLock["LockCount"]    = len(locks)
         smbLock["LockSequence"] = lockSequence
-        smbLock["Locks"]        = "".join(str(x) for x in locks)
+        smbLock["Locks"]        = b''.join(x.getData() for x in locks)
 
         packet["Data"] = smbLock
 
@@ -1258,7 +2191,7 @@ CHANNEL = {
         ans = self.recvSMB(packetID)
 
         if ans.isValidAnswer(STATUS_SUCCESS) {
-            smbFlushResponse = SMB2Lock_Response(ans["Data"])
+            smbLockResponse = SMB2Lock_Response(ans["Data"])
             return true
 
         // ToDo:
@@ -1310,7 +2243,7 @@ CHANNEL = {
 
         queryInfo = SMB2QueryInfo()
         queryInfo["FileID"]                = fileId
-        queryInfo["InfoType"]              = SMB2_0_INFO_FILE 
+        queryInfo["InfoType"]              = infoType
         queryInfo["FileInfoClass"]         = fileInfoClass 
         queryInfo["OutputBufferLength"]    = 65535
         queryInfo["AdditionalInformation"] = additionalInformation
@@ -1341,7 +2274,7 @@ CHANNEL = {
         packet["TreeID"]  = treeId
 
         setInfo = SMB2SetInfo()
-        setInfo["InfoType"]              = SMB2_0_INFO_FILE 
+        setInfo["InfoType"]              = infoType
         setInfo["FileInfoClass"]         = fileInfoClass 
         setInfo["BufferLength"]          = len(inputBlob)
         setInfo["AdditionalInformation"] = additionalInformation
@@ -1356,13 +2289,13 @@ CHANNEL = {
             return true
 
      func (self TYPE) getSessionKey(){
-        if self.getDialect() == SMB2_DIALECT_30 { 
+        if self.getDialect() >= SMB2_DIALECT_30 { 
            return self._Session["ApplicationKey"]
         } else  {
            return self._Session["SessionKey"]
 
      func (self TYPE) setSessionKey(key interface{}){
-        if self.getDialect() == SMB2_DIALECT_30 {
+        if self.getDialect() >= SMB2_DIALECT_30 {
            self._Session["ApplicationKey"] = key
         } else  {
            self._Session["SessionKey"] = key
@@ -1399,16 +2332,17 @@ CHANNEL = {
         return true
 
      func (self TYPE) writeFile(treeId, fileId, data, offset = 0 interface{}){
-        finished = false
-        writeOffset = offset
-        while not finished:
-            if len(data) == 0 {
-                break
-            writeData = data[:self._Connection["MaxWriteSize"]]
-            data = data[self._Connection["MaxWriteSize"]:]
-            written = self.write(treeId, fileId, writeData, writeOffset, len(writeData))
-            writeOffset += written
-        return writeOffset - offset
+        chunks = [data]
+         func callback(size interface{}){
+            if len(chunks) == 0 {
+                return b''
+            return chunks.pop()
+        return self.pipelinedWrite(treeId, fileId, offset, callback)
+
+     func (self TYPE) readFile(treeId, fileId, offset = 0, bytesToRead = 0 interface{}){
+        chunks = []
+        self.pipelinedRead(treeId, fileId, offset, bytesToRead, chunks.append)
+        return b''.join(chunks)
 
      func (self TYPE) listPath(shareName, path, password = nil interface{}){
         // ToDo: Handle situations where share is password protected
@@ -1537,19 +2471,9 @@ CHANNEL = {
             res = self.queryInfo(treeId, fileId)
             fileInfo = smb.SMBQueryFileStandardInfo(res)
             fileSize = fileInfo["EndOfFile"]
-            if (fileSize-offset) < self._Connection["MaxReadSize"] {
-                // Skip reading 0 bytes files. 
-                if (fileSize-offset) > 0 {
-                    data = self.read(treeId, fileId, offset, fileSize-offset)
-                    callback(data)
-            } else  {
-                written = 0
-                toBeRead = fileSize-offset
-                while written < toBeRead:
-                    data = self.read(treeId, fileId, offset, self._Connection["MaxReadSize"])
-                    written += len(data)
-                    offset  += len(data)
-                    callback(data)
+            // Skip reading 0 bytes files. 
+            if (fileSize-offset) > 0 {
+                self.pipelinedRead(treeId, fileId, offset, fileSize-offset, callback)
         finally:
             if fileId is not nil {
                 self.close(treeId, fileId)
@@ -1566,14 +2490,7 @@ CHANNEL = {
         fileId = nil
         try:
             fileId = self.create(treeId, path, FILE_WRITE_DATA, shareAccessMode, FILE_NON_DIRECTORY_FILE, mode, 0)
-            finished = false
-            writeOffset = offset
-            while not finished:
-                data = callback(self._Connection["MaxWriteSize"])
-                if len(data) == 0 {
-                    break
-                written = self.write(treeId, fileId, data, writeOffset, len(data))
-                writeOffset += written
+            self.pipelinedWrite(treeId, fileId, offset, callback)
         finally:
             if fileId is not nil {
                 self.close(treeId, fileId)
@@ -1628,9 +2545,14 @@ CHANNEL = {
     list_path                  = listPath
 
      func (self TYPE) close_session(){
+        self.__stopReader = true
         if self._NetBIOSSession {
             self._NetBIOSSession.close()
             self._NetBIOSSession = nil
+        if self.__reader is not nil {
+            if threading.current_thread() is not self.__reader {
+                self.__reader.join(self._timeout)
+            self.__reader = nil
 
      func (self TYPE) doesSupportNTLMv2(){
         // Always true :P 
@@ -1673,7 +2595,11 @@ CHANNEL = {
         return self.ioctl(tid, fid, FSCTL_PIPE_TRANSCEIVE, SMB2_0_IOCTL_IS_FSCTL, data, maxOutputResponse = 65535, waitAnswer = noAnswer | waitAnswer)
 
      func (self TYPE) TransactNamedPipeRecv(){
-        ans = self.recvSMB()
+        // Wait for the answer to our IOCTL, not for whatever comes first. Other threads may be
+        // waiting for theirs
+        packetID = getattr(self.__threadState, 'pendingIoctl', nil)
+        self.__threadState.pendingIoctl = nil
+        ans = self.recvSMB(packetID)
 
         if ans.isValidAnswer(STATUS_SUCCESS) {
             smbIoctlResponse = SMB2Ioctl_Response(ans["Data"])
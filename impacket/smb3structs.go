@@ -422,6 +422,28 @@ SL_INDEX_SPECIFIED      = 0x00000004
 // TRANSFORM_HEADER
 SMB2_ENCRYPTION_AES128_CCM = 0x0001
 SMB2_ENCRYPTION_AES128_GCM = 0x0002
+SMB2_ENCRYPTION_AES256_CCM = 0x0003
+SMB2_ENCRYPTION_AES256_GCM = 0x0004
+
+// Transform Header Flags (3.1.1)
+SMB2_TRANSFORM_ENCRYPTED = 0x0001
+
+// Negotiate Context Types (3.1.1)
+SMB2_PREAUTH_INTEGRITY_CAPABILITIES = 0x0001
+SMB2_ENCRYPTION_CAPABILITIES        = 0x0002
+SMB2_COMPRESSION_CAPABILITIES       = 0x0003
+SMB2_NETNAME_NEGOTIATE_CONTEXT_ID   = 0x0005
+SMB2_TRANSPORT_CAPABILITIES         = 0x0006
+SMB2_RDMA_TRANSFORM_CAPABILITIES    = 0x0007
+SMB2_SIGNING_CAPABILITIES           = 0x0008
+
+// Preauth Integrity Hash Algorithms
+SMB2_PREAUTH_INTEGRITY_SHA512 = 0x0001
+
+// Signing Algorithms
+SMB2_SIGNING_HMAC_SHA256 = 0x0000
+SMB2_SIGNING_AES_CMAC    = 0x0001
+SMB2_SIGNING_AES_GMAC    = 0x0002
 
 
 // STRUCtures
@@ -545,11 +567,60 @@ SMB2_ENCRYPTION_AES128_GCM = 0x0002
         ('Dialects','*<H'),
     }
 
+// SMB2_NEGOTIATE when 3.1.1 is among the dialects. ClientStartTime becomes the negotiate context list
+// location, and the list goes after the dialects, 8 bytes aligned
+ type SMB311Negotiate struct { // Structure: (
+         StructureSize uint16 // =36
+         DialectCount uint16 // =0
+         SecurityMode uint16 // =0
+         Reserved uint16 // =0
+         Capabilities uint32 // =0
+         ClientGuid [6]byte // =""
+         NegotiateContextOffset uint32 // =0
+         NegotiateContextCount uint16 // =0
+         Reserved2 uint16 // =0
+        ('_Dialects','_-Dialects','self.DialectCount*2'),
+        ('Dialects',':'),
+        ('_Padding','_-Padding','self.NegotiateContextOffset"] - (64 + self["StructureSize"] + self["DialectCount*2)'),
+        ('Padding',':=""'),
+        ('NegotiateContextList',':=""'),
+    }
+
+ type SMB2NegotiateContext struct { // Structure: (
+         ContextType uint16 // =0
+         DataLength uint16 // =0
+         Reserved uint32 // =0
+        ('_Data','_-Data','self.DataLength'),
+        ('Data',':=""'),
+    }
+
+ type SMB2PreauthIntegrityCapabilities struct { // Structure: (
+         HashAlgorithmCount uint16 // =0
+         SaltLength uint16 // =0
+        ('_HashAlgorithms','_-HashAlgorithms','self.HashAlgorithmCount*2'),
+        ('HashAlgorithms',':'),
+        ('_Salt','_-Salt','self.SaltLength'),
+        ('Salt',':'),
+    }
+
+ type SMB2EncryptionCapabilities struct { // Structure: (
+         CipherCount uint16 // =0
+        ('_Ciphers','_-Ciphers','self.CipherCount*2'),
+        ('Ciphers',':'),
+    }
+
+ type SMB2SigningCapabilities struct { // Structure: (
+         SigningAlgorithmCount uint16 // =0
+        ('_SigningAlgorithms','_-SigningAlgorithms','self.SigningAlgorithmCount*2'),
+        ('SigningAlgorithms',':'),
+    }
+
  type SMB2Negotiate_Response struct { // Structure: (
          StructureSize uint16 // =65
          SecurityMode uint16 // =0
          DialectRevision uint16 // =0
-         Reserved uint16 // =0
+        // Reserved before 3.1.1
+         NegotiateContextCount uint16 // =0
          ServerGuid [6]byte // =""
          Capabilities uint32 // =0
          MaxTransactSize uint32 // =0
@@ -559,7 +630,8 @@ SMB2_ENCRYPTION_AES128_GCM = 0x0002
          ServerStartTime uint64 // =0
          SecurityBufferOffset uint16 // =0
          SecurityBufferLength uint16 // =0
-         Reserved2 uint32 // =0
+        // Reserved2 before 3.1.1
+         NegotiateContextOffset uint32 // =0
         ('_AlignPad','_-AlignPad','self.SecurityBufferOffset"] - (64 + self["StructureSize - 1)'),
         ('AlignPad',':=""'),
         ('_Buffer','_-Buffer','self.SecurityBufferLength'),
@@ -1146,6 +1218,66 @@ SMB2Echo_Response = SMB2Echo
         ("DataBuffer", ":")
     }
 
+// [MS-DFSC] FSCTL_DFS_GET_REFERRALS
+// ReferralHeaderFlags
+DFSREF_REFERRAL_SERVER = 0x00000001
+DFSREF_STORAGE_SERVER  = 0x00000002
+DFSREF_TARGET_FAILBACK = 0x00000004
+
+// ServerType
+DFS_SERVER_NON_ROOT    = 0x0000
+DFS_SERVER_ROOT        = 0x0001
+
+// ReferralEntryFlags
+DFS_NAME_LIST_REFERRAL  = 0x0002
+DFS_TARGET_SET_BOUNDARY = 0x0004
+
+ type REQ_GET_DFS_REFERRAL struct { // Structure: (
+         MaxReferralLevel uint16 // =4
+        ('RequestFileName',':'),
+    }
+
+ type RESP_GET_DFS_REFERRAL struct { // Structure: (
+         PathConsumed uint16 // =0
+         NumberOfReferrals uint16 // =0
+         ReferralHeaderFlags uint32 // =0
+        ('ReferralEntries',':'),
+    }
+
+ type DFS_REFERRAL_V1 struct { // Structure: (
+         VersionNumber uint16 // =1
+         Size uint16 // =0
+         ServerType uint16 // =0
+         ReferralEntryFlags uint16 // =0
+        ('ShareName',':'),
+    }
+
+ type DFS_REFERRAL_V2 struct { // Structure: (
+         VersionNumber uint16 // =2
+         Size uint16 // =0
+         ServerType uint16 // =0
+         ReferralEntryFlags uint16 // =0
+         Proximity uint32 // =0
+         TimeToLive uint32 // =0
+         DFSPathOffset uint16 // =0
+         DFSAlternatePathOffset uint16 // =0
+         NetworkAddressOffset uint16 // =0
+    }
+
+// Also DFS_REFERRAL_V4. With DFS_NAME_LIST_REFERRAL the offsets are SpecialNameOffset, NumberOfExpandedNames
+// and ExpandedNameOffset instead
+ type DFS_REFERRAL_V3 struct { // Structure: (
+         VersionNumber uint16 // =3
+         Size uint16 // =0
+         ServerType uint16 // =0
+         ReferralEntryFlags uint16 // =0
+         TimeToLive uint32 // =0
+         DFSPathOffset uint16 // =0
+         DFSAlternatePathOffset uint16 // =0
+         NetworkAddressOffset uint16 // =0
+         ServiceSiteGuid [6]byte // =""
+    }
+
  type SMB2Ioctl_Response struct { // Structure: (
          StructureSize uint16 // =49
          Reserved uint16 // =0
@@ -1307,6 +1439,7 @@ SMB2Echo_Response = SMB2Echo
          Nonce [6]byte // =""
          OriginalMessageSize uint32 // =0
          Reserved uint16 // =0
+        // Flags for 3.1.1
          EncryptionAlgorithm uint16 // =0
          SessionID uint64 // =0
     }
@@ -422,6 +422,28 @@ SL_INDEX_SPECIFIED      = 0x00000004
 # TRANSFORM_HEADER
 SMB2_ENCRYPTION_AES128_CCM = 0x0001
 SMB2_ENCRYPTION_AES128_GCM = 0x0002
+SMB2_ENCRYPTION_AES256_CCM = 0x0003
+SMB2_ENCRYPTION_AES256_GCM = 0x0004
+
+# Transform Header Flags (3.1.1)
+SMB2_TRANSFORM_ENCRYPTED = 0x0001
+
+# Negotiate Context Types (3.1.1)
+SMB2_PREAUTH_INTEGRITY_CAPABILITIES = 0x0001
+SMB2_ENCRYPTION_CAPABILITIES        = 0x0002
+SMB2_COMPRESSION_CAPABILITIES       = 0x0003
+SMB2_NETNAME_NEGOTIATE_CONTEXT_ID   = 0x0005
+SMB2_TRANSPORT_CAPABILITIES         = 0x0006
+SMB2_RDMA_TRANSFORM_CAPABILITIES    = 0x0007
+SMB2_SIGNING_CAPABILITIES           = 0x0008
+
+# Preauth Integrity Hash Algorithms
+SMB2_PREAUTH_INTEGRITY_SHA512 = 0x0001
+
+# Signing Algorithms
+SMB2_SIGNING_HMAC_SHA256 = 0x0000
+SMB2_SIGNING_AES_CMAC    = 0x0001
+SMB2_SIGNING_AES_GMAC    = 0x0002
 
 
 # STRUCtures
@@ -552,12 +574,66 @@ class SMB2Negotiate(Structure):
         ('Dialects','*<H'),
     )
 
+# SMB2_NEGOTIATE when 3.1.1 is among the dialects. ClientStartTime becomes the negotiate context list
+# location, and the list goes after the dialects, 8 bytes aligned
+class SMB311Negotiate(Structure):
+    structure = (
+        ('StructureSize','<H=36'),
+        ('DialectCount','<H=0'),
+        ('SecurityMode','<H=0'),
+        ('Reserved','<H=0'),
+        ('Capabilities','<L=0'),
+        ('ClientGuid','16s=""'),
+        ('NegotiateContextOffset','<L=0'),
+        ('NegotiateContextCount','<H=0'),
+        ('Reserved2','<H=0'),
+        ('_Dialects','_-Dialects','self["DialectCount"]*2'),
+        ('Dialects',':'),
+        ('_Padding','_-Padding','self["NegotiateContextOffset"] - (64 + self["StructureSize"] + self["DialectCount"]*2)'),
+        ('Padding',':=""'),
+        ('NegotiateContextList',':=""'),
+    )
+
+class SMB2NegotiateContext(Structure):
+    structure = (
+        ('ContextType','<H=0'),
+        ('DataLength','<H=0'),
+        ('Reserved','<L=0'),
+        ('_Data','_-Data','self["DataLength"]'),
+        ('Data',':=""'),
+    )
+
+class SMB2PreauthIntegrityCapabilities(Structure):
+    structure = (
+        ('HashAlgorithmCount','<H=0'),
+        ('SaltLength','<H=0'),
+        ('_HashAlgorithms','_-HashAlgorithms','self["HashAlgorithmCount"]*2'),
+        ('HashAlgorithms',':'),
+        ('_Salt','_-Salt','self["SaltLength"]'),
+        ('Salt',':'),
+    )
+
+class SMB2EncryptionCapabilities(Structure):
+    structure = (
+        ('CipherCount','<H=0'),
+        ('_Ciphers','_-Ciphers','self["CipherCount"]*2'),
+        ('Ciphers',':'),
+    )
+
+class SMB2SigningCapabilities(Structure):
+    structure = (
+        ('SigningAlgorithmCount','<H=0'),
+        ('_SigningAlgorithms','_-SigningAlgorithms','self["SigningAlgorithmCount"]*2'),
+        ('SigningAlgorithms',':'),
+    )
+
 class SMB2Negotiate_Response(Structure):
     structure = (
         ('StructureSize','<H=65'),
         ('SecurityMode','<H=0'),
         ('DialectRevision','<H=0'),
-        ('Reserved','<H=0'),
+        # Reserved before 3.1.1
+        ('NegotiateContextCount','<H=0'),
         ('ServerGuid','16s=""'),
         ('Capabilities','<L=0'),
         ('MaxTransactSize','<L=0'),
@@ -567,7 +643,8 @@ class SMB2Negotiate_Response(Structure):
         ('ServerStartTime','<Q=0'),
         ('SecurityBufferOffset','<H=0'),
         ('SecurityBufferLength','<H=0'),
-        ('Reserved2','<L=0'),
+        # Reserved2 before 3.1.1
+        ('NegotiateContextOffset','<L=0'),
         ('_AlignPad','_-AlignPad','self["SecurityBufferOffset"] - (64 + self["StructureSize"] - 1)'),
         ('AlignPad',':=""'),
         ('_Buffer','_-Buffer','self["SecurityBufferLength"]'),
@@ -1214,6 +1291,71 @@ class MOUNT_POINT_REPARSE_GUID_DATA_STRUCTURE(Structure):
         ("DataBuffer", ":")
     )
 
+# [MS-DFSC] FSCTL_DFS_GET_REFERRALS
+# ReferralHeaderFlags
+DFSREF_REFERRAL_SERVER = 0x00000001
+DFSREF_STORAGE_SERVER  = 0x00000002
+DFSREF_TARGET_FAILBACK = 0x00000004
+
+# ServerType
+DFS_SERVER_NON_ROOT    = 0x0000
+DFS_SERVER_ROOT        = 0x0001
+
+# ReferralEntryFlags
+DFS_NAME_LIST_REFERRAL  = 0x0002
+DFS_TARGET_SET_BOUNDARY = 0x0004
+
+class REQ_GET_DFS_REFERRAL(Structure):
+    structure = (
+        ('MaxReferralLevel','<H=4'),
+        ('RequestFileName',':'),
+    )
+
+class RESP_GET_DFS_REFERRAL(Structure):
+    structure = (
+        ('PathConsumed','<H=0'),
+        ('NumberOfReferrals','<H=0'),
+        ('ReferralHeaderFlags','<L=0'),
+        ('ReferralEntries',':'),
+    )
+
+class DFS_REFERRAL_V1(Structure):
+    structure = (
+        ('VersionNumber','<H=1'),
+        ('Size','<H=0'),
+        ('ServerType','<H=0'),
+        ('ReferralEntryFlags','<H=0'),
+        ('ShareName',':'),
+    )
+
+class DFS_REFERRAL_V2(Structure):
+    structure = (
+        ('VersionNumber','<H=2'),
+        ('Size','<H=0'),
+        ('ServerType','<H=0'),
+        ('ReferralEntryFlags','<H=0'),
+        ('Proximity','<L=0'),
+        ('TimeToLive','<L=0'),
+        ('DFSPathOffset','<H=0'),
+        ('DFSAlternatePathOffset','<H=0'),
+        ('NetworkAddressOffset','<H=0'),
+    )
+
+# Also DFS_REFERRAL_V4. With DFS_NAME_LIST_REFERRAL the offsets are SpecialNameOffset, NumberOfExpandedNames
+# and ExpandedNameOffset instead
+class DFS_REFERRAL_V3(Structure):
+    structure = (
+        ('VersionNumber','<H=3'),
+        ('Size','<H=0'),
+        ('ServerType','<H=0'),
+        ('ReferralEntryFlags','<H=0'),
+        ('TimeToLive','<L=0'),
+        ('DFSPathOffset','<H=0'),
+        ('DFSAlternatePathOffset','<H=0'),
+        ('NetworkAddressOffset','<H=0'),
+        ('ServiceSiteGuid','16s=""'),
+    )
+
 class SMB2Ioctl_Response(Structure):
     structure = (
         ('StructureSize','<H=49'),
@@ -1388,6 +1530,7 @@ class SMB2_TRANSFORM_HEADER(Structure):
         ('Nonce','16s=""'),
         ('OriginalMessageSize','<L=0'),
         ('Reserved','<H=0'),
+        # Flags for 3.1.1
         ('EncryptionAlgorithm','<H=0'),
         ('SessionID','<Q=0'),
     )
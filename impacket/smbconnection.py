@@ -12,21 +12,58 @@
 # You can still play with the low level methods (version dependent)
 # by calling getSMBServer()
 #
+import fnmatch
+import hashlib
+import hmac
+import io
 import ntpath
+import os
 import socket
+import stat
+import struct
+import threading
+import time
+from binascii import hexlify
+from contextlib import contextmanager
 
 from impacket import smb, smb3, nmb, nt_errors, LOG
 from impacket.ntlm import compute_lmhash, compute_nthash
-from impacket.smb3structs import SMB2Packet, SMB2_DIALECT_002, SMB2_DIALECT_21, SMB2_DIALECT_30, GENERIC_ALL, FILE_SHARE_READ, \
+from impacket.smb3structs import SMB2Packet, SMB2_DIALECT_002, SMB2_DIALECT_21, SMB2_DIALECT_30, SMB2_DIALECT_302, \
+    SMB2_DIALECT_311, GENERIC_ALL, FILE_SHARE_READ, \
     FILE_SHARE_WRITE, FILE_SHARE_DELETE, FILE_NON_DIRECTORY_FILE, FILE_OVERWRITE_IF, FILE_ATTRIBUTE_NORMAL, \
-    SMB2_IL_IMPERSONATION, SMB2_OPLOCK_LEVEL_NONE, FILE_READ_DATA , FILE_WRITE_DATA, FILE_OPEN, GENERIC_READ, GENERIC_WRITE, \
+    SMB2_IL_IMPERSONATION, SMB2_OPLOCK_LEVEL_NONE, SMB2_OPLOCK_LEVEL_BATCH, FILE_READ_DATA , FILE_WRITE_DATA, FILE_OPEN, GENERIC_READ, GENERIC_WRITE, \
     FILE_OPEN_REPARSE_POINT, MOUNT_POINT_REPARSE_DATA_STRUCTURE, FSCTL_SET_REPARSE_POINT, SMB2_0_IOCTL_IS_FSCTL, \
-    MOUNT_POINT_REPARSE_GUID_DATA_STRUCTURE, FSCTL_DELETE_REPARSE_POINT
+    MOUNT_POINT_REPARSE_GUID_DATA_STRUCTURE, FSCTL_DELETE_REPARSE_POINT, SMB2_FILE_END_OF_FILE_INFO, FILE_CREATE, \
+    SMB2_FILE_BASIC_INFO, FSCTL_SRV_REQUEST_RESUME_KEY, FSCTL_SRV_COPYCHUNK, SRV_REQUEST_RESUME_KEY, SRV_COPYCHUNK_COPY, \
+    SRV_COPYCHUNK, SRV_COPYCHUNK_RESPONSE, SMB2Ioctl_Response, \
+    FILE_OPEN_IF, FILE_READ_ATTRIBUTES, FILE_WRITE_ATTRIBUTES, FILE_ATTRIBUTE_DIRECTORY, FILE_ATTRIBUTE_READONLY, \
+    SMB2_0_INFO_SECURITY, OWNER_SECURITY_INFORMATION, GROUP_SECURITY_INFORMATION, DACL_SECURITY_INFORMATION, \
+    SACL_SECURITY_INFORMATION, READ_CONTROL, WRITE_DAC, WRITE_OWNER, ACCESS_SYSTEM_SECURITY, SMB2_FILE_STREAM_INFO, \
+    SMB2_FULL_EA_INFO, SL_RESTART_SCAN, FILE_READ_EA, FILE_WRITE_EA, FILE_LIST_DIRECTORY, FILE_DIRECTORY_FILE, \
+    SMB2_WATCH_TREE, FILE_NOTIFY_CHANGE_FILE_NAME, FILE_NOTIFY_CHANGE_DIR_NAME, FILE_NOTIFY_CHANGE_SIZE, \
+    FILE_NOTIFY_CHANGE_LAST_WRITE, FILE_NOTIFY_INFORMATION, SMB2_LOCK_ELEMENT, SMB2_LOCKFLAG_SHARED_LOCK, \
+    SMB2_LOCKFLAG_EXCLUSIVE_LOCK, SMB2_LOCKFLAG_UNLOCK, SMB2_LOCKFLAG_FAIL_IMMEDIATELY, FSCTL_DFS_GET_REFERRALS, \
+    REQ_GET_DFS_REFERRAL, RESP_GET_DFS_REFERRAL, DFS_REFERRAL_V1, DFS_REFERRAL_V2, DFS_REFERRAL_V3, \
+    DFS_NAME_LIST_REFERRAL
+from impacket.ldap.ldaptypes import SR_SECURITY_DESCRIPTOR
 
 
 # So the user doesn't need to import smb, the smb3 are already in here
 SMB_DIALECT = smb.SMB_DIALECT
 
+# How long before the TGT expires it is renewed (seconds), see setKerberosRenewal
+KERBEROS_RENEWAL_MARGIN = 300
+
+# How many DFS referrals are followed for a single path before giving up
+DFS_MAX_HOPS = 8
+
+# How long (seconds) referrals that don't say, the V1 ones, are cached
+DFS_DEFAULT_TTL = 300
+
+# Action of the events watch() gives when the server couldn't keep track of the changes. The directory
+# has to be enumerated again
+FILE_ACTION_OVERFLOW = 0
+
 class SMBConnection:
     """
     SMBConnection class
@@ -62,6 +99,16 @@ class SMBConnection:
         self._kdcHost = None
         self._useCache = True
         self._ntlmFallback = True
+        self._dfsEnabled = False
+        self._dfsCache = DFS_REFERRAL_CACHE
+        # Connections to the DFS targets, by server name
+        self._dfsConnections = {}
+        self._dfsLock = threading.Lock()
+        self._kerberosRenewal = True
+        self._renewalMargin = KERBEROS_RENEWAL_MARGIN
+        self._renewalTimer = None
+        # The ccache Credential for our TGT, it has its times and flags
+        self._tgtCredential = None
 
         if existingConnection is not None:
             # Existing Connection must be a smb or smb3 instance
@@ -126,7 +173,7 @@ class SMBConnection:
             if preferredDialect == smb.SMB_DIALECT:
                 self._SMBConnection = smb.SMB(self._remoteName, self._remoteHost, self._myName, hostType,
                                               self._sess_port, self._timeout)
-            elif preferredDialect in [SMB2_DIALECT_002, SMB2_DIALECT_21, SMB2_DIALECT_30]:
+            elif preferredDialect in [SMB2_DIALECT_002, SMB2_DIALECT_21, SMB2_DIALECT_30, SMB2_DIALECT_302, SMB2_DIALECT_311]:
                 self._SMBConnection = smb3.SMB3(self._remoteName, self._remoteHost, self._myName, hostType,
                                                 self._sess_port, self._timeout, preferredDialect=preferredDialect)
             else:
@@ -269,9 +316,11 @@ class SMBConnection:
             raise SessionError(e.get_error_code(), e.get_error_packet())
 
     def kerberosLogin(self, user, password, domain='', lmhash='', nthash='', aesKey='', kdcHost=None, TGT=None,
-                      TGS=None, useCache=True):
+                      TGS=None, useCache=True, keytab=None):
         """
         logins into the target system explicitly using Kerberos. Hashes are used if RC4_HMAC is supported.
+        If domain isn't known (nor in the ccache) it's looked up in krb5.conf (KRB5_CONFIG or /etc/krb5.conf).
+        The TGT is kept fresh while the connection lives, see setKerberosRenewal
 
         :param string user: username
         :param string password: password for the user
@@ -279,20 +328,24 @@ class SMBConnection:
         :param string lmhash: LMHASH used to authenticate using hashes (password is not used)
         :param string nthash: NTHASH used to authenticate using hashes (password is not used)
         :param string aesKey: aes256-cts-hmac-sha1-96 or aes128-cts-hmac-sha1-96 used for Kerberos authentication
-        :param string kdcHost: hostname or IP Address for the KDC. If None, the domain will be used (it needs to resolve tho)
+        :param string kdcHost: hostname or IP Address for the KDC. If None, the krb5.conf one for the domain, or the domain itself (it needs to resolve tho)
         :param struct TGT: If there's a TGT available, send the structure here and it will be used
         :param struct TGS: same for TGS. See smb3.py for the format
-        :param bool useCache: whether or not we should use the ccache for credentials lookup. If TGT or TGS are specified this is False
+        :param bool useCache: whether or not we should use the ccache for credentials lookup. If TGT or TGS are specified this is False.
+                              The tickets we get are written back to the ccache
+        :param string keytab: keytab file name (or a Keytab) where the user key is taken from if there's no password,
+                              hashes, aesKey or ticket
 
         :return: None, raises a Session Error if error.
         """
-        import os
         from impacket.krb5.ccache import CCache
         from impacket.krb5.kerberosv5 import KerberosError
+        from impacket.krb5.krb5conf import getKrb5Conf
         from impacket.krb5 import constants
 
         self._kdcHost = kdcHost
         self._useCache = useCache
+        tgtCredential = None
 
         if TGT is not None or TGS is not None:
             useCache = False
@@ -318,6 +371,7 @@ class SMBConnection:
                     creds =  ccache.getCredential(principal)
                     if creds is not None:
                         TGT = creds.toTGT()
+                        tgtCredential = creds
                         LOG.debug('Using TGT from cache')
                     else:
                         LOG.debug("No valid credentials found in cache. ")
@@ -333,13 +387,26 @@ class SMBConnection:
                     user = ccache.principal.components[0]['data']
                     LOG.debug('Username retrieved from CCache: %s' % user)
 
+        if domain == '':
+            domain = getKrb5Conf().getRealm(self.getRemoteName())
+            if domain is None:
+                domain = ''
+            else:
+                LOG.debug('Domain retrieved from krb5.conf: %s' % domain)
+
+        if keytab is not None and TGT is None and TGS is None and password == '' and lmhash == '' and nthash == '' \
+                and (aesKey == '' or aesKey is None):
+            aesKey, nthash = self._keytabKey(keytab, user, domain)
+
         while True:
             try:
                 if self.getDialect() == smb.SMB_DIALECT:
-                    return self._SMBConnection.kerberos_login(user, password, domain, lmhash, nthash, aesKey, kdcHost,
-                                                              TGT, TGS)
-                return self._SMBConnection.kerberosLogin(user, password, domain, lmhash, nthash, aesKey, kdcHost, TGT,
-                                                         TGS)
+                    result = self._SMBConnection.kerberos_login(user, password, domain, lmhash, nthash, aesKey,
+                                                                kdcHost, TGT, TGS)
+                else:
+                    result = self._SMBConnection.kerberosLogin(user, password, domain, lmhash, nthash, aesKey, kdcHost,
+                                                               TGT, TGS)
+                break
             except (smb.SessionError, smb3.SessionError) as e:
                 raise SessionError(e.get_error_code(), e.get_error_packet())
             except KerberosError as e:
@@ -356,6 +423,167 @@ class SMBConnection:
                 else:
                     raise e
 
+        newTGT, newTGS = self.getCredentials()[6:]
+        if useCache is True:
+            # Only the tickets we didn't have
+            self._saveKerberosTickets(newTGT if TGT is None else None, newTGS if TGS is None else None)
+        if tgtCredential is None and newTGT is not None and 'oldSessionKey' in newTGT:
+            tgtCredential = self._ticketCredential(newTGT)
+        self._scheduleKerberosRenewal(tgtCredential)
+        return result
+
+    def _keytabKey(self, keytab, user, domain):
+        # aesKey, nthash for user out of the keytab
+        from impacket.krb5.keytab import Keytab
+        from impacket.krb5 import constants
+
+        if isinstance(keytab, Keytab) is not True:
+            keytab = Keytab.loadFile(keytab)
+        keyblock = keytab.getKey('%s@%s' % (user, domain))
+        if keyblock is None:
+            LOG.error('No key for %s@%s in the keytab' % (user, domain))
+            raise SessionError(error = nt_errors.STATUS_NO_SUCH_USER)
+        key = hexlify(keyblock['keyvalue']['data']).decode('utf-8')
+        if keyblock['keytype'] == constants.EncryptionTypes.rc4_hmac.value:
+            return '', key
+        elif keyblock['keytype'] in (constants.EncryptionTypes.aes256_cts_hmac_sha1_96.value,
+                                     constants.EncryptionTypes.aes128_cts_hmac_sha1_96.value):
+            return key, ''
+        LOG.error('Unsupported keytab key type %d' % keyblock['keytype'])
+        raise SessionError(error = nt_errors.STATUS_NO_SUCH_USER)
+
+    def _ticketCredential(self, ticket):
+        # The ccache Credential for a TGT/TGS we got from the KDC (it needs the oldSessionKey)
+        from impacket.krb5.ccache import CCache
+
+        ccache = CCache()
+        ccache.fromTGT(ticket['KDC_REP'], ticket['oldSessionKey'], ticket['sessionKey'])
+        return ccache.credentials[0]
+
+    def _saveKerberosTickets(self, TGT, TGS):
+        # Writes the tickets through to the ccache (KRB5CCNAME), creating it if there isn't one. A ccache
+        # that belongs to someone else is left alone
+        from impacket.krb5.ccache import CCache
+
+        fileName = os.getenv('KRB5CCNAME')
+        tickets = [ticket for ticket in (TGT, TGS) if ticket is not None and 'oldSessionKey' in ticket]
+        if fileName is None or len(tickets) == 0:
+            return
+        try:
+            ccache = CCache.loadFile(fileName)
+        except Exception:
+            ccache = None
+        for ticket in tickets:
+            if ccache is None:
+                # A new ccache, its principal is the ticket's client
+                ccache = CCache()
+                ccache.fromTGT(ticket['KDC_REP'], ticket['oldSessionKey'], ticket['sessionKey'])
+            elif ccache.setCredential(self._ticketCredential(ticket)) is False:
+                LOG.debug('%s is not our ccache, the tickets are not saved' % fileName)
+                return
+        try:
+            ccache.saveFile(fileName)
+            LOG.debug('Tickets saved to %s' % fileName)
+        except (IOError, OSError) as e:
+            LOG.debug('Could not save the tickets to %s: %s' % (fileName, e))
+
+    def setKerberosRenewal(self, enabled=True, margin=KERBEROS_RENEWAL_MARGIN):
+        """
+        whether the Kerberos tickets are renewed by themselves before the TGT expires, so a long lived connection
+        can still reconnect, follow DFS referrals, etc. A renewable TGT is renewed with the KDC until its renew-till,
+        after that (or if it's not renewable) a new one is asked for if we have a password, hashes, aesKey or keytab.
+        On by default
+
+        :param bool enabled: whether to renew the tickets
+        :param integer margin: seconds before the TGT expires to renew it
+
+        :return: None
+        """
+        self._kerberosRenewal = enabled
+        self._renewalMargin = margin
+        if enabled is False and self._renewalTimer is not None:
+            self._renewalTimer.cancel()
+            self._renewalTimer = None
+        elif enabled is True:
+            self._scheduleKerberosRenewal(self._tgtCredential)
+
+    def renewKerberosTickets(self):
+        """
+        gets a fresh TGT (renewing the current one if possible) and a fresh cifs ticket for the server. With SMB2/3
+        the session is authenticated again with it (before the next request if the reader thread isn't running),
+        so the server doesn't expire it. They're also used the next time we log in (e.g. reconnect) and written to
+        the ccache like kerberosLogin does
+
+        :return: None, raises a SessionError exception if error.
+        """
+        from impacket.krb5.kerberosv5 import getKerberosTGT, getKerberosTGS
+        from impacket.krb5.types import Principal
+        from impacket.krb5 import constants
+
+        userName, password, domain, lmhash, nthash, aesKey, TGT, TGS = self.getCredentials()
+        credential = self._tgtCredential
+        # tktflags has the first flag in the highest bit
+        renewable = credential is not None and \
+                    credential['tktflags'] & (1 << (31 - constants.TicketFlags.renewable.value)) != 0 and \
+                    credential['time']['renew_till'] > time.time() + self._renewalMargin
+        if TGT is not None and renewable is True:
+            LOG.debug('Renewing the TGT')
+            serverName = Principal('krbtgt/%s' % domain.upper(), type=constants.PrincipalNameType.NT_SRV_INST.value)
+            tgt, cipher, oldSessionKey, sessionKey = getKerberosTGS(serverName, domain, self._kdcHost,
+                                                                    TGT['KDC_REP'], TGT['cipher'],
+                                                                    TGT['sessionKey'], renew=True)
+        elif password != '' or nthash not in ('', b'') or aesKey not in ('', None):
+            LOG.debug('Getting a new TGT')
+            clientName = Principal(userName, type=constants.PrincipalNameType.NT_PRINCIPAL.value)
+            tgt, cipher, oldSessionKey, sessionKey = getKerberosTGT(clientName, password, domain, lmhash, nthash,
+                                                                    aesKey, self._kdcHost)
+        else:
+            raise SessionError(error = nt_errors.STATUS_NO_TGT_REPLY)
+        newTGT = {'KDC_REP': tgt, 'cipher': cipher, 'oldSessionKey': oldSessionKey, 'sessionKey': sessionKey}
+
+        serverName = Principal('cifs/%s' % self.getRemoteName(), type=constants.PrincipalNameType.NT_SRV_INST.value)
+        tgs, cipher, oldSessionKey, sessionKey = getKerberosTGS(serverName, domain, self._kdcHost, tgt, cipher,
+                                                                sessionKey)
+        newTGS = {'KDC_REP': tgs, 'cipher': cipher, 'oldSessionKey': oldSessionKey, 'sessionKey': sessionKey}
+
+        self._SMBConnection.setKerberosTickets(newTGT, newTGS)
+        if self._useCache is True:
+            self._saveKerberosTickets(newTGT, newTGS)
+        self._scheduleKerberosRenewal(self._ticketCredential(newTGT))
+
+        if self.getDialect() == smb.SMB_DIALECT:
+            # Not done with SMB1, the tickets are used the next time we log in
+            return
+        try:
+            self._SMBConnection.scheduleReauthentication()
+        except (smb.SessionError, smb3.SessionError) as e:
+            raise SessionError(e.get_error_code(), e.get_error_packet())
+
+    def _scheduleKerberosRenewal(self, tgtCredential):
+        if self._renewalTimer is not None:
+            self._renewalTimer.cancel()
+            self._renewalTimer = None
+        self._tgtCredential = tgtCredential
+        if self._kerberosRenewal is False or tgtCredential is None:
+            return
+        remaining = tgtCredential['time']['endtime'] - time.time()
+        # Short lived tickets are renewed half way through
+        if remaining > 2 * self._renewalMargin:
+            delay = remaining - self._renewalMargin
+        else:
+            delay = max(remaining / 2, 0)
+        LOG.debug('Kerberos tickets will be renewed in %d seconds' % delay)
+        self._renewalTimer = threading.Timer(delay, self._renewalTimerFired)
+        self._renewalTimer.daemon = True
+        self._renewalTimer.start()
+
+    def _renewalTimerFired(self):
+        self._renewalTimer = None
+        try:
+            self.renewKerberosTickets()
+        except Exception as e:
+            LOG.error('Could not renew the Kerberos tickets: %s' % e)
+
     def isGuestSession(self):
         try:
             return self._SMBConnection.isGuestSession()
@@ -419,7 +647,8 @@ class SMBConnection:
         try:
             return self._SMBConnection.list_path(shareName, path, password)
         except (smb.SessionError, smb3.SessionError) as e:
-            raise SessionError(e.get_error_code(), e.get_error_packet())
+            return self._dfsRedirect(e, shareName, path, lambda connection, shareName, path:
+                                     connection._SMBConnection.list_path(shareName, path, password))
 
     def createFile(self, treeId, pathName, desiredAccess=GENERIC_ALL,
                    shareMode=FILE_SHARE_READ | FILE_SHARE_WRITE | FILE_SHARE_DELETE,
@@ -575,6 +804,13 @@ class SMBConnection:
 
         :return: the data read, if not raises a SessionError exception. Length of data read is not always bytesToRead
         """
+        if self.getDialect() != smb.SMB_DIALECT and singleCall is False and bytesToRead is not None:
+            # SMB2/3 keeps several reads in flight
+            try:
+                return self._SMBConnection.readFile(treeId, fileId, offset, bytesToRead)
+            except (smb.SessionError, smb3.SessionError) as e:
+                raise SessionError(e.get_error_code(), e.get_error_packet())
+
         finished = False
         data = b''
         maxReadSize = self._SMBConnection.getIOCapabilities()['MaxReadSize']
@@ -792,7 +1028,11 @@ class SMBConnection:
             else:
                 return self._SMBConnection.retr_file(shareName, pathName, callback, shareAccessMode=shareAccessMode)
         except (smb.SessionError, smb3.SessionError) as e:
-            raise SessionError(e.get_error_code(), e.get_error_packet())
+            return self._dfsRedirect(e, shareName, pathName, lambda connection, shareName, pathName:
+                                     connection._SMBConnection.retr_file(shareName, pathName, callback)
+                                     if shareAccessMode is None else
+                                     connection._SMBConnection.retr_file(shareName, pathName, callback,
+                                                                         shareAccessMode=shareAccessMode))
 
     def putFile(self, shareName, pathName, callback, shareAccessMode = None):
         """
@@ -813,8 +1053,396 @@ class SMBConnection:
             else:
                 return self._SMBConnection.stor_file(shareName, pathName, callback, shareAccessMode)
         except (smb.SessionError, smb3.SessionError) as e:
+            return self._dfsRedirect(e, shareName, pathName, lambda connection, shareName, pathName:
+                                     connection._SMBConnection.stor_file(shareName, pathName, callback)
+                                     if shareAccessMode is None else
+                                     connection._SMBConnection.stor_file(shareName, pathName, callback,
+                                                                         shareAccessMode))
+
+    def setDfs(self, enabled=True, cache=None):
+        """
+        whether listPath/getFile/putFile follow DFS referrals when the server says the path is somewhere else
+        (STATUS_PATH_NOT_COVERED, or STATUS_BAD_NETWORK_NAME for a domain based namespace). The targets are
+        reached with new connections that log in with our credentials, so it's off by default
+
+        :param bool enabled: whether to follow the referrals
+        :param DFSReferralCache cache: where to keep the referrals, the one shared by all the connections if None
+
+        :return: None
+        """
+        self._dfsEnabled = enabled
+        self._dfsCache = DFS_REFERRAL_CACHE if cache is None else cache
+
+    def getDfsReferral(self, path):
+        """
+        asks the server where a DFS path lives ([MS-DFSC] referral request)
+
+        :param string path: the DFS path, e.g. \\contoso.com\namespace\folder
+
+        :return: a dict with 'PathConsumed' (how many characters of path the referral covers), 'Flags' (DFSREF_*)
+                 and 'Referrals', a list of dicts with 'ServerType', 'Flags', 'TimeToLive', 'DFSPath',
+                 'DFSAlternatePath' and 'NetworkAddress' (or 'SpecialName' and 'ExpandedNames' for name list
+                 referrals). Raises a SessionError exception if error.
+        """
+        # [MS-DFSC] paths have a single leading backslash
+        path = '\\' + path.replace('/', '\\').lstrip('\\')
+        request = REQ_GET_DFS_REFERRAL()
+        request['MaxReferralLevel'] = 4
+        request['RequestFileName'] = (path + '\x00').encode('utf-16le')
+
+        treeId = self.connectTree('IPC$')
+        try:
+            if self.getDialect() == smb.SMB_DIALECT:
+                data = self._SMBConnection.get_dfs_referral(treeId, request.getData())
+            else:
+                data = self._SMBConnection.ioctl(treeId, None, FSCTL_DFS_GET_REFERRALS, flags=SMB2_0_IOCTL_IS_FSCTL,
+                                                 inputBlob=request.getData(), maxInputResponse=0,
+                                                 maxOutputResponse=65536)
+        except (smb.SessionError, smb3.SessionError) as e:
+            raise SessionError(e.get_error_code(), e.get_error_packet())
+        finally:
+            self.disconnectTree(treeId)
+        return _parseDfsReferrals(data)
+
+    def _dfsRedirect(self, error, shareName, pathName, call):
+        # Runs call(connection, shareName, pathName) where the DFS referral for shareName\pathName points to,
+        # following the referrals of the targets too, up to DFS_MAX_HOPS of them. call goes straight to the
+        # SMB/SMB3 object, so the hops are only counted here. Raises error (or the last target's) as a
+        # SessionError if it doesn't make sense or there's no referral
+        connection = self
+        for _ in range(DFS_MAX_HOPS):
+            if self._dfsEnabled is False or error.get_error_code() not in (nt_errors.STATUS_PATH_NOT_COVERED,
+                                                                            nt_errors.STATUS_BAD_NETWORK_NAME):
+                break
+            try:
+                connection, targetShare, targetPath = connection._dfsResolve(shareName, pathName)
+            except SessionError as e:
+                LOG.debug('DFS referral for %s\\%s failed: %s' % (shareName, pathName, e))
+                break
+            LOG.debug('DFS: %s\\%s is at \\\\%s\\%s\\%s' % (shareName, pathName, connection.getRemoteName(),
+                                                            targetShare, targetPath))
+            shareName, pathName = targetShare, targetPath
+            try:
+                return call(connection, shareName, pathName)
+            except (smb.SessionError, smb3.SessionError) as e:
+                error = e
+        raise SessionError(error.get_error_code(), error.get_error_packet())
+
+    def _dfsResolve(self, shareName, pathName):
+        shareName = shareName.replace('/', '\\').strip('\\').split('\\')[-1]
+        pathName = pathName.replace('/', '\\').strip('\\')
+        # listPath patterns aren't part of the DFS path
+        pattern = ''
+        if '*' in ntpath.basename(pathName) or '?' in ntpath.basename(pathName):
+            pathName, pattern = ntpath.split(pathName)
+        dfsPath = '\\%s\\%s' % (self.getRemoteName(), shareName)
+        if pathName != '':
+            dfsPath += '\\' + pathName
+
+        cached = self._dfsCache.lookup(dfsPath)
+        if cached is None:
+            referral = self.getDfsReferral(dfsPath)
+            targets = [entry['NetworkAddress'] for entry in referral['Referrals'] if entry.get('NetworkAddress')]
+            if len(targets) == 0:
+                raise SessionError(error = nt_errors.STATUS_PATH_NOT_COVERED)
+            prefix = dfsPath[:referral['PathConsumed']]
+            self._dfsCache.add(prefix, targets, min([entry['TimeToLive'] for entry in referral['Referrals']]))
+        else:
+            prefix, targets = cached
+
+        remainder = dfsPath[len(prefix):].strip('\\')
+        error = SessionError(error = nt_errors.STATUS_PATH_NOT_COVERED)
+        for target in targets:
+            # \server\share[\path]
+            items = target.strip('\\').split('\\')
+            if len(items) < 2:
+                continue
+            targetPath = '\\'.join([item for item in items[2:] + [remainder, pattern] if item != ''])
+            if items[0].upper() == self.getRemoteName().upper() and items[1].upper() == shareName.upper() and \
+                    targetPath.upper() == ntpath.join(pathName, pattern).upper():
+                # Pointing back to where we are, nothing to follow
+                continue
+            try:
+                return self._dfsConnect(items[0]), items[1], targetPath
+            except SessionError as e:
+                LOG.debug('DFS target %s unavailable: %s' % (target, e))
+                error = e
+        raise error
+
+    def _dfsConnect(self, serverName):
+        if serverName.upper() == self.getRemoteName().upper():
+            return self
+        with self._dfsLock:
+            if serverName.upper() in self._dfsConnections:
+                return self._dfsConnections[serverName.upper()]
+
+        # Logging in takes a while, the other threads going elsewhere don't need to wait for it
+        userName, password, domain, lmhash, nthash, aesKey, TGT, TGS = self.getCredentials()
+        connection = SMBConnection(serverName, serverName, sess_port=self._sess_port, timeout=self._timeout,
+                                   preferredDialect=self._preferredDialect)
+        try:
+            if self._SMBConnection.getKerberos() is True:
+                # The TGS we have is for another server
+                connection.kerberosLogin(userName, password, domain, lmhash, nthash, aesKey, self._kdcHost, TGT)
+            else:
+                connection.login(userName, password, domain, lmhash, nthash, self._ntlmFallback)
+        except:
+            connection.close()
+            raise
+        connection._dfsEnabled = self._dfsEnabled
+        connection._dfsCache = self._dfsCache
+
+        with self._dfsLock:
+            existing = self._dfsConnections.get(serverName.upper())
+            if existing is None:
+                self._dfsConnections[serverName.upper()] = connection
+        if existing is not None:
+            # Someone else got there first
+            connection.close()
+            return existing
+        return connection
+
+    def copyFile(self, shareName, sourcePath, destPath, destShareName=None, overwrite=True, serverSide=True,
+                 progress=None):
+        """
+        copies a file within the server. With SMB2/3 the server copies the data itself (FSCTL_SRV_COPYCHUNK),
+        if it can't (or it's SMB1, or serverSide is False) the data goes through us
+
+        :param string shareName: name for the share where the source file is
+        :param string sourcePath: the file to copy
+        :param string destPath: the file to create
+        :param string destShareName: share for destPath, shareName if None
+        :param bool overwrite: whether to replace destPath if it exists
+        :param bool serverSide: whether to try a server side copy
+        :param callback progress: if given, called as progress(bytesCopied, totalBytes)
+
+        :return: the amount of bytes copied, raises a SessionError exception if error.
+        """
+        if destShareName is None:
+            destShareName = shareName
+        sourceTreeId = self.connectTree(shareName)
+        destTreeId = None
+        sourceFileId = None
+        destFileId = None
+        try:
+            destTreeId = self.connectTree(destShareName)
+            sourceFileId = self.openFile(sourceTreeId, sourcePath, desiredAccess=FILE_READ_DATA | FILE_READ_ATTRIBUTES)
+            size = self.queryInfo(sourceTreeId, sourceFileId)['EndOfFile']
+            # The server side copy needs to read the target too
+            destFileId = self.openFile(destTreeId, destPath, desiredAccess=FILE_READ_DATA | FILE_WRITE_DATA,
+                                       creationDisposition=FILE_OVERWRITE_IF if overwrite is True else FILE_CREATE)
+            if serverSide is True and self.getDialect() != smb.SMB_DIALECT:
+                try:
+                    return self._copyChunks(sourceTreeId, sourceFileId, destTreeId, destFileId, size, progress)
+                except SessionError as e:
+                    if e.getErrorCode() not in (nt_errors.STATUS_NOT_SUPPORTED, nt_errors.STATUS_INVALID_DEVICE_REQUEST,
+                                                nt_errors.STATUS_INVALID_PARAMETER):
+                        raise
+                    LOG.debug('Server side copy not available (%s), copying through the client' % e)
+
+            offset = 0
+            while offset < size:
+                data = self.readFile(sourceTreeId, sourceFileId, offset, min(size - offset, 1024 * 1024),
+                                     singleCall=False)
+                if len(data) == 0:
+                    break
+                self.writeFile(destTreeId, destFileId, data, offset)
+                offset += len(data)
+                if progress is not None:
+                    progress(offset, size)
+            return offset
+        finally:
+            if destFileId is not None:
+                self.closeFile(destTreeId, destFileId)
+            if sourceFileId is not None:
+                self.closeFile(sourceTreeId, sourceFileId)
+            if destTreeId is not None:
+                self.disconnectTree(destTreeId)
+            self.disconnectTree(sourceTreeId)
+
+    def _copyChunks(self, sourceTreeId, sourceFileId, destTreeId, destFileId, size, progress):
+        try:
+            resumeKey = SRV_REQUEST_RESUME_KEY(self._SMBConnection.ioctl(sourceTreeId, sourceFileId,
+                                                                         FSCTL_SRV_REQUEST_RESUME_KEY,
+                                                                         flags=SMB2_0_IOCTL_IS_FSCTL,
+                                                                         maxInputResponse=0,
+                                                                         maxOutputResponse=32))['ResumeKey']
+        except smb3.SessionError as e:
             raise SessionError(e.get_error_code(), e.get_error_packet())
 
+        # What Windows takes by default: 1 MiB chunks, 16 MiB per request. If the server wants
+        # less it tells us its limits
+        chunkSize = 1024 * 1024
+        chunksPerRequest = 16
+        bytesPerRequest = chunkSize * chunksPerRequest
+        offset = 0
+        while offset < size:
+            copyChunk = SRV_COPYCHUNK_COPY()
+            copyChunk['SourceKey'] = resumeKey
+            copyChunk['ChunkCount'] = 0
+            copyChunk['Chunks'] = b''
+            chunkOffset = offset
+            while chunkOffset < size and copyChunk['ChunkCount'] < chunksPerRequest and \
+                    chunkOffset - offset < bytesPerRequest:
+                chunk = SRV_COPYCHUNK()
+                chunk['SourceOffset'] = chunkOffset
+                chunk['TargetOffset'] = chunkOffset
+                chunk['Length'] = min(size - chunkOffset, chunkSize, bytesPerRequest - (chunkOffset - offset))
+                copyChunk['Chunks'] += chunk.getData()
+                copyChunk['ChunkCount'] += 1
+                chunkOffset += chunk['Length']
+
+            try:
+                response = SRV_COPYCHUNK_RESPONSE(self._SMBConnection.ioctl(destTreeId, destFileId,
+                                                                            FSCTL_SRV_COPYCHUNK,
+                                                                            flags=SMB2_0_IOCTL_IS_FSCTL,
+                                                                            inputBlob=copyChunk.getData(),
+                                                                            maxInputResponse=0,
+                                                                            maxOutputResponse=12))
+            except smb3.SessionError as e:
+                if e.get_error_code() == nt_errors.STATUS_INVALID_PARAMETER:
+                    limits = self._copyChunkLimits(e.get_error_packet())
+                    # Only worth another try if we asked for more than the server takes
+                    if limits is not None and 0 < limits['ChunksWritten'] and 0 < limits['ChunkBytesWritten'] and \
+                            0 < limits['TotalBytesWritten'] and (limits['ChunksWritten'] < chunksPerRequest or
+                                                                 limits['ChunkBytesWritten'] < chunkSize or
+                                                                 limits['TotalBytesWritten'] < bytesPerRequest):
+                        chunksPerRequest = min(chunksPerRequest, limits['ChunksWritten'])
+                        chunkSize = min(chunkSize, limits['ChunkBytesWritten'])
+                        bytesPerRequest = min(bytesPerRequest, limits['TotalBytesWritten'])
+                        LOG.debug('Server side copy limits: %d chunks of %d bytes, %d bytes per request' % (
+                                  chunksPerRequest, chunkSize, bytesPerRequest))
+                        continue
+                raise SessionError(e.get_error_code(), e.get_error_packet())
+
+            if response['TotalBytesWritten'] == 0:
+                raise SessionError(nt_errors.STATUS_NOT_SUPPORTED)
+            offset += response['TotalBytesWritten']
+            if progress is not None:
+                progress(offset, size)
+        return offset
+
+    @staticmethod
+    def _copyChunkLimits(packet):
+        # When the request is over its limits the server fails with STATUS_INVALID_PARAMETER and
+        # answers with them: ChunksWritten, ChunkBytesWritten and TotalBytesWritten are the most chunks,
+        # bytes per chunk and bytes per request it takes. None if they're not there
+        try:
+            if struct.unpack('<H', packet['Data'][:2])[0] != 49:
+                return None
+            buffer = SMB2Ioctl_Response(packet['Data'])['Buffer']
+            if len(buffer) < len(SRV_COPYCHUNK_RESPONSE()):
+                return None
+            return SRV_COPYCHUNK_RESPONSE(buffer)
+        except Exception as e:
+            LOG.debug('Could not get the server side copy limits: %s' % e)
+            return None
+
+    def _remoteSize(self, shareName, pathName):
+        # None if it's not there
+        try:
+            files = self.listPath(shareName, pathName)
+        except SessionError as e:
+            if e.getErrorCode() in (nt_errors.STATUS_NO_SUCH_FILE, nt_errors.STATUS_OBJECT_NAME_NOT_FOUND,
+                                    nt_errors.STATUS_OBJECT_PATH_NOT_FOUND):
+                return None
+            raise
+        return files[0].get_filesize()
+
+    def _remoteRange(self, shareName, pathName, offset, length):
+        treeId = self.connectTree(shareName)
+        try:
+            fileId = self.openFile(treeId, pathName, desiredAccess=FILE_READ_DATA,
+                                   shareMode=FILE_SHARE_READ | FILE_SHARE_WRITE)
+            try:
+                return self.readFile(treeId, fileId, offset, length, singleCall=False)
+            finally:
+                self.closeFile(treeId, fileId)
+        finally:
+            self.disconnectTree(treeId)
+
+    @staticmethod
+    def _localRange(fileName, offset, length):
+        with open(fileName, 'rb') as localFile:
+            localFile.seek(offset)
+            return localFile.read(length)
+
+    def downloadFile(self, shareName, pathName, localFileName, resume=True, verifySize=64 * 1024, callback=None):
+        """
+        downloads a file to localFileName. With resume, if localFileName already has part of the file its
+        last verifySize bytes are compared with the remote file and, if they match, only the rest is
+        downloaded. Otherwise it starts over
+
+        :param callback callback: if given, called with each piece of data written
+
+        :return: the offset the download started at, raises a SessionError exception if error.
+        """
+        offset = 0
+        remoteSize = self._remoteSize(shareName, pathName)
+        if remoteSize is None:
+            raise SessionError(nt_errors.STATUS_OBJECT_NAME_NOT_FOUND)
+        if resume is True and os.path.isfile(localFileName):
+            localSize = os.path.getsize(localFileName)
+            if 0 < localSize <= remoteSize:
+                verifyOffset = max(localSize - verifySize, 0)
+                if self._localRange(localFileName, verifyOffset, localSize - verifyOffset) == \
+                        self._remoteRange(shareName, pathName, verifyOffset, localSize - verifyOffset):
+                    offset = localSize
+                else:
+                    LOG.debug('%s doesn\'t match %s, downloading it again' % (localFileName, pathName))
+
+        with open(localFileName, 'r+b' if offset > 0 else 'wb') as localFile:
+            localFile.seek(offset)
+
+            def write(data):
+                localFile.write(data)
+                if callback is not None:
+                    callback(data)
+
+            try:
+                self._SMBConnection.retr_file(shareName, pathName, write, offset=offset)
+            except (smb.SessionError, smb3.SessionError) as e:
+                raise SessionError(e.get_error_code(), e.get_error_packet())
+        return offset
+
+    def uploadFile(self, shareName, pathName, localFileName, resume=True, verifySize=64 * 1024, callback=None):
+        """
+        uploads localFileName. With resume, if the remote file already has part of it its last verifySize
+        bytes are compared with localFileName and, if they match, only the rest is uploaded. Otherwise it
+        starts over
+
+        :param callback callback: if given, called with each piece of data read
+
+        :return: the offset the upload started at, raises a SessionError exception if error.
+        """
+        offset = 0
+        localSize = os.path.getsize(localFileName)
+        if resume is True:
+            remoteSize = self._remoteSize(shareName, pathName)
+            if remoteSize is not None and 0 < remoteSize <= localSize:
+                verifyOffset = max(remoteSize - verifySize, 0)
+                if self._localRange(localFileName, verifyOffset, remoteSize - verifyOffset) == \
+                        self._remoteRange(shareName, pathName, verifyOffset, remoteSize - verifyOffset):
+                    offset = remoteSize
+                else:
+                    LOG.debug('%s doesn\'t match %s, uploading it again' % (pathName, localFileName))
+
+        with open(localFileName, 'rb') as localFile:
+            localFile.seek(offset)
+
+            def read(size):
+                data = localFile.read(size)
+                if callback is not None:
+                    callback(data)
+                return data
+
+            try:
+                self._SMBConnection.stor_file(shareName, pathName, read, FILE_OPEN if offset > 0 else FILE_OVERWRITE_IF,
+                                              offset)
+            except (smb.SessionError, smb3.SessionError) as e:
+                raise SessionError(e.get_error_code(), e.get_error_packet())
+        return offset
+
     def createMountPoint(self, tid, path, target):
         """
         creates a mount point at an existing directory
@@ -825,7 +1453,7 @@ class SMBConnection:
         """
 
         # Verify we're under SMB2+ session
-        if self.getDialect() not in [SMB2_DIALECT_002, SMB2_DIALECT_21, SMB2_DIALECT_30]:
+        if self.getDialect() not in [SMB2_DIALECT_002, SMB2_DIALECT_21, SMB2_DIALECT_30, SMB2_DIALECT_302, SMB2_DIALECT_311]:
             raise SessionError(error = nt_errors.STATUS_NOT_SUPPORTED)
 
         fid = self.openFile(tid, path, GENERIC_READ | GENERIC_WRITE,
@@ -859,7 +1487,7 @@ class SMBConnection:
         """
 
         # Verify we're under SMB2+ session
-        if self.getDialect() not in [SMB2_DIALECT_002, SMB2_DIALECT_21, SMB2_DIALECT_30]:
+        if self.getDialect() not in [SMB2_DIALECT_002, SMB2_DIALECT_21, SMB2_DIALECT_30, SMB2_DIALECT_302, SMB2_DIALECT_311]:
             raise SessionError(error = nt_errors.STATUS_NOT_SUPPORTED)
 
         fid = self.openFile(tid, path, GENERIC_READ | GENERIC_WRITE,
@@ -895,15 +1523,347 @@ class SMBConnection:
         except (smb.SessionError, smb3.SessionError) as e:
             raise SessionError(e.get_error_code(), e.get_error_packet())
 
+    def setEndOfFile(self, treeId, fileId, size):
+        """
+        truncates or extends an opened file
+
+        :param HANDLE treeId: a valid handle for the share where the file is
+        :param HANDLE fileId: a valid handle for the file, opened for writing
+        :param integer size: the new size of the file
+
+        :return: None, raises a SessionError exception if error.
+
+        """
+        endOfFile = smb.SMBSetFileEndOfFileInfo()
+        endOfFile['EndOfFile'] = size
+        try:
+            if self.getDialect() == smb.SMB_DIALECT:
+                self._SMBConnection.set_file_info(treeId, fileId, endOfFile.getData(), smb.SMB_SET_FILE_END_OF_FILE_INFO)
+            else:
+                self._SMBConnection.setInfo(treeId, fileId, inputBlob=endOfFile.getData(),
+                                            fileInfoClass=SMB2_FILE_END_OF_FILE_INFO)
+        except (smb.SessionError, smb3.SessionError) as e:
+            raise SessionError(e.get_error_code(), e.get_error_packet())
+
+    def lockFile(self, treeId, fileId, offset, length, exclusive=True, wait=False):
+        """
+        locks a byte range of an opened file. A blocking lock (wait) can be given up on by calling this inside
+        useContext(), once the context is done the request is cancelled on the server
+
+        :param HANDLE treeId: a valid handle for the share where the file is
+        :param HANDLE fileId: a valid handle for the file
+        :param integer offset: where the range starts
+        :param integer length: the range's length
+        :param bool exclusive: an exclusive (write) lock if True, a shared (read) one if False
+        :param bool wait: whether to wait for conflicting locks to go away, otherwise it fails right away with
+               STATUS_LOCK_NOT_GRANTED (or STATUS_FILE_LOCK_CONFLICT)
+
+        :return: None, raises a SessionError exception if error.
+        """
+        try:
+            if self.getDialect() == smb.SMB_DIALECT:
+                if wait is False:
+                    timeout = 0
+                elif self._SMBConnection.get_timeout() is None:
+                    timeout = 0xffffffff
+                else:
+                    # The server gives up before we stop listening
+                    timeout = max(int(self._SMBConnection.get_timeout() * 1000) - 1000, 0)
+                self._SMBConnection.locking_andx(treeId, fileId, offset, length,
+                                                 0 if exclusive is True else smb.LOCKING_ANDX_SHARED_LOCK, timeout)
+            else:
+                lock = SMB2_LOCK_ELEMENT()
+                lock['Offset'] = offset
+                lock['Length'] = length
+                lock['Flags']  = SMB2_LOCKFLAG_EXCLUSIVE_LOCK if exclusive is True else SMB2_LOCKFLAG_SHARED_LOCK
+                if wait is False:
+                    lock['Flags'] |= SMB2_LOCKFLAG_FAIL_IMMEDIATELY
+                self._SMBConnection.lock(treeId, fileId, [lock])
+        except (smb.SessionError, smb3.SessionError) as e:
+            raise SessionError(e.get_error_code(), e.get_error_packet())
+
+    def unlockFile(self, treeId, fileId, offset, length):
+        """
+        unlocks a byte range locked with lockFile. offset and length must be the same ones used to lock it
+
+        :param HANDLE treeId: a valid handle for the share where the file is
+        :param HANDLE fileId: a valid handle for the file
+        :param integer offset: where the range starts
+        :param integer length: the range's length
+
+        :return: None, raises a SessionError exception if error.
+        """
+        try:
+            if self.getDialect() == smb.SMB_DIALECT:
+                self._SMBConnection.locking_andx(treeId, fileId, offset, length, unlock=True)
+            else:
+                lock = SMB2_LOCK_ELEMENT()
+                lock['Offset'] = offset
+                lock['Length'] = length
+                lock['Flags']  = SMB2_LOCKFLAG_UNLOCK
+                self._SMBConnection.lock(treeId, fileId, [lock])
+        except (smb.SessionError, smb3.SessionError) as e:
+            raise SessionError(e.get_error_code(), e.get_error_packet())
+
+    def setBasicInfo(self, treeId, fileId, creationTime=0, lastAccessTime=0, lastWriteTime=0, changeTime=0,
+                     fileAttributes=0):
+        """
+        sets the times and attributes of an opened file. Times are FILETIMEs, 0 leaves the value (or the
+        attributes) untouched
+
+        :param HANDLE treeId: a valid handle for the share where the file is
+        :param HANDLE fileId: a valid handle for the file, opened with FILE_WRITE_ATTRIBUTES
+
+        :return: None, raises a SessionError exception if error.
+
+        """
+        basicInfo = smb.SMBQueryFileBasicInfo()
+        basicInfo['CreationTime']      = creationTime
+        basicInfo['LastAccessTime']    = lastAccessTime
+        basicInfo['LastWriteTime']     = lastWriteTime
+        basicInfo['LastChangeTime']    = changeTime
+        basicInfo['ExtFileAttributes'] = fileAttributes
+        # FILE_BASIC_INFORMATION ends with 4 reserved bytes
+        data = basicInfo.getData() + b'\x00' * 4
+        try:
+            if self.getDialect() == smb.SMB_DIALECT:
+                self._SMBConnection.set_file_info(treeId, fileId, data, smb.SMB_SET_FILE_BASIC_INFO)
+            else:
+                self._SMBConnection.setInfo(treeId, fileId, inputBlob=data, fileInfoClass=SMB2_FILE_BASIC_INFO)
+        except (smb.SessionError, smb3.SessionError) as e:
+            raise SessionError(e.get_error_code(), e.get_error_packet())
+
+    def getSecurity(self, shareName, pathName,
+                    securityInformation=OWNER_SECURITY_INFORMATION | GROUP_SECURITY_INFORMATION |
+                                        DACL_SECURITY_INFORMATION):
+        """
+        reads the security descriptor of a file or directory (SMB2/3 only)
+
+        :param string shareName: name for the share where the file is
+        :param string pathName: the file or directory, '' for the share's root
+        :param int securityInformation: a combination of OWNER_/GROUP_/DACL_/SACL_SECURITY_INFORMATION. Reading the
+               SACL requires SeSecurityPrivilege on the server
+
+        :return: a ldaptypes.SR_SECURITY_DESCRIPTOR (toSDDL() gives its SDDL form), raises a SessionError exception if
+                 error.
+        """
+        if self.getDialect() == smb.SMB_DIALECT:
+            raise SessionError(error = nt_errors.STATUS_NOT_SUPPORTED)
+
+        desiredAccess = READ_CONTROL
+        if securityInformation & SACL_SECURITY_INFORMATION:
+            desiredAccess |= ACCESS_SYSTEM_SECURITY
+        data = self._infoCall(shareName, pathName, desiredAccess, self._SMBConnection.queryInfo,
+                              infoType=SMB2_0_INFO_SECURITY, fileInfoClass=0,
+                              additionalInformation=securityInformation)
+        return SR_SECURITY_DESCRIPTOR(data=data)
+
+    def setSecurity(self, shareName, pathName, securityDescriptor, securityInformation=None):
+        """
+        replaces (parts of) the security descriptor of a file or directory (SMB2/3 only)
+
+        :param string shareName: name for the share where the file is
+        :param string pathName: the file or directory, '' for the share's root
+        :param securityDescriptor: a ldaptypes.SR_SECURITY_DESCRIPTOR or an SDDL string
+        :param int securityInformation: which parts to set, by default the ones present in securityDescriptor
+
+        :return: None, raises a SessionError exception if error.
+        """
+        if self.getDialect() == smb.SMB_DIALECT:
+            raise SessionError(error = nt_errors.STATUS_NOT_SUPPORTED)
+
+        if isinstance(securityDescriptor, str):
+            sddl = securityDescriptor
+            securityDescriptor = SR_SECURITY_DESCRIPTOR()
+            securityDescriptor.fromSDDL(sddl)
+
+        if securityInformation is None:
+            securityInformation = 0
+            if securityDescriptor['OwnerSid'] != b'':
+                securityInformation |= OWNER_SECURITY_INFORMATION
+            if securityDescriptor['GroupSid'] != b'':
+                securityInformation |= GROUP_SECURITY_INFORMATION
+            if securityDescriptor['Dacl'] != b'' or securityDescriptor['Control'] & SR_SECURITY_DESCRIPTOR.SE_DACL_PRESENT:
+                securityInformation |= DACL_SECURITY_INFORMATION
+            if securityDescriptor['Sacl'] != b'' or securityDescriptor['Control'] & SR_SECURITY_DESCRIPTOR.SE_SACL_PRESENT:
+                securityInformation |= SACL_SECURITY_INFORMATION
+
+        desiredAccess = 0
+        if securityInformation & (OWNER_SECURITY_INFORMATION | GROUP_SECURITY_INFORMATION):
+            desiredAccess |= WRITE_OWNER
+        if securityInformation & DACL_SECURITY_INFORMATION:
+            desiredAccess |= WRITE_DAC
+        if securityInformation & SACL_SECURITY_INFORMATION:
+            desiredAccess |= ACCESS_SYSTEM_SECURITY
+        self._infoCall(shareName, pathName, desiredAccess, self._SMBConnection.setInfo,
+                       inputBlob=securityDescriptor.getData(), infoType=SMB2_0_INFO_SECURITY, fileInfoClass=0,
+                       additionalInformation=securityInformation)
+
+    def listStreams(self, shareName, pathName):
+        """
+        lists the data streams of a file or directory, the unnamed one (::$DATA) included
+
+        :param string shareName: name for the share where the file is
+        :param string pathName: the file or directory
+
+        :return: a list of (streamName, size) tuples, e.g. (':Zone.Identifier:$DATA', 26), raises a SessionError
+                 exception if error.
+        """
+        if self.getDialect() == smb.SMB_DIALECT:
+            data = self._infoCall(shareName, pathName, FILE_READ_ATTRIBUTES, self._SMBConnection.query_file_info,
+                                  fileInfoClass=smb.SMB_QUERY_FILE_STREAM_INFO)
+        else:
+            data = self._infoCall(shareName, pathName, FILE_READ_ATTRIBUTES, self._SMBConnection.queryInfo,
+                                  fileInfoClass=SMB2_FILE_STREAM_INFO)
+        return _unpackStreamList(data)
+
+    def openStream(self, treeId, pathName, streamName, desiredAccess=FILE_READ_DATA, shareMode=FILE_SHARE_READ,
+                   creationDisposition=FILE_OPEN):
+        """
+        opens an alternate data stream of a file, use readFile/writeFile/closeFile on the returned handle
+
+        :param HANDLE treeId: a valid handle for the share where the file is
+        :param string pathName: the file the stream belongs to
+        :param string streamName: the stream, as returned by listStreams (':Zone.Identifier:$DATA') or just its
+               name ('Zone.Identifier')
+
+        :return: a valid file descriptor, if not raises a SessionError exception.
+        """
+        return self.openFile(treeId, pathName + ':' + streamName.lstrip(':'), desiredAccess=desiredAccess,
+                             shareMode=shareMode, creationDisposition=creationDisposition)
+
+    def getEA(self, shareName, pathName):
+        """
+        reads the extended attributes of a file or directory
+
+        :param string shareName: name for the share where the file is
+        :param string pathName: the file or directory
+
+        :return: a dict of EA name -> value (bytes), raises a SessionError exception if error.
+        """
+        try:
+            if self.getDialect() == smb.SMB_DIALECT:
+                data = self._infoCall(shareName, pathName, FILE_READ_EA, self._SMBConnection.query_file_info,
+                                      fileInfoClass=smb.SMB_INFO_QUERY_ALL_EAS)
+                return _unpackFeaList(data)
+            data = self._infoCall(shareName, pathName, FILE_READ_EA, self._SMBConnection.queryInfo,
+                                  fileInfoClass=SMB2_FULL_EA_INFO, flags=SL_RESTART_SCAN)
+            return _unpackFullEaList(data)
+        except SessionError as e:
+            if e.getErrorCode() == nt_errors.STATUS_NO_EAS_ON_FILE:
+                return {}
+            raise
+
+    def setEA(self, shareName, pathName, eas):
+        """
+        sets extended attributes of a file or directory, the ones not in eas are left alone
+
+        :param string shareName: name for the share where the file is
+        :param string pathName: the file or directory
+        :param dict eas: EA name -> value (bytes), an empty value (or None) removes the EA
+
+        :return: None, raises a SessionError exception if error.
+        """
+        eas = [(name, value or b'') for name, value in eas.items()]
+        if self.getDialect() == smb.SMB_DIALECT:
+            self._infoCall(shareName, pathName, FILE_WRITE_EA, self._SMBConnection.set_file_info,
+                           data=_packFeaList(eas), fileInfoClass=smb.SMB_INFO_SET_EAS)
+        else:
+            self._infoCall(shareName, pathName, FILE_WRITE_EA, self._SMBConnection.setInfo,
+                           inputBlob=_packFullEaList(eas), fileInfoClass=SMB2_FULL_EA_INFO)
+
+    def watch(self, shareName, pathName='', completionFilter=FILE_NOTIFY_CHANGE_FILE_NAME | FILE_NOTIFY_CHANGE_DIR_NAME |
+              FILE_NOTIFY_CHANGE_SIZE | FILE_NOTIFY_CHANGE_LAST_WRITE, recursive=False, context=None):
+        """
+        follows the changes made to a directory (SMB2/3 only). The calls run inside useContext(context), cancelling
+        the context (from any thread) ends the iteration, so does closing the generator
+
+        :param string shareName: name for the share where the directory is
+        :param string pathName: the directory, '' for the share's root
+        :param int completionFilter: a combination of FILE_NOTIFY_CHANGE_* values
+        :param bool recursive: whether to watch the subdirectories too
+        :param smb3.Context context: optional, to stop watching
+
+        :return: a generator of (action, fileName) tuples, action being one of FILE_ACTION_*. fileName is relative
+                 to pathName, None if action is FILE_ACTION_OVERFLOW. Raises a SessionError exception if error.
+        """
+        if self.getDialect() == smb.SMB_DIALECT:
+            raise SessionError(error = nt_errors.STATUS_NOT_SUPPORTED)
+
+        if context is None:
+            # Without one the waits would time out like any other call, changes may take long to come
+            context = smb3.Context()
+
+        treeId = self.connectTree(shareName)
+        fileId = None
+        try:
+            fileId = self.openFile(treeId, pathName, desiredAccess=FILE_LIST_DIRECTORY,
+                                   shareMode=FILE_SHARE_READ | FILE_SHARE_WRITE | FILE_SHARE_DELETE,
+                                   creationOption=FILE_DIRECTORY_FILE)
+            while True:
+                try:
+                    # Only the wait is bound to the context, we still need to close the directory once it's done
+                    with self._SMBConnection.useContext(context):
+                        data = self._SMBConnection.changeNotify(treeId, fileId, completionFilter,
+                                                                SMB2_WATCH_TREE if recursive is True else 0)
+                except smb3.SessionError as e:
+                    if context.isDone() is True:
+                        return
+                    raise SessionError(e.get_error_code(), e.get_error_packet())
+                if data is None:
+                    yield FILE_ACTION_OVERFLOW, None
+                    continue
+                for event in _unpackNotifyList(data):
+                    yield event
+        finally:
+            if fileId is not None:
+                self.closeFile(treeId, fileId)
+            self.disconnectTree(treeId)
+
+    def _infoCall(self, shareName, pathName, desiredAccess, method, **kwargs):
+        treeId = self.connectTree(shareName)
+        fileId = None
+        try:
+            # No FILE_NON_DIRECTORY_FILE, directories have descriptors, streams and EAs too
+            fileId = self.openFile(treeId, pathName, desiredAccess=desiredAccess,
+                                   shareMode=FILE_SHARE_READ | FILE_SHARE_WRITE | FILE_SHARE_DELETE, creationOption=0)
+            return method(treeId, fileId, **kwargs)
+        except (smb.SessionError, smb3.SessionError) as e:
+            raise SessionError(e.get_error_code(), e.get_error_packet())
+        finally:
+            if fileId is not None:
+                self.closeFile(treeId, fileId)
+            self.disconnectTree(treeId)
+
+    def openShareFS(self, shareName):
+        """
+        gives a filesystem like view of a share, see SMBShareFS
+
+        :param string shareName: name for the share to work with
+
+        :return: a SMBShareFS instance, raises a SessionError exception if error.
+
+        """
+        return SMBShareFS(self, shareName)
+
     def reconnect(self):
         """
         reconnects the SMB object based on the original options and credentials used. Only exception is that
         manualNegotiate will not be honored.
         Not only the connection will be created but also a login attempt using the original credentials and
         method (Kerberos, PtH, etc)
+        For SMB2/3 the trees connected and the files opened with durable handles (see setDurableHandles) are
+        brought back too, so their ids keep working. This can also happen by itself when the connection drops,
+        see setAutoReconnect
 
         :return: True, raises a SessionError exception if error
         """
+        if self.getDialect() != smb.SMB_DIALECT:
+            try:
+                return self._SMBConnection.reconnect()
+            except smb3.SessionError as e:
+                raise SessionError(e.get_error_code(), e.get_error_packet())
+
         userName, password, domain, lmhash, nthash, aesKey, TGT, TGS = self.getCredentials()
         self.negotiateSession(self._preferredDialect)
         if self._doKerberos is True:
@@ -913,6 +1873,73 @@ class SMBConnection:
 
         return True
 
+    def setIOWindow(self, window):
+        """
+        sets how many READ/WRITE requests are kept in flight by getFile, putFile, readFile and writeFile.
+        Only meaningful for SMB2/3, SMB1 always does one at a time
+
+        :param integer window: amount of outstanding requests, 1 turns pipelining off
+
+        :return: None
+        """
+        if self.getDialect() != smb.SMB_DIALECT:
+            self._SMBConnection.setIOWindow(window)
+
+    def setAutoReconnect(self, enabled, attempts=3):
+        """
+        whether to reconnect by itself (see reconnect) and resume what was going on when the connection
+        drops after being logged in. Only meaningful for SMB2/3, off by default. Opens only survive if
+        durable handles were asked for, see setDurableHandles. Of the requests in flight only the ones
+        that can safely run twice (reads, queries, creates asking for a durable handle) are sent again,
+        the rest fail with STATUS_CONNECTION_DISCONNECTED
+
+        :param bool enabled: True to reconnect automatically
+        :param integer attempts: how many times to try before giving up
+
+        :return: None
+        """
+        if self.getDialect() != smb.SMB_DIALECT:
+            self._SMBConnection.setAutoReconnect(enabled, attempts)
+
+    def setDurableHandles(self, enabled, timeout=0, oplockLevel=SMB2_OPLOCK_LEVEL_BATCH):
+        """
+        whether to ask for durable v2 handles when opening files, so they survive a reconnect. Only
+        meaningful for SMB 3.x. Unless the share is continuously available the server only makes a
+        handle durable along with a batch oplock, so files opened without one ask for oplockLevel instead.
+        The oplock breaks have to be acknowledged right away, so this starts the thread that reads the
+        answers (see useContext)
+
+        :param bool enabled: True to request durable handles
+        :param integer timeout: milliseconds the server keeps the handle around after a disconnect, 0 lets it choose
+        :param integer oplockLevel: oplock to ask for when the caller didn't ask for any
+
+        :return: None
+        """
+        if self.getDialect() != smb.SMB_DIALECT:
+            self._SMBConnection.setDurableHandles(enabled, timeout, oplockLevel)
+
+    @contextmanager
+    def useContext(self, context):
+        """
+        gives a deadline and a way to cancel the calls this thread makes inside the with block. Once the
+        context is done they raise SessionError with STATUS_IO_TIMEOUT or STATUS_CANCELLED, and the request
+        being waited for is cancelled on the server (SMB2 CANCEL).
+        For SMB2/3 this also starts a thread that reads the answers and routes them by MessageID, from then
+        on the connection can be shared by many threads. SMB1 only gets the deadline, as a timeout
+
+        :param smb3.Context context: the context, e.g. smb3.Context(timeout=30)
+
+        :return: a context manager
+        """
+        if self.getDialect() != smb.SMB_DIALECT:
+            with self._SMBConnection.useContext(context):
+                yield
+        elif context.remaining() is None:
+            yield
+        else:
+            with self._SMBConnection.use_timeout(max(context.remaining(), 1)):
+                yield
+
     def setTimeout(self, timeout):
         try:
             return self._SMBConnection.set_timeout(timeout)
@@ -931,12 +1958,34 @@ class SMBConnection:
         else:
             return self._SMBConnection.setSessionKey(key)
             
+    def echo(self):
+        """
+        sends an ECHO request, handy to check the connection is still alive
+
+        :return: True, raises a SessionError exception if error.
+        """
+        try:
+            if self.getDialect() == smb.SMB_DIALECT:
+                self._SMBConnection.echo()
+                return True
+            return self._SMBConnection.echo()
+        except (smb.SessionError, smb3.SessionError) as e:
+            raise SessionError(e.get_error_code(), e.get_error_packet())
+
     def close(self):
         """
         logs off and closes the underlying _NetBIOSSession()
 
         :return: None
         """
+        if self._renewalTimer is not None:
+            self._renewalTimer.cancel()
+            self._renewalTimer = None
+        with self._dfsLock:
+            dfsConnections = list(self._dfsConnections.values())
+            self._dfsConnections = {}
+        for connection in dfsConnections:
+            connection.close()
         try:
             self.logoff()
         except:
@@ -968,3 +2017,1063 @@ class SessionError(Exception):
             return 'SMB SessionError: %s(%s)' % (nt_errors.ERROR_MESSAGES[self.error])
         else:
             return 'SMB SessionError: 0x%x' % self.error
+
+
+class SMBFileInfo:
+    """
+    What SMBShareFS knows about a file or directory. The st_* attributes follow os.stat_result
+    so it can be used wherever one of those is expected
+    """
+    def __init__(self, sharedFile, name=None):
+        if name is None:
+            name = sharedFile.get_longname()
+        self.name = name
+        self.attributes = sharedFile.get_attributes()
+        self.st_size = sharedFile.get_filesize()
+        self.st_atime = sharedFile.get_atime_epoch()
+        self.st_mtime = sharedFile.get_mtime_epoch()
+        self.st_ctime = sharedFile.get_ctime_epoch()
+        if self.isDir():
+            self.st_mode = stat.S_IFDIR | 0o755
+        else:
+            self.st_mode = stat.S_IFREG | 0o644
+        if self.attributes & FILE_ATTRIBUTE_READONLY:
+            self.st_mode &= ~0o222
+
+    def isDir(self):
+        return self.attributes & FILE_ATTRIBUTE_DIRECTORY == FILE_ATTRIBUTE_DIRECTORY
+
+    def __repr__(self):
+        return '<SMBFileInfo name=%r size=%d dir=%s>' % (self.name, self.st_size, self.isDir())
+
+class SMBFile(io.RawIOBase):
+    """
+    file object over an opened remote file. Besides read/write/seek/tell/truncate it has readAt/writeAt,
+    which don't touch the file position, so it can be handed to zipfile, tarfile, shutil.copyfileobj
+    and friends. Wrap it in io.BufferedReader/io.TextIOWrapper if you need buffering or text.
+    """
+    def __init__(self, smbConnection, treeId, fileId, name, mode='rb'):
+        io.RawIOBase.__init__(self)
+        self._connection = smbConnection
+        self._treeId = treeId
+        self._fileId = fileId
+        self._position = 0
+        self.name = name
+        self.mode = mode
+
+    def __checkClosed(self):
+        if self.closed:
+            raise ValueError('I/O operation on closed file')
+
+    def readable(self):
+        return 'r' in self.mode or '+' in self.mode
+
+    def writable(self):
+        return 'w' in self.mode or 'a' in self.mode or 'x' in self.mode or '+' in self.mode
+
+    def seekable(self):
+        return True
+
+    def getSize(self):
+        self.__checkClosed()
+        return self._connection.queryInfo(self._treeId, self._fileId)['EndOfFile']
+
+    def readAt(self, offset, size):
+        """
+        reads up to size bytes at offset. Less than size bytes only means we got to the end of the file
+        """
+        self.__checkClosed()
+        if size <= 0:
+            return b''
+        return self._connection.readFile(self._treeId, self._fileId, offset, size, singleCall=False)
+
+    def writeAt(self, data, offset):
+        """
+        writes all of data at offset, returns the amount of bytes written
+        """
+        self.__checkClosed()
+        if len(data) == 0:
+            return 0
+        return self._connection.writeFile(self._treeId, self._fileId, data, offset)
+
+    def readall(self):
+        # One go instead of RawIOBase's DEFAULT_BUFFER_SIZE sized reads
+        if not self.readable():
+            raise io.UnsupportedOperation('not readable')
+        data = self.readAt(self._position, max(self.getSize() - self._position, 0))
+        self._position += len(data)
+        return data
+
+    def readinto(self, b):
+        if not self.readable():
+            raise io.UnsupportedOperation('not readable')
+        data = self.readAt(self._position, len(b))
+        b[:len(data)] = data
+        self._position += len(data)
+        return len(data)
+
+    def write(self, b):
+        if not self.writable():
+            raise io.UnsupportedOperation('not writable')
+        if 'a' in self.mode:
+            self._position = self.getSize()
+        written = self.writeAt(bytes(b), self._position)
+        self._position += written
+        return written
+
+    def seek(self, offset, whence=io.SEEK_SET):
+        self.__checkClosed()
+        if whence == io.SEEK_SET:
+            position = offset
+        elif whence == io.SEEK_CUR:
+            position = self._position + offset
+        elif whence == io.SEEK_END:
+            position = self.getSize() + offset
+        else:
+            raise ValueError('invalid whence (%r)' % whence)
+        if position < 0:
+            raise ValueError('negative seek position %d' % position)
+        self._position = position
+        return self._position
+
+    def tell(self):
+        self.__checkClosed()
+        return self._position
+
+    def truncate(self, size=None):
+        if not self.writable():
+            raise io.UnsupportedOperation('not writable')
+        if size is None:
+            size = self._position
+        self.__checkClosed()
+        self._connection.setEndOfFile(self._treeId, self._fileId, size)
+        return size
+
+    def lock(self, offset, length, exclusive=True, wait=False, context=None):
+        """
+        locks a byte range, see SMBConnection.lockFile. With wait, cancelling context (or its deadline, or
+        the connection's timeout if there's no context) gives up on the lock with SessionError(STATUS_CANCELLED
+        or STATUS_IO_TIMEOUT), and the request is cancelled on the server
+        """
+        self.__checkClosed()
+        if context is None and (wait is False or self._connection.getDialect() == smb.SMB_DIALECT):
+            # SMB1 has the server give up before we do
+            return self._connection.lockFile(self._treeId, self._fileId, offset, length, exclusive, wait)
+        # Let the reader thread do the waiting, it cancels the LOCK when it takes too long
+        with self._connection.useContext(context):
+            return self._connection.lockFile(self._treeId, self._fileId, offset, length, exclusive, wait)
+
+    def unlock(self, offset, length):
+        self.__checkClosed()
+        self._connection.unlockFile(self._treeId, self._fileId, offset, length)
+
+    def close(self):
+        if not self.closed:
+            try:
+                self._connection.closeFile(self._treeId, self._fileId)
+            finally:
+                io.RawIOBase.close(self)
+
+class SMBShareFS:
+    """
+    filesystem like view of a share. Paths are relative to the share root and can use either
+    '/' or '\\'. Errors are raised as SessionError, the same way SMBConnection does.
+
+    with smbClient.openShareFS('C$') as share:
+        for dirPath, dirNames, fileNames in share.walk('Windows/System32/drivers/etc'):
+            ...
+        zipFile = zipfile.ZipFile(share.open('backup.zip'))
+    """
+    def __init__(self, smbConnection, shareName):
+        self._connection = smbConnection
+        self._shareName = shareName
+        self._treeId = smbConnection.connectTree(shareName)
+
+    def __enter__(self):
+        return self
+
+    def __exit__(self, *args):
+        self.close()
+
+    def close(self):
+        if self._treeId is not None:
+            self._connection.disconnectTree(self._treeId)
+            self._treeId = None
+
+    def getShareName(self):
+        return self._shareName
+
+    @staticmethod
+    def _path(name):
+        name = ntpath.normpath(name.replace('/', '\\'))
+        name = name.lstrip('\\')
+        if name == '.':
+            name = ''
+        return name
+
+    def open(self, name, mode='rb'):
+        """
+        opens a file the way the builtin open() does. mode is one of r, w, a or x, plus optional + (and b,
+        since it's always binary)
+
+        :return: a SMBFile instance, raises a SessionError exception if error.
+        """
+        if mode.replace('b', '') not in ('r', 'w', 'a', 'x', 'r+', 'w+', 'a+', 'x+'):
+            raise ValueError('invalid mode: %r' % mode)
+
+        desiredAccess = FILE_READ_ATTRIBUTES
+        if 'r' in mode or '+' in mode:
+            desiredAccess |= GENERIC_READ
+        if 'r' not in mode or '+' in mode:
+            desiredAccess |= GENERIC_WRITE | FILE_WRITE_ATTRIBUTES
+
+        if 'w' in mode:
+            creationDisposition = FILE_OVERWRITE_IF
+        elif 'a' in mode:
+            creationDisposition = FILE_OPEN_IF
+        elif 'x' in mode:
+            creationDisposition = FILE_CREATE
+        else:
+            creationDisposition = FILE_OPEN
+
+        path = self._path(name)
+        fileId = self._connection.openFile(self._treeId, path, desiredAccess=desiredAccess,
+                                           shareMode=FILE_SHARE_READ | FILE_SHARE_WRITE,
+                                           creationDisposition=creationDisposition)
+        smbFile = SMBFile(self._connection, self._treeId, fileId, path, mode)
+        if 'a' in mode:
+            smbFile.seek(0, io.SEEK_END)
+        return smbFile
+
+    def stat(self, name):
+        """
+        :return: a SMBFileInfo instance, raises a SessionError exception if error.
+        """
+        path = self._path(name)
+        if path == '':
+            # The share root doesn't show up in any listing
+            return SMBFileInfo(smb.SharedFile(0, 0, 0, 0, 0, FILE_ATTRIBUTE_DIRECTORY, '', ''), '.')
+
+        files = self._connection.listPath(self._shareName, path)
+        for sharedFile in files:
+            if sharedFile.get_longname().upper() == ntpath.basename(path).upper():
+                return SMBFileInfo(sharedFile)
+        # Wildcards in name could match something else
+        raise SessionError(nt_errors.STATUS_OBJECT_NAME_NOT_FOUND)
+
+    def readDir(self, name=''):
+        """
+        :return: the directory entries as SMBFileInfo instances sorted by name, raises a SessionError exception
+        if error.
+        """
+        entries = []
+        for sharedFile in self._connection.listPath(self._shareName, ntpath.join(self._path(name), '*')):
+            if sharedFile.get_longname() not in ('.', '..'):
+                entries.append(SMBFileInfo(sharedFile))
+        return sorted(entries, key=lambda entry: entry.name)
+
+    def listdir(self, name=''):
+        return [entry.name for entry in self.readDir(name)]
+
+    def exists(self, name):
+        try:
+            self.stat(name)
+        except SessionError:
+            return False
+        return True
+
+    def isdir(self, name):
+        try:
+            return self.stat(name).isDir()
+        except SessionError:
+            return False
+
+    def isfile(self, name):
+        try:
+            return not self.stat(name).isDir()
+        except SessionError:
+            return False
+
+    def walk(self, top='', include=None, exclude=None, maxDepth=None):
+        """
+        same as os.walk() (top down), dirPath being relative to the share root.
+        include and exclude are lists of glob patterns (case insensitive) matched against the names and
+        against the paths relative to top, using '/'. Excluded directories aren't walked into, include only
+        applies to files. maxDepth limits how deep it goes, 0 being just top
+        """
+        top = self._path(top)
+        for dirPath, _, dirEntries, fileEntries in _walkEntries(self._listEntries, top, ntpath.join, include,
+                                                                exclude, maxDepth):
+            dirNames = [entry[0] for entry in dirEntries]
+            yield dirPath, dirNames, [entry[0] for entry in fileEntries]
+            # The caller can prune dirNames, just like with os.walk()
+            dirEntries[:] = [entry for entry in dirEntries if entry[0] in dirNames]
+
+    def _listEntries(self, path):
+        return [(entry.name, entry.isDir(), entry.st_size, entry.st_atime, entry.st_mtime)
+                for entry in self.readDir(path)]
+
+    def utime(self, name, times=None):
+        """
+        same as os.utime(), sets the access and modification times (epoch) of a file or directory
+        """
+        if times is None:
+            times = (time.time(), time.time())
+        atime, mtime = times
+        fileId = self._connection.openFile(self._treeId, self._path(name), desiredAccess=FILE_WRITE_ATTRIBUTES,
+                                           shareMode=FILE_SHARE_READ | FILE_SHARE_WRITE | FILE_SHARE_DELETE,
+                                           creationOption=0)
+        try:
+            self._connection.setBasicInfo(self._treeId, fileId, lastAccessTime=_fileTime(atime),
+                                          lastWriteTime=_fileTime(mtime))
+        finally:
+            self._connection.closeFile(self._treeId, fileId)
+
+    def syncFromLocal(self, localDir, remoteDir='', include=None, exclude=None, maxDepth=None, checksum=False,
+                      delete=False, progress=None):
+        """
+        mirrors localDir into remoteDir. Files are copied when the size or modification time differ (or
+        the SHA-256, if checksum is True) and get the local times. Missing directories are created, and
+        get the local times too once their contents are synced. With delete, files and directories not in
+        localDir are removed from remoteDir. include, exclude and maxDepth work as in walk() and apply to
+        both sides.
+
+        progress, if given, is called as progress(action, path, done, total), action being 'mkdir', 'copy'
+        (once per chunk, done and total in bytes), 'skip' or 'delete'
+
+        :return: a dict with the amount of 'dirs' created, files 'copied', 'skipped' and 'deleted', and 'bytes'
+                 copied. Raises a SessionError exception if error.
+        """
+        remoteDir = self._path(remoteDir)
+        if remoteDir != '' and self.exists(remoteDir) is False:
+            self._makeDirs(remoteDir)
+        return _sync(_LocalTree(localDir), _ShareTree(self, remoteDir), include, exclude, maxDepth, checksum,
+                     delete, progress)
+
+    def syncToLocal(self, remoteDir, localDir, include=None, exclude=None, maxDepth=None, checksum=False,
+                    delete=False, progress=None):
+        """
+        mirrors remoteDir into localDir, see syncFromLocal()
+        """
+        if os.path.isdir(localDir) is False:
+            os.makedirs(localDir)
+        return _sync(_ShareTree(self, self._path(remoteDir)), _LocalTree(localDir), include, exclude, maxDepth,
+                     checksum, delete, progress)
+
+    def _makeDirs(self, name):
+        path = ''
+        for component in name.split('\\'):
+            path = ntpath.join(path, component)
+            if self.exists(path) is False:
+                self.mkdir(path)
+
+    def readFile(self, name):
+        smbFile = self.open(name, 'rb')
+        try:
+            return smbFile.readall()
+        finally:
+            smbFile.close()
+
+    def writeFile(self, name, data):
+        smbFile = self.open(name, 'wb')
+        try:
+            smbFile.writeAt(data, 0)
+        finally:
+            smbFile.close()
+
+    def mkdir(self, name):
+        return self._connection.createDirectory(self._shareName, self._path(name))
+
+    def rmdir(self, name):
+        return self._connection.deleteDirectory(self._shareName, self._path(name))
+
+    def remove(self, name):
+        return self._connection.deleteFile(self._shareName, self._path(name))
+
+    def rename(self, oldName, newName):
+        return self._connection.rename(self._shareName, self._path(oldName), self._path(newName))
+
+
+def _fileTime(epoch):
+    return int(epoch * 10000000) + 116444736000000000
+
+def _matches(name, relPath, patterns):
+    if patterns is None:
+        return False
+    for pattern in patterns:
+        pattern = pattern.lower()
+        if fnmatch.fnmatchcase(name.lower(), pattern) or fnmatch.fnmatchcase(relPath.lower(), pattern):
+            return True
+    return False
+
+def _walkEntries(listEntries, top, join, include, exclude, maxDepth, depth=0, relTop=''):
+    # Yields (path, relative path, dir entries, file entries), entries being
+    # (name, isDir, size, atime, mtime). Used by SMBShareFS.walk() and the sync
+    dirEntries = []
+    fileEntries = []
+    for entry in listEntries(top):
+        relPath = entry[0] if relTop == '' else relTop + '/' + entry[0]
+        if _matches(entry[0], relPath, exclude):
+            continue
+        if entry[1]:
+            dirEntries.append(entry)
+        elif include is None or _matches(entry[0], relPath, include):
+            fileEntries.append(entry)
+
+    yield top, relTop, dirEntries, fileEntries
+
+    if maxDepth is not None and depth >= maxDepth:
+        return
+    for entry in dirEntries:
+        relPath = entry[0] if relTop == '' else relTop + '/' + entry[0]
+        for result in _walkEntries(listEntries, join(top, entry[0]), join, include, exclude, maxDepth, depth + 1,
+                                   relPath):
+            yield result
+
+
+class _LocalTree:
+    # One side of a sync, a local directory. Paths are relative and use '/'
+    def __init__(self, root):
+        self.root = root
+        self.join = os.path.join
+
+    def path(self, relPath):
+        if relPath == '':
+            return self.root
+        return os.path.join(self.root, *relPath.split('/'))
+
+    def listEntries(self, path):
+        entries = []
+        for name in os.listdir(path):
+            # Links aren't followed, and only directories and regular files are of interest
+            st = os.lstat(os.path.join(path, name))
+            if stat.S_ISDIR(st.st_mode) is False and stat.S_ISREG(st.st_mode) is False:
+                continue
+            entries.append((name, stat.S_ISDIR(st.st_mode), st.st_size, st.st_atime, st.st_mtime))
+        return sorted(entries)
+
+    def open(self, relPath, mode):
+        return open(self.path(relPath), mode)
+
+    def mkdir(self, relPath):
+        os.mkdir(self.path(relPath))
+
+    def remove(self, relPath):
+        os.remove(self.path(relPath))
+
+    def rmdir(self, relPath):
+        os.rmdir(self.path(relPath))
+
+    def setTimes(self, relPath, atime, mtime):
+        os.utime(self.path(relPath), (atime, mtime))
+
+
+class _ShareTree(_LocalTree):
+    # The other side, a directory in a share
+    def __init__(self, shareFS, root):
+        self.root = root
+        self.join = ntpath.join
+        self.shareFS = shareFS
+
+    def path(self, relPath):
+        if relPath == '':
+            return self.root
+        return ntpath.join(self.root, *relPath.split('/'))
+
+    def listEntries(self, path):
+        return self.shareFS._listEntries(path)
+
+    def open(self, relPath, mode):
+        return self.shareFS.open(self.path(relPath), mode)
+
+    def mkdir(self, relPath):
+        self.shareFS.mkdir(self.path(relPath))
+
+    def remove(self, relPath):
+        self.shareFS.remove(self.path(relPath))
+
+    def rmdir(self, relPath):
+        self.shareFS.rmdir(self.path(relPath))
+
+    def setTimes(self, relPath, atime, mtime):
+        self.shareFS.utime(self.path(relPath), (atime, mtime))
+
+
+SYNC_CHUNK_SIZE = 1024 * 1024
+
+def _collectEntries(tree, include, exclude, maxDepth):
+    # Returns [(lowercase relative path, (relative path, isDir, size, atime, mtime))], parents before
+    # children, and the relative paths of the directories whose contents were listed
+    entries = []
+    walked = set()
+    for _, relTop, dirEntries, fileEntries in _walkEntries(tree.listEntries, tree.path(''), tree.join, include,
+                                                            exclude, maxDepth):
+        walked.add(relTop)
+        for entry in dirEntries + fileEntries:
+            relPath = entry[0] if relTop == '' else relTop + '/' + entry[0]
+            entries.append((relPath.lower(), (relPath,) + tuple(entry[1:])))
+    return entries, walked
+
+def _hashFile(tree, relPath):
+    digest = hashlib.sha256()
+    fileObject = tree.open(relPath, 'rb')
+    try:
+        while True:
+            data = fileObject.read(SYNC_CHUNK_SIZE)
+            if not data:
+                break
+            digest.update(data)
+    finally:
+        fileObject.close()
+    return digest.digest()
+
+def _sync(source, destination, include, exclude, maxDepth, checksum, delete, progress):
+    stats = {'dirs': 0, 'copied': 0, 'skipped': 0, 'deleted': 0, 'bytes': 0}
+
+    def report(action, relPath, done, total):
+        if progress is not None:
+            progress(action, relPath, done, total)
+
+    sourceEntries, _ = _collectEntries(source, include, exclude, maxDepth)
+    destEntries, walked = _collectEntries(destination, include, exclude, maxDepth)
+    destByPath = dict((entry[0], entry) for _, entry in destEntries)
+    destByKey = {}
+    for key, entry in destEntries:
+        destByKey.setdefault(key, []).append(entry)
+    # Destination paths that stand for a source entry, and the ones already removed
+    kept = set()
+    removed = set()
+    # Source directory -> destination directory, the names may differ in case
+    destDirs = {'': ''}
+    # (destination directory, atime, mtime), set once nothing else changes in them
+    dirTimes = []
+    sourceKeys = set()
+
+    def findDest(destPath, key):
+        # The same name if it's there, else one that only differs in case and isn't taken yet
+        candidates = [destByPath[destPath]] if destPath in destByPath else []
+        for entry in candidates + destByKey.get(key, []):
+            if entry[0] not in kept and entry[0] not in removed:
+                return entry
+        return None
+
+    def deleteEntry(relPath, isDir):
+        if isDir:
+            destination.rmdir(relPath)
+        else:
+            destination.remove(relPath)
+        removed.add(relPath)
+        stats['deleted'] += 1
+        report('delete', relPath, 0, 0)
+
+    def deleteTree(relPath):
+        # What we walked goes first, anything else left in there makes the rmdir fail
+        prefix = relPath + '/'
+        for _, (childPath, childIsDir, _, _, _) in reversed(destEntries):
+            if childPath.startswith(prefix) and childPath not in removed:
+                deleteEntry(childPath, childIsDir)
+        deleteEntry(relPath, True)
+
+    for key, (relPath, isDir, size, atime, mtime) in sourceEntries:
+        parent, _, name = relPath.rpartition('/')
+        if parent not in destDirs:
+            # Its directory was skipped
+            continue
+        if key in sourceKeys:
+            # The destination may not tell them apart
+            LOG.warning('Skipping %s, another name only differs from it in case' % relPath)
+            continue
+        sourceKeys.add(key)
+
+        destPath = name if destDirs[parent] == '' else destDirs[parent] + '/' + name
+        dest = findDest(destPath, key)
+        if dest is not None and dest[1] != isDir:
+            # A file where we want a directory or the other way around
+            if dest[1]:
+                deleteTree(dest[0])
+            else:
+                deleteEntry(dest[0], False)
+            dest = None
+        if dest is not None:
+            # Keep the destination's name if only the case differs
+            destPath = dest[0]
+            kept.add(destPath)
+
+        if isDir:
+            destDirs[relPath] = destPath
+            dirTimes.append((destPath, atime, mtime))
+            if dest is None:
+                destination.mkdir(destPath)
+                stats['dirs'] += 1
+                report('mkdir', relPath, 0, 0)
+            continue
+
+        if dest is not None and dest[2] == size and abs(dest[4] - mtime) < 2:
+            # FAT keeps times with 2 seconds of resolution
+            if checksum is False or _hashFile(source, relPath) == _hashFile(destination, destPath):
+                stats['skipped'] += 1
+                report('skip', relPath, size, size)
+                continue
+
+        sourceFile = source.open(relPath, 'rb')
+        try:
+            destFile = destination.open(destPath, 'wb')
+            try:
+                done = 0
+                while True:
+                    data = sourceFile.read(SYNC_CHUNK_SIZE)
+                    if not data:
+                        break
+                    destFile.write(data)
+                    done += len(data)
+                    report('copy', relPath, done, size)
+            finally:
+                destFile.close()
+        finally:
+            sourceFile.close()
+        destination.setTimes(destPath, atime, mtime)
+        stats['copied'] += 1
+        stats['bytes'] += done
+
+    if delete is True:
+        # Children come after their parents, so backwards they go first
+        for _, (relPath, isDir, _, _, _) in reversed(destEntries):
+            if relPath in kept or relPath in removed:
+                continue
+            if isDir:
+                # Only directories we looked into and are empty by now. Whatever is still there
+                # was filtered out or too deep
+                if relPath not in walked or len(destination.listEntries(destination.path(relPath))) > 0:
+                    continue
+            deleteEntry(relPath, isDir)
+
+    # Creating, copying and deleting in a directory updates its times. Children go first, although
+    # touching them doesn't change their parents
+    for destPath, atime, mtime in reversed(dirTimes):
+        destination.setTimes(destPath, atime, mtime)
+
+    return stats
+
+class DFSReferralCache:
+    """
+    DFS referrals by path prefix, kept until their TimeToLive runs out. All the SMBConnections share
+    DFS_REFERRAL_CACHE unless they're given another one (SMBConnection.setDfs)
+    """
+    def __init__(self):
+        self._lock = threading.Lock()
+        # Prefix in upper case -> (prefix, targets, expiration)
+        self._entries = {}
+
+    def add(self, prefix, targets, timeToLive):
+        with self._lock:
+            self._entries[prefix.rstrip('\\').upper()] = (prefix.rstrip('\\'), list(targets), time.time() + timeToLive)
+
+    def lookup(self, path):
+        """
+        :return: (prefix, targets) for the longest prefix of path with a live referral, None if there's none
+        """
+        path = path.rstrip('\\').upper()
+        now = time.time()
+        with self._lock:
+            for key in list(self._entries.keys()):
+                if self._entries[key][2] <= now:
+                    del self._entries[key]
+            while path != '':
+                if path in self._entries:
+                    return self._entries[path][0], list(self._entries[path][1])
+                path = path[:path.rfind('\\')] if '\\' in path else ''
+        return None
+
+    def remove(self, prefix):
+        with self._lock:
+            self._entries.pop(prefix.rstrip('\\').upper(), None)
+
+    def clear(self):
+        with self._lock:
+            self._entries = {}
+
+DFS_REFERRAL_CACHE = DFSReferralCache()
+
+def _readDfsString(data, offset):
+    # Null terminated UTF-16LE string at offset
+    end = offset
+    while end + 1 < len(data) and data[end:end + 2] != b'\x00\x00':
+        end += 2
+    return data[offset:end].decode('utf-16le')
+
+def _parseDfsReferrals(data):
+    response = RESP_GET_DFS_REFERRAL(data)
+    referrals = []
+    offset = 8
+    for i in range(response['NumberOfReferrals']):
+        version = struct.unpack('<H', data[offset:offset + 2])[0]
+        if version == 1:
+            entry = DFS_REFERRAL_V1(data[offset:])
+            referrals.append({'ServerType': entry['ServerType'], 'Flags': entry['ReferralEntryFlags'],
+                              'TimeToLive': DFS_DEFAULT_TTL, 'DFSPath': '', 'DFSAlternatePath': '',
+                              'NetworkAddress': _readDfsString(data, offset + 8)})
+        elif version == 2:
+            entry = DFS_REFERRAL_V2(data[offset:])
+            referrals.append({'ServerType': entry['ServerType'], 'Flags': entry['ReferralEntryFlags'],
+                              'TimeToLive': entry['TimeToLive'],
+                              'DFSPath': _readDfsString(data, offset + entry['DFSPathOffset']),
+                              'DFSAlternatePath': _readDfsString(data, offset + entry['DFSAlternatePathOffset']),
+                              'NetworkAddress': _readDfsString(data, offset + entry['NetworkAddressOffset'])})
+        else:
+            entry = DFS_REFERRAL_V3(data[offset:])
+            if entry['ReferralEntryFlags'] & DFS_NAME_LIST_REFERRAL:
+                # Domain and DC referrals
+                names = []
+                nameOffset = offset + entry['NetworkAddressOffset']
+                for j in range(entry['DFSAlternatePathOffset']):
+                    names.append(_readDfsString(data, nameOffset))
+                    nameOffset += (len(names[-1]) + 1) * 2
+                referrals.append({'ServerType': entry['ServerType'], 'Flags': entry['ReferralEntryFlags'],
+                                  'TimeToLive': entry['TimeToLive'],
+                                  'SpecialName': _readDfsString(data, offset + entry['DFSPathOffset']),
+                                  'ExpandedNames': names})
+            else:
+                referrals.append({'ServerType': entry['ServerType'], 'Flags': entry['ReferralEntryFlags'],
+                                  'TimeToLive': entry['TimeToLive'],
+                                  'DFSPath': _readDfsString(data, offset + entry['DFSPathOffset']),
+                                  'DFSAlternatePath': _readDfsString(data, offset + entry['DFSAlternatePathOffset']),
+                                  'NetworkAddress': _readDfsString(data, offset + entry['NetworkAddressOffset'])})
+        if entry['Size'] == 0:
+            break
+        offset += entry['Size']
+    # PathConsumed is in bytes
+    return {'PathConsumed': response['PathConsumed'] // 2, 'Flags': response['ReferralHeaderFlags'],
+            'Referrals': referrals}
+
+def _unpackStreamList(data):
+    # FILE_STREAM_INFORMATION entries into [(streamName, size)]
+    streams = []
+    while len(data) >= 24:
+        entry = smb.SMBFileStreamInformation(data)
+        streams.append((entry['StreamName'][:entry['StreamNameLength']].decode('utf-16le'), entry['StreamSize']))
+        if entry['NextEntryOffset'] == 0:
+            break
+        data = data[entry['NextEntryOffset']:]
+    return streams
+
+def _unpackNotifyList(data):
+    # FILE_NOTIFY_INFORMATION entries into [(action, fileName)]
+    events = []
+    while len(data) >= 12:
+        entry = FILE_NOTIFY_INFORMATION(data)
+        events.append((entry['Action'], entry['FileName'].decode('utf-16le')))
+        if entry['NextEntryOffset'] == 0:
+            break
+        data = data[entry['NextEntryOffset']:]
+    return events
+
+def _packFullEaList(eas):
+    # FILE_FULL_EA_INFORMATION entries (SMB2), 4 bytes aligned. eas is [(name, value)]
+    entries = []
+    for name, value in eas:
+        entry = struct.pack('<LBBH', 0, 0, len(name), len(value)) + name.encode('ascii') + b'\x00' + value
+        entries.append(entry + b'\x00' * ((4 - len(entry) % 4) % 4))
+    data = b''
+    for i, entry in enumerate(entries):
+        if i < len(entries) - 1:
+            entry = struct.pack('<L', len(entry)) + entry[4:]
+        data += entry
+    return data
+
+def _unpackFullEaList(data):
+    eas = {}
+    while len(data) >= 8:
+        nextEntryOffset, flags, nameLength, valueLength = struct.unpack('<LBBH', data[:8])
+        eas[data[8:8 + nameLength].decode('ascii', 'replace')] = data[9 + nameLength:9 + nameLength + valueLength]
+        if nextEntryOffset == 0:
+            break
+        data = data[nextEntryOffset:]
+    return eas
+
+def _packFeaList(eas):
+    # SMB_FEA_LIST (SMB1), the size includes itself and the entries aren't aligned
+    data = b''
+    for name, value in eas:
+        data += struct.pack('<BBH', 0, len(name), len(value)) + name.encode('ascii') + b'\x00' + value
+    return struct.pack('<L', len(data) + 4) + data
+
+def _unpackFeaList(data):
+    eas = {}
+    size = struct.unpack('<L', data[:4])[0]
+    data = data[4:size]
+    while len(data) >= 4:
+        flags, nameLength, valueLength = struct.unpack('<BBH', data[:4])
+        eas[data[4:4 + nameLength].decode('ascii', 'replace')] = data[5 + nameLength:5 + nameLength + valueLength]
+        data = data[5 + nameLength + valueLength:]
+    return eas
+
+class SMBConnectionPool:
+    """
+    keeps logged in SMBConnections around so the next caller for the same host, credentials and dialect
+    doesn't have to negotiate and log in again. Trees connected through a pooled connection stay connected
+    for whoever gets it next. Connections idle for longer than idleTimeout are closed, and the ones
+    handed out again are checked with an ECHO first (when healthCheck is True).
+
+    pool = SMBConnectionPool(maxActive=4)
+    with pool.getConnection('server', '10.0.0.1', 'user', 'password', 'DOMAIN') as smbClient:
+        tid = smbClient.connectTree('C$')
+        ...
+    pool.close()
+
+    :param integer maxIdle: connections kept per key when nobody uses them
+    :param integer maxActive: connections handed out at the same time per key, 0 for no limit
+    :param integer idleTimeout: seconds an unused connection is kept
+    :param bool healthCheck: whether to ECHO idle connections before handing them out
+    """
+    def __init__(self, maxIdle=2, maxActive=8, idleTimeout=300, healthCheck=True):
+        self._maxIdle = maxIdle
+        self._maxActive = maxActive
+        self._idleTimeout = idleTimeout
+        self._healthCheck = healthCheck
+        self._condition = threading.Condition()
+        # Key -> {'idle': [entry, ...], 'active': amount handed out}
+        self._pools = {}
+        # Keeps the secrets digest in the keys from being checked against a guessed password
+        self._salt = os.urandom(32)
+
+    def __enter__(self):
+        return self
+
+    def __exit__(self, *args):
+        self.close()
+
+    @staticmethod
+    def _ticketIdentity(ticket):
+        # TGT/TGS as returned by getKerberosTGT/getKerberosTGS, the KDC_REP tells them apart
+        if ticket is None:
+            return ''
+        if isinstance(ticket, dict) and 'KDC_REP' in ticket:
+            return hexlify(bytes(ticket['KDC_REP'])).decode('ascii')
+        return repr(ticket)
+
+    def _key(self, remoteName, remoteHost, sess_port, preferredDialect, user, password, domain, lmhash, nthash,
+             aesKey, kdcHost, TGT, TGS, useKerberos):
+        # No need to keep the secrets themselves in the keys
+        secrets = '\x00'.join(['%s' % secret for secret in (password, lmhash, nthash, aesKey,
+                                                            self._ticketIdentity(TGT), self._ticketIdentity(TGS))])
+        digest = hmac.new(self._salt, secrets.encode('utf-8'), hashlib.sha256).hexdigest()
+        return (remoteName.upper(), remoteHost.lower(), sess_port, preferredDialect, user.lower(), domain.upper(),
+                digest, useKerberos, (kdcHost or '').lower())
+
+    def _connect(self, remoteName, remoteHost, sess_port, timeout, preferredDialect):
+        return SMBConnection(remoteName, remoteHost, sess_port=sess_port, timeout=timeout,
+                             preferredDialect=preferredDialect)
+
+    def getConnection(self, remoteName, remoteHost='', user='', password='', domain='', lmhash='', nthash='',
+                      aesKey='', kdcHost=None, useKerberos=False, sess_port=nmb.SMB_SESSION_PORT, timeout=60,
+                      preferredDialect=None, wait=None, TGT=None, TGS=None):
+        """
+        gets a logged in connection, reusing an idle one if there's any. Blocks while maxActive connections
+        for the same key are out, for up to wait seconds (None waits forever)
+
+        :return: a PooledSMBConnection, close() it (or use it with 'with') to give it back.
+                 Raises a SessionError exception if error.
+        """
+        if remoteHost == '':
+            remoteHost = remoteName
+        key = self._key(remoteName, remoteHost, sess_port, preferredDialect, user, password, domain, lmhash, nthash,
+                        aesKey, kdcHost, TGT, TGS, useKerberos)
+
+        deadline = None if wait is None else time.time() + wait
+        # Closing may take a while, nobody else needs to wait for it
+        with self._condition:
+            expired = self._evictIdle()
+        for entry in expired:
+            self._closeEntry(entry)
+
+        with self._condition:
+            pool = self._pools.setdefault(key, {'idle': [], 'active': 0})
+            while self._maxActive > 0 and pool['active'] >= self._maxActive:
+                remaining = None if deadline is None else deadline - time.time()
+                if remaining is not None and remaining <= 0:
+                    raise SessionError(nt_errors.STATUS_IO_TIMEOUT)
+                self._condition.wait(remaining)
+            pool['active'] += 1
+
+        try:
+            while True:
+                with self._condition:
+                    if len(pool['idle']) == 0:
+                        break
+                    entry = pool['idle'].pop()
+                if self._isAlive(entry) is True:
+                    return PooledSMBConnection(self, key, entry)
+                self._closeEntry(entry)
+
+            connection = self._connect(remoteName, remoteHost, sess_port, timeout, preferredDialect)
+            try:
+                if useKerberos is True:
+                    connection.kerberosLogin(user, password, domain, lmhash, nthash, aesKey, kdcHost, TGT, TGS)
+                else:
+                    connection.login(user, password, domain, lmhash, nthash)
+            except:
+                connection.close()
+                raise
+            return PooledSMBConnection(self, key, {'connection': connection, 'trees': {}, 'lastUsed': time.time()})
+        except:
+            with self._condition:
+                pool['active'] -= 1
+                self._condition.notify_all()
+            raise
+
+    def _isAlive(self, entry):
+        if self._healthCheck is False:
+            return True
+        try:
+            return entry['connection'].echo() is True
+        except Exception as e:
+            LOG.debug('Pooled connection failed the health check: %s' % e)
+            return False
+
+    def _release(self, key, entry, reusable):
+        # Called by PooledSMBConnection.close()
+        entry['lastUsed'] = time.time()
+        with self._condition:
+            pool = self._pools[key]
+            pool['active'] -= 1
+            if reusable is True and len(pool['idle']) < self._maxIdle:
+                pool['idle'].append(entry)
+                entry = None
+            self._condition.notify_all()
+        if entry is not None:
+            self._closeEntry(entry)
+
+    def _evictIdle(self):
+        # Called with the lock held. Returns the entries that were idle for too long, for the caller
+        # to close once it lets go of the lock
+        now = time.time()
+        expired = []
+        for key in list(self._pools.keys()):
+            pool = self._pools[key]
+            for entry in list(pool['idle']):
+                if now - entry['lastUsed'] > self._idleTimeout:
+                    pool['idle'].remove(entry)
+                    expired.append(entry)
+            if len(pool['idle']) == 0 and pool['active'] == 0:
+                del(self._pools[key])
+        return expired
+
+    @staticmethod
+    def _closeEntry(entry):
+        try:
+            entry['connection'].close()
+        except Exception as e:
+            LOG.debug('Error closing pooled connection: %s' % e)
+
+    def getStats(self):
+        """
+        :return: a dict (remoteName, remoteHost, user, domain) -> {'idle': n, 'active': n}
+        """
+        stats = {}
+        with self._condition:
+            for key, pool in self._pools.items():
+                stat = stats.setdefault((key[0], key[1], key[4], key[5]), {'idle': 0, 'active': 0})
+                stat['idle'] += len(pool['idle'])
+                stat['active'] += pool['active']
+        return stats
+
+    def close(self):
+        """
+        closes the idle connections. The ones still out are closed when given back
+        """
+        with self._condition:
+            entries = []
+            for pool in self._pools.values():
+                entries.extend(pool['idle'])
+                pool['idle'] = []
+            self._maxIdle = 0
+        for entry in entries:
+            self._closeEntry(entry)
+
+
+class PooledSMBConnection:
+    """
+    a SMBConnection handed out by SMBConnectionPool. Everything not listed here goes straight to the
+    SMBConnection. Trees stay connected when disconnectTree is called so the next user gets them for free.
+    Files opened through it and left open are closed when it's given back.
+    close() gives the connection back to the pool, logoff() throws it away
+    """
+    def __init__(self, pool, key, entry):
+        self._pool = pool
+        self._key = key
+        self._entry = entry
+        self._reusable = True
+        # (treeId, fileId) opened by this borrower and not closed yet
+        self._files = []
+
+    def _getEntry(self):
+        if self._entry is None:
+            raise SessionError(nt_errors.STATUS_INVALID_HANDLE)
+        return self._entry
+
+    def __getattr__(self, name):
+        return getattr(self._getEntry()['connection'], name)
+
+    def __enter__(self):
+        return self
+
+    def __exit__(self, excType, *args):
+        # Something went wrong, better not hand this one out again
+        if excType is not None and excType is not SessionError:
+            self._reusable = False
+        self.close()
+
+    def getConnection(self):
+        return self._getEntry()['connection']
+
+    def connectTree(self, share):
+        entry = self._getEntry()
+        shareName = share.split('\\')[-1].upper()
+        if (shareName in entry['trees']) is False:
+            entry['trees'][shareName] = entry['connection'].connectTree(share)
+        return entry['trees'][shareName]
+
+    def disconnectTree(self, treeId):
+        self._getEntry()
+        return True
+
+    def createFile(self, treeId, pathName, *args, **kwargs):
+        fileId = self._getEntry()['connection'].createFile(treeId, pathName, *args, **kwargs)
+        self._files.append((treeId, fileId))
+        return fileId
+
+    def openFile(self, treeId, pathName, *args, **kwargs):
+        fileId = self._getEntry()['connection'].openFile(treeId, pathName, *args, **kwargs)
+        self._files.append((treeId, fileId))
+        return fileId
+
+    def closeFile(self, treeId, fileId):
+        answer = self._getEntry()['connection'].closeFile(treeId, fileId)
+        if (treeId, fileId) in self._files:
+            self._files.remove((treeId, fileId))
+        return answer
+
+    def openShareFS(self, shareName):
+        self._getEntry()
+        return SMBShareFS(self, shareName)
+
+    def logoff(self):
+        entry = self._getEntry()
+        self._reusable = False
+        return entry['connection'].logoff()
+
+    def close(self):
+        if self._entry is not None:
+            entry = self._entry
+            self._entry = None
+            # The next borrower shouldn't inherit handles (and share locks) it doesn't know about
+            if self._reusable is True:
+                for treeId, fileId in self._files:
+                    try:
+                        entry['connection'].closeFile(treeId, fileId)
+                    except Exception as e:
+                        LOG.debug('Error closing a file left open in a pooled connection: %s' % e)
+                        self._reusable = False
+                        break
+            self._files = []
+            self._pool._release(self._key, entry, self._reusable)
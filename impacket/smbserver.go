@@ -35,17 +35,21 @@ import fnmatch
 import errno
 import sys
 import random
+import re
 import shutil
 import string
 import hashlib
 import hmac
+import zlib
+import json
 
 from binascii import unhexlify, hexlify, a2b_hex
+from contextlib import contextmanager
 from six import PY2, b, text_type
-from six.moves import configparser, socketserver
+from six.moves import configparser, socketserver, BaseHTTPServer
 
 // For signing
-from impacket import smb, nmb, ntlm, uuid
+from impacket import smb, nmb, ntlm, uuid, nt_errors
 from impacket import smb3structs as smb2
 from impacket.spnego import SPNEGO_NegTokenInit, TypesMech, MechTypes, SPNEGO_NegTokenResp, ASN1_AID, ASN1_SUPPORTED_MECH
 from impacket.nt_errors import STATUS_NO_MORE_FILES, STATUS_NETWORK_NAME_DELETED, STATUS_INVALID_PARAMETER, \
@@ -53,7 +57,10 @@ from impacket.nt_errors import STATUS_NO_MORE_FILES, STATUS_NETWORK_NAME_DELETED
     STATUS_FILE_IS_A_DIRECTORY, STATUS_NOT_IMPLEMENTED, STATUS_INVALID_HANDLE, STATUS_OBJECT_NAME_COLLISION, \
     STATUS_NO_SUCH_FILE, STATUS_CANCELLED, STATUS_OBJECT_NAME_NOT_FOUND, STATUS_SUCCESS, STATUS_ACCESS_DENIED, \
     STATUS_NOT_SUPPORTED, STATUS_INVALID_DEVICE_REQUEST, STATUS_FS_DRIVER_REQUIRED, STATUS_INVALID_INFO_CLASS, \
-    STATUS_LOGON_FAILURE
+    STATUS_LOGON_FAILURE, STATUS_ACCOUNT_LOCKED_OUT, STATUS_NO_SUCH_USER, STATUS_WRONG_PASSWORD, \
+    STATUS_NO_LOGON_SERVERS, STATUS_EAS_NOT_SUPPORTED, STATUS_EA_TOO_LARGE, STATUS_INVALID_EA_NAME, \
+    STATUS_NO_EAS_ON_FILE, STATUS_NO_MORE_EAS, STATUS_BUFFER_TOO_SMALL, STATUS_OBJECT_PATH_SYNTAX_BAD, \
+    STATUS_BUFFER_OVERFLOW
 
 // Setting LOG to current's module name
 LOG = logging.getLogger(__name__)
@@ -124,6 +131,303 @@ STATUS_SMB_BAD_TID = 0x00050002
         return STATUS_LOGON_FAILURE, exportedSessionKey
 
 
+ func computeExportedSessionKey(sessionBaseKey, authenticateMessage, ntlmChallenge interface{}){
+    // For NTLMv2 the key exchange key is the session base key itself
+    keyExchangeKey = sessionBaseKey
+    if ntlmChallenge["flags"] & ntlm.NTLMSSP_NEGOTIATE_KEY_EXCH {
+        return ntlm.generateEncryptedSessionKey(keyExchangeKey, authenticateMessage["session_key"])
+    return keyExchangeKey
+
+ type SMBAuthenticator: struct {
+    """
+    Base  type for the NTLM credential backends. SMBSERVER asks every registered struct {
+    backend, in order, until one of them knows the user. authenticate() returns
+    (errorCode, exportedSessionKey, groups), STATUS_NO_SUCH_USER passes the ball
+    to the next backend.
+    """
+     func (self TYPE) hasUser(userName interface{}){
+        return false
+
+     func (self TYPE) authenticate(serverChallenge, authenticateMessage, challengeMessage, negotiateMessage interface{}){
+        return STATUS_NO_SUCH_USER, nil, []
+
+    @staticmethod
+     func checkNTHash(nthash, groups, serverChallenge, authenticateMessage, challengeMessage, negotiateMessage interface{}){
+        identity = authenticateMessage["user_name"].decode("utf-16le")
+        errorCode, sessionKey = computeNTLMv2(identity, '', nthash, serverChallenge, authenticateMessage,
+                                              challengeMessage, negotiateMessage)
+        if errorCode != STATUS_SUCCESS {
+            return errorCode, nil, []
+        return errorCode, sessionKey, groups
+
+ type NTHashFileAuthenticator struct { // SMBAuthenticator:
+    """
+    htpasswd alike file, one user per line:
+
+        name:nthash[:group1,group2,...]
+
+    Lines starting with // are skipped. The file is read again whenever it changes.
+    """
+     func (self TYPE) __init__(fileName interface{}){
+        self.__fileName = fileName
+        self.__mtime    = nil
+        self.__users    = {}
+        self.__lock     = threading.Lock()
+
+     func (self TYPE) __reload(){
+        mtime = os.stat(self.__fileName).st_mtime
+        if mtime == self.__mtime {
+            return
+        users = {}
+        with open(self.__fileName) as fd:
+            for line in fd:
+                line = line.strip("\r\n")
+                if line == '' or line.startswith("//") {
+                    continue
+                fields = line.split(":")
+                if len(fields) < 2 {
+                    LOG.error('Skipping malformed line in %s' % self.__fileName)
+                    continue
+                groups = []
+                if len(fields) > 2 {
+                    groups = [x.strip() for x in fields[2].split(",") if x.strip() != '']
+                users[fields[0].upper()] = (unhexlify(fields[1].strip()), groups)
+        self.__users = users
+        self.__mtime = mtime
+
+     func (self TYPE) __getUser(userName interface{}){
+        with self.__lock:
+            self.__reload()
+            return self.__users.get(userName.upper())
+
+     func (self TYPE) hasUser(userName interface{}){
+        return self.__getUser(userName) is not nil
+
+     func (self TYPE) authenticate(serverChallenge, authenticateMessage, challengeMessage, negotiateMessage interface{}){
+        user = self.__getUser(authenticateMessage["user_name"].decode("utf-16le"))
+        if user == nil {
+            return STATUS_NO_SUCH_USER, nil, []
+        nthash, groups = user
+        return self.checkNTHash(nthash, groups, serverChallenge, authenticateMessage, challengeMessage,
+                                negotiateMessage)
+
+ type SQLiteAuthenticator struct { // SMBAuthenticator:
+    """
+    Users stored in a SQLite table with (at least) the following columns:
+
+        name   TEXT, case insensitive match
+        nthash TEXT, hex encoded
+        groups TEXT, comma separated, can be NULL
+    """
+     func (self TYPE) __init__(fileName, table = "users" interface{}){
+        import sqlite3
+        // It goes into the statement as it is, identifiers can't be bound
+        if re.match(r'^[A-Za-z_][A-Za-z0-9_]*$', table) == nil {
+            raise Exception('Invalid table name %r' % table)
+        self.__sqlite   = sqlite3
+        self.__fileName = fileName
+        self.__table    = table
+
+     func (self TYPE) __getUser(userName interface{}){
+        // One connection per query, sqlite3 connections can't be shared among the handler threads
+        db = self.__sqlite.connect(self.__fileName)
+        try:
+            row = db.execute('SELECT nthash, groups FROM %s WHERE name = ? COLLATE NOCASE' % self.__table,
+                             (userName,)).fetchone()
+        finally:
+            db.close()
+        if row == nil {
+            return nil
+        groups = []
+        if row[1] is not nil {
+            groups = [x.strip() for x in row[1].split(",") if x.strip() != '']
+        return unhexlify(row[0]), groups
+
+     func (self TYPE) hasUser(userName interface{}){
+        return self.__getUser(userName) is not nil
+
+     func (self TYPE) authenticate(serverChallenge, authenticateMessage, challengeMessage, negotiateMessage interface{}){
+        user = self.__getUser(authenticateMessage["user_name"].decode("utf-16le"))
+        if user == nil {
+            return STATUS_NO_SUCH_USER, nil, []
+        nthash, groups = user
+        return self.checkNTHash(nthash, groups, serverChallenge, authenticateMessage, challengeMessage,
+                                negotiateMessage)
+
+ type NetlogonAuthenticator struct { // SMBAuthenticator:
+    """
+    Passes the NTLM exchange to a domain controller through NetrLogonSamLogonWithFlags.
+    It needs a machine account (and its NT hash) to set up the Netlogon secure channel.
+    Groups are returned as SIDs.
+    """
+     func (self TYPE) __init__(dcHost, domain, machineAccount, machineHash interface{}){
+        self.__dcHost         = dcHost
+        self.__domain         = domain
+        self.__machineAccount = machineAccount
+        if machineAccount.endswith("$") {
+            self.__computerName = machineAccount[:-1]
+        } else  {
+            self.__computerName = machineAccount
+            self.__machineAccount = machineAccount + '$'
+        if len(machineHash) == 32 {
+            machineHash = unhexlify(machineHash)
+        self.__machineHash    = machineHash
+        self.__dce            = nil
+        self.__sessionKey     = nil
+        self.__clientCredential = nil
+        // What the DC said about the users we asked for, hasUser() has nothing else to go on
+        self.__knownUsers     = {}
+        self.__lock           = threading.Lock()
+
+     func (self TYPE) __connect(){
+        from impacket.dcerpc.v5 import nrpc, epm, transport
+        from impacket.dcerpc.v5.rpcrt import RPC_C_AUTHN_NETLOGON, RPC_C_AUTHN_LEVEL_PKT_PRIVACY
+
+        stringBinding = epm.hept_map(self.__dcHost, nrpc.MSRPC_UUID_NRPC, protocol = "ncacn_ip_tcp")
+        rpctransport = transport.DCERPCTransportFactory(stringBinding)
+        dce = rpctransport.get_dce_rpc()
+        dce.connect()
+        dce.bind(nrpc.MSRPC_UUID_NRPC)
+
+        clientChallenge = os.urandom(8)
+        resp = nrpc.hNetrServerReqChallenge(dce, NULL, self.__computerName + '\x00', clientChallenge)
+        sessionKey = nrpc.ComputeSessionKeyStrongKey('', clientChallenge, resp["ServerChallenge"], self.__machineHash)
+        clientCredential = nrpc.ComputeNetlogonCredential(clientChallenge, sessionKey)
+        nrpc.hNetrServerAuthenticate3(dce, NULL, self.__machineAccount + '\x00',
+                                      nrpc.NETLOGON_SECURE_CHANNEL_TYPE.WorkstationSecureChannel,
+                                      self.__computerName + '\x00', clientCredential, 0x600FFFFF)
+
+        // From now on everything goes through the secure channel
+        dce.set_credentials(self.__machineAccount, '', self.__domain)
+        dce.set_auth_type(RPC_C_AUTHN_NETLOGON)
+        dce.set_auth_level(RPC_C_AUTHN_LEVEL_PKT_PRIVACY)
+        dce2 = dce.alter_ctx(nrpc.MSRPC_UUID_NRPC)
+        dce2.set_session_key(sessionKey)
+
+        self.__dce = dce2
+        self.__sessionKey = sessionKey
+        self.__clientCredential = clientCredential
+
+     func (self TYPE) __stepCredential(value interface{}){
+        // The stored credential is a 64 bits counter, it wraps around
+        self.__clientCredential = struct.pack('<Q', (struct.unpack('<Q', self.__clientCredential)[0] + value) &
+                                              0xffffffffffffffff)
+
+     func (self TYPE) __getAuthenticator(){
+        from impacket.dcerpc.v5 import nrpc
+        // [MS-NRPC] 3.1.4.5, the stored credential moves forward with every call
+        timestamp = int(time.time())
+        self.__stepCredential(timestamp)
+        authenticator = nrpc.NETLOGON_AUTHENTICATOR()
+        authenticator["Credential"] = nrpc.ComputeNetlogonCredential(self.__clientCredential, self.__sessionKey)
+        authenticator["Timestamp"] = timestamp
+        return authenticator
+
+     func (self TYPE) __checkReturnAuthenticator(returnAuthenticator interface{}){
+        from impacket.dcerpc.v5 import nrpc
+        // The DC answers with the stored credential plus one, that's how we know it's the DC we set up the channel with
+        self.__stepCredential(1)
+        return returnAuthenticator["Credential"] == nrpc.ComputeNetlogonCredential(self.__clientCredential,
+                                                                                  self.__sessionKey)
+
+     func (self TYPE) __samLogon(serverChallenge, authenticateMessage interface{}){
+        from impacket.dcerpc.v5 import nrpc
+        from impacket.dcerpc.v5.rpcrt import DCERPCException
+
+        request = nrpc.NetrLogonSamLogonWithFlags()
+        request["LogonServer"] = "\x00"
+        request["ComputerName"] = self.__computerName + '\x00'
+        request["ValidationLevel"] = nrpc.NETLOGON_VALIDATION_INFO_CLASS.NetlogonValidationSamInfo4
+        request["LogonLevel"] = nrpc.NETLOGON_LOGON_INFO_CLASS.NetlogonNetworkTransitiveInformation
+        request["LogonInformation"]["tag"] = nrpc.NETLOGON_LOGON_INFO_CLASS.NetlogonNetworkTransitiveInformation
+        logonInfo = request["LogonInformation"]["LogonNetworkTransitive"]
+        logonInfo["Identity"]["LogonDomainName"] = authenticateMessage["domain_name"].decode("utf-16le")
+        // MSV1_0_ALLOW_SERVER_TRUST_ACCOUNT | MSV1_0_ALLOW_WORKSTATION_TRUST_ACCOUNT
+        logonInfo["Identity"]["ParameterControl"] = 0x00000820
+        logonInfo["Identity"]["UserName"] = authenticateMessage["user_name"].decode("utf-16le")
+        logonInfo["Identity"]["Workstation"] = authenticateMessage["host_name"].decode("utf-16le")
+        logonInfo["LmChallenge"] = serverChallenge
+        logonInfo["NtChallengeResponse"] = authenticateMessage["ntlm"]
+        logonInfo["LmChallengeResponse"] = authenticateMessage["lanman"]
+        request["Authenticator"] = self.__getAuthenticator()
+        request["ReturnAuthenticator"]["Credential"] = b'\x00' * 8
+        request["ReturnAuthenticator"]["Timestamp"] = 0
+        request["ExtraFlags"] = 0
+        try:
+            resp = self.__dce.request(request)
+        except DCERPCException as e:
+            // Failed logons come with a return authenticator as well, the DC only skips it if it didn't like ours
+            if e.get_error_code() != STATUS_ACCESS_DENIED and e.get_packet() is not nil {
+                if self.__checkReturnAuthenticator(e.get_packet()["ReturnAuthenticator"]) is false {
+                    raise Exception('invalid return authenticator from %s' % self.__dcHost)
+            raise
+        if self.__checkReturnAuthenticator(resp["ReturnAuthenticator"]) is false {
+            raise Exception('invalid return authenticator from %s' % self.__dcHost)
+        return resp
+
+     func (self TYPE) __setKnownUser(userName, known interface{}){
+        if len(self.__knownUsers) >= 4096 {
+            self.__knownUsers.clear()
+        self.__knownUsers[userName.upper()] = known
+
+     func (self TYPE) hasUser(userName interface{}){
+        // Only the DC knows, we remember what it said last time we asked
+        if userName == nil {
+            return false
+        with self.__lock:
+            return self.__knownUsers.get(userName.upper(), false)
+
+     func (self TYPE) authenticate(serverChallenge, authenticateMessage, challengeMessage, negotiateMessage interface{}){
+        from impacket.dcerpc.v5.rpcrt import DCERPCException
+
+        userName = authenticateMessage["user_name"].decode("utf-16le")
+        with self.__lock:
+            resp = nil
+            // Second chance in case the secure channel went away
+            for attempt in range(2):
+                if self.__dce == nil {
+                    try:
+                        self.__connect()
+                    except Exception as e:
+                        LOG.error('Netlogon: cannot set up the secure channel with %s: %s' % (self.__dcHost, e))
+                        return STATUS_NO_LOGON_SERVERS, nil, []
+                try:
+                    resp = self.__samLogon(serverChallenge, authenticateMessage)
+                    break
+                except DCERPCException as e:
+                    errorCode = e.get_error_code()
+                    if errorCode in (STATUS_NO_SUCH_USER, STATUS_WRONG_PASSWORD, STATUS_LOGON_FAILURE) {
+                        LOG.debug('Netlogon: %s' % e)
+                        self.__setKnownUser(userName, errorCode != STATUS_NO_SUCH_USER)
+                        return STATUS_LOGON_FAILURE, nil, []
+                    if errorCode in nt_errors.ERROR_MESSAGES and errorCode != STATUS_ACCESS_DENIED {
+                        // Account restrictions (disabled, expired, etc) go back to the client as they are
+                        self.__setKnownUser(userName, true)
+                        return errorCode, nil, []
+                    // Anything else means the secure channel is no good anymore
+                    LOG.error('Netlogon: %s' % e)
+                    self.__dce = nil
+                except Exception as e:
+                    LOG.error('Netlogon: %s' % e)
+                    self.__dce = nil
+            if resp == nil {
+                return STATUS_NO_LOGON_SERVERS, nil, []
+            self.__setKnownUser(userName, true)
+
+        validation = resp["ValidationInformation"]["ValidationSam4"]
+        // SamInfo4 comes through a sealed channel, so the session key is not encrypted. The USER_SESSION_KEY
+        // itself, its 16 bytes are the session base key
+        sessionBaseKey = validation.fields["UserSessionKey"].getData()
+        sessionKey = computeExportedSessionKey(sessionBaseKey, authenticateMessage, challengeMessage)
+        domainSid = validation["LogonDomainId"].formatCanonical()
+        groups = ['%s-%d' % (domainSid, validation["PrimaryGroupId"])]
+        for group in validation["GroupIds"]:
+            groups.append('%s-%d' % (domainSid, group["RelativeId"]))
+        for extraSid in validation["ExtraSids"]:
+            groups.append(extraSid["Sid"].formatCanonical())
+        return STATUS_SUCCESS, sessionKey, groups
+
+
  func outputToJohnFormat(challenge, username, domain, lmresponse, ntresponse interface{}){
 // We don't want to add a possible failure here, since this is an
 // extra bonus. We try, if it fails, returns nothing
@@ -213,6 +517,211 @@ STATUS_SMB_BAD_TID = 0x00050002
     d = datetime.datetime.fromtimestamp(t)
     return (d.hour << 8) + (d.minute << 4) + d.second 
 
+// Valid characters in 8.3 names, besides letters and digits
+SHORT_NAME_CHARS = "!//$%&'()-@^_`{}~"
+// Same alphabet Samba's hash2 mangling uses
+SHORT_NAME_HASH_CHARS = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+ func isShortName(fileName interface{}){
+    // Is it a valid 8.3 name already? Case doesn't matter, the names are looked up ignoring it
+    if fileName in ('.', '..') {
+        return true
+    base, dot, extension = fileName.partition(".")
+    if len(base) == 0 or len(base) > 8 or len(extension) > 3 or '.' in extension {
+        return false
+    for c in base + extension:
+        if not (c.isalnum() and ord(c) < 0x80) and c not in SHORT_NAME_CHARS {
+            return false
+    return true
+
+ func getShortName(fileName, prefixLength = 1 interface{}){
+    """
+    8.3 name for fileName, empty when fileName is a valid 8.3 name already. As Samba's hash2
+    mangling does, the name is derived from a hash of the long one, so it stays the same
+    for as long as the file does, without keeping any state:
+
+        prefix (prefixLength chars) + hash + ~ + hash . first 3 extension chars
+    """
+    if isShortName(fileName) {
+        return ''
+
+     func clean(name interface{}){
+        return ''.join([c if (c.isalnum() and ord(c) < 0x80) or c in SHORT_NAME_CHARS else '_' for c in name.upper()])
+
+    dot = fileName.rfind(".")
+    if dot > 0 {
+        base, extension = fileName[:dot], clean(fileName[dot+1:].replace(' ', ''))[:3]
+    } else  {
+        base, extension = fileName, ''
+
+    // FNV-1 over the whole name, forced into 31 bits to stay within the 36^6 mangle space. The extension
+    // is in, otherwise report.docx and report.docm would get the same short name
+    value = 0xa6b93095
+    for c in fileName.encode("utf-8"):
+        value = ((value * 0x01000193) & 0xffffffff) ^ (c if isinstance(c, int) else ord(c))
+    value &= 0x7fffffff
+
+    shortName = list(clean(base.replace(' ', '').replace('.', ''))[:prefixLength].ljust(prefixLength, '_')) + [""] * (8 - prefixLength)
+    shortName[7] = SHORT_NAME_HASH_CHARS[value % 36]
+    shortName[6] = "~"
+    for i in range(5, prefixLength - 1, -1):
+        value //= 36
+        shortName[i] = SHORT_NAME_HASH_CHARS[value % 36]
+    shortName = "".join(shortName)
+    if extension != '' {
+        shortName += '.' + extension
+    return shortName
+
+ func getFileId(st interface{}){
+    // Stable 64 bit file id out of the device and inode numbers. Kept positive as it goes
+    // in signed fields
+    return ((st.st_dev & 0x7fff) << 48) | (st.st_ino & 0xffffffffffff)
+
+// Extended attributes live in the user namespace of the file's xattrs
+EA_XATTR_PREFIX = "user."
+// [MS-FSCC] 2.4.15, characters not allowed in EA names
+EA_INVALID_CHARS = ""*+,/:;<=>?[\\]|"
+
+ func isValidEaName(name interface{}){
+    if len(name) == 0 or len(name) > 255 {
+        return false
+    for c in name:
+        if ord(c) < 0x20 or ord(c) > 0x7e or c in EA_INVALID_CHARS {
+            return false
+    return true
+
+ func listEas(pathName interface{}){
+    // [(name, value)] out of the user.* xattrs, [] if the platform or filesystem has no xattrs
+    if not hasattr(os, 'listxattr') {
+        return []
+    eas = []
+    try:
+        for xattrName in sorted(os.listxattr(pathName)):
+            if xattrName.startswith(EA_XATTR_PREFIX) and isValidEaName(xattrName[len(EA_XATTR_PREFIX):]) {
+                eas.append((xattrName[len(EA_XATTR_PREFIX):], os.getxattr(pathName, xattrName)))
+    except OSError:
+        pass
+    return eas
+
+ func packEaList(eas interface{}){
+    // FILE_FULL_EA_INFORMATION entries, 4 bytes aligned. eas is [(name, value)]
+    entries = []
+    for name, value in eas:
+        entry = struct.pack('<LBBH', 0, 0, len(name), len(value)) + name.encode("ascii") + b'\x00' + value
+        entries.append(entry + b'\x00' * ((4 - len(entry) % 4) % 4))
+    data = b''
+    for i, entry in enumerate(entries):
+        if i < len(entries) - 1 {
+            entry = struct.pack('<L', len(entry)) + entry[4:]
+        data += entry
+    return data
+
+ func unpackEaList(data interface{}){
+    // FILE_FULL_EA_INFORMATION entries into [(name, value, flags)]
+    eas = []
+    while len(data) >= 8:
+        nextEntryOffset, flags, nameLength, valueLength = struct.unpack('<LBBH', data[:8])
+        name = data[8:8 + nameLength].decode('ascii', 'replace')
+        value = data[8 + nameLength + 1:8 + nameLength + 1 + valueLength]
+        eas.append((name, value, flags))
+        if nextEntryOffset == 0 {
+            break
+        data = data[nextEntryOffset:]
+    return eas
+
+ func unpackGetEaList(data interface{}){
+    // FILE_GET_EA_INFORMATION entries into [name]
+    names = []
+    while len(data) >= 5:
+        nextEntryOffset, nameLength = struct.unpack('<LB', data[:5])
+        names.append(data[5:5 + nameLength].decode('ascii', 'replace'))
+        if nextEntryOffset == 0 {
+            break
+        data = data[nextEntryOffset:]
+    return names
+
+ func getEaSize(pathName interface{}){
+    // What FileEaInformation and the directory listings report
+    eas = listEas(pathName)
+    if len(eas) == 0 {
+        return 0
+    return len(packEaList(eas))
+
+ func setEas(pathName, eas interface{}){
+    // eas is [(name, value, flags)], an empty value removes the EA. EA names don't care about case,
+    // so whatever was there with a different case gets replaced
+    if not hasattr(os, 'setxattr') {
+        return STATUS_EAS_NOT_SUPPORTED
+    for name, value, flags in eas:
+        if not isValidEaName(name) {
+            return STATUS_INVALID_EA_NAME
+        if len(value) > 0xffff {
+            return STATUS_EA_TOO_LARGE
+
+    existing = dict([(name.upper(), name) for name, value in listEas(pathName)])
+    try:
+        for name, value, flags in eas:
+            if name.upper() in existing {
+                os.removexattr(pathName, EA_XATTR_PREFIX + existing.pop(name.upper()))
+            if len(value) > 0 {
+                os.setxattr(pathName, EA_XATTR_PREFIX + name, value)
+                existing[name.upper()] = name
+    except OSError as e:
+        LOG.error('setEas: %s: %s' % (pathName, e))
+        if e.errno in (errno.ENOTSUP, errno.EOPNOTSUPP) {
+            return STATUS_EAS_NOT_SUPPORTED
+        if e.errno in (errno.E2BIG, errno.ENOSPC, errno.ERANGE) {
+            return STATUS_EA_TOO_LARGE
+        return STATUS_ACCESS_DENIED
+    return STATUS_SUCCESS
+
+ func queryEas(pathName, names, flags, outputBufferLength, index interface{}){
+    // Answers a FileFullEaInformation query. Returns (data, errorCode, nextIndex)
+    eas = listEas(pathName)
+    if len(names) > 0 {
+        // The ones asked for, with empty values for the ones not there
+        found = dict([(name.upper(), (name, value)) for name, value in eas])
+        eas = [found.get(name.upper(), (name, b'')) for name in names]
+        index = 0
+    elif len(eas) == 0 {
+        return b'', STATUS_NO_EAS_ON_FILE, 0
+    elif flags & smb2.SL_RESTART_SCAN {
+        index = 0
+
+    if index >= len(eas) {
+        return b'', STATUS_NO_MORE_EAS, index
+    if flags & smb2.SL_RETURN_SINGLE_ENTRY {
+        eas = eas[index:index + 1]
+    } else  {
+        eas = eas[index:]
+
+    // As many as fit, the rest come with the next query
+    count = len(eas)
+    data = packEaList(eas)
+    while count > 0 and len(data) > outputBufferLength:
+        count -= 1
+        data = packEaList(eas[:count])
+    if count == 0 {
+        return b'', STATUS_BUFFER_TOO_SMALL, index
+    if count < len(eas) {
+        return data, STATUS_BUFFER_OVERFLOW, index + count
+    return data, STATUS_SUCCESS, index + count
+
+ func getCreateContexts(recvPacket, createRequest interface{}){
+    // {name: data} out of the SMB2_CREATE request's create contexts
+    contexts = {}
+    if createRequest["CreateContextsLength"] == 0 {
+        return contexts
+    // The offset counts from the SMB2 header
+    data = recvPacket["Data"][createRequest["CreateContextsOffset"] - 64:][:createRequest["CreateContextsLength"]]
+    while len(data) >= 16:
+        nextOffset, nameOffset, nameLength, reserved, dataOffset, dataLength = struct.unpack('<LHHHHL', data[:16])
+        contexts[data[nameOffset:nameOffset + nameLength]] = data[dataOffset:dataOffset + dataLength]
+        if nextOffset == 0 {
+            break
+        data = data[nextOffset:]
+    return contexts
+
  func getShares(connId, smbServer interface{}){
     config = smbServer.getServerConfig()
     sections = config.sections()
@@ -230,13 +739,112 @@ STATUS_SMB_BAD_TID = 0x00050002
     } else  {
        return nil
 
+ type NameCache: struct {
+    """
+    Case insensitive view of the directories being served. Windows clients don't care
+    about case, but most of the filesystems we run on do. Every directory listing is
+    kept along with the directory's mtime, so changes made behind our back are noticed
+    as well. Handlers creating, renaming or deleting files invalidate the parent.
+    """
+     func (self TYPE) __init__(maxEntries = 4096 interface{}){
+        self.__maxEntries = maxEntries
+        // dirName: (mtime, {lowerName: [names]})
+        self.__entries    = {}
+        self.__lock       = threading.Lock()
+
+     func (self TYPE) __getNames(dirName interface{}){
+        try:
+            mtime = os.stat(dirName).st_mtime
+        except OSError:
+            return {}
+        with self.__lock:
+            if dirName in self.__entries and self.__entries[dirName][0] == mtime {
+                return self.__entries[dirName][1]
+        names = {}
+        try:
+            for name in os.listdir(dirName):
+                names.setdefault(name.lower(), []).append(name)
+        except OSError:
+            return {}
+        for lowerName in names:
+            if len(names[lowerName]) > 1 {
+                names[lowerName].sort()
+                LOG.warning('Case collision in %s: %s' % (dirName, ', '.join(names[lowerName])))
+        with self.__lock:
+            if len(self.__entries) >= self.__maxEntries {
+                self.__entries.clear()
+            self.__entries[dirName] = (mtime, names)
+        return names
+
+     func (self TYPE) lookup(dirName, name interface{}){
+        // Returns the name as found on disk, nil if there's no such thing
+        candidates = self.__getNames(dirName).get(name.lower())
+        if candidates == nil {
+            return nil
+        if len(candidates) > 1 {
+            LOG.warning('%s is ambiguous in %s, picking %s out of %s' % (name, dirName, candidates[0],
+                                                                         ', '.join(candidates)))
+        if os.path.lexists(os.path.join(dirName, candidates[0])) is not true {
+            // Stale, same mtime but gone
+            self.invalidate(dirName)
+            return nil
+        return candidates[0]
+
+     func (self TYPE) invalidate(dirName interface{}){
+        with self.__lock:
+            self.__entries.pop(dirName, nil)
+
+     func (self TYPE) getCollisions(dirName interface{}){
+        return [names for names in self.__getNames(dirName).values() if len(names) > 1]
+
+NAME_CACHE = NameCache()
+
+ func resolvePath(path, fileName, resolveLeaf = true interface{}){
+    // path is the share's root and fileName an already normalized relative name. Every component
+    // not found as is gets looked up ignoring case. Names not found at all are kept as they came,
+    // so they can be created
+    pathName = path
+    if fileName.startswith("/") {
+        // Absolute already, os.path.join would drop path as well
+        pathName = "/"
+    components = [x for x in fileName.split("/") if x not in ('', '.')]
+    for i, component in enumerate(components):
+        candidate = os.path.join(pathName, component)
+        if component != '..' and (resolveLeaf or i < len(components) - 1) and os.path.lexists(candidate) is not true {
+            actualName = NAME_CACHE.lookup(pathName, component)
+            if actualName is not nil {
+                candidate = os.path.join(pathName, actualName)
+        pathName = candidate
+    if len(components) == 0 {
+        // Keep os.path.join's behaviour for the share's root
+        pathName = os.path.join(path, fileName)
+    return pathName
+
+ func isInFileJail(path, pathName interface{}){
+    // Whether pathName, once .. and symlinks are resolved, is still inside the share's root
+    sharePath = os.path.realpath(path)
+    pathName = os.path.realpath(pathName)
+    return pathName == sharePath or pathName.startswith(os.path.join(sharePath, ''))
+
+ func invalidateNameCache(pathName interface{}){
+    // Something was created, renamed or deleted in pathName's directory
+    NAME_CACHE.invalidate(os.path.dirname(pathName))
+
+ func findCaseCollisions(path interface{}){
+    // Walks path returning [(directory, [names])] for every set of names only differing in case
+    collisions = []
+    for dirName, dirNames, fileNames in os.walk(path):
+        for names in NAME_CACHE.getCollisions(dirName):
+            collisions.append((dirName, names))
+    return collisions
+
  func openFile(path,fileName, accessMode, fileAttributes, openMode interface{}){
     fileName = os.path.normpath(fileName.replace('\\','/'))
     errorCode = 0
     if len(fileName) > 0 and (fileName[0] == '/' or fileName[0] == '\\') {
        // strip leading '/'
        fileName = fileName[1:]
-    pathName = os.path.join(path,fileName)
+    pathName = resolvePath(path,fileName)
     mode = 0
     // Check the Open Mode
     if openMode & 0x10 {
@@ -264,6 +872,8 @@ STATUS_SMB_BAD_TID = 0x00050002
         if sys.platform == 'win32' {
             mode |= os.O_BINARY
         fid = os.open(pathName, mode)
+        if mode & os.O_CREAT {
+            invalidateNameCache(pathName)
     except Exception as e:
         LOG.error("openFile: %s,%s" % (pathName, mode) ,e)
         fid = 0
@@ -282,12 +892,13 @@ STATUS_SMB_BAD_TID = 0x00050002
     if len(fileName) > 0 and (fileName[0] == '/' or fileName[0] == '\\') {
        // strip leading '/'
        fileName = fileName[1:]
-    pathName = os.path.join(path,fileName)
+    pathName = resolvePath(path,fileName)
     fileSize = os.path.getsize(pathName)
     (mode, ino, dev, nlink, uid, gid, size, atime, mtime, ctime) = os.stat(pathName)
     if level == smb.SMB_QUERY_FS_ATTRIBUTE_INFO or level == smb2.SMB2_FILESYSTEM_ATTRIBUTE_INFO {
         data = smb.SMBQueryFsAttributeInfo()
-        data["FileSystemAttributes"]      = smb.FILE_CASE_SENSITIVE_SEARCH | smb.FILE_CASE_PRESERVED_NAMES
+        // Names are looked up ignoring case, see resolvePath
+        data["FileSystemAttributes"]      = smb.FILE_CASE_PRESERVED_NAMES
         data["MaxFilenNameLengthInBytes"] = 255
         data["LengthOfFileSystemName"]    = len("XTFS")*2
         data["FileSystemName"]            = "XTFS".encode("utf-16le")
@@ -335,7 +946,7 @@ STATUS_SMB_BAD_TID = 0x00050002
         // strip leading '/'
         fileName = fileName[1:]
 
-     pathName = os.path.join(path,fileName)
+     pathName = resolvePath(path,fileName)
      files = []
 
      if pathName.find("*") == -1 and pathName.find("?") == -1 {
@@ -368,73 +979,83 @@ STATUS_SMB_BAD_TID = 0x00050002
      searchCount = len(files)
      errorCode = STATUS_SUCCESS
 
+     if isSMB2 is true {
+         levels = {
+             smb2.SMB2_FILE_DIRECTORY_INFO         : smb.SMBFindFileDirectoryInfo,
+             smb2.SMB2_FULL_DIRECTORY_INFO         : smb.SMBFindFileFullDirectoryInfo,
+             smb2.SMB2_FILE_BOTH_DIRECTORY_INFO    : smb.SMBFindFileBothDirectoryInfo,
+             smb2.SMB2_FILE_NAMES_INFO             : smb.SMBFindFileNamesInfo,
+             smb2.SMB2_FILE_ID_FULL_DIRECTORY_INFO : smb.SMBFindFileIdFullDirectoryInfo,
+             smb2.SMB2_FILE_ID_BOTH_DIRECTORY_INFO : smb.SMBFindFileIdBothDirectoryInfo,
+         }
+     } else  {
+         levels = {
+             smb.SMB_FIND_INFO_STANDARD               : smb.SMBFindInfoStandard,
+             smb.SMB_FIND_FILE_DIRECTORY_INFO         : smb.SMBFindFileDirectoryInfo,
+             smb.SMB_FIND_FILE_FULL_DIRECTORY_INFO    : smb.SMBFindFileFullDirectoryInfo,
+             smb.SMB_FIND_FILE_NAMES_INFO             : smb.SMBFindFileNamesInfo,
+             smb.SMB_FIND_FILE_BOTH_DIRECTORY_INFO    : smb.SMBFindFileBothDirectoryInfo,
+             smb.SMB_FIND_FILE_ID_FULL_DIRECTORY_INFO : smb.SMBFindFileIdFullDirectoryInfo,
+             smb.SMB_FIND_FILE_ID_BOTH_DIRECTORY_INFO : smb.SMBFindFileIdBothDirectoryInfo,
+         }
+     if level not in levels {
+         LOG.error("Wrong level %d!" % level)
+         return  searchResult, searchCount, STATUS_NOT_SUPPORTED
+
      for i in files:
-        if level == smb.SMB_FIND_FILE_BOTH_DIRECTORY_INFO or level == smb2.SMB2_FILE_BOTH_DIRECTORY_INFO {
-            item = smb.SMBFindFileBothDirectoryInfo( flags = pktFlags )
-        elif level == smb.SMB_FIND_FILE_DIRECTORY_INFO or level == smb2.SMB2_FILE_DIRECTORY_INFO {
-            item = smb.SMBFindFileDirectoryInfo( flags = pktFlags )
-        elif level == smb.SMB_FIND_FILE_FULL_DIRECTORY_INFO or level == smb2.SMB2_FULL_DIRECTORY_INFO {
-            item = smb.SMBFindFileFullDirectoryInfo( flags = pktFlags )
-        elif level == smb.SMB_FIND_INFO_STANDARD {
-            item = smb.SMBFindInfoStandard( flags = pktFlags )
-        elif level == smb.SMB_FIND_FILE_ID_FULL_DIRECTORY_INFO or level == smb2.SMB2_FILE_ID_FULL_DIRECTORY_INFO {
-            item = smb.SMBFindFileIdFullDirectoryInfo( flags = pktFlags )
-        elif level == smb.SMB_FIND_FILE_ID_BOTH_DIRECTORY_INFO or level == smb2.SMB2_FILE_ID_BOTH_DIRECTORY_INFO {
-            item = smb.SMBFindFileIdBothDirectoryInfo( flags = pktFlags )
-        elif level == smb.SMB_FIND_FILE_NAMES_INFO or level == smb2.SMB2_FILE_NAMES_INFO {
-            item = smb.SMBFindFileNamesInfo( flags = pktFlags )
-        } else  {
-            LOG.error("Wrong level %d!" % level)
-            return  searchResult, searchCount, STATUS_NOT_SUPPORTED
-            
-        (mode, ino, dev, nlink, uid, gid, size, atime, mtime, ctime) = os.stat(i)
+        item = levels[level]( flags = pktFlags )
+        st = os.stat(i)
+        (mode, ino, dev, nlink, uid, gid, size, atime, mtime, ctime) = st
         if os.path.isdir(i) {
-           item["ExtFileAttributes"] = smb.ATTR_DIRECTORY
+           fileAttributes = smb.ATTR_DIRECTORY
         } else  {
-           item["ExtFileAttributes"] = smb.ATTR_NORMAL | smb.ATTR_ARCHIVE
-
-        item["FileName"] = os.path.basename(i).encode(encoding)
+           fileAttributes = smb.ATTR_NORMAL | smb.ATTR_ARCHIVE
+        fileName = os.path.basename(i)
+
+        if isinstance(item, smb.SMBFindInfoStandard) {
+           // [MS-CIFS] 2.2.8.1.1, sizes are 32 bits here. Files of 4GB or more get the largest one there is
+           item["FileDataSize"]      = min(size, 0xffffffff)
+           item["AllocationSize"]    = min(size, 0xffffffff)
+           item["ExtFileAttributes"] = fileAttributes
+           item["CreationDate"]      = getSMBDate(ctime)
+           item["CreationTime"]      = getSMBTime(ctime)
+           item["LastAccessDate"]    = getSMBDate(atime)
+           item["LastAccessTime"]    = getSMBTime(atime)
+           item["LastWriteDate"]     = getSMBDate(mtime)
+           item["LastWriteTime"]     = getSMBTime(mtime)
+           item["FileName"]          = fileName.encode(encoding)
+           searchResult.append(item)
+           continue
 
-        if level == smb.SMB_FIND_FILE_BOTH_DIRECTORY_INFO or level == smb.SMB_FIND_FILE_ID_BOTH_DIRECTORY_INFO or level == smb2.SMB2_FILE_ID_BOTH_DIRECTORY_INFO or level == smb2.SMB2_FILE_BOTH_DIRECTORY_INFO {
-           item["EaSize"]            = 0
-           item["EndOfFile"]         = size
-           item["AllocationSize"]    = size
-           item["CreationTime"]      = getFileTime(ctime)
-           item["LastAccessTime"]    = getFileTime(atime)
-           item["LastWriteTime"]     = getFileTime(mtime)
-           item["LastChangeTime"]    = getFileTime(mtime)
-           item["ShortName"]         = "\x00"*24
-           item["FileName"]          = os.path.basename(i).encode(encoding)
-           padLen = (8-(len(item) % 8)) % 8
-           item["NextEntryOffset"]   = len(item) + padLen
-        elif level == smb.SMB_FIND_FILE_DIRECTORY_INFO {
-           item["EndOfFile"]         = size
-           item["AllocationSize"]    = size
-           item["CreationTime"]      = getFileTime(ctime)
-           item["LastAccessTime"]    = getFileTime(atime)
-           item["LastWriteTime"]     = getFileTime(mtime)
-           item["LastChangeTime"]    = getFileTime(mtime)
-           item["FileName"]          = os.path.basename(i).encode(encoding)
-           padLen = (8-(len(item) % 8)) % 8
-           item["NextEntryOffset"]   = len(item) + padLen
-        elif level == smb.SMB_FIND_FILE_FULL_DIRECTORY_INFO or level == smb.SMB_FIND_FILE_ID_FULL_DIRECTORY_INFO or level == smb2.SMB2_FULL_DIRECTORY_INFO {
-           item["EaSize"]            = 0
+        if not isinstance(item, smb.SMBFindFileNamesInfo) {
+           item["ExtFileAttributes"] = fileAttributes
            item["EndOfFile"]         = size
            item["AllocationSize"]    = size
            item["CreationTime"]      = getFileTime(ctime)
            item["LastAccessTime"]    = getFileTime(atime)
            item["LastWriteTime"]     = getFileTime(mtime)
            item["LastChangeTime"]    = getFileTime(mtime)
-           padLen = (8-(len(item) % 8)) % 8
-           item["NextEntryOffset"]   = len(item) + padLen
-        elif level == smb.SMB_FIND_INFO_STANDARD {
-           item["EaSize"]            = size
-           item["CreationDate"]      = getSMBDate(ctime)
-           item["CreationTime"]      = getSMBTime(ctime)
-           item["LastAccessDate"]    = getSMBDate(atime)
-           item["LastAccessTime"]    = getSMBTime(atime)
-           item["LastWriteDate"]     = getSMBDate(mtime)
-           item["LastWriteTime"]     = getSMBTime(mtime)
+
+        if isinstance(item, (smb.SMBFindFileFullDirectoryInfo, smb.SMBFindFileBothDirectoryInfo,
+                             smb.SMBFindFileIdFullDirectoryInfo, smb.SMBFindFileIdBothDirectoryInfo)):
+           // [MS-FSCC] this one holds the reparse tag for reparse points. We follow the symlinks
+           // ourselves, so nothing listed here is one
+           item["EaSize"]            = getEaSize(i)
+
+        if isinstance(item, (smb.SMBFindFileBothDirectoryInfo, smb.SMBFindFileIdBothDirectoryInfo)) {
+           if fileName in ('.', '..') {
+              shortName = ""
+           } else  {
+              shortName = getShortName(fileName)
+           item["ShortNameLength"]   = len(shortName.encode(encoding))
+           item["ShortName"]         = shortName.encode(encoding) + b'\x00' * (24 - len(shortName.encode(encoding)))
+
+        if isinstance(item, (smb.SMBFindFileIdFullDirectoryInfo, smb.SMBFindFileIdBothDirectoryInfo)) {
+           item["FileID"]            = getFileId(st)
+
+        item["FileName"]          = fileName.encode(encoding)
+        padLen = (8-(len(item) % 8)) % 8
+        item["NextEntryOffset"]   = len(item) + padLen
         searchResult.append(item)
 
      // No more files
@@ -456,7 +1077,7 @@ STATUS_SMB_BAD_TID = 0x00050002
     if len(fileName) > 0 and (fileName[0] == '/' or fileName[0] == '\\') and path != '' {
        // strip leading '/'
        fileName = fileName[1:]
-    pathName = os.path.join(path,fileName)
+    pathName = resolvePath(path,fileName)
     if os.path.exists(pathName) {
         (mode, ino, dev, nlink, uid, gid, size, atime, mtime, ctime) = os.stat(pathName)
         if level == smb.SMB_QUERY_FILE_BASIC_INFO {
@@ -493,6 +1114,7 @@ STATUS_SMB_BAD_TID = 0x00050002
                infoRecord["Directory"]         = 1
             } else  {
                infoRecord["Directory"]         = 0
+            infoRecord["EaSize"]               = getEaSize(pathName)
             infoRecord["FileName"]             = filename.encode("utf-16le")
         elif level == smb2.SMB2_FILE_NETWORK_OPEN_INFO {
             infoRecord = smb.SMBFileNetworkOpenInfo()
@@ -508,6 +1130,7 @@ STATUS_SMB_BAD_TID = 0x00050002
                infoRecord["FileAttributes"] = smb.ATTR_NORMAL | smb.ATTR_ARCHIVE
         elif level == smb.SMB_QUERY_FILE_EA_INFO or level == smb2.SMB2_FILE_EA_INFO { 
             infoRecord = smb.SMBQueryFileEaInfo()
+            infoRecord["EaSize"]               = getEaSize(pathName)
         elif level == smb2.SMB2_FILE_STREAM_INFO {
             infoRecord = smb.SMBFileStreamInformation()
         } else  {
@@ -535,6 +1158,22 @@ STATUS_SMB_BAD_TID = 0x00050002
      func (self TYPE) default(connId, smbServer, recvPacket, parameters, data, maxDataCount = 0 interface{}){
         pass
 
+    @staticmethod
+     func setSecurityDescriptor(connId, smbServer, recvPacket, parameters, data, maxDataCount = 0 interface{}){
+        // [MS-CIFS] 2.2.7.3. Security descriptors aren't applied, but we want to know who tried
+        connData = smbServer.getConnectionData(connId)
+
+        fid, reserved, securityInformation = struct.unpack('<HHL', parameters[:8])
+        if fid in connData["OpenedFiles"] {
+            errorCode = STATUS_NOT_SUPPORTED
+            smbServer.audit(connId, 'set_security', errorCode, connData["OpenedFiles"][fid]["FileName"],
+                            additional_information = securityInformation)
+        } else  {
+            errorCode = STATUS_INVALID_HANDLE
+
+        smbServer.setConnectionData(connId, connData)
+        return b'', b'', b'', errorCode
+
 // Here we implement the NT transaction handlers
  type TRANSCommands: struct {
     @staticmethod
@@ -623,7 +1262,8 @@ STATUS_SMB_BAD_TID = 0x00050002
             } else  {
                 sock = connData["OpenedFiles"][fid]["Socket"]
                 sock.send(data)
-                respData = sock.recv(maxDataCount)
+                with smbServer.unlockConnection(connId):
+                    respData = sock.recv(maxDataCount)
         } else  {
             errorCode = STATUS_INVALID_HANDLE
 
@@ -650,7 +1290,7 @@ STATUS_SMB_BAD_TID = 0x00050002
             if len(fileName) > 0 and (fileName[0] == '/' or fileName[0] == '\\') and path != '' {
                // strip leading '/'
                fileName = fileName[1:]
-            pathName = os.path.join(path,fileName)
+            pathName = resolvePath(path,fileName)
             if os.path.exists(pathName) {
                 informationLevel = setPathInfoParameters["InformationLevel"]
                 if informationLevel == smb.SMB_SET_FILE_BASIC_INFO {
@@ -1384,9 +2024,11 @@ STATUS_SMB_BAD_TID = 0x00050002
                  if connData["OpenedFiles"][comClose["FID"]]["DeleteOnClose"] is true {
                      try:
                          os.remove(connData["OpenedFiles"][comClose["FID"]]["FileName"])
+                         invalidateNameCache(connData["OpenedFiles"][comClose["FID"]]["FileName"])
                      except Exception as e:
                          smbServer.log("comClose %s" % e, logging.ERROR)
                          errorCode = STATUS_ACCESS_DENIED
+                     smbServer.audit(connId, 'delete', errorCode, connData["OpenedFiles"][comClose["FID"]]["FileName"])
                  del(connData["OpenedFiles"][comClose["FID"]])
         } else  {
             errorCode = STATUS_INVALID_HANDLE
@@ -1429,6 +2071,9 @@ STATUS_SMB_BAD_TID = 0x00050002
              except Exception as e:
                  smbServer.log('smbComWrite: %s' % e, logging.ERROR)
                  errorCode = STATUS_ACCESS_DENIED
+             if fileHandle != PIPE_FILE_DESCRIPTOR {
+                 smbServer.audit(connId, 'write', errorCode, connData["OpenedFiles"][comWriteParameters["Fid"]]["FileName"],
+                                 bytes = len(comWriteData["Data"]) if errorCode == STATUS_SUCCESS else 0)
         } else  {
             errorCode = STATUS_INVALID_HANDLE
 
@@ -1494,7 +2139,7 @@ STATUS_SMB_BAD_TID = 0x00050002
                 if fileName[0] == '/' or fileName[0] == '\\' {
                     // strip leading '/'
                     fileName = fileName[1:]
-             pathName = os.path.join(path,fileName)
+             pathName = resolvePath(path,fileName)
              if os.path.exists(pathName) {
                 errorCode = STATUS_OBJECT_NAME_COLLISION
 
@@ -1503,9 +2148,11 @@ STATUS_SMB_BAD_TID = 0x00050002
              } else  {
                  try:
                      os.mkdir(pathName)
+                     invalidateNameCache(pathName)
                  except Exception as e:
                      smbServer.log("smbComCreateDirectory: %s" % e, logging.ERROR)
                      errorCode = STATUS_ACCESS_DENIED
+             smbServer.audit(connId, 'create', errorCode, pathName, directory = true)
         } else  {
             errorCode = STATUS_SMB_BAD_TID
 
@@ -1538,13 +2185,16 @@ STATUS_SMB_BAD_TID = 0x00050002
              if len(oldFileName) > 0 and (oldFileName[0] == '/' or oldFileName[0] == '\\') {
                 // strip leading '/'
                 oldFileName = oldFileName[1:]
-             oldPathName = os.path.join(path,oldFileName)
+             oldPathName = resolvePath(path,oldFileName)
              if len(newFileName) > 0 and (newFileName[0] == '/' or newFileName[0] == '\\') {
                 // strip leading '/'
                 newFileName = newFileName[1:]
-             newPathName = os.path.join(path,newFileName)
+             // The new name keeps its case, that's the whole point of some renames
+             newPathName = resolvePath(path,newFileName, resolveLeaf = false)
 
-             if os.path.exists(oldPathName) is not true {
+             if isInFileJail(path, oldPathName) is not true or isInFileJail(path, newPathName) is not true {
+                errorCode = STATUS_OBJECT_PATH_SYNTAX_BAD
+             elif os.path.exists(oldPathName) is not true {
                 errorCode = STATUS_NO_SUCH_FILE
 
              // TODO: More checks here in the future.. Specially when we support
@@ -1552,9 +2202,12 @@ STATUS_SMB_BAD_TID = 0x00050002
              } else  {
                  try:
                      os.rename(oldPathName,newPathName)
+                     invalidateNameCache(oldPathName)
+                     invalidateNameCache(newPathName)
                  except OSError as e:
                      smbServer.log("smbComRename: %s" % e, logging.ERROR)
                      errorCode = STATUS_ACCESS_DENIED
+             smbServer.audit(connId, 'rename', errorCode, oldPathName, newPathName)
         } else  {
             errorCode = STATUS_SMB_BAD_TID
 
@@ -1587,7 +2240,7 @@ STATUS_SMB_BAD_TID = 0x00050002
              if len(fileName) > 0 and (fileName[0] == '/' or fileName[0] == '\\') {
                 // strip leading '/'
                 fileName = fileName[1:]
-             pathName = os.path.join(path,fileName)
+             pathName = resolvePath(path,fileName)
              if os.path.exists(pathName) is not true {
                 errorCode = STATUS_NO_SUCH_FILE
 
@@ -1596,9 +2249,11 @@ STATUS_SMB_BAD_TID = 0x00050002
              } else  {
                  try:
                      os.remove(pathName)
+                     invalidateNameCache(pathName)
                  except OSError as e:
                      smbServer.log("smbComDelete: %s" % e, logging.ERROR)
                      errorCode = STATUS_ACCESS_DENIED
+             smbServer.audit(connId, 'delete', errorCode, pathName)
         } else  {
             errorCode = STATUS_SMB_BAD_TID
 
@@ -1631,7 +2286,7 @@ STATUS_SMB_BAD_TID = 0x00050002
              if len(fileName) > 0 and (fileName[0] == '/' or fileName[0] == '\\') {
                 // strip leading '/'
                 fileName = fileName[1:]
-             pathName = os.path.join(path,fileName)
+             pathName = resolvePath(path,fileName)
              if os.path.exists(pathName) is not true {
                 errorCode = STATUS_NO_SUCH_FILE
 
@@ -1640,12 +2295,14 @@ STATUS_SMB_BAD_TID = 0x00050002
              } else  {
                  try:
                      os.rmdir(pathName)
+                     invalidateNameCache(pathName)
                  except OSError as e:
                      smbServer.log("smbComDeleteDirectory: %s" % e,logging.ERROR)
                      if e.errno == errno.ENOTEMPTY {
                          errorCode = STATUS_DIRECTORY_NOT_EMPTY
                      } else  {
                          errorCode = STATUS_ACCESS_DENIED
+             smbServer.audit(connId, 'delete', errorCode, pathName, directory = true)
         } else  {
             errorCode = STATUS_SMB_BAD_TID
 
@@ -1700,6 +2357,9 @@ STATUS_SMB_BAD_TID = 0x00050002
              except Exception as e:
                  smbServer.log('smbComWriteAndx: %s' % e, logging.ERROR)
                  errorCode = STATUS_ACCESS_DENIED
+             if fileHandle != PIPE_FILE_DESCRIPTOR {
+                 smbServer.audit(connId, 'write', errorCode, connData["OpenedFiles"][writeAndX["Fid"]]["FileName"],
+                                 bytes = len(writeAndXData["Data"]) if errorCode == STATUS_SUCCESS else 0)
         } else  {
             errorCode = STATUS_INVALID_HANDLE
 
@@ -1733,13 +2393,17 @@ STATUS_SMB_BAD_TID = 0x00050002
                      content = os.read(fileHandle,comReadParameters["Count"])
                  } else  {
                      sock = connData["OpenedFiles"][comReadParameters["Fid"]]["Socket"]
-                     content = sock.recv(comReadParameters["Count"])
+                     with smbServer.unlockConnection(connId):
+                         content = sock.recv(comReadParameters["Count"])
                  respParameters["Count"]    = len(content)
                  respData["DataLength"]     = len(content)
                  respData["Data"]           = content
              except Exception as e:
                  smbServer.log('smbComRead: %s ' % e, logging.ERROR)
                  errorCode = STATUS_ACCESS_DENIED
+             if fileHandle != PIPE_FILE_DESCRIPTOR {
+                 smbServer.audit(connId, 'read', errorCode, connData["OpenedFiles"][comReadParameters["Fid"]]["FileName"],
+                                 bytes = len(content) if errorCode == STATUS_SUCCESS else 0)
         } else  {
             errorCode = STATUS_INVALID_HANDLE
 
@@ -1778,7 +2442,8 @@ STATUS_SMB_BAD_TID = 0x00050002
                      content = os.read(fileHandle,readAndX["MaxCount"])
                  } else  {
                      sock = connData["OpenedFiles"][readAndX["Fid"]]["Socket"]
-                     content = sock.recv(readAndX["MaxCount"])
+                     with smbServer.unlockConnection(connId):
+                         content = sock.recv(readAndX["MaxCount"])
                  respParameters["Remaining"]    = 0xffff
                  respParameters["DataCount"]    = len(content)
                  respParameters["DataOffset"]   = 59
@@ -1787,6 +2452,9 @@ STATUS_SMB_BAD_TID = 0x00050002
              except Exception as e:
                  smbServer.log('smbComReadAndX: %s ' % e, logging.ERROR)
                  errorCode = STATUS_ACCESS_DENIED
+             if fileHandle != PIPE_FILE_DESCRIPTOR {
+                 smbServer.audit(connId, 'read', errorCode, connData["OpenedFiles"][readAndX["Fid"]]["FileName"],
+                                 bytes = len(content) if errorCode == STATUS_SUCCESS else 0)
         } else  {
             errorCode = STATUS_INVALID_HANDLE
 
@@ -1924,8 +2592,12 @@ STATUS_SMB_BAD_TID = 0x00050002
 
         respSMBCommand["Parameters"]   = respParameters
         respSMBCommand["Data"]         = respData 
+        smbServer.audit(connId, 'logoff', errorCode)
         connData["Uid"] = 0
         connData["Authenticated"] = false
+        connData["LogonVerified"] = false
+        connData["UserName"] = ""
+        connData["Groups"] = []
 
         smbServer.setConnectionData(connId, connData)
 
@@ -2010,7 +2682,7 @@ STATUS_SMB_BAD_TID = 0x00050002
              if len(fileName) > 0 and (fileName[0] == '/' or fileName[0] == '\\') {
                 // strip leading '/'
                 fileName = fileName[1:]
-             pathName = os.path.join(path,fileName)
+             pathName = resolvePath(path,fileName)
              createDisposition = ntCreateAndXParameters["Disposition"]
              mode = 0
 
@@ -2055,6 +2727,7 @@ STATUS_SMB_BAD_TID = 0x00050002
                          try:
                              // Let's create the directory
                              os.mkdir(pathName)
+                             invalidateNameCache(pathName)
                              mode = os.O_RDONLY
                          except Exception as e:
                              smbServer.log("NTCreateAndX: %s,%s,%s" % (pathName,mode,e),logging.ERROR)
@@ -2082,11 +2755,17 @@ STATUS_SMB_BAD_TID = 0x00050002
                                 sock.connect(smbServer.getRegisteredNamedPipes()[str(pathName)])
                             } else  {
                                 fid = os.open(pathName, mode)
+                                if mode & os.O_CREAT {
+                                    invalidateNameCache(pathName)
                      except Exception as e:
                          smbServer.log("NTCreateAndX: %s,%s,%s" % (pathName,mode,e),logging.ERROR)
                          //print e
                          fid = 0
                          errorCode = STATUS_ACCESS_DENIED
+
+             if str(pathName) not in smbServer.getRegisteredNamedPipes() {
+                 smbServer.audit(connId, 'create', errorCode, pathName, disposition = createDisposition,
+                                 access = ntCreateAndXParameters["AccessMask"])
         } else  {
             errorCode = STATUS_SMB_BAD_TID
 
@@ -2137,6 +2816,7 @@ STATUS_SMB_BAD_TID = 0x00050002
                 connData["OpenedFiles"][fakefid]["FileHandle"] = fid
                 connData["OpenedFiles"][fakefid]["FileName"] = pathName
                 connData["OpenedFiles"][fakefid]["DeleteOnClose"]  = deleteOnClose
+                connData["OpenedFiles"][fakefid]["Mode"]  = mode
                 if fid == PIPE_FILE_DESCRIPTOR {
                     connData["OpenedFiles"][fakefid]["Socket"] = sock
         } else  {
@@ -2168,6 +2848,7 @@ STATUS_SMB_BAD_TID = 0x00050002
                      openAndXParameters["DesiredAccess"], 
                      openAndXParameters["FileAttributes"], 
                      openAndXParameters["OpenMode"])
+             smbServer.audit(connId, 'create', errorCode, pathName, access = openAndXParameters["DesiredAccess"])
         } else  {
            errorCode = STATUS_SMB_BAD_TID
 
@@ -2245,7 +2926,12 @@ STATUS_SMB_BAD_TID = 0x00050002
             path = ntpath.basename(UNCOrShare)
 
         share = searchShare(connId, path, smbServer) 
-        if share is not nil {
+        if share is not nil and not smbServer.isShareAllowed(connId, share) {
+            smbServer.log("TreeConnectAndX %s denied to %s" % (path, connData["UserName"]), logging.ERROR)
+            errorCode = STATUS_ACCESS_DENIED
+            resp["ErrorCode"]   = errorCode >> 16
+            resp["ErrorClass"]  = errorCode & 0xff
+        elif share is not nil {
             // Simple way to generate a Tid
             if len(connData["ConnectedShares"]) == 0 {
                tid = 1
@@ -2253,6 +2939,7 @@ STATUS_SMB_BAD_TID = 0x00050002
                tid = list(connData["ConnectedShares"].keys())[-1] + 1
             connData["ConnectedShares"][tid] = share
             connData["ConnectedShares"][tid]["shareName"] = path
+            connData["ConnectedShares"][tid]["connectTime"] = time.time()
             resp["Tid"] = tid
             //smbServer.log("Connecting Share(%d:%s)" % (tid,path))
         } else  {
@@ -2260,6 +2947,7 @@ STATUS_SMB_BAD_TID = 0x00050002
             errorCode = STATUS_OBJECT_PATH_NOT_FOUND
             resp["ErrorCode"]   = errorCode >> 16
             resp["ErrorClass"]  = errorCode & 0xff
+        smbServer.audit(connId, 'tree_connect', errorCode, share = path)
         //#
         respParameters["OptionalSupport"] = smb.SMB.SMB_SUPPORT_SEARCH_BITS
 
@@ -2351,6 +3039,8 @@ STATUS_SMB_BAD_TID = 0x00050002
                 negotiateMessage.fromString(token)
                 // Let's store it in the connection data
                 connData["NEGOTIATE_MESSAGE"] = negotiateMessage
+                // The MIC is computed over the messages as they went through the wire
+                connData["NEGOTIATE_MESSAGE_DATA"] = token
                 // Let's build the answer flags
                 // TODO: Parse all the flags. With this we're leaving some clients out 
 
@@ -2424,26 +3114,27 @@ STATUS_SMB_BAD_TID = 0x00050002
                 authenticateMessage["user_name"].decode("utf-16le"),
                 authenticateMessage["host_name"].decode("utf-16le")))
                 // Do we have credentials to check?
-                if len(smbServer.getCredentials()) > 0 {
+                if smbServer.isAuthenticationRequired() {
                     identity = authenticateMessage["user_name"].decode("utf-16le")
-                    // Do we have this user's credentials?
-                    if identity in smbServer.getCredentials() {
-                        // Process data:
-                        // Let's parse some data and keep it to ourselves in case it is asked
-                        uid, lmhash, nthash = smbServer.getCredentials()[identity]
-
-                        errorCode, sessionKey = computeNTLMv2(identity, lmhash, nthash, smbServer.getSMBChallenge(),
-                                             authenticateMessage, connData["CHALLENGE_MESSAGE"], connData["NEGOTIATE_MESSAGE"])
+                    lockoutStatus = smbServer.checkLockout(connData["ClientIP"], identity)
+                    if lockoutStatus != STATUS_SUCCESS {
+                        // Don't even look at the credentials
+                        errorCode = lockoutStatus
+                    } else  {
+                        // Local credentials first, then the authentication backends
+                        errorCode, sessionKey, groups = smbServer.authenticate(connData, authenticateMessage, token)
 
                         if sessionKey is not nil {
                             connData["SignatureEnabled"] = false
                             connData["SigningSessionKey"] = sessionKey
                             connData["SignSequenceNumber"] = 1
-                    } else  {
-                        errorCode = STATUS_LOGON_FAILURE
+                        connData["Groups"] = groups
+                    smbServer.registerLogon(connData["ClientIP"], identity, errorCode)
+                    connData["LogonVerified"] = errorCode == STATUS_SUCCESS
                 } else  {
                     // No credentials provided, let's grant access
                     errorCode = STATUS_SUCCESS
+                    connData["LogonVerified"] = false
 
                 if errorCode == STATUS_SUCCESS {
                     connData["Authenticated"] = true
@@ -2455,6 +3146,8 @@ STATUS_SMB_BAD_TID = 0x00050002
                                                                               authenticateMessage["host_name"].decode("utf-16le")))
                     // Let's store it in the connection data
                     connData["AUTHENTICATE_MESSAGE"] = authenticateMessage
+                    connData["UserName"] = authenticateMessage["user_name"].decode("utf-16le")
+                    connData["SessionStart"] = time.time()
                     try:
                         jtr_dump_path = smbServer.getJTRdumpPath()
                         ntlm_hash_data = outputToJohnFormat(connData["CHALLENGE_MESSAGE"]["challenge"],
@@ -2470,6 +3163,8 @@ STATUS_SMB_BAD_TID = 0x00050002
                     respToken = SPNEGO_NegTokenResp()
                     respToken["NegResult"] = b'\x02'
                     smbServer.log("Could not authenticate user!")
+                smbServer.audit(connId, 'session_setup', errorCode, user = authenticateMessage["user_name"].decode("utf-16le"),
+                                domain = authenticateMessage["domain_name"].decode("utf-16le"))
             } else  {
                 raise Exception("Unknown NTLMSSP MessageType %d" % messageType)
 
@@ -2492,8 +3187,13 @@ STATUS_SMB_BAD_TID = 0x00050002
             errorCode = STATUS_SUCCESS
             connData["Uid"] = 10
             connData["Authenticated"] = true
+            // Nobody checked the password, the account is just what the client says
+            connData["LogonVerified"] = false
+            connData["UserName"] = sessionSetupData["Account"]
+            connData["SessionStart"] = time.time()
             respParameters["Action"] = 0
             smbServer.log('User %s\\%s authenticated successfully (basic)' % (sessionSetupData["PrimaryDomain"], sessionSetupData["Account"]))
+            smbServer.audit(connId, 'session_setup', errorCode, domain = sessionSetupData["PrimaryDomain"])
             try:
                 jtr_dump_path = smbServer.getJTRdumpPath()
                 ntlm_hash_data = outputToJohnFormat( b'', sessionSetupData["Account"], sessionSetupData["PrimaryDomain"], sessionSetupData["AnsiPwd"], sessionSetupData["UnicodePwd"] )
@@ -2508,8 +3208,11 @@ STATUS_SMB_BAD_TID = 0x00050002
         respSMBCommand["Parameters"] = respParameters
         respSMBCommand["Data"]       = respData 
 
-        // From now on, the client can ask for other commands
-        connData["Authenticated"] = true
+        // From now on, the client can ask for other commands. A failed logon takes that away
+        if errorCode == STATUS_SUCCESS {
+            connData["Authenticated"] = true
+        elif errorCode != STATUS_MORE_PROCESSING_REQUIRED {
+            connData["Authenticated"] = false
         // For now, just switching to nobody
         //os.setregid(65534,65534)
         //os.setreuid(65534,65534)
@@ -2727,6 +3430,8 @@ STATUS_SMB_BAD_TID = 0x00050002
             negotiateMessage.fromString(token)
             // Let's store it in the connection data
             connData["NEGOTIATE_MESSAGE"] = negotiateMessage
+            // The MIC is computed over the messages as they went through the wire
+            connData["NEGOTIATE_MESSAGE_DATA"] = token
             // Let's build the answer flags
             // TODO: Parse all the flags. With this we're leaving some clients out 
 
@@ -2800,29 +3505,29 @@ STATUS_SMB_BAD_TID = 0x00050002
             authenticateMessage["host_name"].decode("utf-16le")))
             // TODO: Check the credentials! Now granting permissions
             // Do we have credentials to check?
-            if len(smbServer.getCredentials()) > 0 {
+            if smbServer.isAuthenticationRequired() {
                 isGuest = false
                 identity = authenticateMessage["user_name"].decode("utf-16le")
-                // Do we have this user's credentials?
-                if identity in smbServer.getCredentials() {
-                    // Process data:
-                    // Let's parse some data and keep it to ourselves in case it is asked
-                    uid, lmhash, nthash = smbServer.getCredentials()[identity]
-
-                    errorCode, sessionKey = computeNTLMv2(identity, lmhash, nthash, smbServer.getSMBChallenge(),
-                                                          authenticateMessage, connData["CHALLENGE_MESSAGE"],
-                                                          connData["NEGOTIATE_MESSAGE"])
+                lockoutStatus = smbServer.checkLockout(connData["ClientIP"], identity)
+                if lockoutStatus != STATUS_SUCCESS {
+                    // Don't even look at the credentials
+                    errorCode = lockoutStatus
+                } else  {
+                    // Local credentials first, then the authentication backends
+                    errorCode, sessionKey, groups = smbServer.authenticate(connData, authenticateMessage, token)
 
                     if sessionKey is not nil {
                         connData["SignatureEnabled"] = true
                         connData["SigningSessionKey"] = sessionKey
                         connData["SignSequenceNumber"] = 1
-                } else  {
-                    errorCode = STATUS_LOGON_FAILURE
+                    connData["Groups"] = groups
+                smbServer.registerLogon(connData["ClientIP"], identity, errorCode)
+                connData["LogonVerified"] = errorCode == STATUS_SUCCESS
             } else  {
                 // No credentials provided, let's grant access
                 isGuest = true
                 errorCode = STATUS_SUCCESS
+                connData["LogonVerified"] = false
 
             if errorCode == STATUS_SUCCESS {
                 connData["Authenticated"] = true
@@ -2833,6 +3538,8 @@ STATUS_SMB_BAD_TID = 0x00050002
                 authenticateMessage["user_name"].decode("utf-16le"), authenticateMessage["host_name"].decode("utf-16le")))
                 // Let's store it in the connection data
                 connData["AUTHENTICATE_MESSAGE"] = authenticateMessage
+                connData["UserName"] = authenticateMessage["user_name"].decode("utf-16le")
+                connData["SessionStart"] = time.time()
                 try:
                     jtr_dump_path = smbServer.getJTRdumpPath()
                     ntlm_hash_data = outputToJohnFormat(connData["CHALLENGE_MESSAGE"]["challenge"],
@@ -2853,6 +3560,8 @@ STATUS_SMB_BAD_TID = 0x00050002
                 respToken = SPNEGO_NegTokenResp()
                 respToken["NegResult"] = b'\x02'
                 smbServer.log("Could not authenticate user!")
+            smbServer.audit(connId, 'session_setup', errorCode, user = authenticateMessage["user_name"].decode("utf-16le"),
+                            domain = authenticateMessage["domain_name"].decode("utf-16le"))
         } else  {
             raise Exception("Unknown NTLMSSP MessageType %d" % messageType)
 
@@ -2860,8 +3569,11 @@ STATUS_SMB_BAD_TID = 0x00050002
         respSMBCommand["SecurityBufferLength"] = len(respToken)
         respSMBCommand["Buffer"] = respToken.getData()
 
-        // From now on, the client can ask for other commands
-        connData["Authenticated"] = true
+        // From now on, the client can ask for other commands. A failed logon takes that away
+        if errorCode == STATUS_SUCCESS {
+            connData["Authenticated"] = true
+        elif errorCode != STATUS_MORE_PROCESSING_REQUIRED {
+            connData["Authenticated"] = false
         // For now, just switching to nobody
         //os.setregid(65534,65534)
         //os.setreuid(65534,65534)
@@ -2900,7 +3612,11 @@ STATUS_SMB_BAD_TID = 0x00050002
             path = ntpath.basename(UNCOrShare)
 
         share = searchShare(connId, path.upper(), smbServer)
-        if share is not nil {
+        if share is not nil and not smbServer.isShareAllowed(connId, share) {
+            smbServer.log("SMB2_TREE_CONNECT %s denied to %s" % (path, connData["UserName"]), logging.ERROR)
+            errorCode = STATUS_ACCESS_DENIED
+            respPacket["Status"] = errorCode
+        elif share is not nil {
             // Simple way to generate a Tid
             if len(connData["ConnectedShares"]) == 0 {
                tid = 1
@@ -2908,12 +3624,14 @@ STATUS_SMB_BAD_TID = 0x00050002
                tid = list(connData["ConnectedShares"].keys())[-1] + 1
             connData["ConnectedShares"][tid] = share
             connData["ConnectedShares"][tid]["shareName"] = path
+            connData["ConnectedShares"][tid]["connectTime"] = time.time()
             respPacket["TreeID"]    = tid
             smbServer.log("Connecting Share(%d:%s)" % (tid,path))
         } else  {
             smbServer.log("SMB2_TREE_CONNECT not found %s" % path, logging.ERROR)
             errorCode = STATUS_OBJECT_PATH_NOT_FOUND
             respPacket["Status"] = errorCode
+        smbServer.audit(connId, 'tree_connect', errorCode, share = path)
         //#
 
         if path.upper() == 'IPC$' {
@@ -2955,12 +3673,15 @@ STATUS_SMB_BAD_TID = 0x00050002
                  errorCode = STATUS_ACCESS_DENIED
 
              deleteOnClose = false
+             newDirectory = false
 
              fileName = os.path.normpath(ntCreateRequest["Buffer"][:ntCreateRequest["NameLength"]].decode("utf-16le").replace('\\','/'))
              if len(fileName) > 0 and (fileName[0] == '/' or fileName[0] == '\\') {
                 // strip leading '/'
                 fileName = fileName[1:]
-             pathName = os.path.join(path,fileName)
+             pathName = resolvePath(path,fileName)
+             // Whatever we create gets removed if the request fails later on
+             fileExisted = os.path.lexists(pathName)
              createDisposition = ntCreateRequest["CreateDisposition"]
              mode = 0
 
@@ -3005,6 +3726,8 @@ STATUS_SMB_BAD_TID = 0x00050002
                          try:
                              // Let's create the directory
                              os.mkdir(pathName)
+                             invalidateNameCache(pathName)
+                             newDirectory = true
                              mode = os.O_RDONLY
                          except Exception as e:
                              smbServer.log("SMB2_CREATE: %s,%s,%s" % (pathName,mode,e),logging.ERROR)
@@ -3032,11 +3755,36 @@ STATUS_SMB_BAD_TID = 0x00050002
                                 sock.connect(smbServer.getRegisteredNamedPipes()[str(pathName)])
                             } else  {
                                 fid = os.open(pathName, mode)
+                                if mode & os.O_CREAT {
+                                    invalidateNameCache(pathName)
                      except Exception as e:
                          smbServer.log("SMB2_CREATE: %s,%s,%s" % (pathName,mode,e),logging.ERROR)
                          //print e
                          fid = 0
                          errorCode = STATUS_ACCESS_DENIED
+
+                 // EAs given at creation time only count for new or overwritten files
+                 createContexts = getCreateContexts(recvPacket, ntCreateRequest)
+                 if errorCode == STATUS_SUCCESS and fid != PIPE_FILE_DESCRIPTOR and \
+                         struct.pack('>L', smb2.SMB2_CREATE_EA_BUFFER) in createContexts and \
+                         (newDirectory is true or mode & (os.O_CREAT | os.O_TRUNC)):
+                     errorCode = setEas(pathName, unpackEaList(createContexts[struct.pack('>L', smb2.SMB2_CREATE_EA_BUFFER)]))
+                     if errorCode != STATUS_SUCCESS {
+                         if fid > 0 {
+                             os.close(fid)
+                         if fileExisted is false {
+                             try:
+                                 if newDirectory is true {
+                                     os.rmdir(pathName)
+                                 } else  {
+                                     os.remove(pathName)
+                                 invalidateNameCache(pathName)
+                             except OSError as e:
+                                 smbServer.log("SMB2_CREATE: %s,%s" % (pathName,e),logging.ERROR)
+
+             if str(pathName) not in smbServer.getRegisteredNamedPipes() {
+                 smbServer.audit(connId, 'create', errorCode, pathName, disposition = createDisposition,
+                                 access = ntCreateRequest["DesiredAccess"])
         } else  {
             errorCode = STATUS_SMB_BAD_TID
 
@@ -3079,6 +3827,7 @@ STATUS_SMB_BAD_TID = 0x00050002
                 connData["OpenedFiles"][fakefid]["FileHandle"] = fid
                 connData["OpenedFiles"][fakefid]["FileName"] = pathName
                 connData["OpenedFiles"][fakefid]["DeleteOnClose"]  = deleteOnClose
+                connData["OpenedFiles"][fakefid]["Mode"]  = mode
                 connData["OpenedFiles"][fakefid]["Open"]  = {}
                 connData["OpenedFiles"][fakefid]["Open"]["EnumerationLocation"] = 0
                 connData["OpenedFiles"][fakefid]["Open"]["EnumerationSearchPattern"] = ""
@@ -3132,9 +3881,11 @@ STATUS_SMB_BAD_TID = 0x00050002
                              shutil.rmtree(connData["OpenedFiles"][fileID]["FileName"])
                          } else  {
                              os.remove(connData["OpenedFiles"][fileID]["FileName"])
+                         invalidateNameCache(connData["OpenedFiles"][fileID]["FileName"])
                      except Exception as e:
                          smbServer.log("SMB2_CLOSE %s" % e, logging.ERROR)
                          errorCode = STATUS_ACCESS_DENIED
+                     smbServer.audit(connId, 'delete', errorCode, pathName)
     
                  // Now fill out the response
                  if infoRecord is not nil {
@@ -3183,7 +3934,16 @@ STATUS_SMB_BAD_TID = 0x00050002
                     if queryInfo["FileInfoClass"] == smb2.SMB2_FILE_INTERNAL_INFO {
                         // No need to call queryFileInformation, we have the data here
                         infoRecord = smb2.FileInternalInformation()
-                        infoRecord["IndexNumber"] = fileID
+                        infoRecord["IndexNumber"] = getFileId(os.stat(fileName))
+                    elif queryInfo["FileInfoClass"] == smb2.SMB2_FULL_EA_INFO {
+                        names = []
+                        if queryInfo["InputBufferLength"] > 0 {
+                            names = unpackGetEaList(queryInfo["Buffer"])
+                        infoRecord, errorCode, connData["OpenedFiles"][fileID]["EaIndex"] = queryEas(
+                            fileName, names, queryInfo["Flags"], queryInfo["OutputBufferLength"],
+                            connData["OpenedFiles"][fileID].get('EaIndex', 0))
+                        if errorCode not in (STATUS_SUCCESS, STATUS_BUFFER_OVERFLOW) {
+                            infoRecord = nil
                     } else  {
                         infoRecord, errorCode = queryFileInformation(os.path.dirname(fileName),
                                                                      os.path.basename(fileName),
@@ -3267,19 +4027,46 @@ STATUS_SMB_BAD_TID = 0x00050002
                             os.write(fileHandle, b'\x00')
                     elif informationLevel == smb2.SMB2_FILE_RENAME_INFO {
                         renameInfo = smb2.FILE_RENAME_INFORMATION_TYPE_2(setInfo["Buffer"])
-                        newPathName = os.path.join(path,renameInfo["FileName"].decode("utf-16le").replace('\\', '/')) 
-                        if renameInfo["ReplaceIfExists"] == 0 and os.path.exists(newPathName) {
+                        newFileName = os.path.normpath(renameInfo["FileName"].decode("utf-16le").replace('\\', '/')).lstrip("/")
+                        // The new name keeps its case, but whatever is there with a different one counts
+                        newPathName = resolvePath(path, newFileName, resolveLeaf = false)
+                        existingPathName = resolvePath(path, newFileName)
+                        if isInFileJail(path, newPathName) is not true or \
+                                isInFileJail(path, existingPathName) is not true:
+                            smbServer.audit(connId, 'rename', STATUS_OBJECT_PATH_SYNTAX_BAD, pathName, newPathName)
+                            return [smb2.SMB2Error()], nil, STATUS_OBJECT_PATH_SYNTAX_BAD
+                        if os.path.exists(existingPathName) and os.path.exists(pathName) and \
+                                os.path.samefile(existingPathName, pathName):
+                            // Just changing the case
+                            existingPathName = newPathName
+                        if renameInfo["ReplaceIfExists"] == 0 and os.path.exists(existingPathName) {
+                            smbServer.audit(connId, 'rename', STATUS_OBJECT_NAME_COLLISION, pathName, newPathName)
                             return [smb2.SMB2Error()], nil, STATUS_OBJECT_NAME_COLLISION
+                        if existingPathName != newPathName and os.path.exists(existingPathName) {
+                            // Replace what's there rather than leaving two names only differing in case
+                            newPathName = existingPathName
                         try:
                              os.rename(pathName,newPathName)
+                             invalidateNameCache(pathName)
+                             invalidateNameCache(newPathName)
                              connData["OpenedFiles"][fileID]["FileName"] = newPathName
                         except Exception as e:
                              smbServer.log("smb2SetInfo: %s" % e, logging.ERROR)
                              errorCode = STATUS_ACCESS_DENIED
+                        smbServer.audit(connId, 'rename', errorCode, pathName, newPathName)
+                    elif informationLevel == smb2.SMB2_FULL_EA_INFO {
+                        errorCode = setEas(pathName, unpackEaList(setInfo["Buffer"]))
+                        smbServer.audit(connId, 'set_ea', errorCode, pathName)
                     } else  {
                         smbServer.log('Unknown level for set file info! 0x%x' % informationLevel, logging.ERROR)
                         // UNSUPPORTED
                         errorCode =  STATUS_NOT_SUPPORTED
+                elif setInfo["InfoType"] == smb2.SMB2_0_INFO_SECURITY {
+                    // Not supported yet, but we want to know who tried it
+                    smbServer.log("setInfo not supported (%x)" %  setInfo["InfoType"], logging.ERROR)
+                    errorCode = STATUS_NOT_SUPPORTED
+                    smbServer.audit(connId, 'set_security', errorCode, pathName,
+                                    additional_information = setInfo["AdditionalInformation"])
                 //elif setInfo["InfoType"] == smb2.SMB2_0_INFO_FILESYSTEM {
                 //    # The underlying object store information is being set.
                 //    setInfo = queryFsInformation('/', fileName, queryInfo["FileInfoClass"])
@@ -3340,6 +4127,9 @@ STATUS_SMB_BAD_TID = 0x00050002
              except Exception as e:
                  smbServer.log('SMB2_WRITE: %s' % e, logging.ERROR)
                  errorCode = STATUS_ACCESS_DENIED
+             if fileHandle != PIPE_FILE_DESCRIPTOR {
+                 smbServer.audit(connId, 'write', errorCode, connData["OpenedFiles"][fileID]["FileName"],
+                                 bytes = len(writeRequest["Buffer"]) if errorCode == STATUS_SUCCESS else 0)
         } else  {
             errorCode = STATUS_INVALID_HANDLE
 
@@ -3374,7 +4164,8 @@ STATUS_SMB_BAD_TID = 0x00050002
                      content = os.read(fileHandle,readRequest["Length"])
                  } else  {
                      sock = connData["OpenedFiles"][fileID]["Socket"]
-                     content = sock.recv(readRequest["Length"])
+                     with smbServer.unlockConnection(connId):
+                         content = sock.recv(readRequest["Length"])
 
                  respSMBCommand["DataOffset"]   = 0x50
                  respSMBCommand["DataLength"]   = len(content)
@@ -3383,6 +4174,9 @@ STATUS_SMB_BAD_TID = 0x00050002
              except Exception as e:
                  smbServer.log('SMB2_READ: %s ' % e, logging.ERROR)
                  errorCode = STATUS_ACCESS_DENIED
+             if fileHandle != PIPE_FILE_DESCRIPTOR {
+                 smbServer.audit(connId, 'read', errorCode, connData["OpenedFiles"][fileID]["FileName"],
+                                 bytes = len(content) if errorCode == STATUS_SUCCESS else 0)
         } else  {
             errorCode = STATUS_INVALID_HANDLE
 
@@ -3577,8 +4371,12 @@ STATUS_SMB_BAD_TID = 0x00050002
         } else  {
             errorCode = STATUS_SUCCESS
 
+        smbServer.audit(connId, 'logoff', errorCode)
         connData["Uid"] = 0
         connData["Authenticated"] = false
+        connData["LogonVerified"] = false
+        connData["UserName"] = ""
+        connData["Groups"] = []
 
         smbServer.setConnectionData(connId, connData)
         return [respSMBCommand], nil, errorCode
@@ -3655,7 +4453,8 @@ STATUS_SMB_BAD_TID = 0x00050002
                  } else  {
                      sock = connData["OpenedFiles"][ioctlRequest["FileID"].getData()]["Socket"]
                      sock.sendall(ioctlRequest["Buffer"])
-                     ioctlResponse = sock.recv(ioctlRequest["MaxOutputResponse"])
+                     with smbServer.unlockConnection(connId):
+                         ioctlResponse = sock.recv(ioctlRequest["MaxOutputResponse"])
              except Exception as e:
                  smbServer.log('fsctlPipeTransceive: %s ' % e, logging.ERROR)
                  errorCode = STATUS_ACCESS_DENIED
@@ -3682,6 +4481,152 @@ STATUS_SMB_BAD_TID = 0x00050002
         return validateNegotiateInfoResponse.getData(), errorCode
 
 
+// Command names, for the metrics labels
+SMB_COMMAND_NAMES = dict((value, name) for name, value in vars(smb.SMB).items() if name.startswith("SMB_COM_"))
+SMB2_COMMAND_NAMES = dict((getattr(smb2, name), name) for name in ('SMB2_NEGOTIATE', 'SMB2_SESSION_SETUP', 'SMB2_LOGOFF',
+                          'SMB2_TREE_CONNECT', 'SMB2_TREE_DISCONNECT', 'SMB2_CREATE', 'SMB2_CLOSE', 'SMB2_FLUSH',
+                          'SMB2_READ', 'SMB2_WRITE', 'SMB2_LOCK', 'SMB2_IOCTL', 'SMB2_CANCEL', 'SMB2_ECHO',
+                          'SMB2_QUERY_DIRECTORY', 'SMB2_CHANGE_NOTIFY', 'SMB2_QUERY_INFO', 'SMB2_SET_INFO',
+                          'SMB2_OPLOCK_BREAK'))
+
+ type SMBServerMetrics: struct {
+    // Same ones the Prometheus client libraries use by default
+    LATENCY_BUCKETS = (0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1.0, 2.5, 5.0, 10.0)
+
+     func (self TYPE) __init__(){
+        self.__lock = threading.Lock()
+        // (Command, Status): Count
+        self.__requests = {}
+        // Command: [Bucket Counts, Sum, Count]
+        self.__latency = {}
+        // (Direction, Share): Bytes
+        self.__bytes = {}
+        // Reason: Count
+        self.__authFailures = {}
+
+    @staticmethod
+     func getStatusName(status interface{}){
+        if status in nt_errors.ERROR_MESSAGES {
+            return nt_errors.ERROR_MESSAGES[status][0]
+        return '0x%08x' % status
+
+    @staticmethod
+     func __escape(value interface{}){
+        return str(value).replace('\\', '\\\\').replace('"', '\\"').replace('\n', '\\n')
+
+     func (self TYPE) addRequest(command, status, duration interface{}){
+        with self.__lock:
+            key = (command, self.getStatusName(status))
+            self.__requests[key] = self.__requests.get(key, 0) + 1
+            if command not in self.__latency {
+                self.__latency[command] = [[0]*len(self.LATENCY_BUCKETS), 0.0, 0]
+            latency = self.__latency[command]
+            for i in range(len(self.LATENCY_BUCKETS)):
+                if duration <= self.LATENCY_BUCKETS[i] {
+                    latency[0][i] += 1
+            latency[1] += duration
+            latency[2] += 1
+
+     func (self TYPE) addBytes(direction, share, count interface{}){
+        with self.__lock:
+            key = (direction, share)
+            self.__bytes[key] = self.__bytes.get(key, 0) + count
+
+     func (self TYPE) addAuthFailure(reason interface{}){
+        with self.__lock:
+            self.__authFailures[reason] = self.__authFailures.get(reason, 0) + 1
+
+     func (self TYPE) render(activeConnections interface{}){
+        // Text exposition format, version 0.0.4
+        connections = sessions = openFiles = 0
+        for connId, connData in list(activeConnections.items()):
+            connections += 1
+            if connData.get("Authenticated") is true {
+                sessions += 1
+            for fid, openedFile in list(connData.get('OpenedFiles', {}).items()):
+                if openedFile["FileHandle"] != PIPE_FILE_DESCRIPTOR {
+                    openFiles += 1
+
+        lines = []
+        lines.append("// HELP smb_active_connections Connections currently established.")
+        lines.append("// TYPE smb_active_connections gauge")
+        lines.append('smb_active_connections %d' % connections)
+        lines.append("// HELP smb_active_sessions Connections with an authenticated session.")
+        lines.append("// TYPE smb_active_sessions gauge")
+        lines.append('smb_active_sessions %d' % sessions)
+        lines.append("// HELP smb_open_files Files currently opened, named pipes not included.")
+        lines.append("// TYPE smb_open_files gauge")
+        lines.append('smb_open_files %d' % openFiles)
+
+        with self.__lock:
+            lines.append("// HELP smb_requests_total Requests processed, by command and NTSTATUS.")
+            lines.append("// TYPE smb_requests_total counter")
+            for command, status in sorted(self.__requests.keys()):
+                lines.append('smb_requests_total{command="%s",status="%s"} %d' % (
+                    self.__escape(command), self.__escape(status), self.__requests[(command, status)]))
+
+            lines.append("// HELP smb_request_duration_seconds Time spent processing requests, by command.")
+            lines.append("// TYPE smb_request_duration_seconds histogram")
+            for command in sorted(self.__latency.keys()):
+                buckets, total, count = self.__latency[command]
+                for i in range(len(self.LATENCY_BUCKETS)):
+                    lines.append('smb_request_duration_seconds_bucket{command="%s",le="%s"} %d' % (
+                        self.__escape(command), self.LATENCY_BUCKETS[i], buckets[i]))
+                lines.append('smb_request_duration_seconds_bucket{command="%s",le="+Inf"} %d' % (self.__escape(command), count))
+                lines.append('smb_request_duration_seconds_sum{command="%s"} %f' % (self.__escape(command), total))
+                lines.append('smb_request_duration_seconds_count{command="%s"} %d' % (self.__escape(command), count))
+
+            lines.append("// HELP smb_bytes_total Bytes read and written, by share.")
+            lines.append("// TYPE smb_bytes_total counter")
+            for direction, share in sorted(self.__bytes.keys()):
+                lines.append('smb_bytes_total{direction="%s",share="%s"} %d' % (
+                    self.__escape(direction), self.__escape(share), self.__bytes[(direction, share)]))
+
+            lines.append("// HELP smb_auth_failures_total Failed session setups, by reason.")
+            lines.append("// TYPE smb_auth_failures_total counter")
+            for reason in sorted(self.__authFailures.keys()):
+                lines.append('smb_auth_failures_total{reason="%s"} %d' % (self.__escape(reason), self.__authFailures[reason]))
+
+        return '\n'.join(lines) + '\n'
+
+ type SMBMetricsServer struct { // threading.Thread:
+    // Serves the SMBSERVER metrics over HTTP, for Prometheus to scrape
+     type MetricsHandler struct { // BaseHTTPServer.BaseHTTPRequestHandler:
+         func (self TYPE) do_GET(){
+            if self.path.split("?")[0] not in ('/', '/metrics') {
+                self.send_error(404)
+                return
+            data = self.server.smbServer.getMetrics().render(self.server.smbServer.getActiveConnections()).encode("utf-8")
+            self.send_response(200)
+            self.send_header('Content-Type', 'text/plain; version=0.0.4; charset=utf-8')
+            self.send_header('Content-Length', str(len(data)))
+            self.end_headers()
+            self.wfile.write(data)
+
+         func (self TYPE) log_message(format, *args interface{}){
+            LOG.debug('Metrics: %s - %s' % (self.client_address[0], format % args))
+
+     type MetricsHTTPServer struct { // socketserver.ThreadingMixIn, BaseHTTPServer.HTTPServer:
+        daemon_threads = true
+
+     func (self TYPE) __init__(smbServer, address = ('127.0.0.1', 9445) interface{}){
+        threading.Thread.__init__(self)
+        self.daemon = true
+        self.__server = self.MetricsHTTPServer(address, self.MetricsHandler)
+        self.__server.smbServer = smbServer
+
+     func (self TYPE) getListenPort(){
+        return self.__server.server_address[1]
+
+     func (self TYPE) run(){
+        LOG.info('Metrics listening on %s:%d' % self.__server.server_address[:2])
+        self.__server.serve_forever()
+
+     func (self TYPE) stop(){
+        self.__server.shutdown()
+        self.__server.server_close()
+
+
  type SMBSERVERHandler struct { // socketserver.BaseRequestHandler:
      func (self TYPE) __init__(request, client_address, server, select_poll = false interface{}){
         self.__SMB = server
@@ -3696,7 +4641,7 @@ STATUS_SMB_BAD_TID = 0x00050002
 
      func (self TYPE) handle(){
         self.__SMB.log("Incoming connection (%s,%d)" % (self.__ip, self.__port))
-        self.__SMB.addConnection(self.__connId, self.__ip, self.__port)
+        self.__SMB.addConnection(self.__connId, self.__ip, self.__port, self.__request)
         while true:
             try:
                 // First of all let's get the NETBIOS packet
@@ -3720,14 +4665,20 @@ STATUS_SMB_BAD_TID = 0x00050002
                    r.set_trailer(p.get_trailer())
                    self.__request.send(r.rawData())
                 } else  {
-                   resp = self.__SMB.processRequest(self.__connId, p.get_trailer())
+                   with self.__SMB.lockConnection(self.__connId):
+                       resp = self.__SMB.processRequest(self.__connId, p.get_trailer())
                    // Send all the packets received. Except for big transactions this should be
                    // a single packet
+                   packetsLength = len(p.get_trailer())
                    for i in resp:
                        if hasattr(i, 'getData') {
-                           session.send_packet(i.getData())
+                           data = i.getData()
                        } else  {
-                           session.send_packet(i)
+                           data = i
+                       session.send_packet(data)
+                       packetsLength += len(data)
+                   // Bandwidth caps are enforced by holding the connection back
+                   self.__SMB.throttle(self.__connId, packetsLength)
             except Exception as e:
                 self.__SMB.log("Handle: %s" % e)
                 //import traceback
@@ -3758,6 +4709,46 @@ STATUS_SMB_BAD_TID = 0x00050002
 
         // Our credentials to be used during the server's lifetime
         self.__credentials = {}
+        // name: [groups] for the local credentials
+        self.__credentialGroups = {}
+        // SMBAuthenticator instances, asked in order when the user is not a local one
+        self.__authenticators = []
+
+        // Users allowed to administer the server through the RPC interfaces
+        self.__adminUsers = []
+
+        // NTLM hardening, everything off by default but validating the MIC when there's one
+        self.__ntlmRejectV1      = false
+        self.__ntlmRequireMIC    = false
+        self.__ntlmMaxClockSkew  = 0
+        self.__ntlmSPNValidation = 0
+        self.__ntlmSPNAliases    = []
+
+        // Audit trail, JSON lines to a file and/or events to a callback
+        self.__auditFile     = nil
+        self.__auditCallback = nil
+        self.__auditLock     = threading.Lock()
+
+        // Called with the connId of every connection that goes away
+        self.__closeCallbacks = []
+
+        // Lockout and rate limiting, all of them disabled by default
+        self.__lockoutThreshold    = 0
+        self.__lockoutWindow       = 300
+        self.__lockoutDuration     = 900
+        self.__connectionRateLimit = 0
+        self.__bandwidthLimit      = 0
+        // ('ip' or 'user', value): [failed logon times]
+        self.__logonFailures       = {}
+        // ('ip' or 'user', value): locked out until
+        self.__lockouts            = {}
+        // IP: [connection times]
+        self.__connectionAttempts  = {}
+        self.__lockoutLock         = threading.Lock()
+
+        // Counters for the metrics listener, always collected
+        self.__metrics       = SMBServerMetrics()
+        self.__metricsServer = nil
 
         // Our log file
         self.__logFile = ""
@@ -3781,7 +4772,8 @@ STATUS_SMB_BAD_TID = 0x00050002
 
         self.__smbNTTransCommands = {
         // NT IOCTL, can't find doc for this
-        0xff                               :self.__smbNTTransHandler.default
+        0xff                               :self.__smbNTTransHandler.default,
+smb.SMB.NT_TRANSACT_SET_SECURITY_DESC  :self.__smbNTTransHandler.setSecurityDescriptor,
         }
 
         self.__smbTransCommands  = {
@@ -3878,14 +4870,178 @@ smb.SMB.TRANS_TRANSACT_NMPIPE          :self.__smbTransHandler.transactNamedPipe
      func (self TYPE) getCredentials(){
         return self.__credentials
 
+     func (self TYPE) addAuthenticator(authenticator interface{}){
+        self.__authenticators.append(authenticator)
+
+     func (self TYPE) getAuthenticators(){
+        return self.__authenticators
+
+     func (self TYPE) isAuthenticationRequired(){
+        // Without credentials nor backends everybody gets in as guest
+        return len(self.__credentials) > 0 or len(self.__authenticators) > 0
+
+     func (self TYPE) hasUser(userName interface{}){
+        if userName in self.__credentials {
+            return true
+        for authenticator in self.__authenticators:
+            if authenticator.hasUser(userName) {
+                return true
+        return false
+
+     func (self TYPE) authenticate(connData, authenticateMessage, authenticateData interface{}){
+        // Returns (errorCode, exportedSessionKey, groups)
+        avPairs = self.__checkAuthenticateMessage(connData, authenticateMessage)
+        if avPairs == nil {
+            return STATUS_LOGON_FAILURE, nil, []
+
+        errorCode, sessionKey, groups = self.__authenticate(connData, authenticateMessage)
+        if errorCode == STATUS_SUCCESS and not self.__checkMIC(connData, authenticateMessage, authenticateData,
+                                                                avPairs, sessionKey):
+            return STATUS_LOGON_FAILURE, nil, []
+        return errorCode, sessionKey, groups
+
+     func (self TYPE) __authenticate(connData, authenticateMessage interface{}){
+        identity = authenticateMessage["user_name"].decode("utf-16le")
+        // Do we have this user's credentials?
+        if identity in self.__credentials {
+            // Process data:
+            // Let's parse some data and keep it to ourselves in case it is asked
+            uid, lmhash, nthash = self.__credentials[identity]
+
+            errorCode, sessionKey = computeNTLMv2(identity, lmhash, nthash, self.__challenge, authenticateMessage,
+                                                  connData["CHALLENGE_MESSAGE"], connData["NEGOTIATE_MESSAGE"])
+            return errorCode, sessionKey, self.__credentialGroups.get(identity, [])
+
+        for authenticator in self.__authenticators:
+            try:
+                errorCode, sessionKey, groups = authenticator.authenticate(self.__challenge, authenticateMessage,
+                                                                           connData["CHALLENGE_MESSAGE"],
+                                                                           connData["NEGOTIATE_MESSAGE"])
+            except Exception as e:
+                self.log('%s failed: %s' % (authenticator.__class__.__name__, e), logging.ERROR)
+                continue
+            if errorCode != STATUS_NO_SUCH_USER {
+                return errorCode, sessionKey, groups
+
+        return STATUS_LOGON_FAILURE, nil, []
+
+     func (self TYPE) __getValidTargetNames(connData interface{}){
+        names = [self.__serverName, socket.gethostname(), socket.getfqdn()] + self.__ntlmSPNAliases
+        try:
+            names.append(connData["ClientSocket"].getsockname()[0])
+        except Exception:
+            pass
+        return [x.upper() for x in names if x]
+
+     func (self TYPE) __checkAuthenticateMessage(connData, authenticateMessage interface{}){
+        // Checks done before looking at the credentials. Returns the client's AV_PAIRS, or nil
+        // if the message must be refused
+        identity = authenticateMessage["user_name"].decode("utf-16le")
+        if len(authenticateMessage["ntlm"]) <= 24 {
+            // NTLMv1 or LM only response, there's nothing else to check
+            if self.__ntlmRejectV1 and identity != '' {
+                self.log('Refusing NTLMv1/LM response from %s\\%s' % (
+                    authenticateMessage["domain_name"].decode("utf-16le"), identity), logging.WARNING)
+                return nil
+            return ntlm.AV_PAIRS()
+
+        // NTProofStr (16) + NTLMv2_CLIENT_CHALLENGE, where the AV_PAIRS start at offset 28
+        clientChallenge = authenticateMessage["ntlm"][16:]
+        try:
+            avPairs = ntlm.AV_PAIRS(clientChallenge[28:])
+        except Exception:
+            self.log('Malformed NTLMv2 response from %s' % identity, logging.WARNING)
+            return nil
+
+        if self.__ntlmMaxClockSkew > 0 {
+            // The NTLMv2_CLIENT_CHALLENGE time, the one that went into the NTProofStr. The MsvAvTimestamp
+            // in the AV_PAIRS is ours, echoed back, it says nothing about the client's clock
+            clientTime = (struct.unpack('<q', clientChallenge[8:16])[0] - 116444736000000000) / 10000000.0
+            if abs(time.time() - clientTime) > self.__ntlmMaxClockSkew {
+                self.log('NTLMv2 response from %s is out of the allowed clock skew (%d seconds off)' % (
+                    identity, time.time() - clientTime), logging.WARNING)
+                return nil
+
+        if self.__ntlmSPNValidation > 0 {
+            // Same levels as Windows' SmbServerNameHardeningLevel: 1 checks the SPN if present, 2 requires it
+            if avPairs[ntlm.NTLMSSP_AV_TARGET_NAME] == nil or avPairs[ntlm.NTLMSSP_AV_TARGET_NAME][0] == 0 {
+                if self.__ntlmSPNValidation > 1 {
+                    self.log('NTLMv2 response from %s without target name' % identity, logging.WARNING)
+                    return nil
+            } else  {
+                targetName = avPairs[ntlm.NTLMSSP_AV_TARGET_NAME][1].decode("utf-16le")
+                service, _, host = targetName.partition("/")
+                // Forget about the port and the service name, if any
+                host = host.split("/")[0].split(":")[0]
+                if service.upper() != 'CIFS' or host.upper() not in self.__getValidTargetNames(connData) {
+                    self.log('NTLMv2 response from %s for the wrong target %s' % (identity, targetName),
+                             logging.WARNING)
+                    return nil
+
+        return avPairs
+
+     func (self TYPE) __checkMIC(connData, authenticateMessage, authenticateData, avPairs, sessionKey interface{}){
+        // MsvAvFlags 0x2 means the AUTHENTICATE_MESSAGE carries a MIC
+        flags = 0
+        if avPairs[ntlm.NTLMSSP_AV_FLAGS] is not nil {
+            flags = struct.unpack('<L', avPairs[ntlm.NTLMSSP_AV_FLAGS][1])[0]
+        identity = authenticateMessage["user_name"].decode("utf-16le")
+        if flags & 0x2 == 0 {
+            if self.__ntlmRequireMIC {
+                self.log('NTLM AUTHENTICATE_MESSAGE from %s without MIC' % identity, logging.WARNING)
+                return false
+            return true
+
+        if sessionKey == nil or 'NEGOTIATE_MESSAGE_DATA' not in connData {
+            return false
+        // The MIC sits right after the Version field and is zeroed for the computation
+        mic = authenticateData[72:88]
+        authenticateData = authenticateData[:72] + b'\x00' * 16 + authenticateData[88:]
+        expectedMIC = ntlm.hmac_md5(sessionKey, connData["NEGOTIATE_MESSAGE_DATA"] +
+                                    connData["CHALLENGE_MESSAGE"].getData() + authenticateData)
+        if mic != expectedMIC {
+            self.log('Bad MIC in the NTLM AUTHENTICATE_MESSAGE from %s' % identity, logging.WARNING)
+            return false
+        return true
+
+     func (self TYPE) getServerSid(){
+        // We don't have a real machine SID, so let's build one that stays the same for a given server name
+        digest = hashlib.md5(self.__serverName.upper().encode("utf-8")).digest()
+        return 'S-1-5-21-%d-%d-%d' % struct.unpack('<LLL', digest[:12])
+
+     func (self TYPE) getLocalAccounts(){
+        // Our local user database is the credentials one. The uid becomes the RID when
+        // it looks like one, otherwise we pick the next free RID starting at 1000
+        accounts = {}
+        for name in sorted(self.__credentials.keys()):
+            try:
+                rid = int(self.__credentials[name][0])
+            except (ValueError, TypeError):
+                rid = 0
+            if rid > 0 and rid not in list(accounts.values()) {
+                accounts[name] = rid
+        rid = 1000
+        for name in sorted(self.__credentials.keys()):
+            if name in accounts {
+                continue
+            while rid in list(accounts.values()):
+                rid += 1
+            accounts[name] = rid
+        return accounts
+
      func (self TYPE) removeConnection(name interface{}){
         try:
            del(self.__activeConnections[name])
         except:
            pass
+        for callback in self.__closeCallbacks:
+            try:
+                callback(name)
+            except Exception as e:
+                self.log('Close callback: %s' % e, logging.ERROR)
         self.log("Remaining connections %s" % list(self.__activeConnections.keys()))
 
-     func (self TYPE) addConnection(name, ip, port interface{}){
+     func (self TYPE) addConnection(name, ip, port, sock = nil interface{}){
         self.__activeConnections[name] = {}
         // Let's init with some know stuff we will need to have
         // TODO: Document what's in there
@@ -3903,6 +5059,17 @@ smb.SMB.TRANS_TRANSACT_NMPIPE          :self.__smbTransHandler.transactNamedPipe
         self.__activeConnections[name]["SigningChallengeResponse"]= ''
         self.__activeConnections[name]["SigningSessionKey"]= b''
         self.__activeConnections[name]["Authenticated"]= false
+        // Whether UserName was checked against the credentials (or a backend)
+        self.__activeConnections[name]["LogonVerified"]= false
+        // Session bookkeeping, used by the SRVS server to answer session queries
+        self.__activeConnections[name]["ClientSocket"]    = sock
+        self.__activeConnections[name]["UserName"]        = ""
+        self.__activeConnections[name]["Groups"]          = []
+        self.__activeConnections[name]["SessionStart"]    = time.time()
+        self.__activeConnections[name]["LastActivity"]    = time.time()
+        // Held while a request is processed, and by anyone touching the connection from another thread
+        self.__activeConnections[name]["Lock"]            = threading.Lock()
+        self.__activeConnections[name]["LockOwner"]       = nil
 
      func (self TYPE) getActiveConnections(){
         return self.__activeConnections
@@ -3915,11 +5082,129 @@ smb.SMB.TRANS_TRANSACT_NMPIPE          :self.__smbTransHandler.transactNamedPipe
      func (self TYPE) getConnectionData(connId, checkStatus = true interface{}){
         conn = self.__activeConnections[connId]
         if checkStatus is true {
-            if ('Authenticated' in conn) is not true {
+            if conn.get("Authenticated") is not true {
                 // Can't keep going further
                 raise Exception("User not Authenticated!")
         return conn
 
+     func (self TYPE) getPipeConnection(address interface{}){
+        // Named pipes are sockets we opened against the DCERPC servers, so the
+        // local address of the socket tells us which connection is behind a call
+        for connId in list(self.__activeConnections.keys()):
+            connData = self.__activeConnections[connId]
+            for fid in list(connData["OpenedFiles"].keys()):
+                if 'Socket' in connData["OpenedFiles"][fid] {
+                    try:
+                        if connData["OpenedFiles"][fid]["Socket"].getsockname() == address {
+                            return connId
+                    except Exception:
+                        pass
+        return nil
+
+    @contextmanager
+     func (self TYPE) lockConnection(connId interface{}){
+        connData = self.__activeConnections[connId]
+        with connData["Lock"]:
+            connData["LockOwner"] = threading.current_thread()
+            try:
+                yield connData
+            finally:
+                connData["LockOwner"] = nil
+
+    @contextmanager
+     func (self TYPE) unlockConnection(connId interface{}){
+        // Around waits on a named pipe. The DCE/RPC server answering might need the connection
+        // itself (e.g. NetrFileClose on one of the caller's files)
+        connData = self.__activeConnections[connId]
+        if connData["LockOwner"] is not threading.current_thread() {
+            yield
+            return
+        connData["LockOwner"] = nil
+        connData["Lock"].release()
+        try:
+            yield
+        finally:
+            connData["Lock"].acquire()
+            connData["LockOwner"] = threading.current_thread()
+
+     func (self TYPE) addCloseCallback(callback interface{}){
+        // callback(connId) is called when a connection goes away, to release whatever is tied to it
+        self.__closeCallbacks.append(callback)
+
+     func (self TYPE) isLoggedOn(connId interface{}){
+        // A user session, not an anonymous one. If we have credentials, they must have been checked
+        if connId not in self.__activeConnections {
+            return false
+        connData = self.__activeConnections[connId]
+        if connData.get("Authenticated") is not true or connData["UserName"] == '' {
+            return false
+        if self.isAuthenticationRequired() is true {
+            return connData.get("LogonVerified") is true
+        return true
+
+     func (self TYPE) isAdministrator(connId interface{}){
+        if connId not in self.__activeConnections {
+            return false
+        // The user name of a logon whose credentials weren't checked (guests, basic security) is whatever
+        // the client said
+        if self.__activeConnections[connId].get("LogonVerified") is not true {
+            return false
+        return self.__isListed(self.__activeConnections[connId], self.__adminUsers)
+
+    @staticmethod
+     func __isListed(connData, names interface{}){
+        // names holds upper case user names and @groups
+        userName = connData["UserName"]
+        if userName == '' {
+            return false
+        if userName.upper() in names {
+            return true
+        for group in connData.get('Groups', []):
+            if '@' + group.upper() in names {
+                return true
+        return false
+
+     func (self TYPE) isShareAllowed(connId, share interface{}){
+        // Shares can be restricted with a "valid users" list of users and @groups
+        if 'valid users' not in share {
+            return true
+        validUsers = [x.strip().upper() for x in share["valid users"].split(",") if x.strip() != '']
+        return self.__isListed(self.__activeConnections[connId], validUsers)
+
+     func (self TYPE) getCaseCollisions(shareName interface{}){
+        // Files only differing in case can't be told apart by Windows clients
+        share = searchShare(nil, shareName.upper(), self)
+        if share == nil or share.get('path', '') == '' {
+            return []
+        return findCaseCollisions(share["path"])
+
+     func (self TYPE) closeOpenedFile(connId, fid interface{}){
+        // Called from the DCE/RPC servers' threads, the connection's own might be using the file
+        if connId not in self.__activeConnections {
+            return false
+        with self.lockConnection(connId) as connData:
+            if fid not in connData["OpenedFiles"] {
+                return false
+            fileHandle = connData["OpenedFiles"][fid]["FileHandle"]
+            try:
+                if fileHandle == PIPE_FILE_DESCRIPTOR {
+                    connData["OpenedFiles"][fid]["Socket"].close()
+                elif fileHandle != VOID_FILE_DESCRIPTOR {
+                    os.close(fileHandle)
+            except Exception as e:
+                self.log("closeOpenedFile %s" % e, logging.ERROR)
+            del(connData["OpenedFiles"][fid])
+        return true
+
+     func (self TYPE) closeConnection(connId interface{}){
+        // Shutting down the socket makes the handler's thread finish and clean up
+        connData = self.__activeConnections[connId]
+        if connData["ClientSocket"] is not nil {
+            try:
+                connData["ClientSocket"].shutdown(socket.SHUT_RDWR)
+            except Exception as e:
+                self.log("closeConnection %s" % e, logging.ERROR)
+
      func (self TYPE) getRegisteredNamedPipes(){
         return self.__registeredNamedPipes
 
@@ -4071,6 +5356,107 @@ smb.SMB.TRANS_TRANSACT_NMPIPE          :self.__smbTransHandler.transactNamedPipe
      func (self TYPE) log(msg, level=logging.INFO interface{}){
         self.__log.log(level,msg)
 
+     func (self TYPE) setAuditFile(fileName interface{}){
+        // Audit events will be appended as JSON lines, nil turns it off
+        with self.__auditLock:
+            if self.__auditFile is not nil {
+                self.__auditFile.close()
+                self.__auditFile = nil
+            if fileName is not nil and fileName != 'nil' {
+                self.__auditFile = open(fileName, 'a')
+
+     func (self TYPE) setAuditCallback(callback interface{}){
+        // callback(event) is called with a dict for every audit event, nil turns it off
+        self.__auditCallback = callback
+
+     func (self TYPE) getMetrics(){
+        return self.__metrics
+
+     func (self TYPE) startMetricsServer(address = "127.0.0.1", port = 9445 interface{}){
+        // Exposes getMetrics() at http://address:port/metrics. Only local by default, the metrics name users and shares
+        if self.__metricsServer is not nil {
+            self.__metricsServer.stop()
+        self.__metricsServer = SMBMetricsServer(self, (address, port))
+        self.__metricsServer.start()
+        return self.__metricsServer.getListenPort()
+
+     func (self TYPE) stopMetricsServer(){
+        if self.__metricsServer is not nil {
+            self.__metricsServer.stop()
+            self.__metricsServer = nil
+
+     func (self TYPE) __countRequest(connData, isSMB2, command, errorCode interface{}){
+        if isSMB2 is true {
+            commandName = SMB2_COMMAND_NAMES.get(command, '0x%04x' % command)
+        } else  {
+            commandName = SMB_COMMAND_NAMES.get(command, '0x%02x' % command)
+        self.__metrics.addRequest(commandName, errorCode, time.time() - connData["RequestStart"])
+
+    @staticmethod
+     func __getSharePath(connData, pathName interface{}){
+        // Translates a local path into the share it belongs to and the path inside of it
+        shareName = nil
+        sharePath = pathName
+        rootLength = -1
+        for share in list(connData.get('ConnectedShares', {}).values()):
+            root = share.get('path', '')
+            if root == '' or len(root) <= rootLength {
+                continue
+            if pathName == root or pathName.startswith(os.path.join(root, '')) {
+                shareName = share["shareName"]
+                sharePath = "\\" + os.path.relpath(pathName, root).replace(os.sep, '\\')
+                if sharePath == '\\.' {
+                    sharePath = "\\"
+                rootLength = len(root)
+        return shareName, sharePath
+
+     func (self TYPE) audit(connId, event, status = STATUS_SUCCESS, pathName = nil, newPathName = nil, **kwargs interface{}){
+        connData = self.__activeConnections.get(connId, {})
+
+        // Some events feed the metrics as well
+        if event in ('read', 'write') and pathName is not nil {
+            self.__metrics.addBytes(event, self.__getSharePath(connData, pathName)[0], kwargs.get('bytes', 0))
+        elif event == 'session_setup' and status != STATUS_SUCCESS {
+            if status == STATUS_LOGON_FAILURE and not self.hasUser(kwargs.get("user")) {
+                self.__metrics.addAuthFailure("unknown_user")
+            elif status == STATUS_LOGON_FAILURE {
+                self.__metrics.addAuthFailure("bad_password")
+            } else  {
+                self.__metrics.addAuthFailure(SMBServerMetrics.getStatusName(status))
+
+        if self.__auditFile == nil and self.__auditCallback == nil {
+            return
+        record = {
+            'time'     : datetime.datetime.utcnow().strftime("%Y-%m-%dT%H:%M:%S.%fZ"),
+            'event'    : event,
+            'client_ip': connData.get("ClientIP"),
+            'user'     : connData.get('UserName', ''),
+            'share'    : nil,
+            'path'     : nil,
+            'status'   : status,
+        }
+        if 'RequestStart' in connData {
+            record["duration"] = round(time.time() - connData["RequestStart"], 6)
+        if pathName is not nil {
+            record["share"], record["path"] = self.__getSharePath(connData, pathName)
+        if newPathName is not nil {
+            record["new_path"] = self.__getSharePath(connData, newPathName)[1]
+        record.update(kwargs)
+        for key in list(record.keys()):
+            if isinstance(record[key], bytes) {
+                record[key] = record[key].decode('utf-8', 'replace')
+
+        if self.__auditCallback is not nil {
+            try:
+                self.__auditCallback(record)
+            except Exception as e:
+                self.log('Audit callback: %s' % e, logging.ERROR)
+
+        if self.__auditFile is not nil {
+            with self.__auditLock:
+                self.__auditFile.write(json.dumps(record) + '\n')
+                self.__auditFile.flush()
+
      func (self TYPE) getServerName(){
         return self.__serverName
 
@@ -4092,11 +5478,92 @@ smb.SMB.TRANS_TRANSACT_NMPIPE          :self.__smbTransHandler.transactNamedPipe
      func (self TYPE) getJTRdumpPath(){
         return self.__jtr_dump_path
 
+     func (self TYPE) __pruneLockouts(now interface{}){
+        // Called with __lockoutLock held. Whatever a spray leaves behind never comes back, so
+        // everything out of its window goes every time, not just the entries being looked up
+        for key in list(self.__logonFailures.keys()):
+            failures = [t for t in self.__logonFailures[key] if now - t < self.__lockoutWindow]
+            if len(failures) == 0 {
+                del(self.__logonFailures[key])
+            } else  {
+                self.__logonFailures[key] = failures
+        for key in list(self.__lockouts.keys()):
+            if self.__lockouts[key] <= now {
+                del(self.__lockouts[key])
+        // Forget about the addresses that were quiet for the last minute
+        for address in list(self.__connectionAttempts.keys()):
+            attempts = [t for t in self.__connectionAttempts[address] if now - t < 60]
+            if len(attempts) == 0 {
+                del(self.__connectionAttempts[address])
+            } else  {
+                self.__connectionAttempts[address] = attempts
+
      func (self TYPE) verify_request(request, client_address interface{}){
-        // TODO: Control here the max amount of processes we want to launch
         // returning false, closes the connection
+        clientIP = client_address[0]
+        now = time.time()
+        with self.__lockoutLock:
+            self.__pruneLockouts(now)
+            if ('ip', clientIP) in self.__lockouts {
+                self.log('Connection from %s refused, address is locked out' % clientIP, logging.WARNING)
+                return false
+
+            if self.__connectionRateLimit > 0 {
+                attempts = self.__connectionAttempts.setdefault(clientIP, [])
+                if len(attempts) >= self.__connectionRateLimit {
+                    self.log('Connection from %s refused, more than %d connections per minute' % (
+                        clientIP, self.__connectionRateLimit), logging.WARNING)
+                    return false
+                attempts.append(now)
         return true
 
+     func (self TYPE) checkLockout(clientIP, userName interface{}){
+        // Returns STATUS_SUCCESS if neither the address nor the account are locked out
+        now = time.time()
+        with self.__lockoutLock:
+            self.__pruneLockouts(now)
+            for key in (('ip', clientIP), ('user', userName.upper())):
+                if key not in self.__lockouts {
+                    continue
+                self.log('Logon from %s as %s blocked, %s %s is locked out' % (clientIP, userName, key[0], key[1]), logging.WARNING)
+                if key[0] == 'user' {
+                    return STATUS_ACCOUNT_LOCKED_OUT
+                return STATUS_ACCESS_DENIED
+        return STATUS_SUCCESS
+
+     func (self TYPE) registerLogon(clientIP, userName, errorCode interface{}){
+        // Keeps track of the failed logons, locking out addresses and accounts going over the threshold
+        if self.__lockoutThreshold == 0 {
+            return
+        now = time.time()
+        with self.__lockoutLock:
+            self.__pruneLockouts(now)
+            if errorCode == STATUS_SUCCESS {
+                // The address keeps its failures, otherwise one good account would hide a spray
+                self.__logonFailures.pop(('user', userName.upper()), nil)
+                return
+            if errorCode != STATUS_LOGON_FAILURE {
+                return
+            for key in (('ip', clientIP), ('user', userName.upper())):
+                failures = self.__logonFailures.get(key, []) + [now]
+                if len(failures) >= self.__lockoutThreshold {
+                    self.__lockouts[key] = now + self.__lockoutDuration
+                    self.__logonFailures.pop(key, nil)
+                    self.log('Locking out %s %s for %d seconds after %d failed logons' % (
+                        key[0], key[1], self.__lockoutDuration, len(failures)), logging.WARNING)
+                } else  {
+                    self.__logonFailures[key] = failures
+
+     func (self TYPE) throttle(connId, length interface{}){
+        // Per session bandwidth cap. Every connection has its own thread, so we just make it wait
+        if self.__bandwidthLimit <= 0 or connId not in self.__activeConnections {
+            return
+        connData = self.__activeConnections[connId]
+        now = time.time()
+        connData["ThrottleTime"] = max(connData.get('ThrottleTime', now), now) + float(length) / self.__bandwidthLimit
+        if connData["ThrottleTime"] > now {
+            time.sleep(connData["ThrottleTime"] - now)
+
      func (self TYPE) signSMBv1(connData, packet, signingSessionKey, signingChallengeResponse interface{}){
         // This logic MUST be applied for messages sent in response to any of the higher-layer actions and in
         // compliance with the message sequencing rules.
@@ -4154,6 +5621,9 @@ smb.SMB.TRANS_TRANSACT_NMPIPE          :self.__smbTransHandler.transactNamedPipe
             isSMB2 = true
 
         connData    = self.getConnectionData(connId, false)
+        connData["LastActivity"] = time.time()
+        // Audit events measure their duration from here
+        connData["RequestStart"] = connData["LastActivity"]
 
         // We might have compound requests
         compoundedPacketsResponse = []
@@ -4174,7 +5644,7 @@ smb.SMB.TRANS_TRANSACT_NMPIPE          :self.__smbTransHandler.transactNamedPipe
             // errorCode   : self explanatory
             if isSMB2 is false {
                 // Is the client authenticated already?
-                if connData["Authenticated"] is false and packet["Command"] not in (smb.SMB.SMB_COM_NEGOTIATE, smb.SMB.SMB_COM_SESSION_SETUP_ANDX) {
+                if connData["Authenticated"] is not true and packet["Command"] not in (smb.SMB.SMB_COM_NEGOTIATE, smb.SMB.SMB_COM_SESSION_SETUP_ANDX) {
                     // Nope.. in that case he should only ask for a few commands, if not throw him out.
                     errorCode = STATUS_ACCESS_DENIED
                     respPackets = nil
@@ -4235,21 +5705,24 @@ smb.SMB.TRANS_TRANSACT_NMPIPE          :self.__smbTransHandler.transactNamedPipe
                         } else  {
                            respCommands, respPackets, errorCode = self.__smbCommands[255](connId, self, SMBCommand, packet)
 
+                self.__countRequest(connData, false, packet["Command"], errorCode)
                 compoundedPacketsResponse.append((respCommands, respPackets, errorCode))
                 compoundedPackets.append(packet)
 
             } else  {
                 // Is the client authenticated already?
-                if connData["Authenticated"] is false and packet["Command"] not in (smb2.SMB2_NEGOTIATE, smb2.SMB2_SESSION_SETUP) {
+                if connData["Authenticated"] is not true and packet["Command"] not in (smb2.SMB2_NEGOTIATE, smb2.SMB2_SESSION_SETUP) {
                     // Nope.. in that case he should only ask for a few commands, if not throw him out.
                     errorCode = STATUS_ACCESS_DENIED
                     respPackets = nil
                     respCommands = [""]
+                    self.__countRequest(connData, true, packet["Command"], errorCode)
                     compoundedPacketsResponse.append((respCommands, respPackets, errorCode))
                     compoundedPackets.append(packet)
                 } else  {
                     done = false
                     while not done:
+                        connData["RequestStart"] = time.time()
                         if packet["Command"] in self.__smb2Commands {
                            if self.__SMB2Support is true {
                                respCommands, respPackets, errorCode = self.__smb2Commands[packet["Command"]](
@@ -4261,6 +5734,7 @@ smb.SMB.TRANS_TRANSACT_NMPIPE          :self.__smbTransHandler.transactNamedPipe
                         } else  {
                            respCommands, respPackets, errorCode = self.__smb2Commands[255](connId, self, packet)
                         // Let's store the result for this compounded packet
+                        self.__countRequest(connData, true, packet["Command"], errorCode)
                         compoundedPacketsResponse.append((respCommands, respPackets, errorCode))
                         compoundedPackets.append(packet)
                         if packet["NextCommand"] != 0 {
@@ -4405,6 +5879,43 @@ smb.SMB.TRANS_TRANSACT_NMPIPE          :self.__smbTransHandler.transactNamedPipe
         } else  {
             self.__SMB2Support = false
 
+        if self.__serverConfig.has_option("global", "ntlm_reject_v1") {
+            self.__ntlmRejectV1 = self.__serverConfig.getboolean("global", "ntlm_reject_v1")
+        if self.__serverConfig.has_option("global", "ntlm_require_mic") {
+            self.__ntlmRequireMIC = self.__serverConfig.getboolean("global", "ntlm_require_mic")
+        if self.__serverConfig.has_option("global", "ntlm_max_clock_skew") {
+            self.__ntlmMaxClockSkew = self.__serverConfig.getint("global", "ntlm_max_clock_skew")
+        if self.__serverConfig.has_option("global", "ntlm_spn_validation") {
+            self.__ntlmSPNValidation = self.__serverConfig.getint("global", "ntlm_spn_validation")
+        if self.__serverConfig.has_option("global", "ntlm_spn_aliases") {
+            self.__ntlmSPNAliases = [x.strip() for x in self.__serverConfig.get("global", "ntlm_spn_aliases").split(",") if x.strip() != '']
+
+        if self.__serverConfig.has_option("global", "admin_users") {
+            self.__adminUsers = [x.strip().upper() for x in self.__serverConfig.get("global", "admin_users").split(",") if x.strip() != '']
+        } else  {
+            self.__adminUsers = []
+
+        if self.__serverConfig.has_option("global", "audit_file") {
+            self.setAuditFile(self.__serverConfig.get("global", "audit_file"))
+
+        if self.__serverConfig.has_option("global", "lockout_threshold") {
+            self.__lockoutThreshold = self.__serverConfig.getint("global", "lockout_threshold")
+        if self.__serverConfig.has_option("global", "lockout_window") {
+            self.__lockoutWindow = self.__serverConfig.getint("global", "lockout_window")
+        if self.__serverConfig.has_option("global", "lockout_duration") {
+            self.__lockoutDuration = self.__serverConfig.getint("global", "lockout_duration")
+        if self.__serverConfig.has_option("global", "connection_rate_limit") {
+            self.__connectionRateLimit = self.__serverConfig.getint("global", "connection_rate_limit")
+        if self.__serverConfig.has_option("global", "bandwidth_limit") {
+            self.__bandwidthLimit = self.__serverConfig.getint("global", "bandwidth_limit")
+
+        if self.__serverConfig.has_option("global", "metrics_port") and self.__metricsServer == nil {
+            if self.__serverConfig.has_option("global", "metrics_address") {
+                metricsAddress = self.__serverConfig.get("global", "metrics_address")
+            } else  {
+                metricsAddress = "127.0.0.1"
+            self.startMetricsServer(metricsAddress, self.__serverConfig.getint("global", "metrics_port"))
+
         if self.__logFile != 'nil' {
             logging.basicConfig(filename = self.__logFile, 
                              level = logging.DEBUG, 
@@ -4418,13 +5929,37 @@ smb.SMB.TRANS_TRANSACT_NMPIPE          :self.__smbTransHandler.transactNamedPipe
             cred = open(credentials_fname)
             line = cred.readline()
             while line:
-                name, uid, lmhash, nthash = line.split(":")
-                self.__credentials[name] = (uid, lmhash, nthash.strip("\r\n"))
+                // name:uid:lmhash:nthash[:group1,group2,...]
+                fields = line.strip("\r\n").split(":")
+                name, uid, lmhash, nthash = fields[:4]
+                self.__credentials[name] = (uid, lmhash, nthash)
+                if len(fields) > 4 {
+                    self.__credentialGroups[name] = [x.strip() for x in fields[4].split(",") if x.strip() != '']
                 line = cred.readline()
             cred.close()
+
+        // And the authentication backends
+        if self.__serverConfig.has_option("global", "auth_nthash_file") {
+            self.__addConfiguredAuthenticator(NTHashFileAuthenticator(self.__serverConfig.get("global", "auth_nthash_file")))
+        if self.__serverConfig.has_option("global", "auth_sqlite_file") {
+            if self.__serverConfig.has_option("global", "auth_sqlite_table") {
+                table = self.__serverConfig.get("global", "auth_sqlite_table")
+            } else  {
+                table = "users"
+            self.__addConfiguredAuthenticator(SQLiteAuthenticator(self.__serverConfig.get("global", "auth_sqlite_file"), table))
+        if self.__serverConfig.has_option("global", "auth_netlogon_dc") {
+            self.__addConfiguredAuthenticator(NetlogonAuthenticator(self.__serverConfig.get("global", "auth_netlogon_dc"),
+                                              self.__serverConfig.get("global", "auth_netlogon_domain"),
+                                              self.__serverConfig.get("global", "auth_netlogon_account"),
+                                              self.__serverConfig.get("global", "auth_netlogon_hash")))
         self.log("Config file parsed")
 
-     func (self TYPE) addCredential(name, uid, lmhash, nthash interface{}){
+     func (self TYPE) __addConfiguredAuthenticator(authenticator interface{}){
+        // processConfigFile can be called many times, only one backend of each kind comes from the config
+        self.__authenticators = [x for x in self.__authenticators if x.__class__ is not authenticator.__class__]
+        self.__authenticators.append(authenticator)
+
+     func (self TYPE) addCredential(name, uid, lmhash, nthash, groups = nil interface{}){
         // If we have hashes, normalize them
         if lmhash != '' or nthash != '' {
             if len(lmhash) % 2 {
@@ -4437,6 +5972,8 @@ smb.SMB.TRANS_TRANSACT_NMPIPE          :self.__smbTransHandler.transactNamedPipe
             except:
                 pass
         self.__credentials[name] = (uid, lmhash, nthash)
+        if groups is not nil {
+            self.__credentialGroups[name] = list(groups)
 
 // For windows platforms, opening a directory is not an option, so we set a void FD
 VOID_FILE_DESCRIPTOR = -1
@@ -4447,47 +5984,237 @@ PIPE_FILE_DESCRIPTOR = -2
 //#####################################################################
 
 from impacket.dcerpc.v5.rpcrt import DCERPCServer
-from impacket.dcerpc.v5.dtypes import NULL
-from impacket.dcerpc.v5.srvs import NetrShareEnum, NetrShareEnumResponse, SHARE_INFO_1, NetrServerGetInfo, NetrServerGetInfoResponse, NetrShareGetInfo, NetrShareGetInfoResponse
-from impacket.dcerpc.v5.wkst import NetrWkstaGetInfo, NetrWkstaGetInfoResponse
-from impacket.system_errors import ERROR_INVALID_LEVEL
+from impacket.dcerpc.v5.dtypes import NULL, ULONG, RPC_UNICODE_STRING
+from impacket.dcerpc.v5.srvs import NetrShareEnum, NetrShareEnumResponse, SHARE_INFO_0, SHARE_INFO_1, SHARE_INFO_2, \
+    SHARE_INFO_502, NetrServerGetInfo, NetrServerGetInfoResponse, NetrShareGetInfo, NetrShareGetInfoResponse, \
+    NetrShareAdd, NetrShareAddResponse, NetrShareSetInfo, NetrShareSetInfoResponse, NetrShareDel, NetrShareDelResponse, \
+    NetrSessionEnum, NetrSessionEnumResponse, NetrSessionDel, NetrSessionDelResponse, SESSION_INFO_0, SESSION_INFO_1, \
+    SESSION_INFO_2, SESSION_INFO_10, SESSION_INFO_502, SESS_GUEST, NetrConnectionEnum, NetrConnectionEnumResponse, \
+    CONNECTION_INFO_0, CONNECTION_INFO_1, NetrFileEnum, NetrFileEnumResponse, FILE_INFO_2, FILE_INFO_3, \
+    PERM_FILE_READ, PERM_FILE_WRITE, PERM_FILE_CREATE, NetrFileClose, NetrFileCloseResponse, NetrRemoteTOD, \
+    NetrRemoteTODResponse
+from impacket.dcerpc.v5.wkst import NetrWkstaGetInfo, NetrWkstaGetInfoResponse, NetrWkstaUserEnum, \
+    NetrWkstaUserEnumResponse, WKSTA_USER_INFO_0, WKSTA_USER_INFO_1, NetrWkstaTransportEnum, \
+    NetrWkstaTransportEnumResponse, WKSTA_TRANSPORT_INFO_0
+from impacket.dcerpc.v5.lsad import LsarOpenPolicy, LsarOpenPolicyResponse, LsarOpenPolicy2, LsarOpenPolicy2Response, \
+    LsarClose, LsarCloseResponse, LsarQueryInformationPolicy, LsarQueryInformationPolicyResponse, \
+    LsarQueryInformationPolicy2, LsarQueryInformationPolicy2Response, POLICY_INFORMATION_CLASS, LSAPR_TRUST_INFORMATION
+from impacket.dcerpc.v5.lsat import LsarLookupSids, LsarLookupSidsResponse, LsarLookupSids2, LsarLookupSids2Response, \
+    LsarLookupNames, LsarLookupNamesResponse, LsarLookupNames2, LsarLookupNames2Response, LsarGetUserName, \
+    LsarGetUserNameResponse, LSAPR_TRANSLATED_NAME, LSAPR_TRANSLATED_NAME_EX, LSA_TRANSLATED_SID, \
+    LSAPR_TRANSLATED_SID_EX
+from impacket.dcerpc.v5.samr import SamrConnect, SamrConnectResponse, SamrConnect2, SamrConnect2Response, \
+    SamrConnect5, SamrConnect5Response, SamrCloseHandle, SamrCloseHandleResponse, SamrLookupDomainInSamServer, \
+    SamrLookupDomainInSamServerResponse, SamrEnumerateDomainsInSamServer, SamrEnumerateDomainsInSamServerResponse, \
+    SamrOpenDomain, SamrOpenDomainResponse, SamrEnumerateUsersInDomain, SamrEnumerateUsersInDomainResponse, \
+    SamrEnumerateAliasesInDomain, SamrEnumerateAliasesInDomainResponse, SamrLookupNamesInDomain, \
+    SamrLookupNamesInDomainResponse, SamrLookupIdsInDomain, SamrLookupIdsInDomainResponse, SAMPR_RID_ENUMERATION, \
+    SID_NAME_USE
+from impacket.nt_errors import STATUS_NONE_MAPPED, STATUS_SOME_NOT_MAPPED, STATUS_NO_SUCH_DOMAIN
+from impacket.system_errors import ERROR_INVALID_LEVEL, ERROR_ACCESS_DENIED, ERROR_INVALID_PARAMETER
+
+// These ones not defined in system_errors
+NERR_UserNotFound       = 0x000008AD
+NERR_UnknownDevDir      = 0x00000844
+NERR_DuplicateShare     = 0x00000846
+NERR_NetNameNotFound    = 0x00000906
+NERR_ClientNameNotFound = 0x00000908
+NERR_FileIdNotFound     = 0x0000090A
+
+// Well known SIDs we can always translate
+// SID: (Domain Name, Domain SID, Account Name, SID_NAME_USE)
+WELL_KNOWN_SIDS = {
+    'S-1-1-0'      : ('', 'S-1-1', 'Everyone', SID_NAME_USE.SidTypeWellKnownGroup),
+    'S-1-3-0'      : ('', 'S-1-3', 'CREATOR OWNER', SID_NAME_USE.SidTypeWellKnownGroup),
+    'S-1-3-1'      : ('', 'S-1-3', 'CREATOR GROUP', SID_NAME_USE.SidTypeWellKnownGroup),
+    'S-1-5-2'      : ('NT AUTHORITY', 'S-1-5', 'NETWORK', SID_NAME_USE.SidTypeWellKnownGroup),
+    'S-1-5-4'      : ('NT AUTHORITY', 'S-1-5', 'INTERACTIVE', SID_NAME_USE.SidTypeWellKnownGroup),
+    'S-1-5-7'      : ('NT AUTHORITY', 'S-1-5', 'ANONYMOUS LOGON', SID_NAME_USE.SidTypeWellKnownGroup),
+    'S-1-5-11'     : ('NT AUTHORITY', 'S-1-5', 'Authenticated Users', SID_NAME_USE.SidTypeWellKnownGroup),
+    'S-1-5-18'     : ('NT AUTHORITY', 'S-1-5', 'SYSTEM', SID_NAME_USE.SidTypeWellKnownGroup),
+    'S-1-5-32-544' : ('BUILTIN', 'S-1-5-32', 'Administrators', SID_NAME_USE.SidTypeAlias),
+    'S-1-5-32-545' : ('BUILTIN', 'S-1-5-32', 'Users', SID_NAME_USE.SidTypeAlias),
+    'S-1-5-32-546' : ('BUILTIN', 'S-1-5-32', 'Guests', SID_NAME_USE.SidTypeAlias),
+}
+
+BUILTIN_DOMAIN_SID = "S-1-5-32"
 
  type WKSTServer struct { // DCERPCServer:
      func (self TYPE) __init__(){
         DCERPCServer.__init__(self)
+        self.__smbServer = nil
         self.wkssvcCallBacks = {
             0: self.NetrWkstaGetInfo,
+            2: self.NetrWkstaUserEnum,
+            5: self.NetrWkstaTransportEnum,
         }
         self.addCallbacks(('6BFFD098-A112-3610-9833-46C3F87E345A', '1.0'),'\\PIPE\\wkssvc', self.wkssvcCallBacks)
 
+     func (self TYPE) setSMBServer(smbServer interface{}){
+        // The SMBSERVER we're answering for. Needed for names and logged on users
+        self.__smbServer = smbServer
+
+     func (self TYPE) __isAdministrator(){
+        if self.__smbServer == nil {
+            return false
+        connId = self.__smbServer.getPipeConnection(self._clientSock.getpeername())
+        return self.__smbServer.isAdministrator(connId)
+
+     func (self TYPE) __getLoggedOnUsers(){
+        users = []
+        if self.__smbServer == nil {
+            return users
+        for connId, connData in list(self.__smbServer.getActiveConnections().items()):
+            if connData["UserName"] != '' and connData["UserName"] not in users {
+                users.append(connData["UserName"])
+        return users
+
      func NetrWkstaGetInfo(self,data interface{}){
         request = NetrWkstaGetInfo(data)
         self.log("NetrWkstaGetInfo Level: %d" % request["Level"])
 
         answer = NetrWkstaGetInfoResponse()
 
-        if request["Level"] not in (100, 101) {
+        if request["Level"] not in (100, 101, 102, 502) {
             answer["ErrorCode"] = ERROR_INVALID_LEVEL
             return answer
 
         answer["WkstaInfo"]["tag"] = request["Level"]
 
-        if request["Level"] == 100 {
-            // Windows. Decimal value 500.
-            answer["WkstaInfo"]["WkstaInfo100"]["wki100_platform_id"] = 0x000001F4
-            answer["WkstaInfo"]["WkstaInfo100"]["wki100_computername"] = NULL
-            answer["WkstaInfo"]["WkstaInfo100"]["wki100_langroup"] = NULL
-            answer["WkstaInfo"]["WkstaInfo100"]["wki100_ver_major"] = 5
-            answer["WkstaInfo"]["WkstaInfo100"]["wki100_ver_minor"] = 0
+        if request["Level"] == 502 {
+            // Windows defaults for the redirector, we don't really have one
+            wkstaInfo = answer["WkstaInfo"]["WkstaInfo502"]
+            wkstaInfo["wki502_char_wait"] = 3600
+            wkstaInfo["wki502_collection_time"] = 250
+            wkstaInfo["wki502_maximum_collection_count"] = 16
+            wkstaInfo["wki502_keep_conn"] = 600
+            wkstaInfo["wki502_max_cmds"] = 50
+            wkstaInfo["wki502_sess_timeout"] = 60
+            wkstaInfo["wki502_siz_char_buf"] = 512
+            wkstaInfo["wki502_max_threads"] = 17
+            wkstaInfo["wki502_lock_quota"] = 6144
+            wkstaInfo["wki502_lock_increment"] = 10
+            wkstaInfo["wki502_lock_maximum"] = 500
+            wkstaInfo["wki502_pipe_increment"] = 10
+            wkstaInfo["wki502_pipe_maximum"] = 500
+            wkstaInfo["wki502_cache_file_timeout"] = 40
+            wkstaInfo["wki502_dormant_file_limit"] = 1
+            wkstaInfo["wki502_read_ahead_throughput"] = 0xffffffff
+            wkstaInfo["wki502_num_mailslot_buffers"] = 3
+            wkstaInfo["wki502_num_srv_announce_buffers"] = 20
+            wkstaInfo["wki502_max_illegal_datagram_events"] = 5
+            wkstaInfo["wki502_illegal_datagram_event_reset_frequency"] = 60
+            wkstaInfo["wki502_log_election_packets"] = 0
+            wkstaInfo["wki502_use_opportunistic_locking"] = 1
+            wkstaInfo["wki502_use_unlock_behind"] = 1
+            wkstaInfo["wki502_use_close_behind"] = 1
+            wkstaInfo["wki502_buf_named_pipes"] = 1
+            wkstaInfo["wki502_use_lock_read_unlock"] = 1
+            wkstaInfo["wki502_utilize_nt_caching"] = 1
+            wkstaInfo["wki502_use_raw_read"] = 1
+            wkstaInfo["wki502_use_raw_write"] = 1
+            wkstaInfo["wki502_use_write_raw_data"] = 0
+            wkstaInfo["wki502_use_encryption"] = 1
+            wkstaInfo["wki502_buf_files_deny_write"] = 1
+            wkstaInfo["wki502_buf_read_only_files"] = 1
+            wkstaInfo["wki502_force_core_create_mode"] = 1
+            wkstaInfo["wki502_use_512_byte_max_transfer"] = 0
+            answer["ErrorCode"] = 0
+            return answer
+
+        wkstaInfo = answer["WkstaInfo"]['WkstaInfo%d' % request["Level"]]
+        prefix = "wki%d_" % request["Level"]
+
+        // Windows. Decimal value 500.
+        wkstaInfo[prefix+'platform_id'] = 0x000001F4
+        if self.__smbServer is not nil {
+            wkstaInfo[prefix+'computername'] = self.__smbServer.getServerName()+'\x00'
+            wkstaInfo[prefix+'langroup'] = self.__smbServer.getServerDomain()+'\x00'
         } else  {
-            // Windows. Decimal value 500.
-            answer["WkstaInfo"]["WkstaInfo101"]["wki101_platform_id"] = 0x000001F4
-            answer["WkstaInfo"]["WkstaInfo101"]["wki101_computername"] = NULL
-            answer["WkstaInfo"]["WkstaInfo101"]["wki101_langroup"] = NULL
-            answer["WkstaInfo"]["WkstaInfo101"]["wki101_ver_major"] = 5
-            answer["WkstaInfo"]["WkstaInfo101"]["wki101_ver_minor"] = 0
-            answer["WkstaInfo"]["WkstaInfo101"]["wki101_lanroot"] = NULL
+            wkstaInfo[prefix+'computername'] = NULL
+            wkstaInfo[prefix+'langroup'] = NULL
+        wkstaInfo[prefix+'ver_major'] = 5
+        wkstaInfo[prefix+'ver_minor'] = 0
+        if request["Level"] in (101, 102) {
+            wkstaInfo[prefix+'lanroot'] = NULL
+        if request["Level"] == 102 {
+            wkstaInfo[prefix+'logged_on_users'] = len(self.__getLoggedOnUsers())
+
+        answer["ErrorCode"] = 0
+        return answer
+
+     func (self TYPE) NetrWkstaUserEnum(data interface{}){
+        request = NetrWkstaUserEnum(data)
+        level = request["UserInfo"]["Level"]
+        self.log("NetrWkstaUserEnum Level: %d" % level)
+
+        answer = NetrWkstaUserEnumResponse()
 
+        if level not in (0, 1) {
+            answer["ErrorCode"] = ERROR_INVALID_LEVEL
+            return answer
+
+        if self.__isAdministrator() is false {
+            answer["ErrorCode"] = ERROR_ACCESS_DENIED
+            return answer
+
+        // Our logged on users are the ones holding an SMB session
+        users = self.__getLoggedOnUsers()
+
+        answer["UserInfo"]["Level"] = level
+        answer["UserInfo"]["WkstaUserInfo"]["tag"] = level
+        answer["UserInfo"]["WkstaUserInfo"]['Level%d' % level]["EntriesRead"] = len(users)
+        answer["TotalEntries"] = len(users)
+        answer["ResumeHandle"] = 0
+
+        for user in users:
+            if level == 0 {
+                userInfo = WKSTA_USER_INFO_0()
+                userInfo["wkui0_username"] = user+'\x00'
+            } else  {
+                userInfo = WKSTA_USER_INFO_1()
+                userInfo["wkui1_username"] = user+'\x00'
+                userInfo["wkui1_logon_domain"] = self.__smbServer.getServerDomain()+'\x00'
+                userInfo["wkui1_oth_domains"] = "\x00"
+                userInfo["wkui1_logon_server"] = self.__smbServer.getServerName()+'\x00'
+            answer["UserInfo"]["WkstaUserInfo"]['Level%d' % level]["Buffer"].append(userInfo)
+
+        answer["ErrorCode"] = 0
+        return answer
+
+     func (self TYPE) NetrWkstaTransportEnum(data interface{}){
+        request = NetrWkstaTransportEnum(data)
+        level = request["TransportInfo"]["Level"]
+        self.log("NetrWkstaTransportEnum Level: %d" % level)
+
+        answer = NetrWkstaTransportEnumResponse()
+
+        if level != 0 {
+            answer["ErrorCode"] = ERROR_INVALID_LEVEL
+            return answer
+
+        if self.__smbServer is not nil {
+            numberOfVcs = len(self.__smbServer.getActiveConnections())
+        } else  {
+            numberOfVcs = 0
+
+        // Just the one transport, SMB over TCP
+        transportInfo = WKSTA_TRANSPORT_INFO_0()
+        transportInfo["wkti0_quality_of_service"] = 0
+        transportInfo["wkti0_number_of_vcs"] = numberOfVcs
+        transportInfo["wkti0_transport_name"] = "\\Device\\NetbiosSmb\x00"
+        // No need to expose the MAC address
+        transportInfo["wkti0_transport_address"] = "000000000000\x00"
+        transportInfo["wkti0_wan_ish"] = 1
+
+        answer["TransportInfo"]["Level"] = level
+        answer["TransportInfo"]["WkstaTransportInfo"]["tag"] = level
+        answer["TransportInfo"]["WkstaTransportInfo"]["Level0"]["EntriesRead"] = 1
+        answer["TransportInfo"]["WkstaTransportInfo"]["Level0"]["Buffer"].append(transportInfo)
+        answer["TotalEntries"] = 1
+        answer["ResumeHandle"] = 0
+
+        answer["ErrorCode"] = 0
         return answer
 
  type SRVSServer struct { // DCERPCServer:
@@ -4497,11 +6224,22 @@ from impacket.system_errors import ERROR_INVALID_LEVEL
         self._shares = {}
         self.__serverConfig = nil
         self.__logFile = nil
+        self.__smbServer = nil
+        self.__startTime = time.time()
 
         self.srvsvcCallBacks = {
+            8: self.NetrConnectionEnum,
+            9: self.NetrFileEnum,
+            11: self.NetrFileClose,
+            12: self.NetrSessionEnum,
+            13: self.NetrSessionDel,
+            14: self.NetrShareAdd,
             15: self.NetrShareEnum,
             16: self.NetrShareGetInfo,
+            17: self.NetrShareSetInfo,
+            18: self.NetrShareDel,
             21: self.NetrServerGetInfo,
+            28: self.NetrRemoteTOD,
         }
 
         self.addCallbacks(('4B324FC8-1670-01D3-1278-5A47BF6EE188', '3.0'),'\\PIPE\\srvsvc', self.srvsvcCallBacks)
@@ -4509,6 +6247,10 @@ from impacket.system_errors import ERROR_INVALID_LEVEL
      func (self TYPE) setServerConfig(config interface{}){
         self.__serverConfig = config
 
+     func (self TYPE) setSMBServer(smbServer interface{}){
+        // The SMBSERVER we're answering for. Needed for sessions, connections and files
+        self.__smbServer = smbServer
+
      func (self TYPE) processConfigFile(configFile=nil interface{}){
        if configFile is not nil {
            self.__serverConfig = configparser.ConfigParser()
@@ -4528,24 +6270,99 @@ from impacket.system_errors import ERROR_INVALID_LEVEL
        for i in sections:
            self._shares[i] = dict(self.__serverConfig.items(i))
 
+    @staticmethod
+     func __getString(value interface{}){
+        // NULL pointers come back empty, the rest are NULL terminated
+        if value is NULL or len(value) == 0 {
+            return ''
+        if value[-1:] == '\x00' {
+            return value[:-1]
+        return value
+
+     func (self TYPE) __setConfig(section, name, value interface{}){
+        // ConfigParser takes % as the start of an interpolation, they come from the client so they're escaped
+        if isinstance(self.__serverConfig, configparser.ConfigParser) {
+            value = value.replace('%', '%%')
+        self.__serverConfig.set(section, name, value)
+
+    @staticmethod
+     func __getFileId(connId, fid interface{}){
+        // Opened files are tracked per connection, let's build a server wide id for them
+        return zlib.crc32(('%s:%r' % (connId, fid)).encode("utf-8")) & 0xffffffff
+
+     func (self TYPE) __isAdministrator(){
+        if self.__smbServer == nil {
+            return false
+        connId = self.__smbServer.getPipeConnection(self._clientSock.getpeername())
+        return self.__smbServer.isAdministrator(connId)
+
+     func (self TYPE) __getConnections(){
+        if self.__smbServer == nil {
+            return {}
+        return self.__smbServer.getActiveConnections()
+
+     func (self TYPE) __getOpenedFiles(connData, path = nil interface{}){
+        // Pipes are our own business, they're not listed
+        files = []
+        for fid in list(connData["OpenedFiles"].keys()):
+            fileData = connData["OpenedFiles"][fid]
+            if fileData["FileHandle"] == PIPE_FILE_DESCRIPTOR {
+                continue
+            if path is not nil and fileData["FileName"].startswith(path) is false {
+                continue
+            files.append((fid, fileData))
+        return files
+
+     func (self TYPE) __getShareUses(name interface{}){
+        uses = 0
+        for connId, connData in list(self.__getConnections().items()):
+            for tid in list(connData["ConnectedShares"].keys()):
+                if connData["ConnectedShares"][tid]["shareName"].upper() == name.upper() {
+                    uses += 1
+        return uses
+
+     func (self TYPE) __fillShareInfo(shareInfo, level, name interface{}){
+        share = self._shares[name]
+        prefix = "shi%d_" % level
+        shareInfo[prefix+'netname'] = name+'\x00'
+        if level == 0 {
+            return
+        shareInfo[prefix+'type'] = int(share["share type"])
+        shareInfo[prefix+'remark'] = share["comment"]+'\x00'
+        if level == 1 {
+            return
+        // ACCESS_ALL, we don't have per share permissions
+        shareInfo[prefix+'permissions'] = 0
+        shareInfo[prefix+'max_uses'] = 0xffffffff
+        shareInfo[prefix+'current_uses'] = self.__getShareUses(name)
+        shareInfo[prefix+'path'] = share["path"]+'\x00'
+        shareInfo[prefix+'passwd'] = NULL
+        if level == 502 {
+            shareInfo[prefix+'reserved'] = 0
+            shareInfo[prefix+'security_descriptor'] = NULL
+
      func NetrShareGetInfo(self,data interface{}){
        request = NetrShareGetInfo(data)
        self.log("NetrGetShareInfo Level: %d" % request["Level"])
 
        s = request["NetName"][:-1].upper()
        answer = NetrShareGetInfoResponse()
-       if s in self._shares {
-           share  = self._shares[s]
-
+       if request["Level"] not in (0, 1, 2, 502) {
+           answer["InfoStruct"]["tag"] = 1
+           answer["InfoStruct"]["ShareInfo1"]= NULL
+           answer["ErrorCode"] = ERROR_INVALID_LEVEL
+       elif request["Level"] in (2, 502) and self.__isAdministrator() is false {
            answer["InfoStruct"]["tag"] = 1
-           answer["InfoStruct"]["ShareInfo1"]["shi1_netname"]= s+'\x00'
-           answer["InfoStruct"]["ShareInfo1"]["shi1_type"]   = share["share type"]
-           answer["InfoStruct"]["ShareInfo1"]["shi1_remark"] = share["comment"]+'\x00' 
+           answer["InfoStruct"]["ShareInfo1"]= NULL
+           answer["ErrorCode"] = ERROR_ACCESS_DENIED
+       elif s in self._shares {
+           answer["InfoStruct"]["tag"] = request["Level"]
+           self.__fillShareInfo(answer["InfoStruct"]['ShareInfo%d' % request["Level"]], request["Level"], s)
            answer["ErrorCode"] = 0
        } else  {
            answer["InfoStruct"]["tag"] = 1
            answer["InfoStruct"]["ShareInfo1"]= NULL
-           answer["ErrorCode"] = 0x0906 //WERR_NET_NAME_NOT_FOUND
+           answer["ErrorCode"] = NERR_NetNameNotFound
 
        return answer
 
@@ -4570,21 +6387,1026 @@ from impacket.system_errors import ERROR_INVALID_LEVEL
        request = NetrShareEnum(data)
        self.log("NetrShareEnum Level: %d" % request["InfoStruct"]["Level"])
        shareEnum = NetrShareEnumResponse()
-       shareEnum["InfoStruct"]["Level"] = 1
-       shareEnum["InfoStruct"]["ShareInfo"]["tag"] = 1
+
+       level = request["InfoStruct"]["Level"]
+       // Paths are only for administrators, the rest get the basic information
+       if level not in (0, 1, 2, 502) or (level in (2, 502) and self.__isAdministrator() is false) {
+           level = 1
+
+       shareInfoClasses = {0: SHARE_INFO_0, 1: SHARE_INFO_1, 2: SHARE_INFO_2, 502: SHARE_INFO_502}
+
+       shareEnum["InfoStruct"]["Level"] = level
+       shareEnum["InfoStruct"]["ShareInfo"]["tag"] = level
        shareEnum["TotalEntries"] = len(self._shares)
-       shareEnum["InfoStruct"]["ShareInfo"]["Level1"]["EntriesRead"] = len(self._shares)
+       shareEnum["InfoStruct"]["ShareInfo"]['Level%d' % level]["EntriesRead"] = len(self._shares)
        shareEnum["ErrorCode"] = 0
 
        for i in self._shares:
-           shareInfo = SHARE_INFO_1()
-           shareInfo["shi1_netname"] = i+'\x00'
-           shareInfo["shi1_type"] = self._shares[i]["share type"]
-           shareInfo["shi1_remark"] = self._shares[i]["comment"]+'\x00'
-           shareEnum["InfoStruct"]["ShareInfo"]["Level1"]["Buffer"].append(shareInfo)
+           shareInfo = shareInfoClasses[level]()
+           self.__fillShareInfo(shareInfo, level, i)
+           shareEnum["InfoStruct"]["ShareInfo"]['Level%d' % level]["Buffer"].append(shareInfo)
 
        return shareEnum
 
+     func (self TYPE) NetrShareAdd(data interface{}){
+        request = NetrShareAdd(data)
+        self.log("NetrShareAdd Level: %d" % request["Level"])
+        answer = NetrShareAddResponse()
+
+        if self.__isAdministrator() is false {
+            answer["ErrorCode"] = ERROR_ACCESS_DENIED
+            return answer
+
+        if request["Level"] not in (2, 502) {
+            answer["ErrorCode"] = ERROR_INVALID_LEVEL
+            return answer
+
+        shareInfo = request["InfoStruct"]['ShareInfo%d' % request["Level"]]
+        prefix = "shi%d_" % request["Level"]
+        name = self.__getString(shareInfo[prefix+'netname']).upper()
+        path = self.__getString(shareInfo[prefix+'path'])
+
+        if name == '' or name in self._shares {
+            answer["ErrorCode"] = NERR_DuplicateShare
+            return answer
+
+        if os.path.isdir(path) is false {
+            answer["ErrorCode"] = NERR_UnknownDevDir
+            return answer
+
+        self.__serverConfig.add_section(name)
+        self.__setConfig(name, 'comment', self.__getString(shareInfo[prefix+'remark']))
+        self.__setConfig(name, 'read only', 'no')
+        self.__setConfig(name, 'share type', str(shareInfo[prefix+'type']))
+        self.__setConfig(name, 'path', path)
+        self.processConfigFile()
+        self.log("Share %s added (%s)" % (name, path))
+
+        answer["ErrorCode"] = 0
+        return answer
+
+     func (self TYPE) NetrShareSetInfo(data interface{}){
+        request = NetrShareSetInfo(data)
+        self.log("NetrShareSetInfo Level: %d" % request["Level"])
+        answer = NetrShareSetInfoResponse()
+
+        if self.__isAdministrator() is false {
+            answer["ErrorCode"] = ERROR_ACCESS_DENIED
+            return answer
+
+        name = request["NetName"][:-1].upper()
+        if name not in self._shares {
+            answer["ErrorCode"] = NERR_NetNameNotFound
+            return answer
+
+        level = request["Level"]
+        if level not in (1, 2, 502, 1004, 1005, 1006, 1501) {
+            answer["ErrorCode"] = ERROR_INVALID_LEVEL
+            return answer
+
+        // Flags, max uses and security descriptors are not kept, we just accept them
+        shareInfo = request["ShareInfo"]['ShareInfo%d' % level]
+        prefix = "shi%d_" % level
+        if level in (1, 2, 502, 1004) {
+            self.__setConfig(name, 'comment', self.__getString(shareInfo[prefix+'remark']))
+        if level in (2, 502) {
+            path = self.__getString(shareInfo[prefix+'path'])
+            if path != '' {
+                if os.path.isdir(path) is false {
+                    answer["ErrorCode"] = NERR_UnknownDevDir
+                    return answer
+                self.__setConfig(name, 'path', path)
+        self.processConfigFile()
+
+        answer["ErrorCode"] = 0
+        return answer
+
+     func (self TYPE) NetrShareDel(data interface{}){
+        request = NetrShareDel(data)
+        name = request["NetName"][:-1].upper()
+        self.log("NetrShareDel %s" % name)
+        answer = NetrShareDelResponse()
+
+        if self.__isAdministrator() is false {
+            answer["ErrorCode"] = ERROR_ACCESS_DENIED
+            return answer
+
+        if name not in self._shares {
+            answer["ErrorCode"] = NERR_NetNameNotFound
+            return answer
+
+        // IPC always needed
+        if name == 'IPC$' {
+            answer["ErrorCode"] = ERROR_ACCESS_DENIED
+            return answer
+
+        self.__serverConfig.remove_section(name)
+        self.processConfigFile()
+
+        answer["ErrorCode"] = 0
+        return answer
+
+     func (self TYPE) NetrSessionEnum(data interface{}){
+        request = NetrSessionEnum(data)
+        level = request["InfoStruct"]["Level"]
+        self.log("NetrSessionEnum Level: %d" % level)
+        answer = NetrSessionEnumResponse()
+
+        sessionInfoClasses = {0: SESSION_INFO_0, 1: SESSION_INFO_1, 2: SESSION_INFO_2, 10: SESSION_INFO_10,
+                              502: SESSION_INFO_502}
+
+        if level not in sessionInfoClasses {
+            answer["ErrorCode"] = ERROR_INVALID_LEVEL
+            return answer
+
+        // Only administrators can see what the users are doing
+        if level in (1, 2, 502) and self.__isAdministrator() is false {
+            answer["ErrorCode"] = ERROR_ACCESS_DENIED
+            return answer
+
+        clientName = self.__getString(request["ClientName"]).lstrip("\\")
+        userName = self.__getString(request["UserName"])
+
+        sessions = []
+        for connId, connData in list(self.__getConnections().items()):
+            if connData["UserName"] == '' {
+                continue
+            if clientName != '' and connData["ClientIP"] != clientName {
+                continue
+            if userName != '' and connData["UserName"].upper() != userName.upper() {
+                continue
+            sessions.append(connData)
+
+        if len(sessions) == 0 and clientName != '' {
+            answer["ErrorCode"] = NERR_ClientNameNotFound
+            return answer
+        if len(sessions) == 0 and userName != '' {
+            answer["ErrorCode"] = NERR_UserNotFound
+            return answer
+
+        answer["InfoStruct"]["Level"] = level
+        answer["InfoStruct"]["SessionInfo"]["tag"] = level
+        answer["InfoStruct"]["SessionInfo"]['Level%d' % level]["EntriesRead"] = len(sessions)
+        answer["TotalEntries"] = len(sessions)
+
+        if self.__smbServer == nil or not self.__smbServer.isAuthenticationRequired() {
+            // Everybody is let in as guest
+            userFlags = SESS_GUEST
+        } else  {
+            userFlags = 0
+
+        now = time.time()
+        prefix = "sesi%d_" % level
+        for connData in sessions:
+            sessionInfo = sessionInfoClasses[level]()
+            sessionInfo[prefix+'cname'] = "\\\\%s\x00" % connData["ClientIP"]
+            if level != 0 {
+                sessionInfo[prefix+'username'] = connData["UserName"]+'\x00'
+                sessionInfo[prefix+'time'] = int(now - connData["SessionStart"])
+                sessionInfo[prefix+'idle_time'] = int(now - connData["LastActivity"])
+            if level in (1, 2, 502) {
+                sessionInfo[prefix+'num_opens'] = len(self.__getOpenedFiles(connData))
+                sessionInfo[prefix+'user_flags'] = userFlags
+            if level in (2, 502) {
+                sessionInfo[prefix+'cltype_name'] = "\x00"
+            if level == 502 {
+                sessionInfo[prefix+'transport'] = "\\Device\\NetbiosSmb\x00"
+            answer["InfoStruct"]["SessionInfo"]['Level%d' % level]["Buffer"].append(sessionInfo)
+
+        answer["ErrorCode"] = 0
+        return answer
+
+     func (self TYPE) NetrSessionDel(data interface{}){
+        request = NetrSessionDel(data)
+        clientName = self.__getString(request["ClientName"]).lstrip("\\")
+        userName = self.__getString(request["UserName"])
+        self.log("NetrSessionDel (%s,%s)" % (clientName, userName))
+        answer = NetrSessionDelResponse()
+
+        if self.__isAdministrator() is false {
+            answer["ErrorCode"] = ERROR_ACCESS_DENIED
+            return answer
+
+        if clientName == '' and userName == '' {
+            answer["ErrorCode"] = ERROR_INVALID_PARAMETER
+            return answer
+
+        found = false
+        for connId, connData in list(self.__getConnections().items()):
+            if connData["UserName"] == '' {
+                continue
+            if clientName != '' and connData["ClientIP"] != clientName {
+                continue
+            if userName != '' and connData["UserName"].upper() != userName.upper() {
+                continue
+            self.__smbServer.closeConnection(connId)
+            found = true
+
+        if found is false {
+            answer["ErrorCode"] = NERR_ClientNameNotFound
+        } else  {
+            answer["ErrorCode"] = 0
+        return answer
+
+     func (self TYPE) NetrConnectionEnum(data interface{}){
+        request = NetrConnectionEnum(data)
+        level = request["InfoStruct"]["Level"]
+        self.log("NetrConnectionEnum Level: %d" % level)
+        answer = NetrConnectionEnumResponse()
+
+        if level not in (0, 1) {
+            answer["ErrorCode"] = ERROR_INVALID_LEVEL
+            return answer
+
+        if self.__isAdministrator() is false {
+            answer["ErrorCode"] = ERROR_ACCESS_DENIED
+            return answer
+
+        // The qualifier is either a share name or a \\computer name
+        qualifier = self.__getString(request["Qualifier"])
+        if qualifier == '' {
+            answer["ErrorCode"] = ERROR_INVALID_PARAMETER
+            return answer
+
+        isClient = qualifier.startswith("\\\\")
+        if isClient is false and qualifier.upper() not in self._shares {
+            answer["ErrorCode"] = NERR_NetNameNotFound
+            return answer
+
+        connections = []
+        for connId, connData in list(self.__getConnections().items()):
+            if isClient is true and connData["ClientIP"] != qualifier.lstrip("\\") {
+                continue
+            for tid in list(connData["ConnectedShares"].keys()):
+                share = connData["ConnectedShares"][tid]
+                if isClient is false and share["shareName"].upper() != qualifier.upper() {
+                    continue
+                if isClient is true {
+                    netName = share["shareName"]
+                } else  {
+                    netName = connData["ClientIP"]
+                connections.append((connData, share, netName))
+
+        answer["InfoStruct"]["Level"] = level
+        answer["InfoStruct"]["ConnectInfo"]["tag"] = level
+        answer["InfoStruct"]["ConnectInfo"]['Level%d' % level]["EntriesRead"] = len(connections)
+        answer["TotalEntries"] = len(connections)
+
+        now = time.time()
+        for connectionId, (connData, share, netName) in enumerate(connections):
+            if level == 0 {
+                connectionInfo = CONNECTION_INFO_0()
+                connectionInfo["coni0_id"] = connectionId
+            } else  {
+                connectionInfo = CONNECTION_INFO_1()
+                connectionInfo["coni1_id"] = connectionId
+                connectionInfo["coni1_type"] = int(share["share type"])
+                if 'path' in share and share["path"] != '' {
+                    connectionInfo["coni1_num_opens"] = len(self.__getOpenedFiles(connData, share["path"]))
+                } else  {
+                    connectionInfo["coni1_num_opens"] = 0
+                connectionInfo["coni1_num_users"] = 1
+                connectionInfo["coni1_time"] = int(now - share["connectTime"])
+                connectionInfo["coni1_username"] = connData["UserName"]+'\x00'
+                connectionInfo["coni1_netname"] = netName+'\x00'
+            answer["InfoStruct"]["ConnectInfo"]['Level%d' % level]["Buffer"].append(connectionInfo)
+
+        answer["ErrorCode"] = 0
+        return answer
+
+     func (self TYPE) NetrFileEnum(data interface{}){
+        request = NetrFileEnum(data)
+        level = request["InfoStruct"]["Level"]
+        self.log("NetrFileEnum Level: %d" % level)
+        answer = NetrFileEnumResponse()
+
+        if level not in (2, 3) {
+            answer["ErrorCode"] = ERROR_INVALID_LEVEL
+            return answer
+
+        if self.__isAdministrator() is false {
+            answer["ErrorCode"] = ERROR_ACCESS_DENIED
+            return answer
+
+        basePath = self.__getString(request["BasePath"])
+        userName = self.__getString(request["UserName"])
+
+        files = []
+        for connId, connData in list(self.__getConnections().items()):
+            if userName != '' and connData["UserName"].upper() != userName.upper() {
+                continue
+            for fid, fileData in self.__getOpenedFiles(connData):
+                if basePath != '' and fileData["FileName"].startswith(basePath) is false {
+                    continue
+                files.append((self.__getFileId(connId, fid), connData, fileData))
+
+        answer["InfoStruct"]["Level"] = level
+        answer["InfoStruct"]["FileInfo"]["tag"] = level
+        answer["InfoStruct"]["FileInfo"]['Level%d' % level]["EntriesRead"] = len(files)
+        answer["TotalEntries"] = len(files)
+
+        for fileId, connData, fileData in files:
+            if level == 2 {
+                fileInfo = FILE_INFO_2()
+                fileInfo["fi2_id"] = fileId
+            } else  {
+                fileInfo = FILE_INFO_3()
+                fileInfo["fi3_id"] = fileId
+                mode = fileData.get('Mode', os.O_RDONLY)
+                if mode & os.O_RDWR {
+                    permissions = PERM_FILE_READ | PERM_FILE_WRITE
+                elif mode & os.O_WRONLY {
+                    permissions = PERM_FILE_WRITE
+                } else  {
+                    permissions = PERM_FILE_READ
+                if mode & os.O_CREAT {
+                    permissions |= PERM_FILE_CREATE
+                fileInfo["fi3_permissions"] = permissions
+                fileInfo["fi3_num_locks"] = 0
+                fileInfo["fi3_path_name"] = fileData["FileName"]+'\x00'
+                fileInfo["fi3_username"] = connData["UserName"]+'\x00'
+            answer["InfoStruct"]["FileInfo"]['Level%d' % level]["Buffer"].append(fileInfo)
+
+        answer["ErrorCode"] = 0
+        return answer
+
+     func (self TYPE) NetrFileClose(data interface{}){
+        request = NetrFileClose(data)
+        self.log("NetrFileClose 0x%x" % request["FileId"])
+        answer = NetrFileCloseResponse()
+
+        if self.__isAdministrator() is false {
+            answer["ErrorCode"] = ERROR_ACCESS_DENIED
+            return answer
+
+        for connId, connData in list(self.__getConnections().items()):
+            for fid, fileData in self.__getOpenedFiles(connData):
+                if self.__getFileId(connId, fid) == request["FileId"] {
+                    if self.__smbServer.closeOpenedFile(connId, fid) is true {
+                        answer["ErrorCode"] = 0
+                        return answer
+
+        answer["ErrorCode"] = NERR_FileIdNotFound
+        return answer
+
+     func (self TYPE) NetrRemoteTOD(data interface{}){
+        NetrRemoteTOD(data)
+        self.log("NetrRemoteTOD")
+        answer = NetrRemoteTODResponse()
+
+        now = time.time()
+        t = time.gmtime(now)
+        if time.localtime(now).tm_isdst > 0 {
+            timezone = time.altzone // 60
+        } else  {
+            timezone = time.timezone // 60
+
+        answer["BufferPtr"]["tod_elapsedt"] = int(now)
+        // Milliseconds since we started, wraps every ~49 days just like the real one
+        answer["BufferPtr"]["tod_msecs"] = int((now - self.__startTime) * 1000) & 0xffffffff
+        answer["BufferPtr"]["tod_hours"] = t.tm_hour
+        answer["BufferPtr"]["tod_mins"] = t.tm_min
+        answer["BufferPtr"]["tod_secs"] = t.tm_sec
+        answer["BufferPtr"]["tod_hunds"] = int((now - int(now)) * 100)
+        answer["BufferPtr"]["tod_timezone"] = timezone & 0xffffffff
+        // Clock tick is 0.0001 seconds, 310 units is what Windows answers
+        answer["BufferPtr"]["tod_tinterval"] = 310
+        answer["BufferPtr"]["tod_day"] = t.tm_mday
+        answer["BufferPtr"]["tod_month"] = t.tm_mon
+        answer["BufferPtr"]["tod_year"] = t.tm_year
+        // Sunday is 0
+        answer["BufferPtr"]["tod_weekday"] = (t.tm_wday + 1) % 7
+
+        answer["ErrorCode"] = 0
+        return answer
+
+ type LSARPCServer struct { // DCERPCServer:
+     func (self TYPE) __init__(){
+        DCERPCServer.__init__(self)
+        self.__smbServer = nil
+        // Handle: connId of the SMB connection that opened it
+        self.__handles = {}
+        self.lsarpcCallBacks = {
+            0: self.LsarClose,
+            6: self.LsarOpenPolicy,
+            7: self.LsarQueryInformationPolicy,
+            14: self.LsarLookupNames,
+            15: self.LsarLookupSids,
+            44: self.LsarOpenPolicy2,
+            45: self.LsarGetUserName,
+            46: self.LsarQueryInformationPolicy2,
+            57: self.LsarLookupSids2,
+            58: self.LsarLookupNames2,
+        }
+        self.addCallbacks(('12345778-1234-ABCD-EF00-0123456789AB', '0.0'),'\\PIPE\\lsarpc', self.lsarpcCallBacks)
+
+     func (self TYPE) setSMBServer(smbServer interface{}){
+        // The SMBSERVER we're answering for. Its credentials are our account database
+        self.__smbServer = smbServer
+        if smbServer is not nil {
+            smbServer.addCloseCallback(self.__releaseHandles)
+
+    @staticmethod
+     func __getString(value interface{}){
+        // NULL pointers come back empty, some clients NULL terminate their strings
+        if value is NULL or len(value) == 0 {
+            return ''
+        if value[-1:] == '\x00' {
+            return value[:-1]
+        return value
+
+    @staticmethod
+     func __getLookupStatus(mappedCount, totalCount interface{}){
+        if totalCount > 0 and mappedCount == 0 {
+            return STATUS_NONE_MAPPED
+        elif mappedCount < totalCount {
+            return STATUS_SOME_NOT_MAPPED
+        return STATUS_SUCCESS
+
+     func (self TYPE) __getAccounts(){
+        // Everything we know about: (Domain Name, Domain SID, Account Name, RID, SID_NAME_USE)
+        // The domains themselves are there too, with no RID
+        accounts = []
+        for sid in sorted(WELL_KNOWN_SIDS.keys()):
+            domainName, domainSid, name, use = WELL_KNOWN_SIDS[sid]
+            accounts.append((domainName, domainSid, name, int(sid.split("-")[-1]), use))
+        accounts.append(('BUILTIN', BUILTIN_DOMAIN_SID, 'BUILTIN', nil, SID_NAME_USE.SidTypeDomain))
+
+        if self.__smbServer is not nil {
+            serverName = self.__smbServer.getServerName()
+            serverSid = self.__smbServer.getServerSid()
+            accounts.append((serverName, serverSid, serverName, nil, SID_NAME_USE.SidTypeDomain))
+            localAccounts = self.__smbServer.getLocalAccounts()
+            for name in sorted(localAccounts.keys()):
+                accounts.append((serverName, serverSid, name, localAccounts[name], SID_NAME_USE.SidTypeUser))
+        return accounts
+
+     func (self TYPE) __lookupSid(sid interface{}){
+        for account in self.__getAccounts():
+            domainName, domainSid, name, rid, use = account
+            if rid == nil {
+                accountSid = domainSid
+            } else  {
+                accountSid = "%s-%d" % (domainSid, rid)
+            if accountSid == sid {
+                return account
+        return nil
+
+     func (self TYPE) __lookupName(name interface{}){
+        // Names can come as DOMAIN\name or just name
+        if '\\' in name {
+            domain, name = name.split('\\', 1)
+        } else  {
+            domain = nil
+        for account in self.__getAccounts():
+            if account[2].upper() != name.upper() {
+                continue
+            if domain is not nil and account[0].upper() != domain.upper() {
+                continue
+            return account
+        return nil
+
+    @staticmethod
+     func __fillReferencedDomains(answer, domains interface{}){
+        answer["ReferencedDomains"]["Entries"] = len(domains)
+        answer["ReferencedDomains"]["MaxEntries"] = len(domains)
+        for domainName, domainSid in domains:
+            trustInfo = LSAPR_TRUST_INFORMATION()
+            trustInfo["Name"] = domainName
+            trustInfo["Sid"].fromCanonical(domainSid)
+            answer["ReferencedDomains"]["Domains"].append(trustInfo)
+
+     func (self TYPE) __getConnection(){
+        // The SMB connection behind this pipe, nil unless there's a logged on user there
+        if self.__smbServer == nil {
+            return nil
+        connId = self.__smbServer.getPipeConnection(self._clientSock.getpeername())
+        if self.__smbServer.isLoggedOn(connId) is false {
+            return nil
+        return connId
+
+     func (self TYPE) __newHandle(connId interface{}){
+        handle = os.urandom(20)
+        self.__handles[handle] = connId
+        return handle
+
+     func (self TYPE) __isHandle(handle interface{}){
+        // Handles are only good for the connection that opened them
+        connId = self.__handles.get(handle)
+        return connId is not nil and connId == self.__getConnection()
+
+     func (self TYPE) __releaseHandles(connId interface{}){
+        for handle, owner in list(self.__handles.items()):
+            if owner == connId {
+                self.__handles.pop(handle, nil)
+
+     func (self TYPE) __openPolicy(answer interface{}){
+        connId = self.__getConnection()
+        if connId == nil {
+            answer["PolicyHandle"] = b'\x00'*20
+            answer["ErrorCode"] = STATUS_ACCESS_DENIED
+            return answer
+        answer["PolicyHandle"] = self.__newHandle(connId)
+        answer["ErrorCode"] = STATUS_SUCCESS
+        return answer
+
+     func (self TYPE) __queryInformationPolicy(request, answer interface{}){
+        if self.__isHandle(request["PolicyHandle"]) is false {
+            answer["PolicyInformation"] = NULL
+            answer["ErrorCode"] = STATUS_INVALID_HANDLE
+            return answer
+
+        if self.__smbServer == nil {
+            serverName = serverDomain = ""
+            serverSid = nil
+        } else  {
+            serverName = self.__smbServer.getServerName()
+            serverDomain = self.__smbServer.getServerDomain()
+            serverSid = self.__smbServer.getServerSid()
+
+        infoClass = request["InformationClass"]
+        if infoClass == POLICY_INFORMATION_CLASS.PolicyPrimaryDomainInformation {
+            // We're just a workgroup member, hence no domain SID
+            answer["PolicyInformation"]["tag"] = infoClass
+            answer["PolicyInformation"]["PolicyPrimaryDomainInfo"]["Name"] = serverDomain
+            answer["PolicyInformation"]["PolicyPrimaryDomainInfo"]["Sid"] = NULL
+        elif infoClass == POLICY_INFORMATION_CLASS.PolicyAccountDomainInformation and serverSid is not nil {
+            answer["PolicyInformation"]["tag"] = infoClass
+            answer["PolicyInformation"]["PolicyAccountDomainInfo"]["DomainName"] = serverName
+            answer["PolicyInformation"]["PolicyAccountDomainInfo"]["DomainSid"].fromCanonical(serverSid)
+        } else  {
+            answer["PolicyInformation"] = NULL
+            answer["ErrorCode"] = STATUS_INVALID_PARAMETER
+            return answer
+
+        answer["ErrorCode"] = STATUS_SUCCESS
+        return answer
+
+     func (self TYPE) __lookupSids(request, answer, extended interface{}){
+        domains = []
+        mappedCount = 0
+        entries = request["SidEnumBuffer"]["Entries"]
+
+        for i in range(entries):
+            sid = request["SidEnumBuffer"]["SidInfo"][i]["Sid"].formatCanonical()
+            account = self.__lookupSid(sid)
+            if extended is true {
+                translatedName = LSAPR_TRANSLATED_NAME_EX()
+                translatedName["Flags"] = 0
+            } else  {
+                translatedName = LSAPR_TRANSLATED_NAME()
+
+            if account == nil {
+                // Like Windows, we give the SID back as the name
+                translatedName["Use"] = SID_NAME_USE.SidTypeUnknown
+                translatedName["Name"] = sid
+                translatedName["DomainIndex"] = -1
+            } else  {
+                mappedCount += 1
+                if (account[0], account[1]) not in domains {
+                    domains.append((account[0], account[1]))
+                translatedName["Use"] = account[4]
+                translatedName["Name"] = account[2]
+                translatedName["DomainIndex"] = domains.index((account[0], account[1]))
+            answer["TranslatedNames"]["Names"].append(translatedName)
+
+        answer["TranslatedNames"]["Entries"] = entries
+        self.__fillReferencedDomains(answer, domains)
+        answer["MappedCount"] = mappedCount
+        answer["ErrorCode"] = self.__getLookupStatus(mappedCount, entries)
+        return answer
+
+     func (self TYPE) __lookupNames(request, answer, extended interface{}){
+        domains = []
+        mappedCount = 0
+        entries = request["Count"]
+
+        for i in range(entries):
+            account = self.__lookupName(self.__getString(request["Names"][i]["Data"]))
+            if extended is true {
+                translatedSid = LSAPR_TRANSLATED_SID_EX()
+                translatedSid["Flags"] = 0
+            } else  {
+                translatedSid = LSA_TRANSLATED_SID()
+
+            if account == nil {
+                translatedSid["Use"] = SID_NAME_USE.SidTypeUnknown
+                translatedSid["RelativeId"] = 0
+                translatedSid["DomainIndex"] = -1
+            } else  {
+                mappedCount += 1
+                if (account[0], account[1]) not in domains {
+                    domains.append((account[0], account[1]))
+                translatedSid["Use"] = account[4]
+                if account[3] == nil {
+                    translatedSid["RelativeId"] = 0
+                } else  {
+                    translatedSid["RelativeId"] = account[3]
+                translatedSid["DomainIndex"] = domains.index((account[0], account[1]))
+            answer["TranslatedSids"]["Sids"].append(translatedSid)
+
+        answer["TranslatedSids"]["Entries"] = entries
+        self.__fillReferencedDomains(answer, domains)
+        answer["MappedCount"] = mappedCount
+        answer["ErrorCode"] = self.__getLookupStatus(mappedCount, entries)
+        return answer
+
+     func (self TYPE) LsarOpenPolicy(data interface{}){
+        LsarOpenPolicy(data)
+        self.log("LsarOpenPolicy")
+        return self.__openPolicy(LsarOpenPolicyResponse())
+
+     func (self TYPE) LsarOpenPolicy2(data interface{}){
+        LsarOpenPolicy2(data)
+        self.log("LsarOpenPolicy2")
+        return self.__openPolicy(LsarOpenPolicy2Response())
+
+     func (self TYPE) LsarClose(data interface{}){
+        request = LsarClose(data)
+        self.log("LsarClose")
+
+        answer = LsarCloseResponse()
+        answer["ObjectHandle"] = b'\x00'*20
+        if self.__isHandle(request["ObjectHandle"]) is true {
+            self.__handles.pop(request["ObjectHandle"], nil)
+            answer["ErrorCode"] = STATUS_SUCCESS
+        } else  {
+            answer["ErrorCode"] = STATUS_INVALID_HANDLE
+        return answer
+
+     func (self TYPE) LsarQueryInformationPolicy(data interface{}){
+        request = LsarQueryInformationPolicy(data)
+        self.log("LsarQueryInformationPolicy Class: %d" % request["InformationClass"])
+        return self.__queryInformationPolicy(request, LsarQueryInformationPolicyResponse())
+
+     func (self TYPE) LsarQueryInformationPolicy2(data interface{}){
+        request = LsarQueryInformationPolicy2(data)
+        self.log("LsarQueryInformationPolicy2 Class: %d" % request["InformationClass"])
+        return self.__queryInformationPolicy(request, LsarQueryInformationPolicy2Response())
+
+     func (self TYPE) LsarLookupSids(data interface{}){
+        request = LsarLookupSids(data)
+        self.log("LsarLookupSids Entries: %d" % request["SidEnumBuffer"]["Entries"])
+
+        answer = LsarLookupSidsResponse()
+        if self.__isHandle(request["PolicyHandle"]) is false {
+            answer["ReferencedDomains"] = NULL
+            answer["ErrorCode"] = STATUS_INVALID_HANDLE
+            return answer
+        return self.__lookupSids(request, answer, false)
+
+     func (self TYPE) LsarLookupSids2(data interface{}){
+        request = LsarLookupSids2(data)
+        self.log("LsarLookupSids2 Entries: %d" % request["SidEnumBuffer"]["Entries"])
+
+        answer = LsarLookupSids2Response()
+        if self.__isHandle(request["PolicyHandle"]) is false {
+            answer["ReferencedDomains"] = NULL
+            answer["ErrorCode"] = STATUS_INVALID_HANDLE
+            return answer
+        return self.__lookupSids(request, answer, true)
+
+     func (self TYPE) LsarLookupNames(data interface{}){
+        request = LsarLookupNames(data)
+        self.log("LsarLookupNames Count: %d" % request["Count"])
+
+        answer = LsarLookupNamesResponse()
+        if self.__isHandle(request["PolicyHandle"]) is false {
+            answer["ReferencedDomains"] = NULL
+            answer["ErrorCode"] = STATUS_INVALID_HANDLE
+            return answer
+        return self.__lookupNames(request, answer, false)
+
+     func (self TYPE) LsarLookupNames2(data interface{}){
+        request = LsarLookupNames2(data)
+        self.log("LsarLookupNames2 Count: %d" % request["Count"])
+
+        answer = LsarLookupNames2Response()
+        if self.__isHandle(request["PolicyHandle"]) is false {
+            answer["ReferencedDomains"] = NULL
+            answer["ErrorCode"] = STATUS_INVALID_HANDLE
+            return answer
+        return self.__lookupNames(request, answer, true)
+
+     func (self TYPE) LsarGetUserName(data interface{}){
+        LsarGetUserName(data)
+        self.log("LsarGetUserName")
+
+        userName = ""
+        if self.__smbServer is not nil {
+            connId = self.__smbServer.getPipeConnection(self._clientSock.getpeername())
+            if connId in self.__smbServer.getActiveConnections() {
+                userName = self.__smbServer.getActiveConnections()[connId]["UserName"]
+
+        answer = LsarGetUserNameResponse()
+        if userName == '' {
+            answer["UserName"] = "ANONYMOUS LOGON"
+            answer["DomainName"] = "NT AUTHORITY"
+        } else  {
+            answer["UserName"] = userName
+            answer["DomainName"] = self.__smbServer.getServerName()
+        answer["ErrorCode"] = STATUS_SUCCESS
+        return answer
+
+ type SAMRServer struct { // DCERPCServer:
+     func (self TYPE) __init__(){
+        DCERPCServer.__init__(self)
+        self.__smbServer = nil
+        // Handle: (connId of the SMB connection that opened it, Domain SID or nil for server handles)
+        self.__handles = {}
+        self.samrCallBacks = {
+            0: self.SamrConnect,
+            1: self.SamrCloseHandle,
+            5: self.SamrLookupDomainInSamServer,
+            6: self.SamrEnumerateDomainsInSamServer,
+            7: self.SamrOpenDomain,
+            13: self.SamrEnumerateUsersInDomain,
+            15: self.SamrEnumerateAliasesInDomain,
+            17: self.SamrLookupNamesInDomain,
+            18: self.SamrLookupIdsInDomain,
+            57: self.SamrConnect2,
+            64: self.SamrConnect5,
+        }
+        self.addCallbacks(('12345778-1234-ABCD-EF00-0123456789AC', '1.0'),'\\PIPE\\samr', self.samrCallBacks)
+
+     func (self TYPE) setSMBServer(smbServer interface{}){
+        // The SMBSERVER we're answering for. Its credentials are our account database
+        self.__smbServer = smbServer
+        if smbServer is not nil {
+            smbServer.addCloseCallback(self.__releaseHandles)
+
+    @staticmethod
+     func __getString(value interface{}){
+        // NULL pointers come back empty, some clients NULL terminate their strings
+        if value is NULL or len(value) == 0 {
+            return ''
+        if value[-1:] == '\x00' {
+            return value[:-1]
+        return value
+
+     func (self TYPE) __getDomains(){
+        // (Domain Name, Domain SID). Ours plus the BUILTIN one
+        domains = []
+        if self.__smbServer is not nil {
+            domains.append((self.__smbServer.getServerName(), self.__smbServer.getServerSid()))
+        domains.append(('Builtin', BUILTIN_DOMAIN_SID))
+        return domains
+
+     func (self TYPE) __getDomainAccounts(domainSid interface{}){
+        // (Account Name, RID, SID_NAME_USE) for every account in the domain
+        accounts = []
+        if domainSid == BUILTIN_DOMAIN_SID {
+            for sid in sorted(WELL_KNOWN_SIDS.keys()):
+                if WELL_KNOWN_SIDS[sid][1] == BUILTIN_DOMAIN_SID {
+                    accounts.append((WELL_KNOWN_SIDS[sid][2], int(sid.split("-")[-1]), WELL_KNOWN_SIDS[sid][3]))
+        elif self.__smbServer is not nil {
+            localAccounts = self.__smbServer.getLocalAccounts()
+            for name in sorted(localAccounts.keys()):
+                accounts.append((name, localAccounts[name], SID_NAME_USE.SidTypeUser))
+        return accounts
+
+     func (self TYPE) __getConnection(){
+        // The SMB connection behind this pipe, nil unless there's a logged on user there
+        if self.__smbServer == nil {
+            return nil
+        connId = self.__smbServer.getPipeConnection(self._clientSock.getpeername())
+        if self.__smbServer.isLoggedOn(connId) is false {
+            return nil
+        return connId
+
+     func (self TYPE) __newHandle(connId, domainSid = nil interface{}){
+        handle = os.urandom(20)
+        self.__handles[handle] = (connId, domainSid)
+        return handle
+
+     func (self TYPE) __isHandle(handle interface{}){
+        // Handles are only good for the connection that opened them
+        if handle not in self.__handles {
+            return false
+        return self.__handles[handle][0] == self.__getConnection()
+
+     func (self TYPE) __isServerHandle(handle interface{}){
+        return self.__isHandle(handle) and self.__handles[handle][1] == nil
+
+     func (self TYPE) __isDomainHandle(handle interface{}){
+        return self.__isHandle(handle) and self.__handles[handle][1] is not nil
+
+     func (self TYPE) __releaseHandles(connId interface{}){
+        for handle, owner in list(self.__handles.items()):
+            if owner[0] == connId {
+                self.__handles.pop(handle, nil)
+
+     func (self TYPE) __connect(answer interface{}){
+        connId = self.__getConnection()
+        if connId == nil {
+            answer["ServerHandle"] = b'\x00'*20
+            answer["ErrorCode"] = STATUS_ACCESS_DENIED
+            return answer
+        answer["ServerHandle"] = self.__newHandle(connId)
+        answer["ErrorCode"] = STATUS_SUCCESS
+        return answer
+
+     func (self TYPE) __enumerateAccounts(request, answer, use interface{}){
+        if self.__isDomainHandle(request["DomainHandle"]) is false {
+            answer["Buffer"] = NULL
+            answer["ErrorCode"] = STATUS_INVALID_HANDLE
+            return answer
+
+        // Everything goes in one shot
+        accounts = [account for account in self.__getDomainAccounts(self.__handles[request["DomainHandle"]][1]) if account[2] == use]
+        for name, rid, accountUse in accounts:
+            entry = SAMPR_RID_ENUMERATION()
+            entry["RelativeId"] = rid
+            entry["Name"] = name
+            answer["Buffer"]["Buffer"].append(entry)
+        answer["Buffer"]["EntriesRead"] = len(accounts)
+        answer["CountReturned"] = len(accounts)
+        answer["EnumerationContext"] = 0
+        answer["ErrorCode"] = STATUS_SUCCESS
+        return answer
+
+     func (self TYPE) SamrConnect(data interface{}){
+        SamrConnect(data)
+        self.log("SamrConnect")
+
+        answer = SamrConnectResponse()
+        return self.__connect(answer)
+
+     func (self TYPE) SamrConnect2(data interface{}){
+        SamrConnect2(data)
+        self.log("SamrConnect2")
+
+        answer = SamrConnect2Response()
+        return self.__connect(answer)
+
+     func (self TYPE) SamrConnect5(data interface{}){
+        SamrConnect5(data)
+        self.log("SamrConnect5")
+
+        answer = SamrConnect5Response()
+        answer["OutVersion"] = 1
+        answer["OutRevisionInfo"]["tag"] = 1
+        answer["OutRevisionInfo"]["V1"]["Revision"] = 3
+        answer["OutRevisionInfo"]["V1"]["SupportedFeatures"] = 0
+        return self.__connect(answer)
+
+     func (self TYPE) SamrCloseHandle(data interface{}){
+        request = SamrCloseHandle(data)
+        self.log("SamrCloseHandle")
+
+        answer = SamrCloseHandleResponse()
+        answer["SamHandle"] = b'\x00'*20
+        if self.__isHandle(request["SamHandle"]) is true {
+            self.__handles.pop(request["SamHandle"], nil)
+            answer["ErrorCode"] = STATUS_SUCCESS
+        } else  {
+            answer["ErrorCode"] = STATUS_INVALID_HANDLE
+        return answer
+
+     func (self TYPE) SamrLookupDomainInSamServer(data interface{}){
+        request = SamrLookupDomainInSamServer(data)
+        domainName = self.__getString(request["Name"])
+        self.log("SamrLookupDomainInSamServer Name: %s" % domainName)
+
+        answer = SamrLookupDomainInSamServerResponse()
+        if self.__isServerHandle(request["ServerHandle"]) is false {
+            answer["DomainId"] = NULL
+            answer["ErrorCode"] = STATUS_INVALID_HANDLE
+            return answer
+
+        for name, sid in self.__getDomains():
+            if name.upper() == domainName.upper() {
+                answer["DomainId"].fromCanonical(sid)
+                answer["ErrorCode"] = STATUS_SUCCESS
+                return answer
+
+        answer["DomainId"] = NULL
+        answer["ErrorCode"] = STATUS_NO_SUCH_DOMAIN
+        return answer
+
+     func (self TYPE) SamrEnumerateDomainsInSamServer(data interface{}){
+        request = SamrEnumerateDomainsInSamServer(data)
+        self.log("SamrEnumerateDomainsInSamServer")
+
+        answer = SamrEnumerateDomainsInSamServerResponse()
+        if self.__isServerHandle(request["ServerHandle"]) is false {
+            answer["Buffer"] = NULL
+            answer["ErrorCode"] = STATUS_INVALID_HANDLE
+            return answer
+
+        domains = self.__getDomains()
+        for name, sid in domains:
+            // Domains have no RID
+            entry = SAMPR_RID_ENUMERATION()
+            entry["RelativeId"] = 0
+            entry["Name"] = name
+            answer["Buffer"]["Buffer"].append(entry)
+        answer["Buffer"]["EntriesRead"] = len(domains)
+        answer["CountReturned"] = len(domains)
+        answer["EnumerationContext"] = 0
+        answer["ErrorCode"] = STATUS_SUCCESS
+        return answer
+
+     func (self TYPE) SamrOpenDomain(data interface{}){
+        request = SamrOpenDomain(data)
+        domainSid = request["DomainId"].formatCanonical()
+        self.log("SamrOpenDomain DomainId: %s" % domainSid)
+
+        answer = SamrOpenDomainResponse()
+        if self.__isServerHandle(request["ServerHandle"]) is false {
+            answer["ErrorCode"] = STATUS_INVALID_HANDLE
+            return answer
+
+        if domainSid not in [sid for name, sid in self.__getDomains()] {
+            answer["ErrorCode"] = STATUS_NO_SUCH_DOMAIN
+            return answer
+
+        answer["DomainHandle"] = self.__newHandle(self.__handles[request["ServerHandle"]][0], domainSid)
+        answer["ErrorCode"] = STATUS_SUCCESS
+        return answer
+
+     func (self TYPE) SamrEnumerateUsersInDomain(data interface{}){
+        request = SamrEnumerateUsersInDomain(data)
+        self.log("SamrEnumerateUsersInDomain")
+        return self.__enumerateAccounts(request, SamrEnumerateUsersInDomainResponse(), SID_NAME_USE.SidTypeUser)
+
+     func (self TYPE) SamrEnumerateAliasesInDomain(data interface{}){
+        request = SamrEnumerateAliasesInDomain(data)
+        self.log("SamrEnumerateAliasesInDomain")
+        return self.__enumerateAccounts(request, SamrEnumerateAliasesInDomainResponse(), SID_NAME_USE.SidTypeAlias)
+
+     func (self TYPE) SamrLookupNamesInDomain(data interface{}){
+        request = SamrLookupNamesInDomain(data)
+        self.log("SamrLookupNamesInDomain Count: %d" % request["Count"])
+
+        answer = SamrLookupNamesInDomainResponse()
+        if self.__isDomainHandle(request["DomainHandle"]) is false {
+            answer["ErrorCode"] = STATUS_INVALID_HANDLE
+            return answer
+
+        accounts = self.__getDomainAccounts(self.__handles[request["DomainHandle"]][1])
+        mappedCount = 0
+        for i in range(request["Count"]):
+            name = self.__getString(request["Names"][i]["Data"])
+            rid = ULONG()
+            rid["Data"] = 0
+            use = ULONG()
+            use["Data"] = SID_NAME_USE.SidTypeUnknown
+            for accountName, accountRid, accountUse in accounts:
+                if accountName.upper() == name.upper() {
+                    rid["Data"] = accountRid
+                    use["Data"] = accountUse
+                    mappedCount += 1
+                    break
+            answer["RelativeIds"]["Element"].append(rid)
+            answer["Use"]["Element"].append(use)
+
+        answer["RelativeIds"]["Count"] = request["Count"]
+        answer["Use"]["Count"] = request["Count"]
+        if request["Count"] > 0 and mappedCount == 0 {
+            answer["ErrorCode"] = STATUS_NONE_MAPPED
+        elif mappedCount < request["Count"] {
+            answer["ErrorCode"] = STATUS_SOME_NOT_MAPPED
+        } else  {
+            answer["ErrorCode"] = STATUS_SUCCESS
+        return answer
+
+     func (self TYPE) SamrLookupIdsInDomain(data interface{}){
+        request = SamrLookupIdsInDomain(data)
+        self.log("SamrLookupIdsInDomain Count: %d" % request["Count"])
+
+        answer = SamrLookupIdsInDomainResponse()
+        if self.__isDomainHandle(request["DomainHandle"]) is false {
+            answer["ErrorCode"] = STATUS_INVALID_HANDLE
+            return answer
+
+        accounts = self.__getDomainAccounts(self.__handles[request["DomainHandle"]][1])
+        mappedCount = 0
+        for i in range(request["Count"]):
+            relativeId = request["RelativeIds"][i]["Data"]
+            name = RPC_UNICODE_STRING()
+            name["Data"] = ""
+            use = ULONG()
+            use["Data"] = SID_NAME_USE.SidTypeUnknown
+            for accountName, accountRid, accountUse in accounts:
+                if accountRid == relativeId {
+                    name["Data"] = accountName
+                    use["Data"] = accountUse
+                    mappedCount += 1
+                    break
+            answer["Names"]["Element"].append(name)
+            answer["Use"]["Element"].append(use)
+
+        answer["Names"]["Count"] = request["Count"]
+        answer["Use"]["Count"] = request["Count"]
+        if request["Count"] > 0 and mappedCount == 0 {
+            answer["ErrorCode"] = STATUS_NONE_MAPPED
+        elif mappedCount < request["Count"] {
+            answer["ErrorCode"] = STATUS_SOME_NOT_MAPPED
+        } else  {
+            answer["ErrorCode"] = STATUS_SUCCESS
+        return answer
+
  type SimpleSMBServer: struct {
     """
     SimpleSMBServer  type - Implements a simple, customizable SMB Server struct {
@@ -4627,14 +7449,28 @@ from impacket.system_errors import ERROR_INVALID_LEVEL
 
         self.__srvsServer = SRVSServer()
         self.__srvsServer.daemon = true
+        self.__srvsServer.setSMBServer(self.__server)
+        self.__srvsServer.setServerConfig(self.__server.getServerConfig())
+        self.__srvsServer.processConfigFile()
         self.__wkstServer = WKSTServer()
         self.__wkstServer.daemon = true
+        self.__wkstServer.setSMBServer(self.__server)
+        self.__lsarpcServer = LSARPCServer()
+        self.__lsarpcServer.daemon = true
+        self.__lsarpcServer.setSMBServer(self.__server)
+        self.__samrServer = SAMRServer()
+        self.__samrServer.daemon = true
+        self.__samrServer.setSMBServer(self.__server)
         self.__server.registerNamedPipe('srvsvc',('127.0.0.1',self.__srvsServer.getListenPort()))
         self.__server.registerNamedPipe('wkssvc',('127.0.0.1',self.__wkstServer.getListenPort()))
+        self.__server.registerNamedPipe('lsarpc',('127.0.0.1',self.__lsarpcServer.getListenPort()))
+        self.__server.registerNamedPipe('samr',('127.0.0.1',self.__samrServer.getListenPort()))
 
      func (self TYPE) start(){
         self.__srvsServer.start()
         self.__wkstServer.start()
+        self.__lsarpcServer.start()
+        self.__samrServer.start()
         self.__server.serve_forever()
 
      func (self TYPE) registerNamedPipe(pipeName, address interface{}){
@@ -4646,13 +7482,19 @@ from impacket.system_errors import ERROR_INVALID_LEVEL
      func (self TYPE) getRegisteredNamedPipes(){
         return self.__server.getRegisteredNamedPipes()
 
-     func (self TYPE) addShare(shareName, sharePath, shareComment='', shareType = 0, readOnly = "no" interface{}){
+     func (self TYPE) getCaseCollisions(shareName interface{}){
+        return self.__server.getCaseCollisions(shareName)
+
+     func (self TYPE) addShare(shareName, sharePath, shareComment='', shareType = 0, readOnly = "no", validUsers = nil interface{}){
         share = shareName.upper()
         self.__smbConfig.add_section(share)
         self.__smbConfig.set(share, 'comment', shareComment)
         self.__smbConfig.set(share, 'read only', readOnly)
         self.__smbConfig.set(share, 'share type', shareType)
         self.__smbConfig.set(share, 'path', sharePath)
+        if validUsers is not nil {
+            // Users and @groups allowed to connect to the share
+            self.__smbConfig.set(share, 'valid users', ','.join(validUsers))
         self.__server.setServerConfig(self.__smbConfig)
         self.__srvsServer.setServerConfig(self.__smbConfig)
         self.__server.processConfigFile()
@@ -4681,8 +7523,12 @@ from impacket.system_errors import ERROR_INVALID_LEVEL
         self.__server.setServerConfig(self.__smbConfig)
         self.__server.processConfigFile()
 
-     func (self TYPE) addCredential(name, uid, lmhash, nthash interface{}){
-        self.__server.addCredential(name, uid, lmhash, nthash)
+     func (self TYPE) addCredential(name, uid, lmhash, nthash, groups = nil interface{}){
+        self.__server.addCredential(name, uid, lmhash, nthash, groups)
+
+     func (self TYPE) addAuthenticator(authenticator interface{}){
+        // NTHashFileAuthenticator, SQLiteAuthenticator, NetlogonAuthenticator or any other SMBAuthenticator
+        self.__server.addAuthenticator(authenticator)
 
      func (self TYPE) setSMB2Support(value interface{}){
         if value is true {
@@ -4691,3 +7537,57 @@ from impacket.system_errors import ERROR_INVALID_LEVEL
             self.__smbConfig.set("global", "SMB2Support", "false")
         self.__server.setServerConfig(self.__smbConfig)
         self.__server.processConfigFile()
+
+     func (self TYPE) setAuditFile(fileName interface{}){
+        // One JSON line per session setup, tree connect and file operation
+        self.__smbConfig.set("global", "audit_file", str(fileName))
+        self.__server.setAuditFile(fileName)
+
+     func (self TYPE) setAuditCallback(callback interface{}){
+        self.__server.setAuditCallback(callback)
+
+     func (self TYPE) startMetricsServer(address = "127.0.0.1", port = 9445 interface{}){
+        // Prometheus metrics at http://address:port/metrics
+        return self.__server.startMetricsServer(address, port)
+
+     func (self TYPE) stopMetricsServer(){
+        self.__server.stopMetricsServer()
+
+    def setNTLMHardening(self, rejectNTLMv1 = false, requireMIC = false, maxClockSkew = 0, spnValidation = 0,
+                         spnAliases = ()):
+        // spnValidation: 0 off, 1 check the target name if the client sent one, 2 require it.
+        // spnAliases are extra names (besides the server name, host name and address) accepted after cifs/
+        self.__smbConfig.set("global", "ntlm_reject_v1", str(rejectNTLMv1))
+        self.__smbConfig.set("global", "ntlm_require_mic", str(requireMIC))
+        self.__smbConfig.set("global", "ntlm_max_clock_skew", str(maxClockSkew))
+        self.__smbConfig.set("global", "ntlm_spn_validation", str(spnValidation))
+        self.__smbConfig.set("global", "ntlm_spn_aliases", ','.join(spnAliases))
+        self.__server.setServerConfig(self.__smbConfig)
+        self.__server.processConfigFile()
+
+     func (self TYPE) setLockoutPolicy(threshold, window = 300, duration = 900 interface{}){
+        // After threshold failed logons within window seconds, the account and the
+        // source address are blocked for duration seconds. 0 turns it off
+        self.__smbConfig.set("global", "lockout_threshold", str(threshold))
+        self.__smbConfig.set("global", "lockout_window", str(window))
+        self.__smbConfig.set("global", "lockout_duration", str(duration))
+        self.__server.setServerConfig(self.__smbConfig)
+        self.__server.processConfigFile()
+
+     func (self TYPE) setConnectionRateLimit(connectionsPerMinute interface{}){
+        // Per source address, 0 turns it off
+        self.__smbConfig.set("global", "connection_rate_limit", str(connectionsPerMinute))
+        self.__server.setServerConfig(self.__smbConfig)
+        self.__server.processConfigFile()
+
+     func (self TYPE) setBandwidthLimit(bytesPerSecond interface{}){
+        // Per session, 0 turns it off
+        self.__smbConfig.set("global", "bandwidth_limit", str(bytesPerSecond))
+        self.__server.setServerConfig(self.__smbConfig)
+        self.__server.processConfigFile()
+
+     func (self TYPE) setAdminUsers(users interface{}){
+        // Users (or @groups) allowed to manage sessions, open files and shares through srvsvc
+        self.__smbConfig.set("global", "admin_users", ','.join(users))
+        self.__server.setServerConfig(self.__smbConfig)
+        self.__server.processConfigFile()
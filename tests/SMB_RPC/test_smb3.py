@@ -0,0 +1,946 @@
+# SECUREAUTH LABS. Copyright 2018 SecureAuth Corporation. All rights reserved.
+#
+# This software is provided under under a slightly modified version
+# of the Apache Software License. See the accompanying LICENSE file
+# for more information.
+#
+# Description:
+#   SMB3 client tests against a fake server that lives in the transport
+#
+import hashlib
+import hmac
+import socket
+import struct
+import threading
+import time
+import unittest
+from binascii import unhexlify
+
+from impacket import smb3, nmb, nt_errors
+from impacket.smb3structs import SMB2Packet, SMB3Packet, SMB2Negotiate, SMB2Negotiate_Response, \
+    SMB2NegotiateContext, SMB2PreauthIntegrityCapabilities, SMB2EncryptionCapabilities, SMB2TreeConnect_Response, \
+    SMB2Create_Response, SMB2Read_Response, SMB2Write_Response, SMB2Close_Response, SMB2Error, SMB2_TRANSFORM_HEADER, \
+    SMB2_DIALECT_30, SMB2_DIALECT_311, SMB2_DIALECT_WILDCARD, SMB2_GLOBAL_CAP_LARGE_MTU, \
+    SMB2_GLOBAL_CAP_ENCRYPTION, SMB2_NEGOTIATE, SMB2_TREE_CONNECT, SMB2_CREATE, SMB2_READ, SMB2_WRITE, SMB2_CLOSE, \
+    SMB2_CANCEL, SMB2_ECHO, SMB2_PREAUTH_INTEGRITY_CAPABILITIES, SMB2_PREAUTH_INTEGRITY_SHA512, \
+    SMB2_ENCRYPTION_CAPABILITIES, SMB2_ENCRYPTION_AES128_CCM, SMB2_ENCRYPTION_AES128_GCM, \
+    SMB2_ENCRYPTION_AES256_GCM, SMB2_SIGNING_AES_GMAC, SMB2_TRANSFORM_ENCRYPTED, SMB2_OPLOCK_BREAK, \
+    SMB2_OPLOCK_LEVEL_NONE, SMB2_OPLOCK_LEVEL_II, SMB2_OPLOCK_LEVEL_BATCH, SMB2_FLAGS_REPLAY_OPERATION, SMB2Create, \
+    SMB2CreateContext, SMB2OplockBreakNotification, SMB2_CREATE_DURABLE_HANDLE_REQUEST_V2, \
+    SMB2_CREATE_DURABLE_HANDLE_RESPONSE_V2, SMB2_CREATE_DURABLE_HANDLE_RECONNECT_V2, SMB2_IOCTL, SMB2Ioctl_Response, \
+    SMB2_FLAGS_ASYNC_COMMAND, FILE_READ_DATA, FILE_WRITE_DATA, FILE_SHARE_READ, FILE_NON_DIRECTORY_FILE, FILE_OPEN
+
+
+class FakeNetBIOSPacket:
+    def __init__(self, data):
+        self.data = data
+
+    def get_trailer(self):
+        return self.data
+
+
+class FakeSMB2Server:
+    # Takes the place of the NetBIOS session. Every request is answered right away, but the answers
+    # wait in a queue until the client reads them, so we know how many requests are in flight.
+    # Each answer grants `grant` credits and the server keeps track of the ones the client can spend
+    def __init__(self, data=b'', grant=1, maxRead=None, maxWrite=None, dialect=SMB2_DIALECT_30, durableOpens=None):
+        self.data = bytearray(data)
+        self.dialect = dialect
+        # CreateGuid -> FileID of the durable opens, they outlive the connection
+        if durableOpens is None:
+            durableOpens = {}
+        self.durableOpens = durableOpens
+        # The FileIDs valid on this connection
+        self.opens = set()
+        self.createdOpens = 0
+        self.acks = []
+        # The connection drops when a request for this command comes in, after running it
+        self.dropOn = None
+        # The server goes async on these commands, the answers wait until released or cancelled
+        self.hold = set()
+        self.held = {}
+        self.cancels = []
+        self.broken = False
+        self.lock = threading.Condition()
+        self.grant = grant
+        self.credits = 1
+        self.maxRead = maxRead
+        self.maxWrite = maxWrite
+        # Offset -> status for the reads and writes that fail
+        self.errors = {}
+        self.requests = []
+        self.responses = []
+        # What went over the wire, request and answer
+        self.exchanges = []
+        self.inFlight = 0
+        self.maxInFlight = 0
+        self.overdrawn = False
+        self.closed = False
+        self.handlers = {
+            SMB2_NEGOTIATE: self.negotiate,
+            SMB2_TREE_CONNECT: self.treeConnect,
+            SMB2_CREATE: self.create,
+            SMB2_CLOSE: self.closeFile,
+            SMB2_READ: self.read,
+            SMB2_WRITE: self.write,
+            SMB2_OPLOCK_BREAK: self.oplockBreak,
+            SMB2_IOCTL: self.transceive,
+        }
+
+    def nextConnection(self, forget=False):
+        # The same server, after the client connects again. It may have forgotten the durable opens
+        if forget is True:
+            durableOpens = {}
+        else:
+            durableOpens = self.durableOpens
+        server = FakeSMB2Server(grant=self.grant, dialect=self.dialect, durableOpens=durableOpens)
+        server.data = self.data
+        return server
+
+    def drop(self):
+        with self.lock:
+            self.broken = True
+            self.responses = []
+            self.lock.notify_all()
+
+    def negotiateResponse(self, maxReadSize=65536, maxWriteSize=65536, dialect=None):
+        # What the client gets when SMBConnection already negotiated. SMB2_DIALECT_WILDCARD makes it
+        # negotiate again
+        if dialect is None:
+            dialect = self.dialect
+        negResp = SMB2Negotiate_Response()
+        negResp['DialectRevision'] = dialect
+        negResp['Capabilities'] = SMB2_GLOBAL_CAP_LARGE_MTU
+        negResp['MaxTransactSize'] = 65536
+        negResp['MaxReadSize'] = maxReadSize
+        negResp['MaxWriteSize'] = maxWriteSize
+        negResp['SecurityBufferOffset'] = 128
+        negResp['Buffer'] = b''
+        packet = SMB2Packet()
+        packet['Data'] = negResp.getData()
+        return packet
+
+    def send_packet(self, data):
+        with self.lock:
+            if self.broken is True:
+                raise socket.error('Connection reset')
+            self.__answer(data)
+            self.lock.notify_all()
+
+    def release(self):
+        with self.lock:
+            for messageId in sorted(self.held):
+                self.responses.append(self.held.pop(messageId))
+            self.lock.notify_all()
+
+    def __cancel(self, request):
+        # [MS-SMB2] 3.3.5.16, found by MessageId or AsyncId. The request ends with STATUS_CANCELLED
+        messageId = request['MessageID']
+        if request['Flags'] & SMB2_FLAGS_ASYNC_COMMAND:
+            messageId = request['Reserved'] | (request['TreeID'] << 32)
+        self.cancels.append(messageId)
+        if messageId in self.held:
+            response = SMB2Packet(self.held.pop(messageId))
+            response['Status'] = nt_errors.STATUS_CANCELLED
+            error = SMB2Error()
+            error['ErrorData'] = b''
+            response['Data'] = error.getData()
+            self.responses.append(response.getData())
+
+    def __answer(self, data):
+        request = SMB3Packet(data)
+        if request['Command'] == SMB2_CANCEL:
+            # No answer and no credits
+            return self.__cancel(request)
+        self.requests.append(request)
+        self.credits -= max(request['CreditCharge'], 1)
+        if self.credits < 0:
+            self.overdrawn = True
+        self.inFlight += 1
+        self.maxInFlight = max(self.maxInFlight, self.inFlight)
+
+        response = SMB2Packet()
+        response['Command'] = request['Command']
+        response['MessageID'] = request['MessageID']
+        response['Flags'] = smb3.SMB2_FLAGS_SERVER_TO_REDIR
+        response['CreditRequestResponse'] = self.grant
+        self.credits += self.grant
+        status, response['Data'] = self.handlers[request['Command']](request, request['Data'])
+        response['TreeID'] = request['TreeID']
+        response['Status'] = status
+        if status != nt_errors.STATUS_SUCCESS:
+            error = SMB2Error()
+            error['ErrorData'] = b''
+            response['Data'] = error.getData()
+        if request['Command'] in self.hold:
+            # Interim answer, the AsyncId is the MessageID
+            interim = SMB2Packet()
+            interim['Command'] = request['Command']
+            interim['MessageID'] = request['MessageID']
+            interim['Status'] = nt_errors.STATUS_PENDING
+            interim['Flags'] = smb3.SMB2_FLAGS_SERVER_TO_REDIR | SMB2_FLAGS_ASYNC_COMMAND
+            interim['Reserved'] = request['MessageID'] & 0xffffffff
+            interim['TreeID'] = request['MessageID'] >> 32
+            interim['Data'] = SMB2Error().getData()
+            self.responses.append(interim.getData())
+            self.held[request['MessageID']] = response.getData()
+        else:
+            self.responses.append(response.getData())
+        self.exchanges.append((data, response.getData()))
+        if request['Command'] == self.dropOn:
+            self.drop()
+
+    def breakOplock(self, fileId, oplockLevel):
+        # Unsolicited, for whoever reads next
+        notification = SMB2OplockBreakNotification()
+        notification['OplockLevel'] = oplockLevel
+        notification['FileID'] = fileId
+        packet = SMB2Packet()
+        packet['Command'] = SMB2_OPLOCK_BREAK
+        packet['MessageID'] = 0xffffffffffffffff
+        packet['Flags'] = smb3.SMB2_FLAGS_SERVER_TO_REDIR
+        packet['Data'] = notification.getData()
+        with self.lock:
+            self.responses.append(packet.getData())
+            self.inFlight += 1
+            self.lock.notify_all()
+
+    def recv_packet(self, timeout=None):
+        with self.lock:
+            if len(self.responses) == 0 and self.broken is False and self.closed is False:
+                self.lock.wait(0.05)
+            if self.broken is True or self.closed is True:
+                raise socket.error('Connection reset')
+            if len(self.responses) == 0:
+                raise nmb.NetBIOSTimeout
+            self.inFlight -= 1
+            return FakeNetBIOSPacket(self.responses.pop(0))
+
+    def get_socket(self):
+        return None
+
+    def close(self):
+        with self.lock:
+            self.closed = True
+            self.lock.notify_all()
+
+    def negotiate(self, request, data):
+        negSession = SMB2Negotiate(data[:36])
+        dialects = struct.unpack('<%dH' % negSession['DialectCount'], data[36:36 + negSession['DialectCount'] * 2])
+        dialect = max(dialect for dialect in dialects if dialect <= self.dialect)
+        negResp = SMB2Negotiate_Response(self.negotiateResponse(dialect=dialect)['Data'])
+        if dialect != SMB2_DIALECT_311:
+            negResp['Capabilities'] |= SMB2_GLOBAL_CAP_ENCRYPTION
+            return nt_errors.STATUS_SUCCESS, negResp.getData()
+
+        preauth = SMB2PreauthIntegrityCapabilities()
+        preauth['HashAlgorithmCount'] = 1
+        preauth['SaltLength'] = 32
+        preauth['HashAlgorithms'] = struct.pack('<H', SMB2_PREAUTH_INTEGRITY_SHA512)
+        preauth['Salt'] = b'\x5a' * 32
+        encryption = SMB2EncryptionCapabilities()
+        encryption['CipherCount'] = 1
+        encryption['Ciphers'] = struct.pack('<H', SMB2_ENCRYPTION_AES128_GCM)
+        contextList = b''
+        for contextType, contextData in ((SMB2_PREAUTH_INTEGRITY_CAPABILITIES, preauth.getData()),
+                                         (SMB2_ENCRYPTION_CAPABILITIES, encryption.getData())):
+            contextList += b'\x00' * ((8 - len(contextList) % 8) % 8)
+            context = SMB2NegotiateContext()
+            context['ContextType'] = contextType
+            context['DataLength'] = len(contextData)
+            context['Data'] = contextData
+            contextList += context.getData()
+        negResp['NegotiateContextOffset'] = 128
+        negResp['NegotiateContextCount'] = 2
+        return nt_errors.STATUS_SUCCESS, negResp.getData() + contextList
+
+    def treeConnect(self, request, data):
+        request['TreeID'] = 5
+        return nt_errors.STATUS_SUCCESS, SMB2TreeConnect_Response().getData()
+
+    def create(self, request, data):
+        smb2Create = SMB2Create(data)
+        contexts = {}
+        contextData = smb2Create['Buffer'][smb2Create['NameLength']:]
+        while len(contextData) > 0:
+            context = SMB2CreateContext(contextData)
+            name = contextData[context['NameOffset']:context['NameOffset'] + context['NameLength']]
+            contexts[name] = contextData[context['DataOffset']:context['DataOffset'] + context['DataLength']]
+            if context['Next'] == 0:
+                break
+            contextData = contextData[context['Next']:]
+
+        createResponse = SMB2Create_Response()
+        createResponse['OplockLevel'] = smb2Create['RequestedOplockLevel']
+        responseContext = None
+        if b'DH2C' in contexts:
+            reconnect = SMB2_CREATE_DURABLE_HANDLE_RECONNECT_V2(contexts[b'DH2C'])
+            if (reconnect['CreateGuid'] in self.durableOpens) is False:
+                return nt_errors.STATUS_OBJECT_NAME_NOT_FOUND, b''
+            # Same persistent part, new volatile one
+            persistent = struct.unpack('<Q', self.durableOpens[reconnect['CreateGuid']][:8])[0]
+            fileId = struct.pack('<QQ', persistent, 100 + len(self.opens))
+        elif b'DH2Q' in contexts:
+            durableRequest = SMB2_CREATE_DURABLE_HANDLE_REQUEST_V2(contexts[b'DH2Q'])
+            if durableRequest['CreateGuid'] in self.durableOpens and request['Flags'] & SMB2_FLAGS_REPLAY_OPERATION:
+                fileId = self.durableOpens[durableRequest['CreateGuid']]
+            else:
+                self.createdOpens += 1
+                fileId = struct.pack('<QQ', self.createdOpens, self.createdOpens)
+                self.durableOpens[durableRequest['CreateGuid']] = fileId
+            responseContext = (b'DH2Q', SMB2_CREATE_DURABLE_HANDLE_RESPONSE_V2().getData())
+        else:
+            self.createdOpens += 1
+            fileId = struct.pack('<QQ', 1000 + self.createdOpens, 2)
+        self.opens.add(fileId)
+
+        createResponse['FileID'] = fileId
+        createResponse['EndOfFile'] = len(self.data)
+        if responseContext is not None:
+            context = SMB2CreateContext()
+            context['NameOffset'] = 16
+            context['NameLength'] = 4
+            context['DataOffset'] = 24
+            context['DataLength'] = len(responseContext[1])
+            context['Buffer'] = responseContext[0] + b'\x00' * 4 + responseContext[1]
+            createResponse['CreateContextsOffset'] = 64 + 88
+            createResponse['CreateContextsLength'] = len(context.getData())
+            createResponse['Buffer'] = context.getData()
+        else:
+            createResponse['Buffer'] = b''
+        return nt_errors.STATUS_SUCCESS, createResponse.getData()
+
+    def oplockBreak(self, request, data):
+        acknowledgment = SMB2OplockBreakNotification(data)
+        self.acks.append((acknowledgment['OplockLevel'], acknowledgment['FileID'].getData()))
+        return nt_errors.STATUS_SUCCESS, data
+
+    def closeFile(self, request, data):
+        return nt_errors.STATUS_SUCCESS, SMB2Close_Response().getData()
+
+    def transceive(self, request, data):
+        # What goes into the pipe comes back
+        inputOffset, inputCount = struct.unpack('<LL', data[24:32])
+        ioctlResponse = SMB2Ioctl_Response()
+        ioctlResponse['CtlCode'] = struct.unpack('<L', data[4:8])[0]
+        ioctlResponse['FileID'] = data[8:24]
+        ioctlResponse['OutputOffset'] = 64 + 48
+        ioctlResponse['Buffer'] = data[inputOffset - 64:inputOffset - 64 + inputCount]
+        ioctlResponse['OutputCount'] = len(ioctlResponse['Buffer'])
+        return nt_errors.STATUS_SUCCESS, ioctlResponse.getData()
+
+    def read(self, request, data):
+        length, offset = struct.unpack('<LQ', data[4:16])
+        if (data[16:32] in self.opens) is False:
+            return nt_errors.STATUS_FILE_CLOSED, b''
+        if offset in self.errors:
+            return self.errors[offset], b''
+        if offset >= len(self.data):
+            return nt_errors.STATUS_END_OF_FILE, b''
+        if self.maxRead is not None:
+            length = min(length, self.maxRead)
+        readResponse = SMB2Read_Response()
+        readResponse['DataOffset'] = 0x50
+        readResponse['Buffer'] = bytes(self.data[offset:offset+length])
+        readResponse['DataLength'] = len(readResponse['Buffer'])
+        return nt_errors.STATUS_SUCCESS, readResponse.getData()
+
+    def write(self, request, data):
+        dataOffset, length, offset = struct.unpack('<HLQ', data[2:16])
+        if offset in self.errors:
+            return self.errors[offset], b''
+        if self.maxWrite is not None:
+            length = min(length, self.maxWrite)
+        buf = data[dataOffset - 64:dataOffset - 64 + length]
+        if len(self.data) < offset:
+            self.data += b'\x00' * (offset - len(self.data))
+        self.data[offset:offset+length] = buf
+        writeResponse = SMB2Write_Response()
+        writeResponse['Count'] = length
+        return nt_errors.STATUS_SUCCESS, writeResponse.getData()
+
+
+def connect(server, **kwargs):
+    client = smb3.SMB3('SERVER', '127.0.0.1', session=server, negSessionResponse=server.negotiateResponse(**kwargs))
+    treeId = client.connectTree('share')
+    fileId = client.create(treeId, 'file.bin', FILE_READ_DATA | FILE_WRITE_DATA, FILE_SHARE_READ,
+                           FILE_NON_DIRECTORY_FILE, FILE_OPEN, 0)
+    return client, treeId, fileId
+
+
+class PipelinedReadTests(unittest.TestCase):
+    DATA = bytes(bytearray(range(256))) * 2048
+
+    def read(self, client, treeId, fileId, offset=0, bytesToRead=None):
+        chunks = []
+        if bytesToRead is None:
+            bytesToRead = len(self.DATA)
+        bytesRead = client.pipelinedRead(treeId, fileId, offset, bytesToRead, chunks.append)
+        self.assertEqual(bytesRead, sum(len(chunk) for chunk in chunks))
+        return b''.join(chunks)
+
+    def test_window(self):
+        server = FakeSMB2Server(self.DATA, grant=8)
+        client, treeId, fileId = connect(server)
+        client.setIOWindow(4)
+        self.assertEqual(self.read(client, treeId, fileId), self.DATA)
+        self.assertEqual(server.maxInFlight, 4)
+        self.assertFalse(server.overdrawn)
+
+    def test_credits(self):
+        # One credit back per answer, never more than one request out
+        server = FakeSMB2Server(self.DATA, grant=1)
+        client, treeId, fileId = connect(server)
+        self.assertEqual(self.read(client, treeId, fileId), self.DATA)
+        self.assertEqual(server.maxInFlight, 1)
+        self.assertFalse(server.overdrawn)
+
+        # Two, the window opens up as the credits come in
+        server = FakeSMB2Server(self.DATA, grant=2)
+        client, treeId, fileId = connect(server)
+        self.assertEqual(self.read(client, treeId, fileId), self.DATA)
+        self.assertTrue(1 < server.maxInFlight <= client.getIOWindow())
+        self.assertFalse(server.overdrawn)
+
+    def test_multi_credit(self):
+        # 128k reads take two credits each
+        server = FakeSMB2Server(self.DATA, grant=3)
+        client, treeId, fileId = connect(server, maxReadSize=131072)
+        self.assertEqual(self.read(client, treeId, fileId), self.DATA)
+        reads = [request for request in server.requests if request['Command'] == SMB2_READ]
+        self.assertEqual(len(reads), len(self.DATA) // 131072)
+        self.assertEqual(set(request['CreditCharge'] for request in reads), set([2]))
+        self.assertFalse(server.overdrawn)
+
+    def test_short_reads(self):
+        server = FakeSMB2Server(self.DATA, grant=8, maxRead=10000)
+        client, treeId, fileId = connect(server)
+        self.assertEqual(self.read(client, treeId, fileId, 100), self.DATA[100:])
+        self.assertFalse(server.overdrawn)
+        self.assertEqual(client._Connection['OutstandingResponses'], {})
+
+    def test_end_of_file(self):
+        # Asking for more than there is stops at the end, the reads past it are collected
+        server = FakeSMB2Server(self.DATA[:200000], grant=8)
+        client, treeId, fileId = connect(server)
+        self.assertEqual(self.read(client, treeId, fileId), self.DATA[:200000])
+        self.assertEqual(server.responses, [])
+        self.assertEqual(client._Connection['OutstandingResponses'], {})
+        self.assertEqual(client._Connection['OutstandingRequests'], {})
+
+    def test_error_drains(self):
+        server = FakeSMB2Server(self.DATA, grant=8)
+        server.errors[65536 * 2] = nt_errors.STATUS_ACCESS_DENIED
+        client, treeId, fileId = connect(server)
+        chunks = []
+        with self.assertRaises(smb3.SessionError) as e:
+            client.pipelinedRead(treeId, fileId, 0, len(self.DATA), chunks.append)
+        self.assertEqual(e.exception.get_error_code(), nt_errors.STATUS_ACCESS_DENIED)
+        self.assertEqual(b''.join(chunks), self.DATA[:65536 * 2])
+        # The rest of the window was read and thrown away
+        self.assertEqual(server.responses, [])
+        self.assertEqual(client._Connection['OutstandingResponses'], {})
+        self.assertEqual(client._Connection['OutstandingRequests'], {})
+        # And the connection still works
+        self.assertEqual(client.read(treeId, fileId, 0, 10), self.DATA[:10])
+
+
+class PipelinedWriteTests(unittest.TestCase):
+    DATA = bytes(bytearray(range(251))) * 2000
+
+    def write(self, client, treeId, fileId, data, offset=0):
+        pending = [data]
+
+        def callback(size):
+            chunk = pending[0][:size]
+            pending[0] = pending[0][size:]
+            return chunk
+
+        return client.pipelinedWrite(treeId, fileId, offset, callback)
+
+    def test_window(self):
+        server = FakeSMB2Server(grant=8)
+        client, treeId, fileId = connect(server)
+        client.setIOWindow(3)
+        self.assertEqual(self.write(client, treeId, fileId, self.DATA), len(self.DATA))
+        self.assertEqual(bytes(server.data), self.DATA)
+        self.assertEqual(server.maxInFlight, 3)
+        self.assertFalse(server.overdrawn)
+
+    def test_credits(self):
+        server = FakeSMB2Server(grant=1)
+        client, treeId, fileId = connect(server)
+        self.assertEqual(self.write(client, treeId, fileId, self.DATA, 10), len(self.DATA))
+        self.assertEqual(bytes(server.data), b'\x00' * 10 + self.DATA)
+        self.assertEqual(server.maxInFlight, 1)
+        self.assertFalse(server.overdrawn)
+
+    def test_short_writes(self):
+        server = FakeSMB2Server(grant=8, maxWrite=30000)
+        client, treeId, fileId = connect(server)
+        self.assertEqual(self.write(client, treeId, fileId, self.DATA), len(self.DATA))
+        self.assertEqual(bytes(server.data), self.DATA)
+        self.assertFalse(server.overdrawn)
+        self.assertEqual(client._Connection['OutstandingResponses'], {})
+
+    def test_error_drains(self):
+        server = FakeSMB2Server(grant=8)
+        server.errors[65536] = nt_errors.STATUS_DISK_FULL
+        client, treeId, fileId = connect(server)
+        with self.assertRaises(smb3.SessionError) as e:
+            self.write(client, treeId, fileId, self.DATA)
+        self.assertEqual(e.exception.get_error_code(), nt_errors.STATUS_DISK_FULL)
+        self.assertEqual(server.responses, [])
+        self.assertEqual(client._Connection['OutstandingResponses'], {})
+        self.assertEqual(client._Connection['OutstandingRequests'], {})
+        self.assertTrue(client.close(treeId, fileId))
+
+
+class LoggedInSMB3(smb3.SMB3):
+    # Logging in again after a reconnect just takes a new SessionID, and remembers the previous one
+    def login(self, user, password, domain='', lmhash='', nthash=''):
+        self.previousSessionIds.append(self._SMB3__previousSessionId)
+        self._Session['SessionID'] = len(self.previousSessionIds) + 1
+
+
+class ReconnectTests(unittest.TestCase):
+    DATA = b'0123456789' * 1000
+
+    def setUp(self):
+        self.server = FakeSMB2Server(self.DATA, grant=8)
+        self.servers = [self.server]
+        self.forget = False
+        self.NetBIOSTCPSession = nmb.NetBIOSTCPSession
+        nmb.NetBIOSTCPSession = self.connect
+        self.client = LoggedInSMB3('SERVER', '127.0.0.1', session=self.server,
+                                   negSessionResponse=self.server.negotiateResponse())
+        self.client.previousSessionIds = []
+        self.client._Session['SessionID'] = 1
+        self.client.setAutoReconnect(True, 1)
+        self.client.RequestDurableHandles = True
+        self.treeId = self.client.connectTree('share')
+
+    def tearDown(self):
+        nmb.NetBIOSTCPSession = self.NetBIOSTCPSession
+
+    def connect(self, *args):
+        server = self.servers[-1].nextConnection(self.forget)
+        self.servers.append(server)
+        return server
+
+    def open(self):
+        return self.client.create(self.treeId, 'file.bin', FILE_READ_DATA | FILE_WRITE_DATA, FILE_SHARE_READ,
+                                  FILE_NON_DIRECTORY_FILE, FILE_OPEN, 0)
+
+    def commands(self, server):
+        return [request['Command'] for request in server.requests]
+
+    def test_reclaim(self):
+        fileId = self.open()
+        self.assertTrue(self.client._Session['OpenTable'][fileId]['Durable'])
+        self.client.reconnect()
+
+        server = self.servers[-1]
+        self.assertEqual(self.commands(server), [SMB2_NEGOTIATE, SMB2_TREE_CONNECT, SMB2_CREATE])
+        self.assertEqual(self.client.previousSessionIds, [1])
+        # The caller's ids keep working, the server gets its new ones
+        self.assertEqual(self.client.read(self.treeId, fileId, 0, 10), self.DATA[:10])
+        self.assertEqual(server.requests[-1]['TreeID'], 5)
+        self.assertEqual(server.requests[-1]['Data'][16:32], struct.pack('<QQ', 1, 100))
+
+    def test_reclaim_fails(self):
+        fileId = self.open()
+        self.client.RequestDurableHandles = False
+        otherFileId = self.open()
+        self.forget = True
+        self.client.reconnect()
+
+        # Only the durable one is asked for, and the server doesn't know about it anymore
+        self.assertEqual(self.commands(self.servers[-1]), [SMB2_NEGOTIATE, SMB2_TREE_CONNECT, SMB2_CREATE])
+        self.assertEqual(self.client._Session['OpenTable'], {})
+        for lostFileId in (fileId, otherFileId):
+            with self.assertRaises(smb3.SessionError) as e:
+                self.client.read(self.treeId, lostFileId, 0, 10)
+            self.assertEqual(e.exception.get_error_code(), nt_errors.STATUS_INVALID_PARAMETER)
+
+    def test_resend_idempotent(self):
+        fileId = self.open()
+        readPacket, _ = self.client._SMB3__readRequest(self.treeId, fileId, 0, 10)
+        readId = self.client.sendSMB(readPacket)
+        writePacket, _ = self.client._SMB3__writeRequest(self.treeId, fileId, b'data', 100, 4)
+        writeId = self.client.sendSMB(writePacket)
+        self.server.drop()
+
+        # The read goes again once reconnected, the write doesn't: the server may have done it already
+        ans = self.client.recvSMB(readId)
+        self.assertEqual(SMB2Read_Response(ans['Data'])['Buffer'], self.DATA[:10])
+        self.assertEqual(self.commands(self.servers[-1]), [SMB2_NEGOTIATE, SMB2_TREE_CONNECT, SMB2_CREATE, SMB2_READ])
+        self.assertEqual(self.servers[-1].requests[-1]['Flags'] & SMB2_FLAGS_REPLAY_OPERATION, 0)
+        with self.assertRaises(smb3.SessionError) as e:
+            self.client.recvSMB(writeId)
+        self.assertEqual(e.exception.get_error_code(), nt_errors.STATUS_CONNECTION_DISCONNECTED)
+
+        # Once the ids are used again nothing is left over
+        self.assertEqual(self.client.read(self.treeId, fileId, 0, 10), self.DATA[:10])
+        self.assertEqual(self.client._SMB3__lostRequests, set())
+
+    def test_write_lost(self):
+        fileId = self.open()
+        self.server.dropOn = SMB2_WRITE
+        with self.assertRaises(smb3.SessionError) as e:
+            self.client.write(self.treeId, fileId, b'data', 0, 4)
+        self.assertEqual(e.exception.get_error_code(), nt_errors.STATUS_CONNECTION_DISCONNECTED)
+        self.assertEqual(self.commands(self.servers[-1]), [SMB2_NEGOTIATE, SMB2_TREE_CONNECT, SMB2_CREATE])
+        # Still usable
+        self.assertEqual(self.client.write(self.treeId, fileId, b'data', 0, 4), 4)
+
+    def test_replay_durable_create(self):
+        # The server made the open but the answer got lost. Sent again with the replay flag, it's the same one
+        self.server.dropOn = SMB2_CREATE
+        fileId = self.open()
+        server = self.servers[-1]
+        self.assertEqual(self.commands(server), [SMB2_NEGOTIATE, SMB2_TREE_CONNECT, SMB2_CREATE])
+        self.assertTrue(server.requests[-1]['Flags'] & SMB2_FLAGS_REPLAY_OPERATION)
+        self.assertEqual(server.createdOpens + self.server.createdOpens, 1)
+        self.assertEqual(self.client.read(self.treeId, fileId, 0, 10), self.DATA[:10])
+
+    def test_create_lost(self):
+        # Without a durable handle there's no telling whether the open is there
+        self.client.RequestDurableHandles = False
+        self.server.dropOn = SMB2_CREATE
+        with self.assertRaises(smb3.SessionError) as e:
+            self.open()
+        self.assertEqual(e.exception.get_error_code(), nt_errors.STATUS_CONNECTION_DISCONNECTED)
+        self.assertEqual(self.commands(self.servers[-1]), [SMB2_NEGOTIATE, SMB2_TREE_CONNECT])
+
+
+class OplockBreakTests(unittest.TestCase):
+    DATA = b'0123456789' * 100
+
+    def setUp(self):
+        self.server = FakeSMB2Server(self.DATA, grant=8)
+        self.client = smb3.SMB3('SERVER', '127.0.0.1', session=self.server,
+                                negSessionResponse=self.server.negotiateResponse())
+        self.treeId = self.client.connectTree('share')
+
+    def tearDown(self):
+        self.client.close_session()
+
+    def open(self, oplockLevel=SMB2_OPLOCK_LEVEL_NONE):
+        return self.client.create(self.treeId, 'file.bin', FILE_READ_DATA, FILE_SHARE_READ, FILE_NON_DIRECTORY_FILE,
+                                  FILE_OPEN, 0, oplockLevel=oplockLevel)
+
+    def test_acknowledge(self):
+        self.client.RequestDurableHandles = True
+        fileId = self.open(SMB2_OPLOCK_LEVEL_BATCH)
+        openFile = self.client._Session['OpenTable'][fileId]
+        self.assertTrue(openFile['Durable'])
+
+        # It comes in while waiting for something else
+        self.server.breakOplock(fileId, SMB2_OPLOCK_LEVEL_II)
+        self.assertEqual(self.client.read(self.treeId, fileId, 0, 10), self.DATA[:10])
+        self.assertEqual(self.server.acks, [(SMB2_OPLOCK_LEVEL_II, fileId)])
+        self.assertEqual(openFile['Oplocklevel'], SMB2_OPLOCK_LEVEL_II)
+        # No batch oplock, no durable handle
+        self.assertFalse(openFile['Durable'])
+
+        # The answer to the acknowledgment is dropped
+        self.assertEqual(self.client.read(self.treeId, fileId, 0, 10), self.DATA[:10])
+        self.assertEqual(self.client._SMB3__oplockAcks, set())
+        self.assertEqual(self.client._Connection['OutstandingResponses'], {})
+
+    def test_no_oplock_without_reader(self):
+        # Nobody would acknowledge the breaks while the caller isn't reading
+        self.client.RequestDurableHandles = True
+        self.open()
+        self.assertEqual(SMB2Create(self.server.requests[-1]['Data'])['RequestedOplockLevel'], SMB2_OPLOCK_LEVEL_NONE)
+
+    def test_acknowledge_from_reader(self):
+        self.client.setDurableHandles(True)
+        fileId = self.open()
+        self.assertEqual(SMB2Create(self.server.requests[-1]['Data'])['RequestedOplockLevel'], SMB2_OPLOCK_LEVEL_BATCH)
+
+        # Nobody calls in, the reader acknowledges it anyway
+        self.server.breakOplock(fileId, SMB2_OPLOCK_LEVEL_NONE)
+        deadline = time.time() + 5
+        while len(self.server.acks) == 0 and time.time() < deadline:
+            time.sleep(0.01)
+        self.assertEqual(self.server.acks, [(SMB2_OPLOCK_LEVEL_NONE, fileId)])
+        self.assertEqual(self.client.read(self.treeId, fileId, 0, 10), self.DATA[:10])
+
+
+def waitFor(condition, timeout=5):
+    deadline = time.time() + timeout
+    while condition() is False and time.time() < deadline:
+        time.sleep(0.01)
+    return condition()
+
+
+class ReaderTests(unittest.TestCase):
+    DATA = bytes(bytearray(range(256))) * 64
+
+    def setUp(self):
+        self.server = FakeSMB2Server(self.DATA, grant=8)
+        self.client, self.treeId, self.fileId = connect(self.server)
+
+    def tearDown(self):
+        self.client.close_session()
+
+    def readRequest(self, offset, length):
+        packet, _ = self.client._SMB3__readRequest(self.treeId, self.fileId, offset, length)
+        return self.client.sendSMB(packet)
+
+    def transact(self):
+        # A read nobody picked up yet is older than the pipe transaction, its answer shows up first
+        readId = self.readRequest(0, 10)
+        self.assertTrue(self.client.TransactNamedPipe(self.treeId, self.fileId, b'request', waitAnswer=0))
+        self.assertTrue(waitFor(lambda: len(self.server.held) == 1))
+        self.assertTrue(waitFor(lambda: self.client._SMB3__reader is None or
+                                        readId in self.client._Connection['OutstandingResponses']))
+        self.server.release()
+        self.assertEqual(self.client.TransactNamedPipeRecv(), b'request')
+        ans = self.client.recvSMB(readId)
+        self.assertEqual(SMB2Read_Response(ans['Data'])['Buffer'], self.DATA[:10])
+
+    def test_transact_named_pipe(self):
+        self.server.hold.add(SMB2_IOCTL)
+        self.transact()
+
+    def test_transact_named_pipe_reader(self):
+        self.server.hold.add(SMB2_IOCTL)
+        self.client.startReader()
+        self.transact()
+
+    def test_threads(self):
+        # Every thread gets its own answers
+        self.client.startReader()
+        errors = []
+
+        def reader(offset):
+            try:
+                for i in range(20):
+                    self.assertEqual(self.client.read(self.treeId, self.fileId, offset, 100), self.DATA[offset:offset+100])
+                    self.assertEqual(self.client.TransactNamedPipe(self.treeId, self.fileId, b'%d' % offset), b'%d' % offset)
+            except Exception as e:
+                errors.append(e)
+
+        threads = [threading.Thread(target=reader, args=(offset,)) for offset in range(0, 1000, 100)]
+        for thread in threads:
+            thread.start()
+        for thread in threads:
+            thread.join()
+        self.assertEqual(errors, [])
+        self.assertEqual(self.client._Connection['OutstandingResponses'], {})
+
+    def test_timeout(self):
+        self.server.hold.add(SMB2_READ)
+        with self.client.useContext(smb3.Context(timeout=0.2)):
+            with self.assertRaises(smb3.SessionError) as e:
+                self.client.read(self.treeId, self.fileId, 0, 10)
+        self.assertEqual(e.exception.get_error_code(), nt_errors.STATUS_IO_TIMEOUT)
+
+        # Cancelled on the server by its AsyncId, and the STATUS_CANCELLED answer goes nowhere
+        readId = self.server.requests[-1]['MessageID']
+        self.assertEqual(self.server.cancels, [readId])
+        self.assertTrue(waitFor(lambda: len(self.client._SMB3__abandoned) == 0))
+        self.assertEqual(self.client._Connection['OutstandingResponses'], {})
+        self.assertEqual(self.client._SMB3__asyncIds, {})
+
+        # Nothing left in the way
+        self.server.hold = set()
+        self.assertEqual(self.client.read(self.treeId, self.fileId, 0, 10), self.DATA[:10])
+
+    def test_cancel(self):
+        self.server.hold.add(SMB2_READ)
+        context = smb3.Context()
+        timer = threading.Timer(0.1, context.cancel)
+        timer.start()
+        with self.client.useContext(context):
+            with self.assertRaises(smb3.SessionError) as e:
+                self.client.read(self.treeId, self.fileId, 0, 10)
+            self.assertEqual(e.exception.get_error_code(), nt_errors.STATUS_CANCELLED)
+            # Once done, nothing else goes out
+            requests = len(self.server.requests)
+            with self.assertRaises(smb3.SessionError) as e:
+                self.client.read(self.treeId, self.fileId, 0, 10)
+            self.assertEqual(e.exception.get_error_code(), nt_errors.STATUS_CANCELLED)
+            self.assertEqual(len(self.server.requests), requests)
+        timer.join()
+        self.assertEqual(len(self.server.cancels), 1)
+
+    def test_parent_context(self):
+        # A child is done when its parent is, and never waits past the parent's deadline
+        parent = smb3.Context(timeout=0.2)
+        child = smb3.Context(timeout=60, parent=parent)
+        self.assertEqual(child.getDeadline(), parent.getDeadline())
+        self.server.hold.add(SMB2_READ)
+        start = time.time()
+        with self.client.useContext(child):
+            with self.assertRaises(smb3.SessionError) as e:
+                self.client.read(self.treeId, self.fileId, 0, 10)
+        self.assertEqual(e.exception.get_error_code(), nt_errors.STATUS_IO_TIMEOUT)
+        self.assertTrue(time.time() - start < 5)
+
+        parent = smb3.Context()
+        child = smb3.Context(parent=parent)
+        parent.cancel()
+        self.assertEqual(child.getError(), nt_errors.STATUS_CANCELLED)
+
+
+class FakeRandom:
+    # Hands out the nonce we want, a byte at a time
+    def __init__(self, data):
+        self.data = bytearray(data)
+
+    def randint(self, a, b):
+        value = self.data[0]
+        self.data = self.data[1:]
+        return value
+
+
+class SMB311Tests(unittest.TestCase):
+    def negotiate(self, preferredDialect=None, dialect=SMB2_DIALECT_311):
+        server = FakeSMB2Server(dialect=dialect)
+        client = smb3.SMB3('SERVER', '127.0.0.1', session=server, preferredDialect=preferredDialect,
+                           negSessionResponse=server.negotiateResponse(dialect=SMB2_DIALECT_WILDCARD))
+        return server, client
+
+    def encrypt(self, client, nonce, plainText):
+        rand = smb3.rand
+        smb3.rand = FakeRandom(nonce)
+        try:
+            return client._SMB3__encrypt(plainText)
+        finally:
+            smb3.rand = rand
+
+    def test_not_offered_by_default(self):
+        server, client = self.negotiate()
+        negSession = SMB2Negotiate(server.requests[0]['Data'])
+        self.assertEqual(negSession['Dialects'], [0x202, 0x210, 0x300, 0x302])
+        self.assertEqual(client.getDialect(), 0x302)
+
+        server, client = self.negotiate(SMB2_DIALECT_311)
+        self.assertEqual(client.getDialect(), SMB2_DIALECT_311)
+
+    def test_preauth_integrity_hash(self):
+        # [MS-SMB2] 3.2.5.2, the hash starts as 64 zeros and takes the NEGOTIATE request and response
+        server, client = self.negotiate(SMB2_DIALECT_311)
+        request, response = server.exchanges[0]
+        self.assertEqual(struct.unpack('<H', request[64+36:64+38])[0], SMB2_DIALECT_311)
+        hashValue = hashlib.sha512(b'\x00' * 64 + request).digest()
+        hashValue = hashlib.sha512(hashValue + response).digest()
+        self.assertEqual(client._Connection['PreauthIntegrityHashValue'], hashValue)
+        self.assertEqual(client._Connection['PreauthIntegrityHashId'], SMB2_PREAUTH_INTEGRITY_SHA512)
+        self.assertEqual(client._Connection['CipherId'], SMB2_ENCRYPTION_AES128_GCM)
+        self.assertTrue(client._Connection['SupportsEncryption'])
+
+        # Session setup messages chain on it
+        client._Session['PreauthIntegrityHashValue'] = hashValue
+        client._SMB3__updatePreauthIntegrityHash(b'request')
+        self.assertEqual(client._Session['PreauthIntegrityHashValue'], hashlib.sha512(hashValue + b'request').digest())
+
+        # Not for older dialects
+        server, client = self.negotiate(dialect=SMB2_DIALECT_30)
+        self.assertEqual(client._Connection['PreauthIntegrityHashValue'], b'\x00' * 64)
+        client._SMB3__updatePreauthIntegrityHash(b'request')
+        self.assertEqual(client._Session['PreauthIntegrityHashValue'], b'')
+
+    def test_kdf_30(self):
+        # The SMB 3.0 keys from Microsoft's key derivation example
+        server, client = self.negotiate(dialect=SMB2_DIALECT_30)
+        self.assertTrue(client._Connection['SupportsEncryption'])
+        client._Session['SessionKey'] = unhexlify('7CD451825D0450D235424E44BA6E78CC')
+        client._SMB3__generateSessionKeys()
+        self.assertEqual(client._Session['SigningKey'], unhexlify('0B7E9C5CAC36C0F6EA9AB275298CEDCE'))
+        self.assertEqual(client._Session['ApplicationKey'], unhexlify('BB23A4575AA26C721AF525AF15A87B4F'))
+        self.assertEqual(client._Session['EncryptionKey'], unhexlify('FAD27796665B313EBB578F388632B4F7'))
+        self.assertEqual(client._Session['DecryptionKey'], unhexlify('B0F0427F7CEB416D1D9DCC0CD4F99447'))
+
+    def test_kdf_311(self):
+        # [MS-SMB2] 3.2.5.3.1, SP800-108 counter mode with one HMAC-SHA256 round per 256 bits
+        def kdf(key, label, context, length):
+            return hmac.new(key, b'\x00\x00\x00\x01' + label + b'\x00' + context + struct.pack('>L', length),
+                            hashlib.sha256).digest()[:length // 8]
+
+        server, client = self.negotiate(SMB2_DIALECT_311)
+        sessionKey = unhexlify('270E1BA896585EEB7AF3472D3B4C75A7')
+        context = hashlib.sha512(b'session').digest()
+        client._Session['SessionKey'] = sessionKey
+        client._Session['PreauthIntegrityHashValue'] = context
+        client._SMB3__generateSessionKeys()
+        self.assertEqual(client._Session['SigningKey'], kdf(sessionKey, b'SMBSigningKey\x00', context, 128))
+        self.assertEqual(client._Session['ApplicationKey'], kdf(sessionKey, b'SMBAppKey\x00', context, 128))
+        self.assertEqual(client._Session['EncryptionKey'], kdf(sessionKey, b'SMBC2SCipherKey\x00', context, 128))
+        self.assertEqual(client._Session['DecryptionKey'], kdf(sessionKey, b'SMBS2CCipherKey\x00', context, 128))
+
+        # AES-256 takes the whole session key and gives 32 byte keys
+        fullSessionKey = sessionKey + unhexlify('00112233445566778899AABBCCDDEEFF')
+        client._Connection['CipherId'] = SMB2_ENCRYPTION_AES256_GCM
+        client._SMB3__generateSessionKeys(fullSessionKey)
+        self.assertEqual(client._Session['SigningKey'], kdf(sessionKey, b'SMBSigningKey\x00', context, 128))
+        self.assertEqual(client._Session['EncryptionKey'], kdf(fullSessionKey, b'SMBC2SCipherKey\x00', context, 256))
+        self.assertEqual(len(client._Session['DecryptionKey']), 32)
+
+    def test_gcm(self):
+        # AES-GCM test case 4 (McGrew and Viega). The header goes in as additional data, so the
+        # tag is not the one from the test case, the cipher text is
+        server, client = self.negotiate(SMB2_DIALECT_311)
+        client._Session['SessionID'] = 0x1122334455667788
+        client._Session['EncryptionKey'] = unhexlify('feffe9928665731c6d6a8f9467308308')
+        client._Session['DecryptionKey'] = client._Session['EncryptionKey']
+        plainText = unhexlify('d9313225f88406e5a55909c5aff5269a86a7a9531534f7da2e4c303d8a318a721c3c0c95956809532f'
+                              'cf0e2449a6b525b16aedf5aa0de657ba637b39')
+        data = self.encrypt(client, unhexlify('cafebabefacedbaddecaf888'), plainText)
+
+        transformHeader = SMB2_TRANSFORM_HEADER(data)
+        self.assertEqual(transformHeader['Nonce'], unhexlify('cafebabefacedbaddecaf888') + b'\x00' * 4)
+        self.assertEqual(transformHeader['OriginalMessageSize'], len(plainText))
+        self.assertEqual(transformHeader['EncryptionAlgorithm'], SMB2_TRANSFORM_ENCRYPTED)
+        self.assertEqual(transformHeader['SessionID'], 0x1122334455667788)
+        self.assertEqual(data[len(transformHeader):], unhexlify(
+            '42831ec2217774244b7221b784d0d49ce3aa212f2c02a4e035c17e2329aca12e21d514b25466931c7d8f6a5aac84aa051ba30b'
+            '396a0aac973d58e091'))
+        self.assertEqual(client._SMB3__decrypt(data), plainText)
+
+        # Anything changed, header included, doesn't get through
+        for offset in (len(data) - 1, 48):
+            tampered = data[:offset] + bytes(bytearray([data[offset] ^ 1])) + data[offset+1:]
+            with self.assertRaises(smb3.SessionError) as e:
+                client._SMB3__decrypt(tampered)
+            self.assertEqual(e.exception.get_error_code(), nt_errors.STATUS_ACCESS_DENIED)
+
+    def test_ccm(self):
+        # SMB 3.0 knows only about AES-128-CCM, with 11 byte nonces
+        server, client = self.negotiate(dialect=SMB2_DIALECT_30)
+        client._Session['EncryptionKey'] = unhexlify('404142434445464748494a4b4c4d4e4f')
+        client._Session['DecryptionKey'] = client._Session['EncryptionKey']
+        data = self.encrypt(client, unhexlify('101112131415161718191a'), b'plain text')
+        transformHeader = SMB2_TRANSFORM_HEADER(data)
+        self.assertEqual(transformHeader['Nonce'], unhexlify('101112131415161718191a') + b'\x00' * 5)
+        self.assertEqual(transformHeader['EncryptionAlgorithm'], SMB2_ENCRYPTION_AES128_CCM)
+        self.assertNotEqual(data[len(transformHeader):], b'plain text')
+        self.assertEqual(client._SMB3__decrypt(data), b'plain text')
+
+    def test_gmac_signing(self):
+        # [MS-SMB2] 3.1.4.1, AES-GMAC over the message, the nonce is the MessageId followed by 4 bytes
+        # that say whether it's a CANCEL. Tags worked out with a separate AES-GCM implementation
+        server, client = self.negotiate(SMB2_DIALECT_311)
+        client._Connection['SigningAlgorithmId'] = SMB2_SIGNING_AES_GMAC
+        client._Session['SessionKey'] = b'\x01' * 16
+        client._Session['SigningKey'] = unhexlify('feffe9928665731c6d6a8f9467308308')
+
+        packet = SMB3Packet()
+        packet['Command'] = SMB2_ECHO
+        packet['MessageID'] = 0x1234
+        packet['SessionID'] = 0x1122334455667788
+        packet['Data'] = b'\x04\x00\x00\x00'
+        client.signSMB(packet)
+        self.assertEqual(packet['Signature'], unhexlify('02cb63b57509c8d6bbdaa78495c459d0'))
+
+        packet['Command'] = SMB2_CANCEL
+        client.signSMB(packet)
+        self.assertEqual(packet['Signature'], unhexlify('aaf97ce6942461648a27342841807c0e'))
+
+
+if __name__ == '__main__':
+    unittest.main(verbosity=1)
@@ -0,0 +1,802 @@
+// SECUREAUTH LABS. Copyright 2018 SecureAuth Corporation. All rights reserved.
+//
+// This software is provided under under a slightly modified version
+// of the Apache Software License. See the accompanying LICENSE file
+// for more information.
+//
+// Description:
+//   SMB client tests that don't need a server, the network is faked
+//
+import hashlib
+import os
+import shutil
+import struct
+import tempfile
+import threading
+import time
+import unittest
+from contextlib import contextmanager
+
+from impacket import smb, smb3, nt_errors
+from impacket.smb3structs import SMB2Packet, SMB2Ioctl_Response, SRV_COPYCHUNK, \
+    SRV_COPYCHUNK_RESPONSE, FSCTL_SRV_REQUEST_RESUME_KEY, SMB2_DIALECT_30, SMB2_READ, FILE_NOTIFY_INFORMATION, \
+    FILE_ACTION_ADDED, FILE_ACTION_RENAMED_OLD_NAME, FILE_ACTION_RENAMED_NEW_NAME, RESP_GET_DFS_REFERRAL, \
+    DFS_REFERRAL_V1, DFS_REFERRAL_V3, DFS_NAME_LIST_REFERRAL
+from impacket.smbconnection import SMBConnection, SMBShareFS, SMBFile, SessionError, _LocalTree, _sync, _unpackStreamList, \
+    _packFullEaList, _unpackFullEaList, _packFeaList, _unpackFeaList, _unpackNotifyList, FILE_ACTION_OVERFLOW, \
+    _parseDfsReferrals, DFSReferralCache, DFS_MAX_HOPS, DFS_DEFAULT_TTL, SMBConnectionPool
+
+
+ type FakeSMB1 struct { // smb.SMB:
+    // Just enough of an SMB to go through writeFile, maxCount caps what every WRITE_ANDX takes
+     func (self TYPE) __init__(maxCount interface{}){
+        self._dialects_parameters = {'Capabilities': smb.SMB.CAP_LARGE_WRITEX, 'MaxBufferSize': 65535}
+        self._SignatureEnabled = false
+        self.maxCount = maxCount
+        self.written = b''
+
+     func (self TYPE) write_andx(tid, fid, data, offset = 0, wait_answer = 1, write_pipe_mode = false, smb_packet = nil interface{}){
+        count = min(len(data), self.maxCount)
+        self.written = self.written[:offset] + data[:count]
+        response = smb.SMBCommand(smb.SMB.SMB_COM_WRITE_ANDX)
+        response["Parameters"] = smb.SMBWriteAndXResponse_Parameters()
+        response["Parameters"]["Count"] = count
+        response["Parameters"]["Available"] = 0
+        packet = smb.NewSMBPacket()
+        packet.addCommand(response)
+        return smb.NewSMBPacket(data = packet.getData())
+
+
+ type WriteFileTests struct { // unittest.TestCase:
+     func (self TYPE) test_write_count(){
+        connection = FakeSMB1(65535)
+        data = b'A' * 100000
+        self.assertEqual(connection.writeFile(1, 1, data), len(data))
+        self.assertEqual(connection.written, data)
+
+     func (self TYPE) test_short_writes(){
+        connection = FakeSMB1(1000)
+        data = bytes(bytearray(range(256))) * 20
+        self.assertEqual(connection.writeFile(1, 1, data), len(data))
+        self.assertEqual(connection.written, data)
+
+     func (self TYPE) test_nothing_written(){
+        self.assertEqual(FakeSMB1(0).writeFile(1, 1, b'A' * 10), 0)
+
+
+ type FakeConnection: struct {
+     func (self TYPE) __init__(files interface{}){
+        self.files = files
+
+     func (self TYPE) connectTree(shareName interface{}){
+        return 1
+
+     func (self TYPE) disconnectTree(treeId interface{}){
+        pass
+
+     func (self TYPE) listPath(shareName, path, password = nil interface{}){
+        return self.files
+
+
+ type ShareFSTests struct { // unittest.TestCase:
+     func (self TYPE) setUp(){
+        self.share = SMBShareFS(FakeConnection([smb.SharedFile(0, 0, 0, 10, 10, 0, '', 'other.txt')]), 'SHARE')
+
+     func (self TYPE) test_stat(){
+        info = self.share.stat("dir/OTHER.TXT")
+        self.assertEqual(info.name, 'other.txt')
+        self.assertEqual(info.st_size, 10)
+
+     func (self TYPE) test_stat_not_found(){
+        // Whatever the listing came back with, it's not what was asked for
+        try:
+            self.share.stat("dir/oth*.txt")
+        except SessionError as e:
+            self.assertEqual(e.getErrorCode(), nt_errors.STATUS_OBJECT_NAME_NOT_FOUND)
+        } else  {
+            self.fail("SessionError not raised")
+
+
+ type StreamListTests struct { // unittest.TestCase:
+     func (self TYPE) entry(name, size, last=false interface{}){
+        entry = smb.SMBFileStreamInformation()
+        entry["StreamName"] = name.encode("utf-16le")
+        entry["StreamNameLength"] = len(entry["StreamName"])
+        entry["StreamSize"] = size
+        entry["StreamAllocationSize"] = size
+        data = entry.getData()
+        data += b'\x00' * ((8 - len(data) % 8) % 8)
+        if last is false {
+            data = struct.pack('<L', len(data)) + data[4:]
+        return data
+
+     func (self TYPE) test_unpack(){
+        data = self.entry('::$DATA', 100) + self.entry(':Zone.Identifier:$DATA', 26, true)
+        self.assertEqual(_unpackStreamList(data), [('::$DATA', 100), (':Zone.Identifier:$DATA', 26)])
+
+     func (self TYPE) test_empty(){
+        // A directory without named streams
+        self.assertEqual(_unpackStreamList(b''), [])
+
+
+ type EaListTests struct { // unittest.TestCase:
+    eas = [('USER.ONE', b'1'), ('USER.TWO', b'value two'), ('USER.EMPTY', b'')]
+
+     func (self TYPE) test_full_ea_list(){
+        data = _packFullEaList(self.eas)
+        self.assertEqual(_unpackFullEaList(data), dict(self.eas))
+        // Every entry but the last one points to the next, 4 bytes aligned
+        offset = 0
+        for _ in self.eas[:-1]:
+            nextEntryOffset = struct.unpack('<L', data[offset:offset + 4])[0]
+            self.assertEqual(nextEntryOffset % 4, 0)
+            offset += nextEntryOffset
+        self.assertEqual(struct.unpack('<L', data[offset:offset + 4])[0], 0)
+
+     func (self TYPE) test_fea_list(){
+        data = _packFeaList(self.eas)
+        self.assertEqual(struct.unpack('<L', data[:4])[0], len(data))
+        self.assertEqual(_unpackFeaList(data), dict(self.eas))
+
+     func (self TYPE) test_fea_list_size(){
+        // What's past the size the list says it takes isn't part of it
+        data = _packFeaList(self.eas[:1])
+        self.assertEqual(_unpackFeaList(data + b'\x00\x04\x01\x00JUNK\x00X'), dict(self.eas[:1]))
+
+
+ func notifyEntries(events interface{}){
+    data = b''
+    for i, (action, fileName) in enumerate(events):
+        entry = FILE_NOTIFY_INFORMATION()
+        entry["Action"] = action
+        entry["FileName"] = fileName.encode("utf-16le")
+        entry["FileNameLength"] = len(entry["FileName"])
+        entry = entry.getData()
+        entry += b'\x00' * ((4 - len(entry) % 4) % 4)
+        if i < len(events) - 1 {
+            entry = struct.pack('<L', len(entry)) + entry[4:]
+        data += entry
+    return data
+
+
+ type FakeNotifySMB3: struct {
+    // Hands out the buffers it's given, one per CHANGE_NOTIFY, then fails like a cancelled wait
+     func (self TYPE) __init__(buffers interface{}){
+        self.buffers = list(buffers)
+        self.contexts = []
+        self.closed = false
+
+     func (self TYPE) getDialect(){
+        return SMB2_DIALECT_30
+
+     func (self TYPE) connect_tree(share interface{}){
+        return 1
+
+     func (self TYPE) disconnect_tree(treeId interface{}){
+        pass
+
+     func (self TYPE) create(treeId, pathName, *args interface{}){
+        return b'F' * 16
+
+     func (self TYPE) close(treeId, fileId interface{}){
+        self.closed = true
+
+    @contextmanager
+     func (self TYPE) useContext(context interface{}){
+        self.contexts.append(context)
+        yield
+
+     func (self TYPE) changeNotify(treeId, fileId, completionFilter, flags=0, outputBufferLength=65536 interface{}){
+        if len(self.buffers) == 0 {
+            self.contexts[-1].cancel()
+            raise smb3.SessionError(nt_errors.STATUS_CANCELLED)
+        return self.buffers.pop(0)
+
+
+ type NotifyTests struct { // unittest.TestCase:
+     func (self TYPE) test_unpack(){
+        events = [(FILE_ACTION_ADDED, 'new.txt'), (FILE_ACTION_RENAMED_OLD_NAME, 'a'),
+                  (FILE_ACTION_RENAMED_NEW_NAME, 'dir\\b.txt')]
+        self.assertEqual(_unpackNotifyList(notifyEntries(events)), events)
+        self.assertEqual(_unpackNotifyList(b''), [])
+
+     func (self TYPE) test_watch(){
+        server = FakeNotifySMB3([notifyEntries([(FILE_ACTION_ADDED, 'one')]), nil,
+                                 notifyEntries([(FILE_ACTION_ADDED, 'two')])])
+        connection = SMBConnection.__new__(SMBConnection)
+        connection._SMBConnection = server
+        events = list(connection.watch('SHARE', 'dir'))
+        self.assertEqual(events, [(FILE_ACTION_ADDED, 'one'), (FILE_ACTION_OVERFLOW, nil), (FILE_ACTION_ADDED, 'two')])
+        self.asserttrue(server.closed)
+        // There's always a context, or the waits would time out
+        self.asserttrue(all(context is not nil for context in server.contexts))
+
+
+ type FakeLockConnection: struct {
+     func (self TYPE) __init__(dialect interface{}){
+        self.dialect = dialect
+        self.locks = []
+        self.context = nil
+
+     func (self TYPE) getDialect(){
+        return self.dialect
+
+    @contextmanager
+     func (self TYPE) useContext(context interface{}){
+        self.context = [context]
+        yield
+        self.context = nil
+
+     func (self TYPE) lockFile(treeId, fileId, offset, length, exclusive=true, wait=false interface{}){
+        // Whether it was waited for inside useContext
+        self.locks.append((offset, length, exclusive, wait, self.context is not nil))
+
+     func (self TYPE) closeFile(treeId, fileId interface{}){
+        pass
+
+
+ type FileLockTests struct { // unittest.TestCase:
+     func (self TYPE) test_no_wait_by_default(){
+        connection = FakeLockConnection(SMB2_DIALECT_30)
+        SMBFile(connection, 1, b'F' * 16, 'file').lock(0, 10)
+        self.assertEqual(connection.locks, [(0, 10, true, false, false)])
+
+     func (self TYPE) test_wait(){
+        // Without a context the reader thread still waits for it, so it's cancelled if it times out
+        connection = FakeLockConnection(SMB2_DIALECT_30)
+        SMBFile(connection, 1, b'F' * 16, 'file').lock(0, 10, wait=true)
+        self.assertEqual(connection.locks, [(0, 10, true, true, true)])
+
+        // SMB1 has the server time out first
+        connection = FakeLockConnection(smb.SMB_DIALECT)
+        SMBFile(connection, 1, 1, 'file').lock(0, 10, exclusive=false, wait=true)
+        self.assertEqual(connection.locks, [(0, 10, false, true, false)])
+
+
+ func dfsString(value interface{}){
+    return (value + '\x00').encode("utf-16le")
+
+ func dfsReferrals(pathConsumed, entries, flags=0 interface{}){
+    // entries are (flags, timeToLive, strings), strings being (DFSPath, DFSAlternatePath, NetworkAddress),
+    // or (SpecialName, [ExpandedNames]) with DFS_NAME_LIST_REFERRAL. All of them version 4, the strings at the end
+    response = RESP_GET_DFS_REFERRAL()
+    response["PathConsumed"] = len(pathConsumed) * 2
+    response["NumberOfReferrals"] = len(entries)
+    response["ReferralHeaderFlags"] = flags
+    entrySize = len(DFS_REFERRAL_V3())
+    stringsOffset = 8 + entrySize * len(entries)
+    referrals = b''
+    strings = b''
+    for i, (entryFlags, timeToLive, values) in enumerate(entries):
+        entry = DFS_REFERRAL_V3()
+        entry["VersionNumber"] = 4
+        entry["Size"] = entrySize
+        entry["ServerType"] = 1
+        entry["ReferralEntryFlags"] = entryFlags
+        entry["TimeToLive"] = timeToLive
+        base = stringsOffset + len(strings) - (8 + entrySize * i)
+        if entryFlags & DFS_NAME_LIST_REFERRAL {
+            specialName, names = values
+            entry["DFSPathOffset"] = base
+            entry["DFSAlternatePathOffset"] = len(names)
+            entry["NetworkAddressOffset"] = base + len(dfsString(specialName))
+            strings += dfsString(specialName) + b''.join([dfsString(name) for name in names])
+        } else  {
+            entry["DFSPathOffset"] = base
+            entry["DFSAlternatePathOffset"] = base + len(dfsString(values[0]))
+            entry["NetworkAddressOffset"] = entry["DFSAlternatePathOffset"] + len(dfsString(values[1]))
+            strings += b''.join([dfsString(value) for value in values])
+        referrals += entry.getData()
+    response["ReferralEntries"] = referrals + strings
+    return response.getData()
+
+
+ type DfsReferralTests struct { // unittest.TestCase:
+     func (self TYPE) test_targets(){
+        data = dfsReferrals('\\contoso.com\\ns', [
+            (0, 300, ('\\contoso.com\\ns', '\\contoso.com\\ns', '\\FS1\\share')),
+            (0, 600, ('\\contoso.com\\ns', '\\contoso.com\\ns', '\\FS2\\share\\dir'))], flags=2)
+        referral = _parseDfsReferrals(data)
+        self.assertEqual(referral["PathConsumed"], len("\\contoso.com\\ns"))
+        self.assertEqual(referral["Flags"], 2)
+        self.assertEqual([(entry["TimeToLive"], entry["DFSPath"], entry["NetworkAddress"])
+                          for entry in referral["Referrals"]],
+                         [(300, '\\contoso.com\\ns', '\\FS1\\share'), (600, '\\contoso.com\\ns', '\\FS2\\share\\dir')])
+
+     func (self TYPE) test_name_list(){
+        data = dfsReferrals('', [(DFS_NAME_LIST_REFERRAL, 600, ('\\CONTOSO', ['\\DC1.contoso.com', '\\DC2.contoso.com']))])
+        referral = _parseDfsReferrals(data)["Referrals"][0]
+        self.assertEqual(referral["SpecialName"], '\\CONTOSO')
+        self.assertEqual(referral["ExpandedNames"], ['\\DC1.contoso.com', '\\DC2.contoso.com'])
+
+     func (self TYPE) test_v1(){
+        entry = DFS_REFERRAL_V1()
+        entry["ShareName"] = dfsString("\\FS1\\share")
+        entry["Size"] = len(entry)
+        response = RESP_GET_DFS_REFERRAL()
+        response["PathConsumed"] = 10
+        response["NumberOfReferrals"] = 1
+        response["ReferralEntries"] = entry.getData()
+        referral = _parseDfsReferrals(response.getData())
+        self.assertEqual(referral["PathConsumed"], 5)
+        self.assertEqual(referral["Referrals"][0]["NetworkAddress"], '\\FS1\\share')
+        // V1 has no TimeToLive, it can't be cached for 0 seconds
+        self.assertEqual(referral["Referrals"][0]["TimeToLive"], DFS_DEFAULT_TTL)
+
+
+ type FakeDfsSMB3: struct {
+    // A server where every share is somewhere else, but for the ones in found
+     func (self TYPE) __init__(found interface{}){
+        self.found = found
+        self.calls = []
+
+     func (self TYPE) getDialect(){
+        return SMB2_DIALECT_30
+
+     func (self TYPE) get_remote_name(){
+        return 'FS1'
+
+     func (self TYPE) list_path(shareName, path, password=nil interface{}){
+        self.calls.append((shareName, path))
+        if shareName in self.found {
+            return [path]
+        raise smb3.SessionError(nt_errors.STATUS_PATH_NOT_COVERED)
+
+
+ type DfsRedirectTests struct { // unittest.TestCase:
+     func (self TYPE) connection(server, referrals, dfs=true interface{}){
+        connection = SMBConnection('FS1', 'FS1', manualNegotiate=true)
+        connection._SMBConnection = server
+        if dfs is true {
+            connection.setDfs(true, DFSReferralCache())
+         func getDfsReferral(path interface{}){
+            for prefix, target in referrals:
+                if path.upper().startswith(prefix.upper()) {
+                    return {'PathConsumed': len(prefix), 'Flags': 0,
+                            'Referrals': [{'TimeToLive': 300, 'NetworkAddress': target}]}
+            raise SessionError(nt_errors.STATUS_NOT_FOUND)
+        connection.getDfsReferral = getDfsReferral
+        return connection
+
+     func (self TYPE) test_follow(){
+        server = FakeDfsSMB3(["B"])
+        connection = self.connection(server, [('\\FS1\\A', '\\FS1\\B\\moved')])
+        self.assertEqual(connection.listPath('A', 'dir\\*'), ["moved\\dir\\*"])
+
+     func (self TYPE) test_off_by_default(){
+        server = FakeDfsSMB3(["B"])
+        connection = self.connection(server, [('\\FS1\\A', '\\FS1\\B\\moved')], dfs=false)
+        try:
+            connection.listPath('A', 'dir\\*')
+        except SessionError as e:
+            self.assertEqual(e.getErrorCode(), nt_errors.STATUS_PATH_NOT_COVERED)
+        } else  {
+            self.fail("SessionError not raised")
+        self.assertEqual(server.calls, [('A', 'dir\\*')])
+
+     func (self TYPE) test_cycle(){
+        // A points to B and B back to A, on the same server. It has to end somewhere
+        server = FakeDfsSMB3([])
+        connection = self.connection(server, [('\\FS1\\A', '\\FS1\\B'), ('\\FS1\\B', '\\FS1\\A')])
+        try:
+            connection.listPath('A', '*')
+        except SessionError as e:
+            self.assertEqual(e.getErrorCode(), nt_errors.STATUS_PATH_NOT_COVERED)
+        } else  {
+            self.fail("SessionError not raised")
+        self.assertEqual(len(server.calls), DFS_MAX_HOPS + 1)
+
+
+ type FakeCopySMB3: struct {
+    // Copies chunks as long as they're within its limits, else answers with them like Windows does
+     func (self TYPE) __init__(maxChunks, maxChunkSize, maxTotal interface{}){
+        self.limits = (maxChunks, maxChunkSize, maxTotal)
+        self.copied = 0
+        self.requests = 0
+
+    def ioctl(self, treeId, fileId, ctlCode=-1, flags=0, inputBlob=b'', maxInputResponse=nil,
+              maxOutputResponse=nil, waitAnswer=1):
+        if ctlCode == FSCTL_SRV_REQUEST_RESUME_KEY {
+            return b'K' * 24 + b'\x00' * 4
+        self.requests += 1
+        // SourceKey, ChunkCount, Reserved and then the chunks
+        chunkCount = struct.unpack('<L', inputBlob[24:28])[0]
+        chunks = [SRV_COPYCHUNK(inputBlob[32 + i * 24:32 + (i + 1) * 24]) for i in range(chunkCount)]
+        response = SRV_COPYCHUNK_RESPONSE()
+        if len(chunks) > self.limits[0] or max(chunk["Length"] for chunk in chunks) > self.limits[1] or \
+                sum(chunk["Length"] for chunk in chunks) > self.limits[2]:
+            response["ChunksWritten"], response["ChunkBytesWritten"], response["TotalBytesWritten"] = self.limits
+            ioctlResponse = SMB2Ioctl_Response()
+            ioctlResponse["FileID"] = fileId
+            ioctlResponse["OutputOffset"] = 112
+            ioctlResponse["OutputCount"] = len(response)
+            ioctlResponse["Buffer"] = response.getData()
+            packet = SMB2Packet()
+            packet["Status"] = nt_errors.STATUS_INVALID_PARAMETER
+            packet["Data"] = ioctlResponse.getData()
+            raise smb3.SessionError(nt_errors.STATUS_INVALID_PARAMETER, packet)
+        response["ChunksWritten"] = len(chunks)
+        response["TotalBytesWritten"] = sum(chunk["Length"] for chunk in chunks)
+        self.copied += response["TotalBytesWritten"]
+        return response.getData()
+
+
+ type CopyChunkTests struct { // unittest.TestCase:
+     func (self TYPE) copy(server, size interface{}){
+        connection = SMBConnection.__new__(SMBConnection)
+        connection._SMBConnection = server
+        return connection._copyChunks(1, b'1' * 16, 1, b'2' * 16, size, nil)
+
+     func (self TYPE) test_defaults(){
+        server = FakeCopySMB3(16, 1024 * 1024, 16 * 1024 * 1024)
+        self.assertEqual(self.copy(server, 20 * 1024 * 1024), 20 * 1024 * 1024)
+        self.assertEqual(server.requests, 2)
+
+     func (self TYPE) test_server_limits(){
+        server = FakeCopySMB3(4, 256 * 1024, 512 * 1024)
+        self.assertEqual(self.copy(server, 3 * 1024 * 1024), 3 * 1024 * 1024)
+        self.assertEqual(server.copied, 3 * 1024 * 1024)
+        // The one that failed, then 512 KiB at a time
+        self.assertEqual(server.requests, 7)
+
+     func (self TYPE) test_limits_not_lower(){
+        // Nothing to go down to, don't keep trying
+        server = FakeCopySMB3(0, 0, 0)
+        try:
+            self.copy(server, 1024)
+        except SessionError as e:
+            self.assertEqual(e.getErrorCode(), nt_errors.STATUS_INVALID_PARAMETER)
+        } else  {
+            self.fail("SessionError not raised")
+        self.assertEqual(server.requests, 1)
+
+
+ type SyncTests struct { // unittest.TestCase:
+    // Both sides local, it's the same code that runs against a share
+     func (self TYPE) setUp(){
+        self.source = tempfile.mkdtemp()
+        self.destination = tempfile.mkdtemp()
+
+     func (self TYPE) tearDown(){
+        shutil.rmtree(self.source)
+        shutil.rmtree(self.destination)
+
+     func (self TYPE) create(root, relPath, data=b'data' interface{}){
+        path = os.path.join(root, *relPath.split("/"))
+        if os.path.isdir(os.path.dirname(path)) is false {
+            os.makedirs(os.path.dirname(path))
+        with open(path, 'wb') as f:
+            f.write(data)
+
+     func (self TYPE) sync(**kwargs interface{}){
+        options = {'include': nil, 'exclude': nil, 'maxDepth': nil, 'checksum': false, 'delete': true,
+                   'progress': nil}
+        options.update(kwargs)
+        return _sync(_LocalTree(self.source), _LocalTree(self.destination), **options)
+
+     func (self TYPE) exists(relPath interface{}){
+        return os.path.lexists(os.path.join(self.destination, *relPath.split("/")))
+
+     func (self TYPE) test_delete(){
+        self.create(self.source, 'a.txt')
+        self.create(self.destination, 'old/b.txt')
+        stats = self.sync()
+        self.assertEqual(stats["copied"], 1)
+        self.assertEqual(stats["deleted"], 2)
+        self.asserttrue(self.exists("a.txt"))
+        self.assertfalse(self.exists("old"))
+
+     func (self TYPE) test_delete_keeps_filtered(){
+        self.create(self.destination, 'logs/a.log')
+        self.create(self.destination, 'logs/b.txt')
+        stats = self.sync(exclude=["*.log"])
+        self.assertEqual(stats["deleted"], 1)
+        self.asserttrue(self.exists("logs/a.log"))
+        self.assertfalse(self.exists("logs/b.txt"))
+
+        self.sync(include=["*.txt"])
+        self.asserttrue(self.exists("logs/a.log"))
+
+     func (self TYPE) test_delete_keeps_too_deep(){
+        self.create(self.destination, 'a/b/c.txt')
+        self.sync(maxDepth=1)
+        self.asserttrue(self.exists("a/b/c.txt"))
+        self.sync(maxDepth=0)
+        self.asserttrue(self.exists("a/b/c.txt"))
+
+     func (self TYPE) test_directory_times(){
+        self.create(self.source, 'a/b/c.txt')
+        self.create(self.destination, 'a/old.txt')
+        for relPath, mtime in (('a/b/c.txt', 1000000000), ('a/b', 1100000000), ('a', 1200000000)):
+            os.utime(os.path.join(self.source, *relPath.split("/")), (mtime, mtime))
+        self.sync()
+        // Set after c.txt was copied into b and old.txt deleted from a
+        for relPath, mtime in (('a/b/c.txt', 1000000000), ('a/b', 1100000000), ('a', 1200000000)):
+            self.assertEqual(os.stat(os.path.join(self.destination, *relPath.split("/"))).st_mtime, mtime)
+        self.assertfalse(self.exists("a/old.txt"))
+
+     func (self TYPE) test_file_replaces_directory(){
+        self.create(self.source, 'name', b'file')
+        self.create(self.destination, 'name/inside.txt')
+        self.sync(delete=false)
+        with open(os.path.join(self.destination, 'name'), 'rb') as f:
+            self.assertEqual(f.read(), b'file')
+
+     func (self TYPE) test_directory_replaces_file(){
+        self.create(self.source, 'name/inside.txt')
+        self.create(self.destination, 'name')
+        self.sync(delete=false)
+        self.asserttrue(self.exists("name/inside.txt"))
+
+     func (self TYPE) test_case(){
+        self.create(self.source, 'dir/file.txt', b'newer')
+        self.create(self.destination, 'DIR/File.txt', b'old')
+        self.create(self.destination, 'DIR/FILE.txt', b'old')
+        self.sync()
+        self.assertEqual(sorted(os.listdir(self.destination)), ["DIR"])
+        // One of them stands for file.txt, the other one goes
+        names = os.listdir(os.path.join(self.destination, 'DIR'))
+        self.assertEqual(len(names), 1)
+        with open(os.path.join(self.destination, 'DIR', names[0]), 'rb') as f:
+            self.assertEqual(f.read(), b'newer')
+
+     func (self TYPE) test_case_collision(){
+        self.create(self.source, 'a.txt', b'lower')
+        self.create(self.source, 'A.txt', b'upper')
+        stats = self.sync()
+        self.assertEqual(stats["copied"], 1)
+
+    @unittest.skipIf(hasattr(os, 'symlink') is false, 'no symlinks')
+     func (self TYPE) test_links_not_followed(){
+        outside = tempfile.mkdtemp()
+        try:
+            self.create(outside, 'secret.txt')
+            os.symlink(outside, os.path.join(self.source, 'link'))
+            os.symlink(os.path.join(outside, 'secret.txt'), os.path.join(self.source, 'file'))
+            stats = self.sync()
+            self.assertEqual(stats["copied"], 0)
+            self.assertEqual(os.listdir(self.destination), [])
+        finally:
+            shutil.rmtree(outside)
+
+
+ type FakeReauthSMB3 struct { // smb3.SMB3:
+    // Only the sending end of an SMB3, sendSMB records what goes out
+     func (self TYPE) __init__(reader=nil interface{}){
+        self._SMB3__threadState = threading.local()
+        self._SMB3__lock = threading.RLock()
+        self._SMB3__reader = reader
+        self._SMB3__reauthPending = false
+        self.sent = []
+
+     func (self TYPE) _SMB3__sendSMB(packet interface{}){
+        self.sent.append(packet["Command"])
+        return len(self.sent)
+
+     func (self TYPE) reauthenticate(){
+        self.sent.append("reauthenticate")
+
+
+ type ReauthenticationTests struct { // unittest.TestCase:
+     func (self TYPE) packet(command interface{}){
+        packet = SMB2Packet()
+        packet["Command"] = command
+        return packet
+
+     func (self TYPE) test_before_next_request(){
+        // No reader, the thread that sends does it
+        server = FakeReauthSMB3()
+        server.scheduleReauthentication()
+        self.assertEqual(server.sent, [])
+        server.sendSMB(self.packet(SMB2_READ))
+        server.sendSMB(self.packet(SMB2_READ))
+        self.assertEqual(server.sent, ['reauthenticate', SMB2_READ, SMB2_READ])
+
+     func (self TYPE) test_with_reader(){
+        server = FakeReauthSMB3(reader=threading.current_thread())
+        server.scheduleReauthentication()
+        self.assertEqual(server.sent, ["reauthenticate"])
+
+
+ type FakePoolConnection: struct {
+    // What SMBConnectionPool and PooledSMBConnection need from an SMBConnection
+     func (self TYPE) __init__(remoteName interface{}){
+        self.remoteName = remoteName
+        self.logins = []
+        self.trees = []
+        self.open = set()
+        self.closed = false
+        self.alive = true
+        self.failClose = false
+        self.nextFileId = 1
+
+     func (self TYPE) login(user, password, domain='', lmhash='', nthash='' interface{}){
+        self.logins.append(('login', user, domain))
+
+    def kerberosLogin(self, user, password, domain='', lmhash='', nthash='', aesKey='', kdcHost=nil, TGT=nil,
+                      TGS=nil):
+        self.logins.append(('kerberos', user, domain, kdcHost, TGT, TGS))
+
+     func (self TYPE) connectTree(share interface{}){
+        self.trees.append(share)
+        return len(self.trees)
+
+     func (self TYPE) openFile(treeId, pathName, *args, **kwargs interface{}){
+        fileId = self.nextFileId
+        self.nextFileId += 1
+        self.open.add((treeId, fileId))
+        return fileId
+
+    createFile = openFile
+
+     func (self TYPE) closeFile(treeId, fileId interface{}){
+        if self.failClose is true {
+            raise SessionError(nt_errors.STATUS_CONNECTION_DISCONNECTED)
+        self.open.remove((treeId, fileId))
+        return true
+
+     func (self TYPE) echo(){
+        return self.alive
+
+     func (self TYPE) logoff(){
+        return true
+
+     func (self TYPE) close(){
+        self.closed = true
+
+
+ type FakePool struct { // SMBConnectionPool:
+     func (self TYPE) __init__(*args, **kwargs interface{}){
+        SMBConnectionPool.__init__(self, *args, **kwargs)
+        self.connections = []
+
+     func (self TYPE) _connect(remoteName, remoteHost, sess_port, timeout, preferredDialect interface{}){
+        self.connections.append(FakePoolConnection(remoteName))
+        return self.connections[-1]
+
+
+ type ConnectionPoolTests struct { // unittest.TestCase:
+     func (self TYPE) setUp(){
+        self.pool = FakePool()
+
+     func (self TYPE) tearDown(){
+        self.pool.close()
+
+     func (self TYPE) get(**kwargs interface{}){
+        args = {'remoteName': 'SERVER', 'remoteHost': '10.0.0.1', 'user': 'user', 'password': 'password',
+                'domain': 'DOMAIN'}
+        args.update(kwargs)
+        return self.pool.getConnection(**args)
+
+     func (self TYPE) test_reused(){
+        with self.get() as smbClient:
+            self.assertEqual(smbClient.connectTree("C$"), 1)
+        with self.get() as smbClient:
+            // Same connection, the tree is still connected
+            self.assertEqual(smbClient.connectTree("\\\\SERVER\\C$"), 1)
+        self.assertEqual(len(self.pool.connections), 1)
+        self.assertEqual(self.pool.connections[0].trees, ["C$"])
+        self.assertEqual(self.pool.getStats(), {('SERVER', '10.0.0.1', 'user', 'DOMAIN'): {'idle': 1, 'active': 0}})
+
+     func (self TYPE) test_different_keys(){
+        TGT = {'KDC_REP': b'tgt one', 'cipher': nil, 'sessionKey': nil}
+        otherTGT = {'KDC_REP': b'tgt two', 'cipher': nil, 'sessionKey': nil}
+        for kwargs in ({}, {'password': 'other'}, {'nthash': 'aa' * 16},
+                       {'useKerberos': true}, {'useKerberos': true, 'kdcHost': 'dc1'},
+                       {'useKerberos': true, 'kdcHost': 'dc2'}, {'useKerberos': true, 'TGT': TGT},
+                       {'useKerberos': true, 'TGT': otherTGT}):
+            self.get(**kwargs).close()
+        self.assertEqual(len(self.pool.connections), 8)
+        self.assertEqual(self.pool.connections[5].logins, [('kerberos', 'user', 'DOMAIN', 'dc2', nil, nil)])
+        self.assertEqual(self.pool.connections[7].logins, [('kerberos', 'user', 'DOMAIN', nil, otherTGT, nil)])
+        // Case doesn't make it a different connection
+        self.get(useKerberos=true, kdcHost='DC1').close()
+        self.assertEqual(len(self.pool.connections), 8)
+
+     func (self TYPE) test_key_salted(){
+        smbClient = self.get()
+        key = smbClient._key
+        smbClient.close()
+        digest = hashlib.sha256('\x00'.join(['password', '', '', '', '', '']).encode("utf-8")).hexdigest()
+        self.assertNotIn(digest, key)
+        self.assertNotIn('password', key)
+        // Another pool, another salt
+        self.assertNotEqual(FakePool()._key('SERVER', '10.0.0.1', 445, nil, 'user', 'password', 'DOMAIN', '', '',
+                                            '', nil, nil, nil, false), key)
+
+     func (self TYPE) test_files_closed_on_release(){
+        smbClient = self.get()
+        tid = smbClient.connectTree("C$")
+        smbClient.openFile(tid, 'left.txt')
+        closed = smbClient.createFile(tid, 'closed.txt')
+        smbClient.closeFile(tid, closed)
+        // Kept referenced, SMBFile closes itself when collected
+        smbFile = SMBShareFS(smbClient, 'C$').open("fs.txt")
+        connection = self.pool.connections[0]
+        self.assertEqual(len(connection.open), 2)
+        smbClient.close()
+        self.assertEqual(connection.open, set())
+        self.assertfalse(connection.closed)
+        self.assertEqual(self.pool.getStats()[('SERVER', '10.0.0.1', 'user', 'DOMAIN')]["idle"], 1)
+
+     func (self TYPE) test_files_not_closed_discarded(){
+        smbClient = self.get()
+        smbClient.openFile(smbClient.connectTree("C$"), 'left.txt')
+        connection = self.pool.connections[0]
+        connection.failClose = true
+        smbClient.close()
+        // Can't tell what's still open in there, nobody gets it again
+        self.asserttrue(connection.closed)
+        self.get().close()
+        self.assertEqual(len(self.pool.connections), 2)
+
+     func (self TYPE) test_closed(){
+        smbClient = self.get()
+        smbClient.close()
+        for method, args in ((smbClient.connectTree, ('C$',)), (smbClient.disconnectTree, (1,)),
+                             (smbClient.openFile, (1, 'file.txt')), (smbClient.closeFile, (1, 1)),
+                             (smbClient.getConnection, ()), (smbClient.openShareFS, ('C$',)),
+                             (smbClient.logoff, ()), (lambda: smbClient.echo(), ())):
+            try:
+                method(*args)
+            except SessionError as e:
+                self.assertEqual(e.getErrorCode(), nt_errors.STATUS_INVALID_HANDLE)
+            } else  {
+                self.fail("SessionError not raised")
+
+     func (self TYPE) test_max_active(){
+        self.pool = FakePool(maxActive=1)
+        smbClient = self.get()
+        try:
+            self.get(wait=0.1)
+        except SessionError as e:
+            self.assertEqual(e.getErrorCode(), nt_errors.STATUS_IO_TIMEOUT)
+        } else  {
+            self.fail("SessionError not raised")
+        // Another key doesn't wait
+        self.get(remoteName='OTHER').close()
+        smbClient.close()
+        self.get(wait=0.1).close()
+        self.assertEqual(len(self.pool.connections), 2)
+
+     func (self TYPE) test_health_check(){
+        self.get().close()
+        self.pool.connections[0].alive = false
+        self.get().close()
+        self.assertEqual(len(self.pool.connections), 2)
+        self.asserttrue(self.pool.connections[0].closed)
+
+     func (self TYPE) test_idle_timeout(){
+        self.pool = FakePool(idleTimeout=0)
+        self.get().close()
+        time.sleep(0.01)
+        self.get(remoteName='OTHER').close()
+        self.asserttrue(self.pool.connections[0].closed)
+        self.assertEqual(list(self.pool.getStats().keys()), [('OTHER', '10.0.0.1', 'user', 'DOMAIN')])
+
+     func (self TYPE) test_logoff_not_reused(){
+        with self.get() as smbClient:
+            smbClient.logoff()
+        self.asserttrue(self.pool.connections[0].closed)
+        self.assertEqual(self.pool.getStats(), {('SERVER', '10.0.0.1', 'user', 'DOMAIN'): {'idle': 0, 'active': 0}})
+
+     func (self TYPE) test_error_not_reused(){
+        try:
+            with self.get():
+                raise ValueError()
+        except ValueError:
+            pass
+        self.asserttrue(self.pool.connections[0].closed)
+
+     func (self TYPE) test_close(){
+        self.get().close()
+        smbClient = self.get(remoteName='OTHER')
+        self.pool.close()
+        self.asserttrue(self.pool.connections[0].closed)
+        self.assertfalse(self.pool.connections[1].closed)
+        smbClient.close()
+        self.asserttrue(self.pool.connections[1].closed)
+
+
+if __name__ == '__main__' {
+    unittest.main(verbosity=1)
@@ -0,0 +1,802 @@
+# SECUREAUTH LABS. Copyright 2018 SecureAuth Corporation. All rights reserved.
+#
+# This software is provided under under a slightly modified version
+# of the Apache Software License. See the accompanying LICENSE file
+# for more information.
+#
+# Description:
+#   SMB client tests that don't need a server, the network is faked
+#
+import hashlib
+import os
+import shutil
+import struct
+import tempfile
+import threading
+import time
+import unittest
+from contextlib import contextmanager
+
+from impacket import smb, smb3, nt_errors
+from impacket.smb3structs import SMB2Packet, SMB2Ioctl_Response, SRV_COPYCHUNK, \
+    SRV_COPYCHUNK_RESPONSE, FSCTL_SRV_REQUEST_RESUME_KEY, SMB2_DIALECT_30, SMB2_READ, FILE_NOTIFY_INFORMATION, \
+    FILE_ACTION_ADDED, FILE_ACTION_RENAMED_OLD_NAME, FILE_ACTION_RENAMED_NEW_NAME, RESP_GET_DFS_REFERRAL, \
+    DFS_REFERRAL_V1, DFS_REFERRAL_V3, DFS_NAME_LIST_REFERRAL
+from impacket.smbconnection import SMBConnection, SMBShareFS, SMBFile, SessionError, _LocalTree, _sync, _unpackStreamList, \
+    _packFullEaList, _unpackFullEaList, _packFeaList, _unpackFeaList, _unpackNotifyList, FILE_ACTION_OVERFLOW, \
+    _parseDfsReferrals, DFSReferralCache, DFS_MAX_HOPS, DFS_DEFAULT_TTL, SMBConnectionPool
+
+
+class FakeSMB1(smb.SMB):
+    # Just enough of an SMB to go through writeFile, maxCount caps what every WRITE_ANDX takes
+    def __init__(self, maxCount):
+        self._dialects_parameters = {'Capabilities': smb.SMB.CAP_LARGE_WRITEX, 'MaxBufferSize': 65535}
+        self._SignatureEnabled = False
+        self.maxCount = maxCount
+        self.written = b''
+
+    def write_andx(self, tid, fid, data, offset = 0, wait_answer = 1, write_pipe_mode = False, smb_packet = None):
+        count = min(len(data), self.maxCount)
+        self.written = self.written[:offset] + data[:count]
+        response = smb.SMBCommand(smb.SMB.SMB_COM_WRITE_ANDX)
+        response['Parameters'] = smb.SMBWriteAndXResponse_Parameters()
+        response['Parameters']['Count'] = count
+        response['Parameters']['Available'] = 0
+        packet = smb.NewSMBPacket()
+        packet.addCommand(response)
+        return smb.NewSMBPacket(data = packet.getData())
+
+
+class WriteFileTests(unittest.TestCase):
+    def test_write_count(self):
+        connection = FakeSMB1(65535)
+        data = b'A' * 100000
+        self.assertEqual(connection.writeFile(1, 1, data), len(data))
+        self.assertEqual(connection.written, data)
+
+    def test_short_writes(self):
+        connection = FakeSMB1(1000)
+        data = bytes(bytearray(range(256))) * 20
+        self.assertEqual(connection.writeFile(1, 1, data), len(data))
+        self.assertEqual(connection.written, data)
+
+    def test_nothing_written(self):
+        self.assertEqual(FakeSMB1(0).writeFile(1, 1, b'A' * 10), 0)
+
+
+class FakeConnection:
+    def __init__(self, files):
+        self.files = files
+
+    def connectTree(self, shareName):
+        return 1
+
+    def disconnectTree(self, treeId):
+        pass
+
+    def listPath(self, shareName, path, password = None):
+        return self.files
+
+
+class ShareFSTests(unittest.TestCase):
+    def setUp(self):
+        self.share = SMBShareFS(FakeConnection([smb.SharedFile(0, 0, 0, 10, 10, 0, '', 'other.txt')]), 'SHARE')
+
+    def test_stat(self):
+        info = self.share.stat('dir/OTHER.TXT')
+        self.assertEqual(info.name, 'other.txt')
+        self.assertEqual(info.st_size, 10)
+
+    def test_stat_not_found(self):
+        # Whatever the listing came back with, it's not what was asked for
+        try:
+            self.share.stat('dir/oth*.txt')
+        except SessionError as e:
+            self.assertEqual(e.getErrorCode(), nt_errors.STATUS_OBJECT_NAME_NOT_FOUND)
+        else:
+            self.fail('SessionError not raised')
+
+
+class StreamListTests(unittest.TestCase):
+    def entry(self, name, size, last=False):
+        entry = smb.SMBFileStreamInformation()
+        entry['StreamName'] = name.encode('utf-16le')
+        entry['StreamNameLength'] = len(entry['StreamName'])
+        entry['StreamSize'] = size
+        entry['StreamAllocationSize'] = size
+        data = entry.getData()
+        data += b'\x00' * ((8 - len(data) % 8) % 8)
+        if last is False:
+            data = struct.pack('<L', len(data)) + data[4:]
+        return data
+
+    def test_unpack(self):
+        data = self.entry('::$DATA', 100) + self.entry(':Zone.Identifier:$DATA', 26, True)
+        self.assertEqual(_unpackStreamList(data), [('::$DATA', 100), (':Zone.Identifier:$DATA', 26)])
+
+    def test_empty(self):
+        # A directory without named streams
+        self.assertEqual(_unpackStreamList(b''), [])
+
+
+class EaListTests(unittest.TestCase):
+    eas = [('USER.ONE', b'1'), ('USER.TWO', b'value two'), ('USER.EMPTY', b'')]
+
+    def test_full_ea_list(self):
+        data = _packFullEaList(self.eas)
+        self.assertEqual(_unpackFullEaList(data), dict(self.eas))
+        # Every entry but the last one points to the next, 4 bytes aligned
+        offset = 0
+        for _ in self.eas[:-1]:
+            nextEntryOffset = struct.unpack('<L', data[offset:offset + 4])[0]
+            self.assertEqual(nextEntryOffset % 4, 0)
+            offset += nextEntryOffset
+        self.assertEqual(struct.unpack('<L', data[offset:offset + 4])[0], 0)
+
+    def test_fea_list(self):
+        data = _packFeaList(self.eas)
+        self.assertEqual(struct.unpack('<L', data[:4])[0], len(data))
+        self.assertEqual(_unpackFeaList(data), dict(self.eas))
+
+    def test_fea_list_size(self):
+        # What's past the size the list says it takes isn't part of it
+        data = _packFeaList(self.eas[:1])
+        self.assertEqual(_unpackFeaList(data + b'\x00\x04\x01\x00JUNK\x00X'), dict(self.eas[:1]))
+
+
+def notifyEntries(events):
+    data = b''
+    for i, (action, fileName) in enumerate(events):
+        entry = FILE_NOTIFY_INFORMATION()
+        entry['Action'] = action
+        entry['FileName'] = fileName.encode('utf-16le')
+        entry['FileNameLength'] = len(entry['FileName'])
+        entry = entry.getData()
+        entry += b'\x00' * ((4 - len(entry) % 4) % 4)
+        if i < len(events) - 1:
+            entry = struct.pack('<L', len(entry)) + entry[4:]
+        data += entry
+    return data
+
+
+class FakeNotifySMB3:
+    # Hands out the buffers it's given, one per CHANGE_NOTIFY, then fails like a cancelled wait
+    def __init__(self, buffers):
+        self.buffers = list(buffers)
+        self.contexts = []
+        self.closed = False
+
+    def getDialect(self):
+        return SMB2_DIALECT_30
+
+    def connect_tree(self, share):
+        return 1
+
+    def disconnect_tree(self, treeId):
+        pass
+
+    def create(self, treeId, pathName, *args):
+        return b'F' * 16
+
+    def close(self, treeId, fileId):
+        self.closed = True
+
+    @contextmanager
+    def useContext(self, context):
+        self.contexts.append(context)
+        yield
+
+    def changeNotify(self, treeId, fileId, completionFilter, flags=0, outputBufferLength=65536):
+        if len(self.buffers) == 0:
+            self.contexts[-1].cancel()
+            raise smb3.SessionError(nt_errors.STATUS_CANCELLED)
+        return self.buffers.pop(0)
+
+
+class NotifyTests(unittest.TestCase):
+    def test_unpack(self):
+        events = [(FILE_ACTION_ADDED, 'new.txt'), (FILE_ACTION_RENAMED_OLD_NAME, 'a'),
+                  (FILE_ACTION_RENAMED_NEW_NAME, 'dir\\b.txt')]
+        self.assertEqual(_unpackNotifyList(notifyEntries(events)), events)
+        self.assertEqual(_unpackNotifyList(b''), [])
+
+    def test_watch(self):
+        server = FakeNotifySMB3([notifyEntries([(FILE_ACTION_ADDED, 'one')]), None,
+                                 notifyEntries([(FILE_ACTION_ADDED, 'two')])])
+        connection = SMBConnection.__new__(SMBConnection)
+        connection._SMBConnection = server
+        events = list(connection.watch('SHARE', 'dir'))
+        self.assertEqual(events, [(FILE_ACTION_ADDED, 'one'), (FILE_ACTION_OVERFLOW, None), (FILE_ACTION_ADDED, 'two')])
+        self.assertTrue(server.closed)
+        # There's always a context, or the waits would time out
+        self.assertTrue(all(context is not None for context in server.contexts))
+
+
+class FakeLockConnection:
+    def __init__(self, dialect):
+        self.dialect = dialect
+        self.locks = []
+        self.context = None
+
+    def getDialect(self):
+        return self.dialect
+
+    @contextmanager
+    def useContext(self, context):
+        self.context = [context]
+        yield
+        self.context = None
+
+    def lockFile(self, treeId, fileId, offset, length, exclusive=True, wait=False):
+        # Whether it was waited for inside useContext
+        self.locks.append((offset, length, exclusive, wait, self.context is not None))
+
+    def closeFile(self, treeId, fileId):
+        pass
+
+
+class FileLockTests(unittest.TestCase):
+    def test_no_wait_by_default(self):
+        connection = FakeLockConnection(SMB2_DIALECT_30)
+        SMBFile(connection, 1, b'F' * 16, 'file').lock(0, 10)
+        self.assertEqual(connection.locks, [(0, 10, True, False, False)])
+
+    def test_wait(self):
+        # Without a context the reader thread still waits for it, so it's cancelled if it times out
+        connection = FakeLockConnection(SMB2_DIALECT_30)
+        SMBFile(connection, 1, b'F' * 16, 'file').lock(0, 10, wait=True)
+        self.assertEqual(connection.locks, [(0, 10, True, True, True)])
+
+        # SMB1 has the server time out first
+        connection = FakeLockConnection(smb.SMB_DIALECT)
+        SMBFile(connection, 1, 1, 'file').lock(0, 10, exclusive=False, wait=True)
+        self.assertEqual(connection.locks, [(0, 10, False, True, False)])
+
+
+def dfsString(value):
+    return (value + '\x00').encode('utf-16le')
+
+def dfsReferrals(pathConsumed, entries, flags=0):
+    # entries are (flags, timeToLive, strings), strings being (DFSPath, DFSAlternatePath, NetworkAddress),
+    # or (SpecialName, [ExpandedNames]) with DFS_NAME_LIST_REFERRAL. All of them version 4, the strings at the end
+    response = RESP_GET_DFS_REFERRAL()
+    response['PathConsumed'] = len(pathConsumed) * 2
+    response['NumberOfReferrals'] = len(entries)
+    response['ReferralHeaderFlags'] = flags
+    entrySize = len(DFS_REFERRAL_V3())
+    stringsOffset = 8 + entrySize * len(entries)
+    referrals = b''
+    strings = b''
+    for i, (entryFlags, timeToLive, values) in enumerate(entries):
+        entry = DFS_REFERRAL_V3()
+        entry['VersionNumber'] = 4
+        entry['Size'] = entrySize
+        entry['ServerType'] = 1
+        entry['ReferralEntryFlags'] = entryFlags
+        entry['TimeToLive'] = timeToLive
+        base = stringsOffset + len(strings) - (8 + entrySize * i)
+        if entryFlags & DFS_NAME_LIST_REFERRAL:
+            specialName, names = values
+            entry['DFSPathOffset'] = base
+            entry['DFSAlternatePathOffset'] = len(names)
+            entry['NetworkAddressOffset'] = base + len(dfsString(specialName))
+            strings += dfsString(specialName) + b''.join([dfsString(name) for name in names])
+        else:
+            entry['DFSPathOffset'] = base
+            entry['DFSAlternatePathOffset'] = base + len(dfsString(values[0]))
+            entry['NetworkAddressOffset'] = entry['DFSAlternatePathOffset'] + len(dfsString(values[1]))
+            strings += b''.join([dfsString(value) for value in values])
+        referrals += entry.getData()
+    response['ReferralEntries'] = referrals + strings
+    return response.getData()
+
+
+class DfsReferralTests(unittest.TestCase):
+    def test_targets(self):
+        data = dfsReferrals('\\contoso.com\\ns', [
+            (0, 300, ('\\contoso.com\\ns', '\\contoso.com\\ns', '\\FS1\\share')),
+            (0, 600, ('\\contoso.com\\ns', '\\contoso.com\\ns', '\\FS2\\share\\dir'))], flags=2)
+        referral = _parseDfsReferrals(data)
+        self.assertEqual(referral['PathConsumed'], len('\\contoso.com\\ns'))
+        self.assertEqual(referral['Flags'], 2)
+        self.assertEqual([(entry['TimeToLive'], entry['DFSPath'], entry['NetworkAddress'])
+                          for entry in referral['Referrals']],
+                         [(300, '\\contoso.com\\ns', '\\FS1\\share'), (600, '\\contoso.com\\ns', '\\FS2\\share\\dir')])
+
+    def test_name_list(self):
+        data = dfsReferrals('', [(DFS_NAME_LIST_REFERRAL, 600, ('\\CONTOSO', ['\\DC1.contoso.com', '\\DC2.contoso.com']))])
+        referral = _parseDfsReferrals(data)['Referrals'][0]
+        self.assertEqual(referral['SpecialName'], '\\CONTOSO')
+        self.assertEqual(referral['ExpandedNames'], ['\\DC1.contoso.com', '\\DC2.contoso.com'])
+
+    def test_v1(self):
+        entry = DFS_REFERRAL_V1()
+        entry['ShareName'] = dfsString('\\FS1\\share')
+        entry['Size'] = len(entry)
+        response = RESP_GET_DFS_REFERRAL()
+        response['PathConsumed'] = 10
+        response['NumberOfReferrals'] = 1
+        response['ReferralEntries'] = entry.getData()
+        referral = _parseDfsReferrals(response.getData())
+        self.assertEqual(referral['PathConsumed'], 5)
+        self.assertEqual(referral['Referrals'][0]['NetworkAddress'], '\\FS1\\share')
+        # V1 has no TimeToLive, it can't be cached for 0 seconds
+        self.assertEqual(referral['Referrals'][0]['TimeToLive'], DFS_DEFAULT_TTL)
+
+
+class FakeDfsSMB3:
+    # A server where every share is somewhere else, but for the ones in found
+    def __init__(self, found):
+        self.found = found
+        self.calls = []
+
+    def getDialect(self):
+        return SMB2_DIALECT_30
+
+    def get_remote_name(self):
+        return 'FS1'
+
+    def list_path(self, shareName, path, password=None):
+        self.calls.append((shareName, path))
+        if shareName in self.found:
+            return [path]
+        raise smb3.SessionError(nt_errors.STATUS_PATH_NOT_COVERED)
+
+
+class DfsRedirectTests(unittest.TestCase):
+    def connection(self, server, referrals, dfs=True):
+        connection = SMBConnection('FS1', 'FS1', manualNegotiate=True)
+        connection._SMBConnection = server
+        if dfs is True:
+            connection.setDfs(True, DFSReferralCache())
+        def getDfsReferral(path):
+            for prefix, target in referrals:
+                if path.upper().startswith(prefix.upper()):
+                    return {'PathConsumed': len(prefix), 'Flags': 0,
+                            'Referrals': [{'TimeToLive': 300, 'NetworkAddress': target}]}
+            raise SessionError(nt_errors.STATUS_NOT_FOUND)
+        connection.getDfsReferral = getDfsReferral
+        return connection
+
+    def test_follow(self):
+        server = FakeDfsSMB3(['B'])
+        connection = self.connection(server, [('\\FS1\\A', '\\FS1\\B\\moved')])
+        self.assertEqual(connection.listPath('A', 'dir\\*'), ['moved\\dir\\*'])
+
+    def test_off_by_default(self):
+        server = FakeDfsSMB3(['B'])
+        connection = self.connection(server, [('\\FS1\\A', '\\FS1\\B\\moved')], dfs=False)
+        try:
+            connection.listPath('A', 'dir\\*')
+        except SessionError as e:
+            self.assertEqual(e.getErrorCode(), nt_errors.STATUS_PATH_NOT_COVERED)
+        else:
+            self.fail('SessionError not raised')
+        self.assertEqual(server.calls, [('A', 'dir\\*')])
+
+    def test_cycle(self):
+        # A points to B and B back to A, on the same server. It has to end somewhere
+        server = FakeDfsSMB3([])
+        connection = self.connection(server, [('\\FS1\\A', '\\FS1\\B'), ('\\FS1\\B', '\\FS1\\A')])
+        try:
+            connection.listPath('A', '*')
+        except SessionError as e:
+            self.assertEqual(e.getErrorCode(), nt_errors.STATUS_PATH_NOT_COVERED)
+        else:
+            self.fail('SessionError not raised')
+        self.assertEqual(len(server.calls), DFS_MAX_HOPS + 1)
+
+
+class FakeCopySMB3:
+    # Copies chunks as long as they're within its limits, else answers with them like Windows does
+    def __init__(self, maxChunks, maxChunkSize, maxTotal):
+        self.limits = (maxChunks, maxChunkSize, maxTotal)
+        self.copied = 0
+        self.requests = 0
+
+    def ioctl(self, treeId, fileId, ctlCode=-1, flags=0, inputBlob=b'', maxInputResponse=None,
+              maxOutputResponse=None, waitAnswer=1):
+        if ctlCode == FSCTL_SRV_REQUEST_RESUME_KEY:
+            return b'K' * 24 + b'\x00' * 4
+        self.requests += 1
+        # SourceKey, ChunkCount, Reserved and then the chunks
+        chunkCount = struct.unpack('<L', inputBlob[24:28])[0]
+        chunks = [SRV_COPYCHUNK(inputBlob[32 + i * 24:32 + (i + 1) * 24]) for i in range(chunkCount)]
+        response = SRV_COPYCHUNK_RESPONSE()
+        if len(chunks) > self.limits[0] or max(chunk['Length'] for chunk in chunks) > self.limits[1] or \
+                sum(chunk['Length'] for chunk in chunks) > self.limits[2]:
+            response['ChunksWritten'], response['ChunkBytesWritten'], response['TotalBytesWritten'] = self.limits
+            ioctlResponse = SMB2Ioctl_Response()
+            ioctlResponse['FileID'] = fileId
+            ioctlResponse['OutputOffset'] = 112
+            ioctlResponse['OutputCount'] = len(response)
+            ioctlResponse['Buffer'] = response.getData()
+            packet = SMB2Packet()
+            packet['Status'] = nt_errors.STATUS_INVALID_PARAMETER
+            packet['Data'] = ioctlResponse.getData()
+            raise smb3.SessionError(nt_errors.STATUS_INVALID_PARAMETER, packet)
+        response['ChunksWritten'] = len(chunks)
+        response['TotalBytesWritten'] = sum(chunk['Length'] for chunk in chunks)
+        self.copied += response['TotalBytesWritten']
+        return response.getData()
+
+
+class CopyChunkTests(unittest.TestCase):
+    def copy(self, server, size):
+        connection = SMBConnection.__new__(SMBConnection)
+        connection._SMBConnection = server
+        return connection._copyChunks(1, b'1' * 16, 1, b'2' * 16, size, None)
+
+    def test_defaults(self):
+        server = FakeCopySMB3(16, 1024 * 1024, 16 * 1024 * 1024)
+        self.assertEqual(self.copy(server, 20 * 1024 * 1024), 20 * 1024 * 1024)
+        self.assertEqual(server.requests, 2)
+
+    def test_server_limits(self):
+        server = FakeCopySMB3(4, 256 * 1024, 512 * 1024)
+        self.assertEqual(self.copy(server, 3 * 1024 * 1024), 3 * 1024 * 1024)
+        self.assertEqual(server.copied, 3 * 1024 * 1024)
+        # The one that failed, then 512 KiB at a time
+        self.assertEqual(server.requests, 7)
+
+    def test_limits_not_lower(self):
+        # Nothing to go down to, don't keep trying
+        server = FakeCopySMB3(0, 0, 0)
+        try:
+            self.copy(server, 1024)
+        except SessionError as e:
+            self.assertEqual(e.getErrorCode(), nt_errors.STATUS_INVALID_PARAMETER)
+        else:
+            self.fail('SessionError not raised')
+        self.assertEqual(server.requests, 1)
+
+
+class SyncTests(unittest.TestCase):
+    # Both sides local, it's the same code that runs against a share
+    def setUp(self):
+        self.source = tempfile.mkdtemp()
+        self.destination = tempfile.mkdtemp()
+
+    def tearDown(self):
+        shutil.rmtree(self.source)
+        shutil.rmtree(self.destination)
+
+    def create(self, root, relPath, data=b'data'):
+        path = os.path.join(root, *relPath.split('/'))
+        if os.path.isdir(os.path.dirname(path)) is False:
+            os.makedirs(os.path.dirname(path))
+        with open(path, 'wb') as f:
+            f.write(data)
+
+    def sync(self, **kwargs):
+        options = {'include': None, 'exclude': None, 'maxDepth': None, 'checksum': False, 'delete': True,
+                   'progress': None}
+        options.update(kwargs)
+        return _sync(_LocalTree(self.source), _LocalTree(self.destination), **options)
+
+    def exists(self, relPath):
+        return os.path.lexists(os.path.join(self.destination, *relPath.split('/')))
+
+    def test_delete(self):
+        self.create(self.source, 'a.txt')
+        self.create(self.destination, 'old/b.txt')
+        stats = self.sync()
+        self.assertEqual(stats['copied'], 1)
+        self.assertEqual(stats['deleted'], 2)
+        self.assertTrue(self.exists('a.txt'))
+        self.assertFalse(self.exists('old'))
+
+    def test_delete_keeps_filtered(self):
+        self.create(self.destination, 'logs/a.log')
+        self.create(self.destination, 'logs/b.txt')
+        stats = self.sync(exclude=['*.log'])
+        self.assertEqual(stats['deleted'], 1)
+        self.assertTrue(self.exists('logs/a.log'))
+        self.assertFalse(self.exists('logs/b.txt'))
+
+        self.sync(include=['*.txt'])
+        self.assertTrue(self.exists('logs/a.log'))
+
+    def test_delete_keeps_too_deep(self):
+        self.create(self.destination, 'a/b/c.txt')
+        self.sync(maxDepth=1)
+        self.assertTrue(self.exists('a/b/c.txt'))
+        self.sync(maxDepth=0)
+        self.assertTrue(self.exists('a/b/c.txt'))
+
+    def test_directory_times(self):
+        self.create(self.source, 'a/b/c.txt')
+        self.create(self.destination, 'a/old.txt')
+        for relPath, mtime in (('a/b/c.txt', 1000000000), ('a/b', 1100000000), ('a', 1200000000)):
+            os.utime(os.path.join(self.source, *relPath.split('/')), (mtime, mtime))
+        self.sync()
+        # Set after c.txt was copied into b and old.txt deleted from a
+        for relPath, mtime in (('a/b/c.txt', 1000000000), ('a/b', 1100000000), ('a', 1200000000)):
+            self.assertEqual(os.stat(os.path.join(self.destination, *relPath.split('/'))).st_mtime, mtime)
+        self.assertFalse(self.exists('a/old.txt'))
+
+    def test_file_replaces_directory(self):
+        self.create(self.source, 'name', b'file')
+        self.create(self.destination, 'name/inside.txt')
+        self.sync(delete=False)
+        with open(os.path.join(self.destination, 'name'), 'rb') as f:
+            self.assertEqual(f.read(), b'file')
+
+    def test_directory_replaces_file(self):
+        self.create(self.source, 'name/inside.txt')
+        self.create(self.destination, 'name')
+        self.sync(delete=False)
+        self.assertTrue(self.exists('name/inside.txt'))
+
+    def test_case(self):
+        self.create(self.source, 'dir/file.txt', b'newer')
+        self.create(self.destination, 'DIR/File.txt', b'old')
+        self.create(self.destination, 'DIR/FILE.txt', b'old')
+        self.sync()
+        self.assertEqual(sorted(os.listdir(self.destination)), ['DIR'])
+        # One of them stands for file.txt, the other one goes
+        names = os.listdir(os.path.join(self.destination, 'DIR'))
+        self.assertEqual(len(names), 1)
+        with open(os.path.join(self.destination, 'DIR', names[0]), 'rb') as f:
+            self.assertEqual(f.read(), b'newer')
+
+    def test_case_collision(self):
+        self.create(self.source, 'a.txt', b'lower')
+        self.create(self.source, 'A.txt', b'upper')
+        stats = self.sync()
+        self.assertEqual(stats['copied'], 1)
+
+    @unittest.skipIf(hasattr(os, 'symlink') is False, 'no symlinks')
+    def test_links_not_followed(self):
+        outside = tempfile.mkdtemp()
+        try:
+            self.create(outside, 'secret.txt')
+            os.symlink(outside, os.path.join(self.source, 'link'))
+            os.symlink(os.path.join(outside, 'secret.txt'), os.path.join(self.source, 'file'))
+            stats = self.sync()
+            self.assertEqual(stats['copied'], 0)
+            self.assertEqual(os.listdir(self.destination), [])
+        finally:
+            shutil.rmtree(outside)
+
+
+class FakeReauthSMB3(smb3.SMB3):
+    # Only the sending end of an SMB3, sendSMB records what goes out
+    def __init__(self, reader=None):
+        self._SMB3__threadState = threading.local()
+        self._SMB3__lock = threading.RLock()
+        self._SMB3__reader = reader
+        self._SMB3__reauthPending = False
+        self.sent = []
+
+    def _SMB3__sendSMB(self, packet):
+        self.sent.append(packet['Command'])
+        return len(self.sent)
+
+    def reauthenticate(self):
+        self.sent.append('reauthenticate')
+
+
+class ReauthenticationTests(unittest.TestCase):
+    def packet(self, command):
+        packet = SMB2Packet()
+        packet['Command'] = command
+        return packet
+
+    def test_before_next_request(self):
+        # No reader, the thread that sends does it
+        server = FakeReauthSMB3()
+        server.scheduleReauthentication()
+        self.assertEqual(server.sent, [])
+        server.sendSMB(self.packet(SMB2_READ))
+        server.sendSMB(self.packet(SMB2_READ))
+        self.assertEqual(server.sent, ['reauthenticate', SMB2_READ, SMB2_READ])
+
+    def test_with_reader(self):
+        server = FakeReauthSMB3(reader=threading.current_thread())
+        server.scheduleReauthentication()
+        self.assertEqual(server.sent, ['reauthenticate'])
+
+
+class FakePoolConnection:
+    # What SMBConnectionPool and PooledSMBConnection need from an SMBConnection
+    def __init__(self, remoteName):
+        self.remoteName = remoteName
+        self.logins = []
+        self.trees = []
+        self.open = set()
+        self.closed = False
+        self.alive = True
+        self.failClose = False
+        self.nextFileId = 1
+
+    def login(self, user, password, domain='', lmhash='', nthash=''):
+        self.logins.append(('login', user, domain))
+
+    def kerberosLogin(self, user, password, domain='', lmhash='', nthash='', aesKey='', kdcHost=None, TGT=None,
+                      TGS=None):
+        self.logins.append(('kerberos', user, domain, kdcHost, TGT, TGS))
+
+    def connectTree(self, share):
+        self.trees.append(share)
+        return len(self.trees)
+
+    def openFile(self, treeId, pathName, *args, **kwargs):
+        fileId = self.nextFileId
+        self.nextFileId += 1
+        self.open.add((treeId, fileId))
+        return fileId
+
+    createFile = openFile
+
+    def closeFile(self, treeId, fileId):
+        if self.failClose is True:
+            raise SessionError(nt_errors.STATUS_CONNECTION_DISCONNECTED)
+        self.open.remove((treeId, fileId))
+        return True
+
+    def echo(self):
+        return self.alive
+
+    def logoff(self):
+        return True
+
+    def close(self):
+        self.closed = True
+
+
+class FakePool(SMBConnectionPool):
+    def __init__(self, *args, **kwargs):
+        SMBConnectionPool.__init__(self, *args, **kwargs)
+        self.connections = []
+
+    def _connect(self, remoteName, remoteHost, sess_port, timeout, preferredDialect):
+        self.connections.append(FakePoolConnection(remoteName))
+        return self.connections[-1]
+
+
+class ConnectionPoolTests(unittest.TestCase):
+    def setUp(self):
+        self.pool = FakePool()
+
+    def tearDown(self):
+        self.pool.close()
+
+    def get(self, **kwargs):
+        args = {'remoteName': 'SERVER', 'remoteHost': '10.0.0.1', 'user': 'user', 'password': 'password',
+                'domain': 'DOMAIN'}
+        args.update(kwargs)
+        return self.pool.getConnection(**args)
+
+    def test_reused(self):
+        with self.get() as smbClient:
+            self.assertEqual(smbClient.connectTree('C$'), 1)
+        with self.get() as smbClient:
+            # Same connection, the tree is still connected
+            self.assertEqual(smbClient.connectTree('\\\\SERVER\\C$'), 1)
+        self.assertEqual(len(self.pool.connections), 1)
+        self.assertEqual(self.pool.connections[0].trees, ['C$'])
+        self.assertEqual(self.pool.getStats(), {('SERVER', '10.0.0.1', 'user', 'DOMAIN'): {'idle': 1, 'active': 0}})
+
+    def test_different_keys(self):
+        TGT = {'KDC_REP': b'tgt one', 'cipher': None, 'sessionKey': None}
+        otherTGT = {'KDC_REP': b'tgt two', 'cipher': None, 'sessionKey': None}
+        for kwargs in ({}, {'password': 'other'}, {'nthash': 'aa' * 16},
+                       {'useKerberos': True}, {'useKerberos': True, 'kdcHost': 'dc1'},
+                       {'useKerberos': True, 'kdcHost': 'dc2'}, {'useKerberos': True, 'TGT': TGT},
+                       {'useKerberos': True, 'TGT': otherTGT}):
+            self.get(**kwargs).close()
+        self.assertEqual(len(self.pool.connections), 8)
+        self.assertEqual(self.pool.connections[5].logins, [('kerberos', 'user', 'DOMAIN', 'dc2', None, None)])
+        self.assertEqual(self.pool.connections[7].logins, [('kerberos', 'user', 'DOMAIN', None, otherTGT, None)])
+        # Case doesn't make it a different connection
+        self.get(useKerberos=True, kdcHost='DC1').close()
+        self.assertEqual(len(self.pool.connections), 8)
+
+    def test_key_salted(self):
+        smbClient = self.get()
+        key = smbClient._key
+        smbClient.close()
+        digest = hashlib.sha256('\x00'.join(['password', '', '', '', '', '']).encode('utf-8')).hexdigest()
+        self.assertNotIn(digest, key)
+        self.assertNotIn('password', key)
+        # Another pool, another salt
+        self.assertNotEqual(FakePool()._key('SERVER', '10.0.0.1', 445, None, 'user', 'password', 'DOMAIN', '', '',
+                                            '', None, None, None, False), key)
+
+    def test_files_closed_on_release(self):
+        smbClient = self.get()
+        tid = smbClient.connectTree('C$')
+        smbClient.openFile(tid, 'left.txt')
+        closed = smbClient.createFile(tid, 'closed.txt')
+        smbClient.closeFile(tid, closed)
+        # Kept referenced, SMBFile closes itself when collected
+        smbFile = SMBShareFS(smbClient, 'C$').open('fs.txt')
+        connection = self.pool.connections[0]
+        self.assertEqual(len(connection.open), 2)
+        smbClient.close()
+        self.assertEqual(connection.open, set())
+        self.assertFalse(connection.closed)
+        self.assertEqual(self.pool.getStats()[('SERVER', '10.0.0.1', 'user', 'DOMAIN')]['idle'], 1)
+
+    def test_files_not_closed_discarded(self):
+        smbClient = self.get()
+        smbClient.openFile(smbClient.connectTree('C$'), 'left.txt')
+        connection = self.pool.connections[0]
+        connection.failClose = True
+        smbClient.close()
+        # Can't tell what's still open in there, nobody gets it again
+        self.assertTrue(connection.closed)
+        self.get().close()
+        self.assertEqual(len(self.pool.connections), 2)
+
+    def test_closed(self):
+        smbClient = self.get()
+        smbClient.close()
+        for method, args in ((smbClient.connectTree, ('C$',)), (smbClient.disconnectTree, (1,)),
+                             (smbClient.openFile, (1, 'file.txt')), (smbClient.closeFile, (1, 1)),
+                             (smbClient.getConnection, ()), (smbClient.openShareFS, ('C$',)),
+                             (smbClient.logoff, ()), (lambda: smbClient.echo(), ())):
+            try:
+                method(*args)
+            except SessionError as e:
+                self.assertEqual(e.getErrorCode(), nt_errors.STATUS_INVALID_HANDLE)
+            else:
+                self.fail('SessionError not raised')
+
+    def test_max_active(self):
+        self.pool = FakePool(maxActive=1)
+        smbClient = self.get()
+        try:
+            self.get(wait=0.1)
+        except SessionError as e:
+            self.assertEqual(e.getErrorCode(), nt_errors.STATUS_IO_TIMEOUT)
+        else:
+            self.fail('SessionError not raised')
+        # Another key doesn't wait
+        self.get(remoteName='OTHER').close()
+        smbClient.close()
+        self.get(wait=0.1).close()
+        self.assertEqual(len(self.pool.connections), 2)
+
+    def test_health_check(self):
+        self.get().close()
+        self.pool.connections[0].alive = False
+        self.get().close()
+        self.assertEqual(len(self.pool.connections), 2)
+        self.assertTrue(self.pool.connections[0].closed)
+
+    def test_idle_timeout(self):
+        self.pool = FakePool(idleTimeout=0)
+        self.get().close()
+        time.sleep(0.01)
+        self.get(remoteName='OTHER').close()
+        self.assertTrue(self.pool.connections[0].closed)
+        self.assertEqual(list(self.pool.getStats().keys()), [('OTHER', '10.0.0.1', 'user', 'DOMAIN')])
+
+    def test_logoff_not_reused(self):
+        with self.get() as smbClient:
+            smbClient.logoff()
+        self.assertTrue(self.pool.connections[0].closed)
+        self.assertEqual(self.pool.getStats(), {('SERVER', '10.0.0.1', 'user', 'DOMAIN'): {'idle': 0, 'active': 0}})
+
+    def test_error_not_reused(self):
+        try:
+            with self.get():
+                raise ValueError()
+        except ValueError:
+            pass
+        self.assertTrue(self.pool.connections[0].closed)
+
+    def test_close(self):
+        self.get().close()
+        smbClient = self.get(remoteName='OTHER')
+        self.pool.close()
+        self.assertTrue(self.pool.connections[0].closed)
+        self.assertFalse(self.pool.connections[1].closed)
+        smbClient.close()
+        self.assertTrue(self.pool.connections[1].closed)
+
+
+if __name__ == '__main__':
+    unittest.main(verbosity=1)
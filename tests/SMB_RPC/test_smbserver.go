@@ -0,0 +1,929 @@
+// SECUREAUTH LABS. Copyright 2018 SecureAuth Corporation. All rights reserved.
+//
+// This software is provided under under a slightly modified version
+// of the Apache Software License. See the accompanying LICENSE file
+// for more information.
+//
+// Description:
+//   SMB server tests that don't need a client, the handlers are called directly
+//
+import os
+import shutil
+import struct
+import tempfile
+import threading
+import time
+import unittest
+from binascii import hexlify
+from six.moves.urllib.request import urlopen
+from six.moves.urllib.error import HTTPError
+
+from six.moves import configparser
+
+from impacket import smbserver, ntlm, smb
+from impacket import smb3structs as smb2
+from impacket.dcerpc.v5 import srvs, wkst, lsad, samr, nrpc
+from impacket.dcerpc.v5.dtypes import NULL, RPC_UNICODE_STRING
+
+
+ func buildServer(**options interface{}){
+    config = configparser.ConfigParser()
+    config.add_section("global")
+    config.set('global', 'server_name', 'TEST')
+    config.set('global', 'server_os', 'UNIX')
+    config.set('global', 'server_domain', 'WORKGROUP')
+    config.set('global', 'log_file', 'nil')
+    config.set('global', 'credentials_file', '')
+    for name, value in options.items():
+        config.set('global', name, value)
+    config.add_section("IPC$")
+    config.set('IPC$', 'comment', '')
+    config.set('IPC$', 'read only', 'yes')
+    config.set('IPC$', 'share type', '3')
+    config.set('IPC$', 'path', '')
+    server = smbserver.SMBSERVER(('127.0.0.1', 0), config_parser=config)
+    server.processConfigFile()
+    return server
+
+
+ type FakeSocket: struct {
+     func (self TYPE) getpeername(){
+        return ('127.0.0.1', 1)
+
+     func (self TYPE) getsockname(){
+        return ('127.0.0.1', 1)
+
+
+ type SMBServerTestCase struct { // unittest.TestCase:
+     func (self TYPE) setUp(){
+        self.server = buildServer(admin_users='admin')
+        self.server.addConnection('conn', '127.0.0.1', 1, FakeSocket())
+        self.connData = self.server.getConnectionData('conn', checkStatus=false)
+
+     func (self TYPE) tearDown(){
+        self.server.server_close()
+
+
+ type AdministratorTests struct { // SMBServerTestCase:
+     func (self TYPE) test_unverified_admin_name(){
+        // What a basic security (or guest) logon says it is
+        self.connData["Authenticated"] = true
+        self.connData["UserName"] = "admin"
+        self.assertfalse(self.server.isAdministrator("conn"))
+
+     func (self TYPE) test_verified_admin(){
+        self.connData["Authenticated"] = true
+        self.connData["LogonVerified"] = true
+        self.connData["UserName"] = "Admin"
+        self.asserttrue(self.server.isAdministrator("conn"))
+        self.connData["UserName"] = "user"
+        self.assertfalse(self.server.isAdministrator("conn"))
+
+
+ type LogonTests struct { // SMBServerTestCase:
+     func (self TYPE) setUp(){
+        SMBServerTestCase.setUp(self)
+        self.server.addCredential('user', 0, '', hexlify(ntlm.compute_nthash("secret")).decode("ascii"))
+
+     func (self TYPE) sessionSetup(token interface{}){
+        sessionSetup = smb2.SMB2SessionSetup()
+        sessionSetup["SecurityMode"] = smb2.SMB2_NEGOTIATE_SIGNING_ENABLED
+        sessionSetup["SecurityBufferLength"] = len(token)
+        sessionSetup["Buffer"] = token
+        packet = smb2.SMB2Packet()
+        packet["Command"] = smb2.SMB2_SESSION_SETUP
+        packet["Data"] = sessionSetup
+        respCommands, respPackets, errorCode = smbserver.SMB2Commands.smb2SessionSetup('conn', self.server,
+                                                                                        smb2.SMB2Packet(packet.getData()))
+        return respCommands[0], errorCode
+
+     func (self TYPE) logon(user, password interface{}){
+        // Raw NTLMSSP, no SPNEGO around it
+        type1 = ntlm.getNTLMSSPType1('', '')
+        type1["flags"] &= ~ntlm.NTLMSSP_NEGOTIATE_KEY_EXCH
+        resp, errorCode = self.sessionSetup(type1.getData())
+        self.assertEqual(errorCode, smbserver.STATUS_MORE_PROCESSING_REQUIRED)
+        type3, exportedSessionKey = ntlm.getNTLMSSPType3(type1, resp["Buffer"], user, password, '')
+        return self.sessionSetup(type3.getData())[1]
+
+     func (self TYPE) test_wrong_password(){
+        self.assertEqual(self.logon('user', 'wrong'), smbserver.STATUS_LOGON_FAILURE)
+        self.assertfalse(self.connData["Authenticated"])
+        self.assertfalse(self.connData["LogonVerified"])
+        self.assertRaises(Exception, self.server.getConnectionData, 'conn')
+
+     func (self TYPE) test_unknown_user(){
+        self.assertEqual(self.logon('nobody', 'secret'), smbserver.STATUS_LOGON_FAILURE)
+        self.assertfalse(self.connData["Authenticated"])
+
+     func (self TYPE) test_failed_reauthentication(){
+        self.assertEqual(self.logon('user', 'secret'), smbserver.STATUS_SUCCESS)
+        self.asserttrue(self.connData["Authenticated"])
+        self.asserttrue(self.connData["LogonVerified"])
+        self.assertEqual(self.logon('user', 'wrong'), smbserver.STATUS_LOGON_FAILURE)
+        self.assertfalse(self.connData["Authenticated"])
+
+
+ type ClockSkewTests struct { // SMBServerTestCase:
+     func (self TYPE) setUp(){
+        self.server = buildServer(ntlm_max_clock_skew = "300")
+        self.server.addConnection('conn', '127.0.0.1', 1, FakeSocket())
+        self.connData = self.server.getConnectionData('conn', checkStatus=false)
+
+    @staticmethod
+     func getFileTime(t interface{}){
+        return struct.pack('<q', int(t * 10000000) + 116444736000000000)
+
+     func (self TYPE) check(blobTime, serverTime = nil interface{}){
+        avPairs = ntlm.AV_PAIRS()
+        if serverTime is not nil {
+            avPairs[ntlm.NTLMSSP_AV_TIME] = self.getFileTime(serverTime)
+        // NTProofStr + NTLMv2_CLIENT_CHALLENGE
+        blob = b'\x01\x01' + b'\x00' * 6 + self.getFileTime(blobTime) + b'C' * 8 + b'\x00' * 4 + avPairs.getData()
+        authenticateMessage = ntlm.NTLMAuthChallengeResponse('user', '', b'')
+        authenticateMessage["ntlm"] = b'P' * 16 + blob
+        return self.server._SMBSERVER__checkAuthenticateMessage(self.connData, authenticateMessage)
+
+     func (self TYPE) test_in_time(){
+        self.assertIsNotnil(self.check(time.time()))
+
+     func (self TYPE) test_client_clock_off(){
+        self.assertIsnil(self.check(time.time() - 3600))
+        // Our own timestamp echoed back doesn't make up for it
+        self.assertIsnil(self.check(time.time() - 3600, time.time()))
+
+     func (self TYPE) test_echoed_timestamp_ignored(){
+        self.assertIsNotnil(self.check(time.time(), time.time() - 3600))
+
+
+ type FakeNetlogonDC: struct {
+    // Checks our authenticators and answers like [MS-NRPC] 3.1.4.5 says, errorCode makes every logon fail
+     func (self TYPE) __init__(credential, sessionKey, errorCode = 0, response = nil interface{}){
+        self.credential = credential
+        self.sessionKey = sessionKey
+        self.errorCode = errorCode
+        self.response = response
+
+     func (self TYPE) request(request interface{}){
+        value = struct.unpack('<Q', self.credential)[0] + request["Authenticator"]["Timestamp"]
+        self.credential = struct.pack('<Q', value & 0xffffffffffffffff)
+        if request["Authenticator"]["Credential"] != nrpc.ComputeNetlogonCredential(self.credential, self.sessionKey) {
+            raise nrpc.DCERPCSessionError(error_code = smbserver.STATUS_ACCESS_DENIED)
+        value = struct.unpack('<Q', self.credential)[0] + 1
+        self.credential = struct.pack('<Q', value & 0xffffffffffffffff)
+        resp = {'ReturnAuthenticator': {'Credential': nrpc.ComputeNetlogonCredential(self.credential,
+                                                                                      self.sessionKey)}}
+        if self.errorCode != 0 {
+            raise nrpc.DCERPCSessionError(error_code = self.errorCode, packet = resp)
+        if self.response is not nil {
+            self.response["ReturnAuthenticator"]["Credential"] = resp["ReturnAuthenticator"]["Credential"]
+            return self.response
+        return resp
+
+
+ func samLogonResponse(userSessionKey interface{}){
+    // What a DC answers to NetrLogonSamLogonWithFlags, as it comes off the wire
+    resp = nrpc.NetrLogonSamLogonWithFlagsResponse()
+    resp["ReturnAuthenticator"]["Credential"] = b'\x00' * 8
+    resp["ReturnAuthenticator"]["Timestamp"] = 0
+    resp["ValidationInformation"]["tag"] = nrpc.NETLOGON_VALIDATION_INFO_CLASS.NetlogonValidationSamInfo4
+    validation = resp["ValidationInformation"]["ValidationSam4"]
+    for name, kind in nrpc.NETLOGON_VALIDATION_SAM_INFO4.structure:
+        if kind is RPC_UNICODE_STRING {
+            validation[name] = ""
+    validation["UserSessionKey"] = userSessionKey
+    validation["LMKey"] = b'\x00' * 8
+    validation["LogonDomainId"].fromCanonical("S-1-5-21-1-2-3")
+    validation["PrimaryGroupId"] = 513
+    group = nrpc.GROUP_MEMBERSHIP()
+    group["RelativeId"] = 512
+    group["Attributes"] = 7
+    validation["GroupIds"].append(group)
+    validation["GroupCount"] = 1
+    validation["ExtraSids"] = NULL
+    resp["ExtraFlags"] = 0
+    resp["ErrorCode"] = 0
+    return nrpc.NetrLogonSamLogonWithFlagsResponse(resp.getData())
+
+
+ type NetlogonAuthenticatorTests struct { // unittest.TestCase:
+     func (self TYPE) setUp(){
+        self.authenticator = smbserver.NetlogonAuthenticator('dc', 'DOMAIN', 'SERVER$', '00' * 16)
+        self.authenticateMessage = ntlm.NTLMAuthChallengeResponse('user', 'secret', b'C' * 8)
+        self.authenticateMessage["domain_name"] = "DOMAIN".encode("utf-16le")
+        self.authenticateMessage["host_name"] = "CLIENT".encode("utf-16le")
+
+     func (self TYPE) setChannel(credential, dc interface{}){
+        self.authenticator._NetlogonAuthenticator__dce = dc
+        self.authenticator._NetlogonAuthenticator__sessionKey = b'K' * 16
+        self.authenticator._NetlogonAuthenticator__clientCredential = credential
+
+     func (self TYPE) samLogon(){
+        return self.authenticator._NetlogonAuthenticator__samLogon(b'S' * 8, self.authenticateMessage)
+
+     func (self TYPE) test_credential_chain(){
+        dc = FakeNetlogonDC(b'\x01' * 8, b'K' * 16)
+        self.setChannel(b'\x01' * 8, dc)
+        // Both sides must stay in step, call after call
+        self.samLogon()
+        self.samLogon()
+        self.assertEqual(self.authenticator._NetlogonAuthenticator__clientCredential, dc.credential)
+
+     func (self TYPE) test_credential_wraps(){
+        dc = FakeNetlogonDC(b'\xff' * 8, b'K' * 16)
+        self.setChannel(b'\xff' * 8, dc)
+        self.samLogon()
+        self.assertEqual(self.authenticator._NetlogonAuthenticator__clientCredential, dc.credential)
+
+     func (self TYPE) test_bad_return_authenticator(){
+        // Somebody who doesn't know the session key
+        self.setChannel(b'\x01' * 8, FakeNetlogonDC(b'\x01' * 8, b'X' * 16))
+        self.assertRaises(Exception, self.samLogon)
+
+     func (self TYPE) test_failed_logon_keeps_step(){
+        dc = FakeNetlogonDC(b'\x01' * 8, b'K' * 16, smbserver.STATUS_WRONG_PASSWORD)
+        self.setChannel(b'\x01' * 8, dc)
+        errorCode, sessionKey, groups = self.authenticator.authenticate(b'S' * 8, self.authenticateMessage, nil, nil)
+        self.assertEqual(errorCode, smbserver.STATUS_LOGON_FAILURE)
+        self.assertEqual(self.authenticator._NetlogonAuthenticator__clientCredential, dc.credential)
+        self.asserttrue(self.authenticator.hasUser("USER"))
+
+     func (self TYPE) successfulLogon(flags interface{}){
+        challengeMessage = ntlm.NTLMAuthChallenge()
+        challengeMessage["flags"] = flags
+        self.setChannel(b'\x01' * 8, FakeNetlogonDC(b'\x01' * 8, b'K' * 16,
+                                                   response = samLogonResponse(b'\x11' * 16)))
+        return self.authenticator.authenticate(b'S' * 8, self.authenticateMessage, challengeMessage, nil)
+
+     func (self TYPE) test_successful_logon(){
+        errorCode, sessionKey, groups = self.successfulLogon(0)
+        self.assertEqual(errorCode, smbserver.STATUS_SUCCESS)
+        self.assertEqual(sessionKey, b'\x11' * 16)
+        self.assertEqual(groups, ['S-1-5-21-1-2-3-513', 'S-1-5-21-1-2-3-512'])
+        self.asserttrue(self.authenticator.hasUser("user"))
+
+     func (self TYPE) test_successful_logon_key_exchange(){
+        // The client picked the key, encrypted with the session base key
+        exportedSessionKey = b'E' * 16
+        self.authenticateMessage["session_key"] = ntlm.generateEncryptedSessionKey(b'\x11' * 16, exportedSessionKey)
+        errorCode, sessionKey, groups = self.successfulLogon(ntlm.NTLMSSP_NEGOTIATE_KEY_EXCH)
+        self.assertEqual(errorCode, smbserver.STATUS_SUCCESS)
+        self.assertEqual(sessionKey, exportedSessionKey)
+
+     func (self TYPE) test_has_user(){
+        self.assertfalse(self.authenticator.hasUser("user"))
+        self.setChannel(b'\x01' * 8, FakeNetlogonDC(b'\x01' * 8, b'K' * 16, smbserver.STATUS_NO_SUCH_USER))
+        self.authenticator.authenticate(b'S' * 8, self.authenticateMessage, nil, nil)
+        self.assertfalse(self.authenticator.hasUser("user"))
+
+
+ type SQLiteAuthenticatorTests struct { // unittest.TestCase:
+     func (self TYPE) setUp(){
+        import sqlite3
+        fd, self.fileName = tempfile.mkstemp()
+        os.close(fd)
+        db = sqlite3.connect(self.fileName)
+        db.execute("CREATE TABLE smb_users (name TEXT, nthash TEXT, groups TEXT)")
+        db.execute('INSERT INTO smb_users VALUES (?, ?, ?)',
+                   ('User', hexlify(ntlm.compute_nthash("secret")).decode("ascii"), 'staff, admins'))
+        db.commit()
+        db.close()
+
+     func (self TYPE) tearDown(){
+        os.unlink(self.fileName)
+
+     func (self TYPE) test_users(){
+        authenticator = smbserver.SQLiteAuthenticator(self.fileName, 'smb_users')
+        self.asserttrue(authenticator.hasUser("user"))
+        self.assertfalse(authenticator.hasUser("other"))
+
+     func (self TYPE) test_table_name(){
+        self.assertRaises(Exception, smbserver.SQLiteAuthenticator, self.fileName, 'users; DROP TABLE smb_users')
+        self.assertRaises(Exception, smbserver.SQLiteAuthenticator, self.fileName, '1users')
+        self.assertRaises(Exception, smbserver.SQLiteAuthenticator, self.fileName, '')
+
+
+ type RenameTests struct { // SMBServerTestCase:
+     func (self TYPE) setUp(){
+        SMBServerTestCase.setUp(self)
+        self.connData["Authenticated"] = true
+        self.root = tempfile.mkdtemp()
+        self.share = os.path.join(self.root, 'share')
+        os.mkdir(self.share)
+        self.fileName = os.path.join(self.share, 'file')
+        open(self.fileName, 'w').close()
+        self.connData["ConnectedShares"][1] = {'path': self.share, 'shareName': 'SHARE'}
+        self.connData["OpenedFiles"][b'F' * 16] = {'FileName': self.fileName}
+
+     func (self TYPE) tearDown(){
+        shutil.rmtree(self.root)
+        SMBServerTestCase.tearDown(self)
+
+     func (self TYPE) rename(newName interface{}){
+        renameInfo = smb2.FILE_RENAME_INFORMATION_TYPE_2()
+        renameInfo["FileName"] = newName.encode("utf-16le")
+        renameInfo["FileNameLength"] = len(renameInfo["FileName"])
+        setInfo = smb2.SMB2SetInfo()
+        setInfo["InfoType"] = smb2.SMB2_0_INFO_FILE
+        setInfo["FileInfoClass"] = smb2.SMB2_FILE_RENAME_INFO
+        setInfo["BufferLength"] = len(renameInfo)
+        setInfo["Buffer"] = renameInfo.getData()
+        setInfo["FileID"] = b'F' * 16
+        packet = smb2.SMB2Packet()
+        packet["Command"] = smb2.SMB2_SET_INFO
+        packet["TreeID"] = 1
+        packet["Data"] = setInfo
+        return smbserver.SMB2Commands.smb2SetInfo('conn', self.server, smb2.SMB2Packet(packet.getData()))[2]
+
+     func (self TYPE) test_rename(){
+        self.assertEqual(self.rename("other"), smbserver.STATUS_SUCCESS)
+        self.asserttrue(os.path.exists(os.path.join(self.share, 'other')))
+
+     func (self TYPE) test_rename_out_of_share(){
+        self.assertEqual(self.rename("..\\..\\escaped"), smbserver.STATUS_OBJECT_PATH_SYNTAX_BAD)
+        self.asserttrue(os.path.exists(self.fileName))
+        self.assertfalse(os.path.exists(os.path.join(self.root, 'escaped')))
+
+     func (self TYPE) test_file_jail(){
+        self.asserttrue(smbserver.isInFileJail(self.share, os.path.join(self.share, 'a/../b')))
+        self.assertfalse(smbserver.isInFileJail(self.share, os.path.join(self.share, '../share2')))
+        os.symlink(self.root, os.path.join(self.share, 'link'))
+        self.assertfalse(smbserver.isInFileJail(self.share, os.path.join(self.share, 'link/escaped')))
+
+
+ type ResolvePathTests struct { // unittest.TestCase:
+     func (self TYPE) setUp(){
+        self.path = tempfile.mkdtemp()
+        os.mkdir(os.path.join(self.path, 'Dir'))
+        open(os.path.join(self.path, 'Dir', 'File'), 'w').close()
+
+     func (self TYPE) tearDown(){
+        shutil.rmtree(self.path)
+
+     func (self TYPE) test_case_insensitive(){
+        self.assertEqual(smbserver.resolvePath(self.path, 'dir/file'), os.path.join(self.path, 'Dir', 'File'))
+        // New names keep their case
+        self.assertEqual(smbserver.resolvePath(self.path, 'dir/new'), os.path.join(self.path, 'Dir', 'new'))
+        self.assertEqual(smbserver.resolvePath(self.path, 'dir/file', resolveLeaf = false),
+                         os.path.join(self.path, 'Dir', 'file'))
+
+     func (self TYPE) test_absolute_name(){
+        // What the handlers do with names they already resolved
+        pathName = os.path.join(self.path, 'dir', 'file')
+        self.assertEqual(smbserver.resolvePath('', pathName), os.path.join(self.path, 'Dir', 'File'))
+        self.assertEqual(smbserver.queryPathInformation('', os.path.join(self.path, 'Dir', 'File'),
+                                                        smb.SMB_QUERY_FILE_ALL_INFO)[1], smbserver.STATUS_SUCCESS)
+
+
+ type ShortNameTests struct { // unittest.TestCase:
+     func (self TYPE) test_short_names(){
+        self.assertEqual(smbserver.getShortName("FILE.TXT"), '')
+        shortName = smbserver.getShortName("Long file name.text")
+        self.asserttrue(smbserver.isShortName(shortName))
+        self.asserttrue(shortName.endswith(".TEX"))
+        // Stable for as long as the name is
+        self.assertEqual(smbserver.getShortName("Long file name.text"), shortName)
+
+     func (self TYPE) test_extension_counts(){
+        self.assertNotEqual(smbserver.getShortName("report.docx"), smbserver.getShortName("report.docm"))
+
+
+ type FindTests struct { // unittest.TestCase:
+     func (self TYPE) setUp(){
+        self.path = tempfile.mkdtemp()
+
+     func (self TYPE) tearDown(){
+        shutil.rmtree(self.path)
+
+     func (self TYPE) findStandard(fileName interface{}){
+        searchResult, searchCount, errorCode = smbserver.findFirst2(self.path, fileName, smb.SMB_FIND_INFO_STANDARD,
+                                                                    smb.ATTR_DIRECTORY)
+        self.assertEqual(errorCode, smbserver.STATUS_SUCCESS)
+        self.assertEqual(searchCount, 1)
+        return smb.SMBFindInfoStandard(flags = smb.SMB.FLAGS2_UNICODE, data = searchResult[0].getData())
+
+     func (self TYPE) test_info_standard_size(){
+        with open(os.path.join(self.path, 'small'), 'wb') as f:
+            f.write(b'A' * 100)
+        item = self.findStandard("small")
+        self.assertEqual(item["FileDataSize"], 100)
+        self.assertEqual(item["FileName"], 'small'.encode("utf-16le"))
+
+     func (self TYPE) test_info_standard_large_file(){
+        with open(os.path.join(self.path, 'large'), 'wb') as f:
+            f.truncate(5 * 1024 * 1024 * 1024)
+        item = self.findStandard("large")
+        self.assertEqual(item["FileDataSize"], 0xffffffff)
+        self.assertEqual(item["AllocationSize"], 0xffffffff)
+
+
+ type EaTests struct { // SMBServerTestCase:
+     func (self TYPE) setUp(){
+        SMBServerTestCase.setUp(self)
+        self.connData["Authenticated"] = true
+        self.share = tempfile.mkdtemp()
+        self.connData["ConnectedShares"][1] = {'path': self.share, 'shareName': 'SHARE'}
+
+     func (self TYPE) tearDown(){
+        shutil.rmtree(self.share)
+        SMBServerTestCase.tearDown(self)
+
+     func (self TYPE) create(fileName, eas, createOptions = smb2.FILE_NON_DIRECTORY_FILE interface{}){
+        eaBuffer = smbserver.packEaList(eas)
+        context = smb2.SMB2CreateContext()
+        context["NameOffset"] = 16
+        context["NameLength"] = 4
+        context["DataOffset"] = 24
+        context["DataLength"] = len(eaBuffer)
+        context["Buffer"] = struct.pack('>L', smb2.SMB2_CREATE_EA_BUFFER) + b'\x00' * 4 + eaBuffer
+        create = smb2.SMB2Create()
+        create["DesiredAccess"] = smb2.FILE_READ_DATA | smb2.FILE_WRITE_DATA
+        create["CreateDisposition"] = smb2.FILE_CREATE
+        create["CreateOptions"] = createOptions
+        create["NameLength"] = len(fileName.encode("utf-16le"))
+        create["Buffer"] = fileName.encode("utf-16le") + context.getData()
+        create["CreateContextsOffset"] = 64 + smb2.SMB2Create.SIZE + create["NameLength"]
+        create["CreateContextsLength"] = len(context)
+        packet = smb2.SMB2Packet()
+        packet["Command"] = smb2.SMB2_CREATE
+        packet["TreeID"] = 1
+        packet["Data"] = create
+        return smbserver.SMB2Commands.smb2Create('conn', self.server, smb2.SMB2Packet(packet.getData()))[2]
+
+     func (self TYPE) test_create_with_eas(){
+        self.assertEqual(self.create('file', [('NAME', b'value')]), smbserver.STATUS_SUCCESS)
+        self.assertEqual(smbserver.listEas(os.path.join(self.share, 'file')), [('NAME', b'value')])
+
+     func (self TYPE) test_create_with_bad_eas(){
+        self.assertEqual(self.create('file', [('BAD*NAME', b'value')]), smbserver.STATUS_INVALID_EA_NAME)
+        self.assertfalse(os.path.exists(os.path.join(self.share, 'file')))
+        self.assertEqual(self.create('dir', [('BAD*NAME', b'value')], smb2.FILE_DIRECTORY_FILE),
+                         smbserver.STATUS_INVALID_EA_NAME)
+        self.assertfalse(os.path.exists(os.path.join(self.share, 'dir')))
+
+     func (self TYPE) test_query_partial(){
+        fileName = os.path.join(self.share, 'file')
+        open(fileName, 'w').close()
+        eas = [('A', b'1' * 20), ('B', b'2' * 20), ('C', b'3' * 20)]
+        smbserver.setEas(fileName, [(name, value, 0) for name, value in eas])
+        oneEntry = len(smbserver.packEaList(eas[:1]))
+        // Room for the first one only
+        data, errorCode, index = smbserver.queryEas(fileName, [], 0, oneEntry + 4, 0)
+        self.assertEqual(errorCode, smbserver.STATUS_BUFFER_OVERFLOW)
+        self.assertEqual([(name, value) for name, value, flags in smbserver.unpackEaList(data)], eas[:1])
+        data, errorCode, index = smbserver.queryEas(fileName, [], 0, 65536, index)
+        self.assertEqual(errorCode, smbserver.STATUS_SUCCESS)
+        self.assertEqual([(name, value) for name, value, flags in smbserver.unpackEaList(data)], eas[1:])
+        // No room for anything
+        self.assertEqual(smbserver.queryEas(fileName, [], smb2.SL_RESTART_SCAN, 8, index)[1],
+                         smbserver.STATUS_BUFFER_TOO_SMALL)
+
+
+ type AuditTests struct { // SMBServerTestCase:
+     func (self TYPE) setUp(){
+        SMBServerTestCase.setUp(self)
+        self.connData["Authenticated"] = true
+        self.events = []
+        self.server.setAuditCallback(self.events.append)
+
+     func (self TYPE) test_smb1_set_security(){
+        self.connData["OpenedFiles"][1] = {'FileName': '/tmp/file'}
+        parameters = struct.pack('<HHL', 1, 0, 4)
+        setup, parameters, data, errorCode = smbserver.NTTRANSCommands.setSecurityDescriptor('conn', self.server,
+                                                                                              nil, parameters, b'')
+        self.assertEqual(errorCode, smbserver.STATUS_NOT_SUPPORTED)
+        self.assertEqual(len(self.events), 1)
+        self.assertEqual(self.events[0]["event"], 'set_security')
+        self.assertEqual(self.events[0]["status"], smbserver.STATUS_NOT_SUPPORTED)
+
+     func (self TYPE) test_smb1_set_security_bad_fid(){
+        parameters = struct.pack('<HHL', 1, 0, 4)
+        errorCode = smbserver.NTTRANSCommands.setSecurityDescriptor('conn', self.server, nil, parameters, b'')[3]
+        self.assertEqual(errorCode, smbserver.STATUS_INVALID_HANDLE)
+
+
+ type FakeClock: struct {
+    // Stands in for the time module in smbserver, sleeping just moves the clock
+     func (self TYPE) __init__(){
+        self.now = 1000000.0
+        self.sleeps = []
+
+     func (self TYPE) time(){
+        return self.now
+
+     func (self TYPE) sleep(seconds interface{}){
+        self.sleeps.append(round(seconds, 6))
+        self.now += seconds
+
+     func (self TYPE) __getattr__(name interface{}){
+        return getattr(time, name)
+
+
+ type LockoutTests struct { // SMBServerTestCase:
+     func (self TYPE) setUp(){
+        self.clock = FakeClock()
+        smbserver.time = self.clock
+        self.server = buildServer(lockout_threshold='3', lockout_window='60', lockout_duration='120',
+                                  connection_rate_limit='2', bandwidth_limit='1000')
+        self.server.addConnection('conn', '127.0.0.1', 1, FakeSocket())
+
+     func (self TYPE) tearDown(){
+        smbserver.time = time
+        SMBServerTestCase.tearDown(self)
+
+     func (self TYPE) failLogon(clientIP, userName, times=1 interface{}){
+        for i in range(times):
+            self.server.registerLogon(clientIP, userName, smbserver.STATUS_LOGON_FAILURE)
+
+     func (self TYPE) test_account_lockout(){
+        self.failLogon('10.0.0.1', 'user', 2)
+        self.assertEqual(self.server.checkLockout('10.0.0.2', 'user'), smbserver.STATUS_SUCCESS)
+        self.failLogon('10.0.0.2', 'USER')
+        self.assertEqual(self.server.checkLockout('10.0.0.3', 'user'), smbserver.STATUS_ACCOUNT_LOCKED_OUT)
+        self.clock.now += 121
+        self.assertEqual(self.server.checkLockout('10.0.0.3', 'user'), smbserver.STATUS_SUCCESS)
+
+     func (self TYPE) test_address_lockout(){
+        // A spray, one failure per account
+        self.failLogon('10.0.0.1', 'user1')
+        self.failLogon('10.0.0.1', 'user2')
+        self.failLogon('10.0.0.1', 'user3')
+        self.assertEqual(self.server.checkLockout('10.0.0.1', 'user4'), smbserver.STATUS_ACCESS_DENIED)
+        self.assertfalse(self.server.verify_request(nil, ('10.0.0.1', 1)))
+        self.asserttrue(self.server.verify_request(nil, ('10.0.0.2', 1)))
+
+     func (self TYPE) test_window(){
+        self.failLogon('10.0.0.1', 'user', 2)
+        self.clock.now += 61
+        self.failLogon('10.0.0.1', 'user')
+        self.assertEqual(self.server.checkLockout('10.0.0.1', 'user'), smbserver.STATUS_SUCCESS)
+
+     func (self TYPE) test_success_clears_account(){
+        self.failLogon('10.0.0.1', 'user', 2)
+        self.server.registerLogon('10.0.0.1', 'user', smbserver.STATUS_SUCCESS)
+        self.failLogon('10.0.0.2', 'user', 2)
+        self.assertEqual(self.server.checkLockout('10.0.0.2', 'user'), smbserver.STATUS_SUCCESS)
+
+     func (self TYPE) test_spray_pruned(){
+        // Keys that never show up again still go once they're out of the window
+        for i in range(100):
+            self.failLogon('10.0.%d.1' % i, 'user%d' % i)
+        self.failLogon('10.1.0.1', 'victim', 3)
+        self.assertEqual(len(self.server._SMBSERVER__logonFailures), 200)
+        self.clock.now += 61
+        self.server.registerLogon('10.2.0.1', 'other', smbserver.STATUS_SUCCESS)
+        self.assertEqual(len(self.server._SMBSERVER__logonFailures), 0)
+        self.assertEqual(len(self.server._SMBSERVER__lockouts), 2)
+        self.clock.now += 60
+        self.server.verify_request(nil, ('10.2.0.1', 1))
+        self.assertEqual(len(self.server._SMBSERVER__lockouts), 0)
+
+     func (self TYPE) test_connection_rate(){
+        self.asserttrue(self.server.verify_request(nil, ('10.0.0.1', 1)))
+        self.asserttrue(self.server.verify_request(nil, ('10.0.0.1', 2)))
+        self.assertfalse(self.server.verify_request(nil, ('10.0.0.1', 3)))
+        self.asserttrue(self.server.verify_request(nil, ('10.0.0.2', 1)))
+        self.clock.now += 60
+        self.asserttrue(self.server.verify_request(nil, ('10.0.0.1', 4)))
+        // The quiet address is gone
+        self.assertEqual(list(self.server._SMBSERVER__connectionAttempts.keys()), ["10.0.0.1"])
+
+     func (self TYPE) test_throttle(){
+        self.server.throttle('conn', 500)
+        self.server.throttle('conn', 500)
+        // Being idle doesn't build up credit for a burst
+        self.clock.now += 10
+        self.server.throttle('conn', 100)
+        self.server.throttle('unknown', 100)
+        self.assertEqual(self.clock.sleeps, [0.5, 0.5, 0.1])
+
+     func (self TYPE) test_disabled(){
+        self.server = buildServer()
+        self.server.addConnection('conn', '127.0.0.1', 1, FakeSocket())
+        self.failLogon('10.0.0.1', 'user', 10)
+        self.assertEqual(self.server.checkLockout('10.0.0.1', 'user'), smbserver.STATUS_SUCCESS)
+        for port in range(10):
+            self.asserttrue(self.server.verify_request(nil, ('10.0.0.1', port)))
+        self.server.throttle('conn', 100000)
+        self.assertEqual(self.clock.sleeps, [])
+
+
+ type MetricsTests struct { // SMBServerTestCase:
+     func (self TYPE) test_render(){
+        metrics = smbserver.SMBServerMetrics()
+        metrics.addRequest('SMB2_READ', smbserver.STATUS_SUCCESS, 0.02)
+        metrics.addRequest('SMB2_READ', smbserver.STATUS_SUCCESS, 3)
+        metrics.addRequest('SMB2_READ', 0xdeadbeef, 0.001)
+        metrics.addBytes('read', 'SHA"RE', 10)
+        metrics.addBytes('read', 'SHA"RE', 5)
+        metrics.addAuthFailure("bad_password")
+        lines = metrics.render({}).splitlines()
+        self.asserttrue('smb_active_connections 0' in lines)
+        self.asserttrue('smb_requests_total{command="SMB2_READ",status="STATUS_SUCCESS"} 2' in lines)
+        self.asserttrue('smb_requests_total{command="SMB2_READ",status="0xdeadbeef"} 1' in lines)
+        // Buckets count everything at or below them
+        self.asserttrue('smb_request_duration_seconds_bucket{command="SMB2_READ",le="0.005"} 1' in lines)
+        self.asserttrue('smb_request_duration_seconds_bucket{command="SMB2_READ",le="0.025"} 2' in lines)
+        self.asserttrue('smb_request_duration_seconds_bucket{command="SMB2_READ",le="5.0"} 3' in lines)
+        self.asserttrue('smb_request_duration_seconds_bucket{command="SMB2_READ",le="+Inf"} 3' in lines)
+        self.asserttrue('smb_request_duration_seconds_count{command="SMB2_READ"} 3' in lines)
+        self.asserttrue('smb_bytes_total{direction="read",share="SHA\\"RE"} 15' in lines)
+        self.asserttrue('smb_auth_failures_total{reason="bad_password"} 1' in lines)
+
+     func (self TYPE) test_gauges(){
+        self.connData["Authenticated"] = true
+        self.connData["OpenedFiles"][1] = {'FileHandle': 10}
+        self.connData["OpenedFiles"][2] = {'FileHandle': smbserver.PIPE_FILE_DESCRIPTOR}
+        self.server.addConnection('other', '127.0.0.1', 2, FakeSocket())
+        lines = self.server.getMetrics().render(self.server.getActiveConnections()).splitlines()
+        self.asserttrue('smb_active_connections 2' in lines)
+        self.asserttrue('smb_active_sessions 1' in lines)
+        self.asserttrue('smb_open_files 1' in lines)
+
+     func (self TYPE) test_requests_counted(){
+        // Not logged on, READ is refused
+        packet = smb2.SMB2Packet()
+        packet["Command"] = smb2.SMB2_READ
+        packet["Data"] = b'\x00' * 49
+        self.server.processRequest('conn', packet.getData())
+        self.asserttrue('smb_requests_total{command="SMB2_READ",status="STATUS_ACCESS_DENIED"} 1' in
+                        self.server.getMetrics().render({}).splitlines())
+
+     func (self TYPE) test_auth_failures(){
+        self.server.addCredential('user', 0, '', hexlify(ntlm.compute_nthash("secret")).decode("ascii"))
+        self.server.audit('conn', 'session_setup', status=smbserver.STATUS_LOGON_FAILURE, user='user')
+        self.server.audit('conn', 'session_setup', status=smbserver.STATUS_LOGON_FAILURE, user='nobody')
+        self.server.audit('conn', 'session_setup', status=smbserver.STATUS_SUCCESS, user='user')
+        lines = self.server.getMetrics().render({}).splitlines()
+        self.asserttrue('smb_auth_failures_total{reason="bad_password"} 1' in lines)
+        self.asserttrue('smb_auth_failures_total{reason="unknown_user"} 1' in lines)
+
+     func (self TYPE) test_http(){
+        port = self.server.startMetricsServer(port=0)
+        try:
+            response = urlopen('http://127.0.0.1:%d/metrics' % port)
+            self.asserttrue(response.headers["Content-Type"].startswith("text/plain; version=0.0.4"))
+            self.asserttrue(b'smb_active_connections 1\n' in response.read())
+            self.assertRaises(HTTPError, urlopen, 'http://127.0.0.1:%d/other' % port)
+        finally:
+            self.server.stopMetricsServer()
+
+
+ type ConnectionLockTests struct { // SMBServerTestCase:
+     func (self TYPE) closeInThread(){
+        self.connData["OpenedFiles"][1] = {'FileHandle': smbserver.VOID_FILE_DESCRIPTOR, 'FileName': 'file'}
+        thread = threading.Thread(target=self.server.closeOpenedFile, args=('conn', 1))
+        thread.start()
+        return thread
+
+     func (self TYPE) test_close_waits_for_request(){
+        // What srvsvc does while the connection's thread is in the middle of a request
+        with self.server.lockConnection("conn"):
+            thread = self.closeInThread()
+            thread.join(0.2)
+            self.asserttrue(thread.is_alive())
+            self.asserttrue(1 in self.connData["OpenedFiles"])
+        thread.join()
+        self.assertfalse(1 in self.connData["OpenedFiles"])
+
+     func (self TYPE) test_close_during_pipe_wait(){
+        // The request waiting on a named pipe is the one asking to close
+        with self.server.lockConnection("conn"):
+            with self.server.unlockConnection("conn"):
+                thread = self.closeInThread()
+                thread.join()
+            self.assertfalse(1 in self.connData["OpenedFiles"])
+        self.assertfalse(self.server.closeOpenedFile('conn', 1))
+
+     func (self TYPE) test_unlock_without_lock(){
+        // Handlers called directly, with nobody holding the lock
+        with self.server.unlockConnection("conn"):
+            pass
+        self.assertfalse(self.connData["Lock"].locked())
+
+
+ type FakeSMBServer: struct {
+     func (self TYPE) getPipeConnection(address interface{}){
+        return 'conn'
+
+     func (self TYPE) isAdministrator(connId interface{}){
+        return true
+
+     func (self TYPE) isAuthenticationRequired(){
+        return false
+
+     func (self TYPE) getActiveConnections(){
+        return {}
+
+
+ type SRVSTests struct { // unittest.TestCase:
+     func (self TYPE) setUp(){
+        self.srvs = smbserver.SRVSServer()
+        config = configparser.ConfigParser()
+        config.add_section("global")
+        config.set('global', 'log_file', 'nil')
+        config.add_section("IPC$")
+        config.set('IPC$', 'comment', '')
+        config.set('IPC$', 'share type', '3')
+        self.srvs.setServerConfig(config)
+        self.srvs.processConfigFile()
+        self.srvs.setSMBServer(FakeSMBServer())
+        self.srvs._clientSock = FakeSocket()
+
+     func (self TYPE) test_share_add_remark_with_percent(){
+        request = srvs.NetrShareAdd()
+        request["ServerName"] = NULL
+        request["Level"] = 2
+        request["InfoStruct"]["tag"] = 2
+        request["InfoStruct"]["ShareInfo2"]["shi2_netname"] = "NEW\x00"
+        request["InfoStruct"]["ShareInfo2"]["shi2_type"] = 0
+        request["InfoStruct"]["ShareInfo2"]["shi2_remark"] = "100% done\x00"
+        request["InfoStruct"]["ShareInfo2"]["shi2_path"] = ".\x00"
+        request["InfoStruct"]["ShareInfo2"]["shi2_passwd"] = NULL
+        request["ParmErr"] = NULL
+        answer = self.srvs.NetrShareAdd(request.getData())
+        self.assertEqual(answer["ErrorCode"], 0)
+        self.assertEqual(self.srvs._shares["NEW"]["comment"], '100% done')
+
+     func (self TYPE) test_session_enum_without_server(){
+        self.srvs.setSMBServer(nil)
+        request = srvs.NetrSessionEnum()
+        request["ServerName"] = NULL
+        request["ClientName"] = NULL
+        request["UserName"] = NULL
+        request["InfoStruct"]["Level"] = 10
+        request["InfoStruct"]["SessionInfo"]["tag"] = 10
+        request["InfoStruct"]["SessionInfo"]["Level10"]["Buffer"] = NULL
+        request["PreferedMaximumLength"] = 0xffffffff
+        request["ResumeHandle"] = NULL
+        answer = self.srvs.NetrSessionEnum(request.getData())
+        self.assertEqual(answer["ErrorCode"], 0)
+        self.assertEqual(answer["TotalEntries"], 0)
+
+
+ type FakeWKSTServer struct { // FakeSMBServer:
+     func (self TYPE) __init__(administrator interface{}){
+        self.administrator = administrator
+
+     func (self TYPE) isAdministrator(connId interface{}){
+        return self.administrator
+
+     func (self TYPE) getServerName(){
+        return 'SERVER'
+
+     func (self TYPE) getServerDomain(){
+        return 'WORKGROUP'
+
+     func (self TYPE) getActiveConnections(){
+        // An anonymous connection and two sessions of the same user
+        return {'1': {'UserName': ''}, '2': {'UserName': 'user'}, '3': {'UserName': 'user'},
+                '4': {'UserName': 'admin'}}
+
+
+ type WKSTTests struct { // unittest.TestCase:
+     func (self TYPE) setUp(){
+        self.wkst = smbserver.WKSTServer()
+        self.wkst.setSMBServer(FakeWKSTServer(true))
+        self.wkst._clientSock = FakeSocket()
+
+     func (self TYPE) getInfo(level interface{}){
+        request = wkst.NetrWkstaGetInfo()
+        request["ServerName"] = NULL
+        request["Level"] = level
+        answer = self.wkst.NetrWkstaGetInfo(request.getData())
+        // Has to go out on the wire
+        answer.getData()
+        return answer
+
+     func (self TYPE) userEnum(level interface{}){
+        request = wkst.NetrWkstaUserEnum()
+        request["ServerName"] = NULL
+        request["UserInfo"]["Level"] = level
+        request["UserInfo"]["WkstaUserInfo"]["tag"] = level
+        request["PreferredMaximumLength"] = 0xffffffff
+        request["ResumeHandle"] = NULL
+        answer = self.wkst.NetrWkstaUserEnum(request.getData())
+        answer.getData()
+        return answer
+
+     func (self TYPE) test_get_info(){
+        for level in (100, 101, 102):
+            answer = self.getInfo(level)
+            self.assertEqual(answer["ErrorCode"], 0)
+            wkstaInfo = answer["WkstaInfo"]['WkstaInfo%d' % level]
+            self.assertEqual(wkstaInfo['wki%d_computername' % level], 'SERVER\x00')
+            self.assertEqual(wkstaInfo['wki%d_langroup' % level], 'WORKGROUP\x00')
+        self.assertEqual(self.getInfo(102)["WkstaInfo"]["WkstaInfo102"]["wki102_logged_on_users"], 2)
+
+     func (self TYPE) test_get_info_502(){
+        answer = self.getInfo(502)
+        self.assertEqual(answer["ErrorCode"], 0)
+        self.assertEqual(answer["WkstaInfo"]["WkstaInfo502"]["wki502_sess_timeout"], 60)
+
+     func (self TYPE) test_get_info_invalid_level(){
+        self.assertEqual(self.getInfo(1234)["ErrorCode"], smbserver.ERROR_INVALID_LEVEL)
+
+     func (self TYPE) test_user_enum(){
+        answer = self.userEnum(0)
+        self.assertEqual(answer["ErrorCode"], 0)
+        self.assertEqual(answer["TotalEntries"], 2)
+        users = [userInfo["wkui0_username"] for userInfo in answer["UserInfo"]["WkstaUserInfo"]["Level0"]["Buffer"]]
+        self.assertEqual(sorted(users), ['admin\x00', 'user\x00'])
+        answer = self.userEnum(1)
+        userInfo = answer["UserInfo"]["WkstaUserInfo"]["Level1"]["Buffer"][0]
+        self.assertEqual(userInfo["wkui1_logon_domain"], 'WORKGROUP\x00')
+        self.assertEqual(userInfo["wkui1_logon_server"], 'SERVER\x00')
+
+     func (self TYPE) test_user_enum_not_admin(){
+        self.wkst.setSMBServer(FakeWKSTServer(false))
+        self.assertEqual(self.userEnum(0)["ErrorCode"], smbserver.ERROR_ACCESS_DENIED)
+
+     func (self TYPE) test_transport_enum(){
+        request = wkst.NetrWkstaTransportEnum()
+        request["ServerName"] = NULL
+        request["TransportInfo"]["Level"] = 0
+        request["TransportInfo"]["WkstaTransportInfo"]["tag"] = 0
+        request["PreferredMaximumLength"] = 0xffffffff
+        request["ResumeHandle"] = NULL
+        answer = self.wkst.NetrWkstaTransportEnum(request.getData())
+        answer.getData()
+        self.assertEqual(answer["ErrorCode"], 0)
+        self.assertEqual(answer["TotalEntries"], 1)
+        transportInfo = answer["TransportInfo"]["WkstaTransportInfo"]["Level0"]["Buffer"][0]
+        self.assertEqual(transportInfo["wkti0_number_of_vcs"], 4)
+
+
+ type AccountServerTests struct { // SMBServerTestCase:
+    // LSA and SAMR answer logged on users only, and their handles belong to the connection
+     func (self TYPE) setUp(){
+        SMBServerTestCase.setUp(self)
+        // The pipe socket is how the RPC servers find the connection behind a call
+        self.connData["OpenedFiles"][1] = {'Socket': FakeSocket()}
+        self.lsa = smbserver.LSARPCServer()
+        self.lsa.setSMBServer(self.server)
+        self.lsa._clientSock = FakeSocket()
+        self.samr = smbserver.SAMRServer()
+        self.samr.setSMBServer(self.server)
+        self.samr._clientSock = FakeSocket()
+
+     func (self TYPE) openPolicy(){
+        request = lsad.LsarOpenPolicy2()
+        request["SystemName"] = NULL
+        request["ObjectAttributes"]["RootDirectory"] = NULL
+        request["ObjectAttributes"]["ObjectName"] = NULL
+        request["ObjectAttributes"]["SecurityDescriptor"] = NULL
+        request["ObjectAttributes"]["SecurityQualityOfService"] = NULL
+        request["DesiredAccess"] = lsad.MAXIMUM_ALLOWED
+        return self.lsa.LsarOpenPolicy2(request.getData())
+
+     func (self TYPE) connect(){
+        request = samr.SamrConnect()
+        request["ServerName"] = NULL
+        request["DesiredAccess"] = samr.MAXIMUM_ALLOWED
+        return self.samr.SamrConnect(request.getData())
+
+     func (self TYPE) closeSam(handle interface{}){
+        request = samr.SamrCloseHandle()
+        request["SamHandle"] = handle
+        return self.samr.SamrCloseHandle(request.getData())
+
+     func (self TYPE) test_anonymous(){
+        self.connData["Authenticated"] = true
+        self.assertEqual(self.openPolicy()["ErrorCode"], smbserver.STATUS_ACCESS_DENIED)
+        self.assertEqual(self.connect()["ErrorCode"], smbserver.STATUS_ACCESS_DENIED)
+
+     func (self TYPE) test_logged_on(){
+        self.connData["Authenticated"] = true
+        self.connData["UserName"] = "user"
+        self.assertEqual(self.openPolicy()["ErrorCode"], smbserver.STATUS_SUCCESS)
+        answer = self.connect()
+        self.assertEqual(answer["ErrorCode"], smbserver.STATUS_SUCCESS)
+        self.assertEqual(self.closeSam(answer["ServerHandle"])["ErrorCode"], smbserver.STATUS_SUCCESS)
+
+     func (self TYPE) test_other_connection(){
+        self.connData["Authenticated"] = true
+        self.connData["UserName"] = "user"
+        handle = self.connect()["ServerHandle"]
+        // Same user, but the call now comes from another connection
+        self.server.addConnection('other', '127.0.0.1', 2, FakeSocket())
+        otherData = self.server.getConnectionData('other', checkStatus=false)
+        otherData["Authenticated"] = true
+        otherData["UserName"] = "user"
+        otherData["OpenedFiles"][1] = self.connData["OpenedFiles"].pop(1)
+        self.assertEqual(self.closeSam(handle)["ErrorCode"], smbserver.STATUS_INVALID_HANDLE)
+
+     func (self TYPE) test_released_on_close(){
+        self.connData["Authenticated"] = true
+        self.connData["UserName"] = "user"
+        handle = self.connect()["ServerHandle"]
+        self.server.removeConnection("conn")
+        self.server.addConnection('conn', '127.0.0.1', 1, FakeSocket())
+        connData = self.server.getConnectionData('conn', checkStatus=false)
+        connData["Authenticated"] = true
+        connData["UserName"] = "user"
+        connData["OpenedFiles"][1] = {'Socket': FakeSocket()}
+        self.assertEqual(self.closeSam(handle)["ErrorCode"], smbserver.STATUS_INVALID_HANDLE)
+
+
+if __name__ == '__main__' {
+    unittest.main(verbosity=1)
@@ -0,0 +1,73 @@
+# SECUREAUTH LABS. Copyright 2018 SecureAuth Corporation. All rights reserved.
+#
+# This software is provided under under a slightly modified version
+# of the Apache Software License. See the accompanying LICENSE file
+# for more information.
+#
+# Description:
+#   CCache tests, credentials replaced and kept apart by client
+#
+import unittest
+from struct import pack
+
+from impacket.krb5.ccache import CCache, Credential, Principal, Header
+
+
+def countedString(value):
+    return pack('!L', len(value)) + value
+
+def principalData(name):
+    names, realm = name.split(b'@')
+    components = names.split(b'/')
+    data = pack('!LL', 1, len(components)) + countedString(realm)
+    for component in components:
+        data += countedString(component)
+    return data
+
+def credential(client, server, ticket):
+    data = principalData(client) + principalData(server)
+    # KeyBlock, Times, is_skey, tktflags, num_address, num_authdata
+    data += pack('!HHH', 18, 0, 32) + b'\x00' * 32
+    data += pack('!LLLL', 0, 0, 0, 0) + pack('!BLLL', 0, 0, 0, 0)
+    data += countedString(ticket) + countedString(b'')
+    return Credential(data)
+
+def ccacheFor(principal):
+    ccache = CCache()
+    ccache.principal = Principal(principalData(principal))
+    return ccache
+
+
+class SetCredentialTests(unittest.TestCase):
+    def test_replace(self):
+        ccache = ccacheFor(b'user@CONTOSO.COM')
+        self.assertTrue(ccache.setCredential(credential(b'user@CONTOSO.COM', b'krbtgt/CONTOSO.COM@CONTOSO.COM',
+                                                        b'old')))
+        self.assertTrue(ccache.setCredential(credential(b'user@CONTOSO.COM', b'cifs/fs1@CONTOSO.COM', b'tgs')))
+        self.assertTrue(ccache.setCredential(credential(b'USER@contoso.com', b'KRBTGT/CONTOSO.COM@CONTOSO.COM',
+                                                        b'new')))
+        self.assertEqual([c.ticket['data'] for c in ccache.credentials], [b'new', b'tgs'])
+
+    def test_other_client(self):
+        # Somebody else's cache stays as it is
+        ccache = ccacheFor(b'user@CONTOSO.COM')
+        ccache.setCredential(credential(b'user@CONTOSO.COM', b'cifs/fs1@CONTOSO.COM', b'mine'))
+        self.assertFalse(ccache.setCredential(credential(b'admin@CONTOSO.COM', b'cifs/fs1@CONTOSO.COM', b'theirs')))
+        self.assertEqual([c.ticket['data'] for c in ccache.credentials], [b'mine'])
+
+    def test_round_trip(self):
+        ccache = ccacheFor(b'user@CONTOSO.COM')
+        # The same header fromTGT writes
+        header = Header()
+        header['tag'] = 1
+        header['taglen'] = 8
+        header['tagdata'] = b'\xff\xff\xff\xff\x00\x00\x00\x00'
+        ccache.headers = [header]
+        ccache.setCredential(credential(b'user@CONTOSO.COM', b'cifs/fs1@CONTOSO.COM', b'tgs'))
+        parsed = CCache(ccache.getData())
+        self.assertEqual(parsed.principal.prettyPrint(), b'user@CONTOSO.COM')
+        self.assertEqual(parsed.getCredential('cifs/fs1@CONTOSO.COM').ticket['data'], b'tgs')
+
+
+if __name__ == '__main__':
+    unittest.main(verbosity=1)
@@ -0,0 +1,75 @@
+// SECUREAUTH LABS. Copyright 2018 SecureAuth Corporation. All rights reserved.
+//
+// This software is provided under under a slightly modified version
+// of the Apache Software License. See the accompanying LICENSE file
+// for more information.
+//
+// Description:
+//   Keytab parsing and key lookup tests
+//
+import unittest
+from struct import pack
+
+from impacket.krb5 import constants
+from impacket.krb5.keytab import Keytab
+
+AES256 = constants.EncryptionTypes.aes256_cts_hmac_sha1_96.value
+RC4 = constants.EncryptionTypes.rc4_hmac.value
+
+
+ func countedString(value interface{}){
+    return pack('!H', len(value)) + value
+
+ func keytabEntry(components, realm, keytype, key, vno8, vno=nil interface{}){
+    entry = pack('!H', len(components)) + countedString(realm)
+    for component in components:
+        entry += countedString(component)
+    entry += pack('!L', constants.PrincipalNameType.NT_PRINCIPAL.value)
+    entry += pack('!LB', 1600000000, vno8) + pack('!H', keytype) + countedString(key)
+    if vno is not nil {
+        entry += pack('!L', vno)
+    return pack('!l', len(entry)) + entry
+
+
+ type KeytabTests struct { // unittest.TestCase:
+     func (self TYPE) setUp(){
+        self.data = b'\x05\x02'
+        self.data += keytabEntry([b'user'], b'CONTOSO.COM', RC4, b'\x11' * 16, 1)
+        self.data += keytabEntry([b'user'], b'CONTOSO.COM', AES256, b'\x22' * 32, 1, 1)
+        // A deleted entry
+        self.data += pack('!l', -12) + b'\x00' * 12
+        // kvno above 255, only the 32 bits one has it right
+        self.data += keytabEntry([b'user'], b'CONTOSO.COM', AES256, b'\x33' * 32, 0, 256)
+        self.data += keytabEntry([b'cifs', b'fs1.contoso.com'], b'CONTOSO.COM', AES256, b'\x44' * 32, 3)
+
+     func (self TYPE) test_parse(){
+        keytab = Keytab(self.data)
+        self.assertEqual(len(keytab.entries), 4)
+        self.assertEqual(keytab.entries[0].principal.prettyPrint(), b'user@CONTOSO.COM')
+        self.assertEqual(keytab.entries[3].principal.prettyPrint(), b'cifs/fs1.contoso.com@CONTOSO.COM')
+        self.assertEqual(keytab.entries[2].getVno(), 256)
+        self.assertEqual(keytab.entries[3].getVno(), 3)
+
+     func (self TYPE) test_round_trip(){
+        // The hole isn't kept
+        keytab = Keytab(self.data)
+        self.assertEqual(Keytab(keytab.getData()).getData(), keytab.getData())
+        self.assertEqual(len(Keytab(keytab.getData()).entries), 4)
+
+     func (self TYPE) test_get_key(){
+        keytab = Keytab(self.data)
+        // The best etype, the newest key
+        key = keytab.getKey("user@contoso.com")
+        self.assertEqual(key["keytype"], AES256)
+        self.assertEqual(key["keyvalue"]["data"], b'\x33' * 32)
+        self.assertEqual(keytab.getKey(b'USER@CONTOSO.COM', RC4)["keyvalue"]["data"], b'\x11' * 16)
+        self.assertEqual(keytab.getKey("cifs/fs1.contoso.com@CONTOSO.COM")["keyvalue"]["data"], b'\x44' * 32)
+        self.assertEqual(keytab.getKey("other@CONTOSO.COM"), nil)
+        self.assertEqual(keytab.getKey('cifs/fs1.contoso.com@CONTOSO.COM', RC4), nil)
+
+     func (self TYPE) test_unsupported_version(){
+        self.assertRaises(Exception, Keytab, b'\x05\x01')
+
+
+if __name__ == '__main__' {
+    unittest.main(verbosity=1)
@@ -0,0 +1,102 @@
+// SECUREAUTH LABS. Copyright 2018 SecureAuth Corporation. All rights reserved.
+//
+// This software is provided under under a slightly modified version
+// of the Apache Software License. See the accompanying LICENSE file
+// for more information.
+//
+// Description:
+//   krb5.conf parsing, realms, KDCs and the cached file
+//
+import os
+import tempfile
+import unittest
+
+from impacket.krb5 import krb5conf
+from impacket.krb5.krb5conf import Krb5Conf
+
+CONFIG = """
+// A comment
+[libdefaults]
+    default_realm = CONTOSO.COM
+    dns_lookup_kdc = false
+
+[realms]
+    CONTOSO.COM = {
+        kdc = dc1.contoso.com
+        kdc = dc2.contoso.com:8888
+        admin_server = dc1.contoso.com
+        auth_to_local = {
+            ; nested blocks are kept and skipped
+            rule = x
+        }
+    }
+    FABRIKAM.COM = {
+        kdc = [fd00::1]:750
+        kdc = [fd00::2]
+        kdc = fd00::3
+    }
+
+[domain_realm]
+    .contoso.com = CONTOSO.COM
+    .eu.contoso.com = EU.CONTOSO.COM
+    legacy.contoso.com = FABRIKAM.COM
+"""
+
+
+ type Krb5ConfTests struct { // unittest.TestCase:
+     func (self TYPE) setUp(){
+        self.conf = Krb5Conf(CONFIG)
+
+     func (self TYPE) test_default_realm(){
+        self.assertEqual(self.conf.getDefaultRealm(), 'CONTOSO.COM')
+        self.assertEqual(self.conf.getValue('libdefaults', 'dns_lookup_kdc'), 'false')
+        self.assertEqual(Krb5Conf("").getDefaultRealm(), nil)
+
+     func (self TYPE) test_realm(){
+        self.assertEqual(self.conf.getRealm("fs1.contoso.com"), 'CONTOSO.COM')
+        // The longest domain wins, a host name beats both
+        self.assertEqual(self.conf.getRealm("FS1.eu.contoso.com"), 'EU.CONTOSO.COM')
+        self.assertEqual(self.conf.getRealm("legacy.contoso.com"), 'FABRIKAM.COM')
+        self.assertEqual(self.conf.getRealm("fs1.example.com"), 'CONTOSO.COM')
+
+     func (self TYPE) test_kdcs(){
+        self.assertEqual(self.conf.getKDCAddresses("contoso.com"),
+                         [('dc1.contoso.com', 88), ('dc2.contoso.com', 8888)])
+        self.assertEqual(self.conf.getKDCs("CONTOSO.COM"), ['dc1.contoso.com', 'dc2.contoso.com'])
+        self.assertEqual(self.conf.getKDCAddresses("FABRIKAM.COM"),
+                         [('fd00::1', 750), ('fd00::2', 88), ('fd00::3', 88)])
+        self.assertEqual(self.conf.getKDCAddresses("EXAMPLE.COM"), [])
+
+     func (self TYPE) test_nested_block(){
+        realm = self.conf.sections["realms"]["CONTOSO.COM"][0]
+        self.assertEqual(realm["admin_server"], ["dc1.contoso.com"])
+        self.assertEqual(realm["auth_to_local"], [{'rule': ["x"]}])
+
+     func (self TYPE) test_cached(){
+        fd, fileName = tempfile.mkstemp()
+        os.write(fd, CONFIG.encode())
+        os.close(fd)
+        oldConfig = os.environ.get("KRB5_CONFIG")
+        os.environ["KRB5_CONFIG"] = fileName
+        try:
+            conf = krb5conf.getKrb5Conf()
+            self.assertEqual(conf.getDefaultRealm(), 'CONTOSO.COM')
+            self.asserttrue(krb5conf.getKrb5Conf() is conf)
+            // Read again once it changes
+            with open(fileName, 'w') as f:
+                f.write("[libdefaults]\n default_realm = FABRIKAM.COM\n")
+            os.utime(fileName, (0, 0))
+            self.assertEqual(krb5conf.getKrb5Conf().getDefaultRealm(), 'FABRIKAM.COM')
+            os.unlink(fileName)
+            self.assertEqual(krb5conf.getKrb5Conf().getDefaultRealm(), nil)
+            open(fileName, 'w').close()
+        finally:
+            if oldConfig == nil {
+                del os.environ["KRB5_CONFIG"]
+            } else  {
+                os.environ["KRB5_CONFIG"] = oldConfig
+            os.unlink(fileName)
+
+
+if __name__ == '__main__' {
+    unittest.main(verbosity=1)
@@ -0,0 +1,107 @@
+# SECUREAUTH LABS. Copyright 2018 SecureAuth Corporation. All rights reserved.
+#
+# This software is provided under under a slightly modified version
+# of the Apache Software License. See the accompanying LICENSE file
+# for more information.
+#
+# Description:
+#   Security descriptor tests, SDDL to binary and back
+#
+import unittest
+
+from impacket.ldap.ldaptypes import SR_SECURITY_DESCRIPTOR, ACL, ACE, ACCESS_MASK, LDAP_SID, \
+    ACCESS_ALLOWED_ACE, ACCESS_ALLOWED_CALLBACK_ACE
+
+DOMAIN_SID = 'S-1-5-21-1004336348-1177238915-682003330'
+
+
+class SDDLTests(unittest.TestCase):
+    def roundTrip(self, sddl, domainSid=None):
+        sd = SR_SECURITY_DESCRIPTOR()
+        sd.fromSDDL(sddl, domainSid)
+        self.assertEqual(sd.toSDDL(domainSid), sddl)
+        # And through the wire format
+        self.assertEqual(SR_SECURITY_DESCRIPTOR(data=sd.getData()).toSDDL(domainSid), sddl)
+        return sd
+
+    def test_simple(self):
+        sd = self.roundTrip('O:BAG:SYD:PAI(A;OICI;FA;;;BA)(A;OICIIO;GA;;;CO)(A;;0x1200a9;;;WD)')
+        self.assertEqual(sd['Control'], SR_SECURITY_DESCRIPTOR.SE_SELF_RELATIVE |
+                         SR_SECURITY_DESCRIPTOR.SE_DACL_PRESENT | SR_SECURITY_DESCRIPTOR.SE_DACL_PROTECTED |
+                         SR_SECURITY_DESCRIPTOR.SE_DACL_AUTO_INHERITED)
+        self.assertEqual(len(sd['Dacl'].aces), 3)
+
+    def test_object_aces(self):
+        self.roundTrip('O:DAG:DUD:AI(OA;CI;RPWP;bf967a7f-0de6-11d0-a285-00aa003049e2;'
+                       'bf967aba-0de6-11d0-a285-00aa003049e2;DA)S:P(AU;SAFA;FA;;;WD)', DOMAIN_SID)
+
+    def test_domain_sids(self):
+        sd = SR_SECURITY_DESCRIPTOR()
+        sd.fromSDDL('O:DA', DOMAIN_SID)
+        self.assertEqual(sd['OwnerSid'].formatCanonical(), DOMAIN_SID + '-512')
+        # Without the domain they're written in full
+        self.assertEqual(sd.toSDDL(), 'O:' + DOMAIN_SID + '-512')
+        self.assertRaises(Exception, sd.fromSDDL, 'O:DA')
+
+    def test_null_dacl(self):
+        sd = self.roundTrip('D:NO_ACCESS_CONTROL')
+        self.assertEqual(sd['Dacl'], b'')
+
+    def test_label(self):
+        self.roundTrip('O:SYD:(D;;FW;;;AN)S:(ML;;NW;;;HI)')
+
+    def test_unknown(self):
+        sd = SR_SECURITY_DESCRIPTOR()
+        self.assertRaises(Exception, sd.fromSDDL, 'D:(A;;QQ;;;WD)')
+        self.assertRaises(Exception, sd.fromSDDL, 'D:(A;;FA;;;XX)')
+        self.assertRaises(Exception, sd.fromSDDL, 'D:(A;;FA;;;WD;(@User.Title=="PM"))')
+
+    def test_control_untouched(self):
+        # Building one by hand, the flags are up to the caller
+        sd = SR_SECURITY_DESCRIPTOR()
+        sd['Revision'] = b'\x01'
+        sd['Sbz1'] = b'\x00'
+        sd['Control'] = 0
+        sd['OwnerSid'] = b''
+        sd['GroupSid'] = b''
+        sd['Sacl'] = b''
+        sd['Dacl'] = ACL()
+        sd['Dacl']['AclRevision'] = 2
+        sd['Dacl']['Sbz1'] = 0
+        sd['Dacl']['Sbz2'] = 0
+        sd['Dacl'].aces = []
+        data = sd.getData()
+        self.assertEqual(sd['Control'], 0)
+        self.assertEqual(SR_SECURITY_DESCRIPTOR(data=data)['Control'], 0)
+
+    def callbackAce(self, applicationData):
+        ace = ACE()
+        ace['AceType'] = ACCESS_ALLOWED_CALLBACK_ACE.ACE_TYPE
+        ace['AceFlags'] = 0
+        ace['Ace'] = ACCESS_ALLOWED_CALLBACK_ACE()
+        ace['Ace']['Mask'] = ACCESS_MASK()
+        ace['Ace']['Mask']['Mask'] = 0x001F01FF
+        ace['Ace']['Sid'] = LDAP_SID()
+        ace['Ace']['Sid'].fromCanonical('S-1-1-0')
+        ace['Ace']['ApplicationData'] = applicationData
+        acl = ACL()
+        acl['AclRevision'] = 2
+        acl['Sbz1'] = 0
+        acl['Sbz2'] = 0
+        acl.aces = [ace]
+        sd = SR_SECURITY_DESCRIPTOR()
+        sd.fromSDDL('D:')
+        sd['Dacl'] = acl
+        return SR_SECURITY_DESCRIPTOR(data=sd.getData())
+
+    def test_callback_padding(self):
+        self.assertEqual(self.callbackAce(b'\x00' * 4).toSDDL(), 'D:(XA;;FA;;;WD)')
+
+    def test_callback_conditions(self):
+        # artx, then the conditional expression. Not something we can write, better not to lose it
+        sd = self.callbackAce(b'artx\xfb\x00\x00\x00')
+        self.assertRaises(Exception, sd.toSDDL)
+
+
+if __name__ == '__main__':
+    unittest.main(verbosity=1)